@@ -0,0 +1,104 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime/debug"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// annotationFlags holds the annotations passed to lrun, see
+// parseAnnotations.
+type annotationFlags struct {
+	pairs []string
+	file  string
+}
+
+// register adds the --annotation and --annotation-file flags to f.
+func (a *annotationFlags) register(f *pflag.FlagSet) {
+	f.StringArrayVarP(&a.pairs, "annotation", "a", nil, "An annotation of the operation in the form key=value, may be repeated")
+	f.StringVar(&a.file, "annotation-file", "", "A JSON file with an object of annotations, --annotation takes precedence")
+}
+
+// parse returns the annotations of the file, if any, merged with those of the
+// flags. It returns nil if there are none.
+func (a *annotationFlags) parse() (map[string]string, error) {
+	annotations := make(map[string]string)
+
+	if a.file != "" {
+		content, err := os.ReadFile(a.file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read annotation file: %w", err)
+		}
+
+		if err := json.Unmarshal(content, &annotations); err != nil {
+			return nil, fmt.Errorf("invalid annotation file %s: %w", a.file, err)
+		}
+
+		for key := range annotations {
+			if key == "" {
+				return nil, fmt.Errorf("invalid annotation file %s: empty key", a.file)
+			}
+		}
+	}
+
+	for _, pair := range a.pairs {
+		// values may contain '=' themselves.
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid annotation %q: expected key=value", pair)
+		}
+
+		if key == "" {
+			return nil, fmt.Errorf("invalid annotation %q: empty key", pair)
+		}
+
+		annotations[key] = value
+	}
+
+	for key := range annotations {
+		if strings.HasPrefix(key, op.LrunAnnotationPrefix) {
+			return nil, fmt.Errorf("invalid annotation %q: the prefix %s is reserved for lrun", key, op.LrunAnnotationPrefix)
+		}
+	}
+
+	if len(annotations) == 0 {
+		return nil, nil
+	}
+
+	return annotations, nil
+}
+
+// autoAnnotations returns the annotations that identify where lrun runs, see
+// op.LrunAnnotationPrefix. Values that cannot be determined are left out.
+func autoAnnotations() map[string]string {
+	annotations := map[string]string{
+		op.LrunVersionAnnotation: lrunVersion(),
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		annotations[op.LrunHostAnnotation] = hostname
+	}
+
+	if u, err := user.Current(); err == nil {
+		annotations[op.LrunUserAnnotation] = u.Username
+	} else if name := os.Getenv("USER"); name != "" {
+		annotations[op.LrunUserAnnotation] = name
+	}
+
+	return annotations
+}
+
+// lrunVersion returns the module version lrun has been built from.
+func lrunVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
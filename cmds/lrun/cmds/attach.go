@@ -0,0 +1,55 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// parseAttach splits the value of --attach, or of another flag with the given
+// name, into the id and auth token of the operation.
+func parseAttach(flag, value string) (id, token string, err error) {
+	id, token, found := strings.Cut(value, ":")
+	if !found || id == "" || token == "" {
+		return "", "", fmt.Errorf("invalid --%s %q: expected id:token", flag, value)
+	}
+
+	return id, token, nil
+}
+
+// attach returns the operation with the given id together with token like a
+// registration would. An error is returned if the operation already reached
+// a terminal state since it can neither be kept alive nor completed anymore.
+func attach(ctx context.Context, cli *op.Client, retries *retryPolicy, id, token string) (*connect.Response[longrunningv1.RegisterOperationResponse], error) {
+	var current *longrunningv1.Operation
+
+	if err := retries.do(ctx, "get operation", retries.attempts, func(ctx context.Context) error {
+		res, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: id,
+		}))
+		if err != nil {
+			return err
+		}
+
+		current = res.Msg
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to attach to operation %s: %w", id, err)
+	}
+
+	switch current.State {
+	case longrunningv1.OperationState_OperationState_COMPLETE,
+		longrunningv1.OperationState_OperationState_LOST:
+		return nil, fmt.Errorf("cannot attach to operation %s: it is already %s", id, strings.TrimPrefix(current.State.String(), "OperationState_"))
+	}
+
+	return connect.NewResponse(&longrunningv1.RegisterOperationResponse{
+		Operation: current,
+		AuthToken: token,
+	}), nil
+}
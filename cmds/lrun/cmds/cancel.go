@@ -0,0 +1,73 @@
+package cmds
+
+import (
+	"context"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/sirupsen/logrus"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// watchCancel watches the operation with the given id until cancellation is
+// requested, it reaches a terminal state or ctx is cancelled. Once requested,
+// the user that requested cancellation, if known, is sent to cancelled which
+// must be buffered. The stream is re-opened with the backoff of retries if it
+// ends or fails with a transient error.
+func watchCancel(ctx context.Context, cli *op.Client, retries *retryPolicy, id string, cancelled chan<- string) {
+	delay := retries.backoff
+
+	for {
+		stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: id,
+		}))
+
+		if err == nil {
+			for stream.Receive() {
+				// the stream works so a later reconnect starts over.
+				delay = retries.backoff
+
+				msg := stream.Msg()
+				if msg.GetAnnotations()[op.CancelRequestedAnnotation] == "true" {
+					_ = stream.Close()
+
+					cancelled <- msg.GetAnnotations()[op.CancelRequestedByAnnotation]
+
+					return
+				}
+
+				switch msg.GetState() {
+				case longrunningv1.OperationState_OperationState_COMPLETE,
+					longrunningv1.OperationState_OperationState_LOST:
+					_ = stream.Close()
+
+					return
+				}
+			}
+
+			err = stream.Err()
+			_ = stream.Close()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil && !transient(err) {
+			logrus.Errorf("failed to watch operation for cancellation, giving up: %s", err)
+
+			return
+		}
+
+		logrus.Debugf("watch stream of operation ended, reconnecting in %s: %v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, retries.maxBackoff)
+	}
+}
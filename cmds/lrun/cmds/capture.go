@@ -0,0 +1,110 @@
+package cmds
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// capture keeps the first headSize and the last tailSize bytes written to it
+// so the output of chatty commands does not pile up in memory or exceed the
+// limits of the completion. It never fails so it can be used with
+// io.MultiWriter without affecting the other writers.
+type capture struct {
+	headSize int
+	tailSize int
+
+	head  []byte
+	tail  []byte
+	total int64
+}
+
+func newCapture(headSize, tailSize int) *capture {
+	return &capture{
+		headSize: max(headSize, 0),
+		tailSize: max(tailSize, 0),
+	}
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	n := len(p)
+	c.total += int64(n)
+
+	if room := c.headSize - len(c.head); room > 0 {
+		k := min(room, len(p))
+		c.head = append(c.head, p[:k]...)
+		p = p[k:]
+	}
+
+	if len(p) == 0 || c.tailSize == 0 {
+		return n, nil
+	}
+
+	if len(p) >= c.tailSize {
+		c.tail = append(c.tail[:0], p[len(p)-c.tailSize:]...)
+
+		return n, nil
+	}
+
+	// drop the bytes that cannot be part of the tail anymore once the buffer
+	// grew to twice its size.
+	if len(c.tail)+len(p) > 2*c.tailSize {
+		keep := c.tailSize - len(p)
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-keep:]...)
+	}
+
+	c.tail = append(c.tail, p...)
+
+	return n, nil
+}
+
+// Total returns the number of bytes written to c.
+func (c *capture) Total() int64 {
+	return c.total
+}
+
+// String returns the captured output. If bytes have been dropped, the head
+// and tail are separated by a marker that holds their number.
+func (c *capture) String() string {
+	tail := c.tail
+	if len(tail) > c.tailSize {
+		tail = tail[len(tail)-c.tailSize:]
+	}
+
+	dropped := c.total - int64(len(c.head)) - int64(len(tail))
+	if dropped == 0 {
+		return string(c.head) + string(tail)
+	}
+
+	// the cuts must not split multi-byte characters since the output is sent
+	// as a protobuf string.
+	head := c.head
+	for idx := len(head) - 1; idx >= max(len(head)-utf8.UTFMax, 0); idx-- {
+		if utf8.RuneStart(head[idx]) {
+			if !utf8.FullRune(head[idx:]) {
+				dropped += int64(len(head) - idx)
+				head = head[:idx]
+			}
+
+			break
+		}
+	}
+
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+		dropped++
+	}
+
+	return fmt.Sprintf("%s\n[... %d bytes truncated ...]\n%s", head, dropped, tail)
+}
+
+// captureAnnotations returns the annotations that record the total size of
+// the output of the command.
+func captureAnnotations(stdout, stderr *capture) map[string]string {
+	return map[string]string{
+		op.StdoutBytesAnnotation: strconv.FormatInt(stdout.Total(), 10),
+		op.StderrBytesAnnotation: strconv.FormatInt(stderr.Total(), 10),
+	}
+}
@@ -0,0 +1,39 @@
+package cmds
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapture(t *testing.T) {
+	c := newCapture(4, 4)
+	_, _ = c.Write([]byte("abc"))
+	_, _ = c.Write([]byte("defg"))
+
+	// nothing is dropped while the output fits.
+	require.Equal(t, "abcdefg", c.String())
+
+	for range 100 {
+		_, _ = c.Write([]byte("xy"))
+	}
+	_, _ = c.Write([]byte("1234"))
+
+	require.Equal(t, int64(211), c.Total())
+	require.Equal(t, "abcd\n[... 203 bytes truncated ...]\n1234", c.String())
+
+	// a single large write keeps its end.
+	c = newCapture(2, 3)
+	_, _ = c.Write([]byte(strings.Repeat("a", 50) + "end"))
+	require.Equal(t, "aa\n[... 48 bytes truncated ...]\nend", c.String())
+
+	// multi-byte characters are not split at the cuts.
+	c = newCapture(2, 2)
+	_, _ = c.Write([]byte("aäxxxxäb"))
+
+	out := c.String()
+	require.True(t, utf8.ValidString(out))
+	require.Equal(t, "a\n[... 8 bytes truncated ...]\nb", out)
+}
@@ -0,0 +1,25 @@
+package cmds
+
+import "strings"
+
+// joinArgs joins the argument vector of a command so it can be pasted into a
+// shell. Arguments with special characters are quoted.
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+
+	for idx, arg := range args {
+		if arg != "" && !strings.ContainsFunc(arg, needsQuoting) {
+			quoted[idx] = arg
+			continue
+		}
+
+		quoted[idx] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// needsQuoting reports whether r has a special meaning in a shell.
+func needsQuoting(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=+,@%", r))
+}
@@ -0,0 +1,160 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// completeOnlyFlags holds the flags of --complete-only which completes an
+// operation registered using --detach, or by --no-complete, without running a
+// command.
+type completeOnlyFlags struct {
+	target   string
+	exitCode int
+	message  string
+}
+
+// register adds the --complete-only, --exit-code and --message flags to f.
+func (c *completeOnlyFlags) register(f *pflag.FlagSet) {
+	f.StringVar(&c.target, "complete-only", "", "Complete an existing operation, in the form id:token, instead of running a command")
+	f.IntVar(&c.exitCode, "exit-code", 0, "The exit code the operation is completed with by --complete-only, it fails unless zero")
+	f.StringVar(&c.message, "message", "", "The output the operation is completed with by --complete-only, - reads it from stdin")
+}
+
+// output returns the message of the completion, read from stdin if
+// requested, bounded like the output of commands.
+func (c *completeOnlyFlags) output(headSize, tailSize int) (*capture, error) {
+	captured := newCapture(headSize, tailSize)
+
+	if c.message != "-" {
+		_, _ = captured.Write([]byte(c.message))
+
+		return captured, nil
+	}
+
+	if _, err := io.Copy(captured, os.Stdin); err != nil {
+		return nil, err
+	}
+
+	return captured, nil
+}
+
+// recordAnnotations merges annotations into those of the operation with the
+// given id.
+func recordAnnotations(ctx context.Context, cli *op.Client, retries *retryPolicy, id, token string, annotations map[string]string) error {
+	return retries.do(ctx, "record annotations", retries.attempts, func(ctx context.Context) error {
+		updReq := connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+			UniqueId:    id,
+			AuthToken:   token,
+			Annotations: annotations,
+			UpdateMask:  &fieldmaskpb.FieldMask{Paths: []string{"annotations"}},
+		})
+		updReq.Header().Set(op.MergeAnnotationsHeader, "true")
+
+		_, err := cli.UpdateOperation(ctx, updReq)
+
+		return err
+	})
+}
+
+// completeOperation completes the operation with the given id with a success
+// that holds stdout and payload if the command succeeded, or with the error
+// of status otherwise. The completed operation is returned.
+func completeOperation(ctx context.Context, cli *op.Client, retries *retryPolicy, id, token string, status exitStatus, stdout, stderr string, payload *anypb.Any) (*longrunningv1.Operation, error) {
+	req := &longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: token,
+	}
+
+	if status.code == 0 {
+		req.Result = &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: stdout,
+				Result:  payload,
+			},
+		}
+	} else {
+		opErr, err := status.operationError(stderr)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Result = &longrunningv1.CompleteOperationRequest_Error{
+			Error: opErr,
+		}
+	}
+
+	// losing the result is the worst outcome so completions are retried
+	// harder. Completing again with the same result is accepted by the
+	// service.
+	var completed *longrunningv1.Operation
+	if err := retries.do(ctx, "complete operation", retries.completeAttempts, func(ctx context.Context) error {
+		res, err := cli.CompleteOperation(ctx, connect.NewRequest(req))
+		if err != nil {
+			return err
+		}
+
+		completed = res.Msg
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return completed, nil
+}
+
+// runCompleteOnly completes the operation of --complete-only with the exit
+// code and message of the flags and returns the exit code.
+func runCompleteOnly(root *cli.Root, flags *completeOnlyFlags, retries *retryPolicy, source resultSource, output *outputFlags, headSize, tailSize int) (int, error) {
+	id, token, err := parseAttach("complete-only", flags.target)
+	if err != nil {
+		return 0, err
+	}
+
+	if flags.exitCode < 0 {
+		return 0, fmt.Errorf("invalid --exit-code %d: must not be negative", flags.exitCode)
+	}
+
+	message, err := flags.output(headSize, tailSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	cli := op.NewClient(root.HttpClient, root.Config().LongRunning)
+	ctx := context.WithoutCancel(root.Context())
+
+	// fails if the operation cannot be completed anymore.
+	if _, err := attach(ctx, cli, retries, id, token); err != nil {
+		return 0, err
+	}
+
+	status := exitStatus{code: flags.exitCode}
+
+	annotations := status.annotations()
+	payload := source.payload(status, message.String(), annotations)
+
+	if err := recordAnnotations(ctx, cli, retries, id, token, annotations); err != nil {
+		logrus.Errorf("failed to record exit code: %s", err)
+	}
+
+	completed, err := completeOperation(ctx, cli, retries, id, token, status, message.String(), message.String(), payload)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark operation as complete: %w", err)
+	}
+
+	output.reportCompleted(root.Print, completed, token, status.code)
+
+	return status.code, nil
+}
@@ -0,0 +1,217 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// Flags that are not set explicitly default to the environment variable
+// LRUN_<NAME>, like LRUN_KIND or LRUN_GRACE_PERIOD, and to the key <name> of the
+// config file, in this order. The config file is shared with the register
+// command which ignores keys of flags it does not have.
+
+// configEnv may point to the config file instead of the default location
+// below os.UserConfigDir.
+const configEnv = "LRUN_CONFIG"
+
+// Sources of the effective value of a flag, see flagDefaults.apply.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+// flagDefaults holds the defaults of the config file.
+type flagDefaults struct {
+	path   string
+	values map[string]any
+}
+
+// configPath returns the path of the config file and whether it has been
+// configured explicitly.
+func configPath() (string, bool) {
+	if path := os.Getenv(configEnv); path != "" {
+		return path, true
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(dir, "lrun", "config.yaml"), false
+}
+
+// loadDefaults reads the config file. It is not an error if the file does
+// not exist at the default location.
+func loadDefaults() (*flagDefaults, error) {
+	path, explicit := configPath()
+	if path == "" {
+		return &flagDefaults{}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return &flagDefaults{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return &flagDefaults{path: path, values: values}, nil
+}
+
+// envName returns the environment variable of the flag with the given name.
+func envName(flag string) string {
+	return "LRUN_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// check returns an error if the config file has keys that do not belong to
+// a flag of f for which skip returns false.
+func (d *flagDefaults) check(f *pflag.FlagSet, skip func(*pflag.Flag) bool) error {
+	for key := range d.values {
+		if flag := f.Lookup(key); flag == nil || skip(flag) {
+			return fmt.Errorf("invalid config file %s: unknown flag %q", d.path, key)
+		}
+	}
+
+	return nil
+}
+
+// apply sets the flags of f that have not been set explicitly to their
+// value of the environment or the config file, skipping those for which skip
+// returns true. The source of the value of each flag is returned.
+func (d *flagDefaults) apply(f *pflag.FlagSet, skip func(*pflag.Flag) bool) (map[string]string, error) {
+	sources := make(map[string]string)
+
+	var err error
+	f.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || skip(flag) {
+			return
+		}
+
+		if flag.Changed {
+			sources[flag.Name] = sourceFlag
+
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+			if serr := f.Set(flag.Name, value); serr != nil {
+				err = fmt.Errorf("invalid %s: %w", envName(flag.Name), serr)
+
+				return
+			}
+
+			sources[flag.Name] = sourceEnv
+
+			return
+		}
+
+		if value, ok := d.values[flag.Name]; ok {
+			// lists set repeated flags, like --annotation, once per element.
+			values, isList := value.([]any)
+			if !isList {
+				values = []any{value}
+			}
+
+			for _, v := range values {
+				if serr := f.Set(flag.Name, fmt.Sprint(v)); serr != nil {
+					err = fmt.Errorf("invalid config file %s: %s: %w", d.path, flag.Name, serr)
+
+					return
+				}
+			}
+
+			sources[flag.Name] = sourceFile
+
+			return
+		}
+
+		sources[flag.Name] = sourceDefault
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// defaultable returns the skip function for flagDefaults.apply that excludes
+// the flags shared by all commands of root.
+func defaultable(root *cli.Root) func(*pflag.Flag) bool {
+	return func(flag *pflag.Flag) bool {
+		return flag.Name == "help" || root.PersistentFlags().Lookup(flag.Name) != nil
+	}
+}
+
+// GetConfigCommand returns the config command that shows the effective
+// defaults of the flags of root.
+func GetConfigCommand(root *cli.Root) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the defaults of lrun",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the effective value of each flag and where it has been set",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			defaults, err := loadDefaults()
+			if err != nil {
+				return err
+			}
+
+			f := root.Flags()
+			if err := defaults.check(f, defaultable(root)); err != nil {
+				return err
+			}
+
+			sources, err := defaults.apply(f, defaultable(root))
+			if err != nil {
+				return err
+			}
+
+			names := make([]string, 0, len(sources))
+			for name := range sources {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			if defaults.path != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "config file: %s\n\n", defaults.path)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "FLAG\tVALUE\tSOURCE")
+
+			for _, name := range names {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", name, f.Lookup(name).Value.String(), sources[name])
+			}
+
+			return w.Flush()
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,101 @@
+package cmds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlagDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+kind: from-file
+owner: from-file
+ttl: 1m
+grace-period: 2m
+annotation:
+  - a=1
+  - b=2
+`), 0o600))
+
+	t.Setenv(configEnv, path)
+	t.Setenv("LRUN_OWNER", "from-env")
+	t.Setenv("LRUN_GRACE_PERIOD", "3m")
+	t.Setenv("LRUN_DESCRIPTION", "from-env")
+
+	var (
+		kind, owner, description, creator string
+		ttl, gracePeriod                  time.Duration
+		annotations                       []string
+		shared                            bool
+	)
+
+	f := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	f.StringVar(&kind, "kind", "", "")
+	f.StringVar(&owner, "owner", "", "")
+	f.StringVar(&description, "description", "", "")
+	f.StringVar(&creator, "creator", "built-in", "")
+	f.DurationVar(&ttl, "ttl", 0, "")
+	f.DurationVar(&gracePeriod, "grace-period", 0, "")
+	f.StringArrayVar(&annotations, "annotation", nil, "")
+	f.BoolVar(&shared, "shared", false, "")
+
+	require.NoError(t, f.Parse([]string{"--kind", "from-flag", "--grace-period", "4m"}))
+
+	defaults, err := loadDefaults()
+	require.NoError(t, err)
+
+	skip := func(flag *pflag.Flag) bool { return flag.Name == "shared" }
+	require.NoError(t, defaults.check(f, skip))
+
+	sources, err := defaults.apply(f, skip)
+	require.NoError(t, err)
+
+	// flag > env > file > built-in default
+	require.Equal(t, "from-flag", kind)
+	require.Equal(t, 4*time.Minute, gracePeriod)
+	require.Equal(t, "from-env", owner)
+	require.Equal(t, "from-env", description)
+	require.Equal(t, time.Minute, ttl)
+	require.Equal(t, []string{"a=1", "b=2"}, annotations)
+	require.Equal(t, "built-in", creator)
+
+	require.Equal(t, map[string]string{
+		"kind":         sourceFlag,
+		"grace-period": sourceFlag,
+		"owner":        sourceEnv,
+		"description":  sourceEnv,
+		"ttl":          sourceFile,
+		"annotation":   sourceFile,
+		"creator":      sourceDefault,
+	}, sources)
+}
+
+func TestFlagDefaultsErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv(configEnv, path)
+
+	// an explicitly configured file must exist.
+	_, err := loadDefaults()
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("knd: typo\n"), 0o600))
+
+	f := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	f.String("kind", "", "")
+	f.Duration("ttl", 0, "")
+
+	defaults, err := loadDefaults()
+	require.NoError(t, err)
+	require.Error(t, defaults.check(f, func(*pflag.Flag) bool { return false }))
+
+	// invalid values are reported with their source.
+	t.Setenv("LRUN_TTL", "soon")
+
+	_, err = defaults.apply(f, func(*pflag.Flag) bool { return false })
+	require.ErrorContains(t, err, "LRUN_TTL")
+}
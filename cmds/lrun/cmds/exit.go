@@ -0,0 +1,150 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// exitStatus describes how the wrapped command exited.
+type exitStatus struct {
+	// code is the exit code of the command, 128 plus the signal number if it
+	// has been killed by a signal, like a shell reports it.
+	code int
+
+	// signal is the name of the signal that killed the command, if any.
+	signal string
+
+	// interrupted is the name of the signal lrun received and forwarded to
+	// the command, if any, see runCommand.
+	interrupted string
+
+	// timeout is the limit of --timeout if the command exceeded it and
+	// elapsed the time the command ran in that case.
+	timeout time.Duration
+	elapsed time.Duration
+
+	// cancelled is set if the command has been stopped because cancellation
+	// of the operation has been requested, by the user in cancelledBy if
+	// known.
+	cancelled   bool
+	cancelledBy string
+
+	// err is set if the command could not be run at all.
+	err error
+}
+
+// exitStatusOf returns the exit status for the error returned by
+// exec.Cmd.Wait.
+func exitStatusOf(err error) exitStatus {
+	if err == nil {
+		return exitStatus{}
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return exitStatus{code: 1, err: err}
+	}
+
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return exitStatus{code: 128 + int(ws.Signal()), signal: ws.Signal().String()}
+	}
+
+	return exitStatus{code: exitErr.ExitCode()}
+}
+
+// annotations returns the annotations that record s on the operation.
+func (s exitStatus) annotations() map[string]string {
+	annotations := map[string]string{
+		op.ExitCodeAnnotation: strconv.Itoa(s.code),
+	}
+
+	if s.signal != "" {
+		annotations[op.ExitSignalAnnotation] = s.signal
+	}
+
+	return annotations
+}
+
+// operationError returns the error of the operation for the failed command.
+// stderr is used as the message unless it is empty or the command has been
+// interrupted, timed out or cancelled.
+func (s exitStatus) operationError(stderr string) (*longrunningv1.OperationError, error) {
+	msg := stderr
+	if s.timeout > 0 {
+		msg = fmt.Sprintf("command timed out after %s, limit is %s (exit code %d)", s.elapsed.Round(time.Millisecond), s.timeout, s.code)
+
+		if strings.TrimSpace(stderr) != "" {
+			msg += "\n\n" + stderr
+		}
+	} else if s.cancelled {
+		msg = fmt.Sprintf("operation cancelled (exit code %d)", s.code)
+		if s.cancelledBy != "" {
+			msg = fmt.Sprintf("operation cancelled by %s (exit code %d)", s.cancelledBy, s.code)
+		}
+
+		if strings.TrimSpace(stderr) != "" {
+			msg += "\n\n" + stderr
+		}
+	} else if s.interrupted != "" {
+		msg = fmt.Sprintf("command interrupted by signal %s (exit code %d)", s.interrupted, s.code)
+
+		if strings.TrimSpace(stderr) != "" {
+			msg += "\n\n" + stderr
+		}
+	} else if strings.TrimSpace(msg) == "" {
+		switch {
+		case s.err != nil:
+			msg = fmt.Sprintf("failed to run command: %s", s.err)
+		case s.signal != "":
+			msg = fmt.Sprintf("command killed by signal %s (exit code %d)", s.signal, s.code)
+		default:
+			msg = fmt.Sprintf("command exited with code %d", s.code)
+		}
+	}
+
+	fields := map[string]any{
+		op.ExitCodeDetail: s.code,
+	}
+
+	if s.signal != "" {
+		fields[op.ExitSignalDetail] = s.signal
+	}
+
+	if s.interrupted != "" {
+		fields[op.ExitInterruptedDetail] = s.interrupted
+	}
+
+	if s.cancelled {
+		fields[op.ExitCancelledDetail] = true
+	}
+
+	if s.timeout > 0 {
+		fields[op.ExitTimeoutDetail] = s.timeout.String()
+		fields[op.ExitElapsedDetail] = s.elapsed.String()
+	}
+
+	details, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	anyDetails, err := anypb.New(details)
+	if err != nil {
+		return nil, err
+	}
+
+	return &longrunningv1.OperationError{
+		Message:      msg,
+		ErrorDetails: anyDetails,
+	}, nil
+}
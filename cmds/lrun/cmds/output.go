@@ -0,0 +1,141 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Formats of --output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputFlags controls what lrun itself prints, the output of the command is
+// always passed through.
+type outputFlags struct {
+	format      string
+	quiet       bool
+	printToken  bool
+	printResult bool
+}
+
+// result is printed to stdout once the command finished if --output is json.
+type result struct {
+	ID        string `json:"id,omitempty"`
+	AuthToken string `json:"authToken,omitempty"`
+	State     string `json:"state,omitempty"`
+	ExitCode  int    `json:"exitCode"`
+
+	// Operation is the operation returned by CompleteOperation, if any.
+	Operation json.RawMessage `json:"operation,omitempty"`
+}
+
+// register adds the --output, --quiet and --print-token flags to f.
+func (o *outputFlags) register(f *pflag.FlagSet) {
+	f.StringVar(&o.format, "output", outputText, "The output format of lrun, either text or json. With json, an object with the operation id, its final state and the exit code is printed to stdout once the command finished")
+	f.BoolVarP(&o.quiet, "quiet", "q", false, "Do not log informational messages, errors and warnings are still logged to stderr")
+	f.BoolVar(&o.printToken, "print-token", false, "Include the auth token of the operation in the output")
+	f.BoolVar(&o.printResult, "print-result", false, "Print the completed operation to stdout, implied by --output json")
+}
+
+// apply validates the flags and configures logging accordingly.
+func (o *outputFlags) apply() error {
+	switch o.format {
+	case outputText, outputJSON:
+	default:
+		return fmt.Errorf("invalid output format %q: expected %s or %s", o.format, outputText, outputJSON)
+	}
+
+	if o.quiet {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+
+	return nil
+}
+
+// token returns token if it may be printed, see --print-token.
+func (o *outputFlags) token(token string) string {
+	if !o.printToken {
+		return ""
+	}
+
+	return token
+}
+
+// report prints the result of the command if --output is json. pbop is nil
+// if the command ran without tracking.
+func (o *outputFlags) report(pbop *longrunningv1.Operation, token string, code int) {
+	if o.format != outputJSON {
+		return
+	}
+
+	o.encode(o.result(pbop, token, code))
+}
+
+// reportCompleted is like report but for the operation returned by
+// CompleteOperation, which is included in the result. Otherwise, it is
+// printed using printer if --print-result is set.
+func (o *outputFlags) reportCompleted(printer cli.OutputFunc, completed *longrunningv1.Operation, token string, code int) {
+	switch {
+	case o.format == outputJSON:
+		res := o.result(completed, token, code)
+
+		blob, err := protojson.Marshal(completed)
+		if err != nil {
+			logrus.Errorf("failed to encode operation: %s", err)
+		} else {
+			res.Operation = blob
+		}
+
+		o.encode(res)
+
+	case o.printResult:
+		printer(completed)
+	}
+}
+
+// detached prints the id and auth token of the operation registered using
+// --detach. The token is printed regardless of --print-token since it is
+// required to take over the operation. The text output is accepted by
+// --attach and --complete-only.
+func (o *outputFlags) detached(res *longrunningv1.RegisterOperationResponse) {
+	if o.format != outputJSON {
+		fmt.Printf("%s:%s\n", res.Operation.UniqueId, res.AuthToken)
+
+		return
+	}
+
+	result := o.result(res.Operation, "", 0)
+	result.AuthToken = res.AuthToken
+
+	o.encode(result)
+}
+
+func (o *outputFlags) result(pbop *longrunningv1.Operation, token string, code int) result {
+	res := result{
+		ExitCode: code,
+	}
+
+	if pbop != nil {
+		res.ID = pbop.UniqueId
+		res.AuthToken = o.token(token)
+		res.State = strings.TrimPrefix(pbop.State.String(), "OperationState_")
+	}
+
+	return res
+}
+
+func (o *outputFlags) encode(res result) {
+	if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+		logrus.Errorf("failed to print result: %s", err)
+	}
+}
@@ -0,0 +1,186 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// paramFlags holds the custom parameters passed to lrun, see parse.
+type paramFlags struct {
+	plain []string
+	json  []string
+
+	env         []string
+	secretEnv   []string
+	allowSecret bool
+}
+
+// defaultSecretEnv are the patterns of environment variables that are not
+// recorded by --env-param unless --allow-secret-env is set.
+var defaultSecretEnv = []string{"*TOKEN*", "*SECRET*", "*PASSWORD*"}
+
+// register adds the --param, --param-json and --env-param flags to f.
+func (p *paramFlags) register(f *pflag.FlagSet) {
+	f.StringArrayVarP(&p.plain, "param", "p", nil, "A string parameter of the operation in the form key=value, may be repeated")
+	f.StringArrayVar(&p.json, "param-json", nil, "A parameter of the operation in the form key=<json>, may be repeated")
+	f.StringArrayVar(&p.env, "env-param", nil, "The name of an environment variable, or a glob like 'CI_*', that is recorded as a parameter, may be repeated. Variables that are not set are recorded as null")
+	f.StringSliceVar(&p.secretEnv, "secret-env", defaultSecretEnv, "Case-insensitive glob patterns of environment variables that --env-param refuses to record")
+	f.BoolVar(&p.allowSecret, "allow-secret-env", false, "Let --env-param record environment variables that match --secret-env")
+}
+
+// parse returns the parameters of the flags. Values of --param are strings
+// while values of --param-json keep their JSON type, environment variables
+// selected by --env-param are added as well, see parseEnv. Keys that are reserved
+// for the parameters set by lrun itself are rejected, as are keys that are
+// passed more than once.
+func (p *paramFlags) parse(reserved ...string) (map[string]*structpb.Value, error) {
+	params := make(map[string]*structpb.Value)
+
+	add := func(pair string, decode func(string) (*structpb.Value, error)) error {
+		// values may contain '=' themselves.
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("invalid parameter %q: expected key=value", pair)
+		}
+
+		switch {
+		case key == "":
+			return fmt.Errorf("invalid parameter %q: empty key", pair)
+		case slices.Contains(reserved, key):
+			return fmt.Errorf("invalid parameter %q: %s is set by lrun", pair, key)
+		}
+
+		if _, ok := params[key]; ok {
+			return fmt.Errorf("invalid parameter %q: %s is passed more than once", pair, key)
+		}
+
+		v, err := decode(value)
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", pair, err)
+		}
+
+		params[key] = v
+
+		return nil
+	}
+
+	for _, pair := range p.plain {
+		if err := add(pair, func(value string) (*structpb.Value, error) {
+			return structpb.NewStringValue(value), nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pair := range p.json {
+		if err := add(pair, decodeJSONValue); err != nil {
+			return nil, err
+		}
+	}
+
+	env, err := p.parseEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range env {
+		switch {
+		case slices.Contains(reserved, key):
+			return nil, fmt.Errorf("invalid environment parameter %q: %s is set by lrun", key, key)
+		case params[key] != nil:
+			return nil, fmt.Errorf("invalid environment parameter %q: %s is passed more than once", key, key)
+		}
+
+		params[key] = value
+	}
+
+	return params, nil
+}
+
+// parseEnv returns the environment variables selected by --env-param keyed by
+// their name. Variables that are not set are null. Names that look like
+// secrets are rejected, variables matched by a glob are skipped instead.
+func (p *paramFlags) parseEnv() (map[string]*structpb.Value, error) {
+	for _, pattern := range p.secretEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid secret environment pattern %q: %w", pattern, err)
+		}
+	}
+
+	secret := func(name string) bool {
+		if p.allowSecret {
+			return false
+		}
+
+		for _, pattern := range p.secretEnv {
+			if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(name)); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	params := make(map[string]*structpb.Value)
+
+	for _, name := range p.env {
+		if name == "" {
+			return nil, fmt.Errorf("invalid environment parameter: empty name")
+		}
+
+		if !strings.ContainsAny(name, "*?[") {
+			if secret(name) {
+				return nil, fmt.Errorf("refusing to record environment variable %s since it looks like a secret, see --allow-secret-env", name)
+			}
+
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				params[name] = structpb.NewNullValue()
+			} else {
+				params[name] = structpb.NewStringValue(value)
+			}
+
+			continue
+		}
+
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("invalid environment parameter %q: %w", name, err)
+		}
+
+		for _, e := range os.Environ() {
+			key, value, _ := strings.Cut(e, "=")
+
+			if ok, _ := path.Match(name, key); !ok {
+				continue
+			}
+
+			if secret(key) {
+				logrus.Warnf("not recording environment variable %s since it looks like a secret, see --allow-secret-env", key)
+
+				continue
+			}
+
+			params[key] = structpb.NewStringValue(value)
+		}
+	}
+
+	return params, nil
+}
+
+// decodeJSONValue parses value as JSON and converts it to a structpb value.
+func decodeJSONValue(value string) (*structpb.Value, error) {
+	var decoded any
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	return structpb.NewValue(decoded)
+}
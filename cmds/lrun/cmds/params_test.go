@@ -0,0 +1,98 @@
+package cmds
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestParseParams(t *testing.T) {
+	flags := paramFlags{
+		plain: []string{"batch=42", "query=a=b"},
+		json:  []string{`count=3`, `dry=true`, `opts={"a":1,"b":["x","y"]}`, `none=null`},
+	}
+
+	params, err := flags.parse("command", "shell", "shellArgs")
+	require.NoError(t, err)
+
+	// plain values are strings, even if they look like numbers.
+	require.Equal(t, "42", params["batch"].GetStringValue())
+	require.Equal(t, "a=b", params["query"].GetStringValue())
+
+	require.Equal(t, float64(3), params["count"].GetNumberValue())
+	require.True(t, params["dry"].GetBoolValue())
+	require.IsType(t, &structpb.Value_NullValue{}, params["none"].Kind)
+
+	opts := params["opts"].GetStructValue().AsMap()
+	require.Equal(t, map[string]any{"a": float64(1), "b": []any{"x", "y"}}, opts)
+
+	// the types survive the encoding of the registration.
+	blob, err := proto.Marshal(&longrunningv1.RegisterOperationRequest{Parameters: params})
+	require.NoError(t, err)
+
+	var decoded longrunningv1.RegisterOperationRequest
+	require.NoError(t, proto.Unmarshal(blob, &decoded))
+	require.True(t, proto.Equal(params["opts"], decoded.Parameters["opts"]))
+	require.Equal(t, float64(3), decoded.Parameters["count"].GetNumberValue())
+}
+
+func TestParseParamsErrors(t *testing.T) {
+	for name, flags := range map[string]paramFlags{
+		"Reserved":     {plain: []string{"command=rm"}},
+		"ReservedJSON": {json: []string{`shell="sh"`}},
+		"Malformed":    {plain: []string{"batch"}},
+		"EmptyKey":     {plain: []string{"=value"}},
+		"InvalidJSON":  {json: []string{`opts={"a":`}},
+		"Duplicate":    {plain: []string{"a=1"}, json: []string{"a=1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := flags.parse("command", "shell", "shellArgs")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseEnvParams(t *testing.T) {
+	t.Setenv("BATCH_ID", "42")
+	t.Setenv("CI_JOB", "build")
+	t.Setenv("CI_JOB_TOKEN", "secret")
+	t.Setenv("DB_PASSWORD", "secret")
+
+	flags := paramFlags{
+		env:       []string{"BATCH_ID", "CI_*", "CONFIG_PROFILE"},
+		secretEnv: defaultSecretEnv,
+	}
+
+	params, err := flags.parse("command", "shell", "shellArgs")
+	require.NoError(t, err)
+
+	require.Equal(t, "42", params["BATCH_ID"].GetStringValue())
+	require.Equal(t, "build", params["CI_JOB"].GetStringValue())
+
+	// missing variables are recorded explicitly.
+	require.IsType(t, &structpb.Value_NullValue{}, params["CONFIG_PROFILE"].Kind)
+
+	// secrets matched by a glob are skipped.
+	require.NotContains(t, params, "CI_JOB_TOKEN")
+
+	// secrets that are named explicitly are refused unless allowed.
+	flags.env = []string{"DB_PASSWORD"}
+
+	_, err = flags.parse("command", "shell", "shellArgs")
+	require.Error(t, err)
+
+	flags.allowSecret = true
+
+	params, err = flags.parse("command", "shell", "shellArgs")
+	require.NoError(t, err)
+	require.Equal(t, "secret", params["DB_PASSWORD"].GetStringValue())
+
+	// environment parameters must not override other parameters.
+	flags.plain = []string{"DB_PASSWORD=x"}
+
+	_, err = flags.parse("command", "shell", "shellArgs")
+	require.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package cmds
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxStatusLength is the maximum number of bytes of an output line that is
+// reported as the status message, well below the default limit of the
+// service.
+const maxStatusLength = 512
+
+// progress tracks the most recent output line of a command and the last
+// percentage matched by re, if any.
+type progress struct {
+	re *regexp.Regexp
+
+	l       sync.Mutex
+	line    string
+	percent int32
+	matched bool
+	changed bool
+}
+
+// snapshot returns the most recent line and percentage and whether they
+// changed since the last call. ok is false if no percentage has been matched
+// yet.
+func (p *progress) snapshot() (line string, percent int32, ok, changed bool) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	changed = p.changed
+	p.changed = false
+
+	return p.line, p.percent, p.matched, changed
+}
+
+// record updates the progress with a complete output line.
+func (p *progress) record(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	p.line = truncateLine(line)
+	p.changed = true
+
+	if p.re == nil {
+		return
+	}
+
+	m := p.re.FindStringSubmatch(line)
+	if len(m) < 2 {
+		return
+	}
+
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return
+	}
+
+	p.percent = int32(min(max(value, 0), 100))
+	p.matched = true
+}
+
+// writer returns an io.Writer that records each line written to it. Each
+// output stream requires its own writer so partial lines are not mixed.
+func (p *progress) writer() *lineWriter {
+	return &lineWriter{p: p}
+}
+
+// lineWriter splits the output of a command into lines, see progress.writer.
+// Carriage returns end a line as well so progress bars are reported.
+type lineWriter struct {
+	p   *progress
+	buf []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+
+	for {
+		idx := bytes.IndexAny(w.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+
+		w.p.record(string(w.buf[:idx]))
+		w.buf = w.buf[idx+1:]
+	}
+
+	// never buffer more than a status message worth of an unterminated line.
+	if len(w.buf) > maxStatusLength {
+		w.buf = w.buf[len(w.buf)-maxStatusLength:]
+	}
+
+	return len(b), nil
+}
+
+// truncateLine cuts line to maxStatusLength bytes without splitting a rune.
+func truncateLine(line string) string {
+	if len(line) <= maxStatusLength {
+		return line
+	}
+
+	line = line[:maxStatusLength]
+	for !utf8.ValidString(line) {
+		line = line[:len(line)-1]
+	}
+
+	return line
+}
@@ -0,0 +1,93 @@
+package cmds
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// commandRetries runs the command again if it failed, see run.
+type commandRetries struct {
+	retries int
+	delay   time.Duration
+}
+
+// register adds the --retries and --retry-delay flags to f.
+func (r *commandRetries) register(f *pflag.FlagSet) {
+	f.IntVar(&r.retries, "retries", 0, "The number of times the command is run again if it fails before the operation is completed with an error. --timeout applies to each attempt")
+	f.DurationVar(&r.delay, "retry-delay", 10*time.Second, "The delay before the command is run again, see --retries")
+}
+
+// run calls attempt until the command succeeds, has been interrupted or
+// cancelled or no retries are left. before is called with the number of the
+// next attempt and the total number of attempts before it is started, if not
+// nil. The status of the last attempt is returned together with the exit
+// codes of all attempts.
+func (r *commandRetries) run(attempt func() exitStatus, before func(n, total int), cancelled <-chan string) (exitStatus, []int) {
+	total := r.retries + 1
+
+	var codes []int
+	for n := 1; ; n++ {
+		status := attempt()
+		codes = append(codes, status.code)
+
+		if status.code == 0 || status.interrupted != "" || status.cancelled || n >= total {
+			return status, codes
+		}
+
+		logrus.Warnf("command failed with exit code %d (attempt %d/%d), running it again in %s", status.code, n, total, r.delay)
+
+		if stopped := r.wait(&status, cancelled); stopped {
+			return status, codes
+		}
+
+		if before != nil {
+			before(n+1, total)
+		}
+	}
+}
+
+// wait blocks for the retry delay. It returns true, and records why in
+// status, if lrun received SIGINT or SIGTERM or cancellation of the operation
+// has been requested in the meantime.
+func (r *commandRetries) wait(status *exitStatus, cancelled <-chan string) bool {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return false
+
+	case sig := <-sigs:
+		logrus.Warnf("received %s, not running the command again", sig)
+		status.interrupted = sig.String()
+
+	case by := <-cancelled:
+		logrus.Warnf("cancellation of the operation has been requested, not running the command again")
+		status.cancelled = true
+		status.cancelledBy = by
+	}
+
+	return true
+}
+
+// formatExitCodes returns the exit codes of all attempts as recorded in the
+// ExitCodesAnnotation.
+func formatExitCodes(codes []int) string {
+	values := make([]string, len(codes))
+	for idx, code := range codes {
+		values[idx] = strconv.Itoa(code)
+	}
+
+	return strings.Join(values, ",")
+}
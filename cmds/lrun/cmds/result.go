@@ -0,0 +1,120 @@
+package cmds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Sources of the result of successful operations, see --result-from.
+const (
+	resultFromLastJSONLine = "last-json-line"
+	resultFromStdout       = "stdout"
+	resultFromFile         = "file:"
+)
+
+// resultSource is where the JSON result of a successful command is read
+// from, see parseResultSource.
+type resultSource struct {
+	mode string
+	path string
+}
+
+// parseResultSource parses the value of --result-from. An empty value
+// disables the result.
+func parseResultSource(value string) (resultSource, error) {
+	switch {
+	case value == "", value == resultFromLastJSONLine, value == resultFromStdout:
+		return resultSource{mode: value}, nil
+
+	case strings.HasPrefix(value, resultFromFile):
+		path := strings.TrimPrefix(value, resultFromFile)
+		if path == "" {
+			return resultSource{}, fmt.Errorf("invalid --result-from %q: missing path", value)
+		}
+
+		return resultSource{mode: resultFromFile, path: path}, nil
+
+	default:
+		return resultSource{}, fmt.Errorf("invalid --result-from %q: expected %s, %s or %s<path>", value, resultFromLastJSONLine, resultFromStdout, resultFromFile)
+	}
+}
+
+// extract returns the result read from the source, or nil if it is
+// disabled. stdout is the captured output of the command so results read
+// from it must fit into --capture-tail or --capture-head.
+func (s resultSource) extract(stdout string) (*anypb.Any, error) {
+	var content []byte
+
+	switch s.mode {
+	case "":
+		return nil, nil
+
+	case resultFromStdout:
+		content = []byte(stdout)
+
+	case resultFromLastJSONLine:
+		lines := strings.Split(strings.TrimRight(stdout, "\r\n\t "), "\n")
+		content = []byte(lines[len(lines)-1])
+
+	case resultFromFile:
+		var err error
+
+		content, err = os.ReadFile(s.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read result: %w", err)
+		}
+	}
+
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil, fmt.Errorf("invalid result: empty %s", s.describe())
+	}
+
+	var decoded any
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		return nil, fmt.Errorf("invalid result in %s: %w", s.describe(), err)
+	}
+
+	value, err := structpb.NewValue(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid result in %s: %w", s.describe(), err)
+	}
+
+	return anypb.New(value)
+}
+
+// payload returns the result for the completion of a command with the given
+// status. Since an unusable result must not fail the operation, the reason is
+// recorded in annotations instead.
+func (s resultSource) payload(status exitStatus, stdout string, annotations map[string]string) *anypb.Any {
+	if status.code != 0 {
+		return nil
+	}
+
+	payload, err := s.extract(stdout)
+	if err != nil {
+		logrus.Warnf("completing without result: %s", err)
+		annotations[op.ResultWarningAnnotation] = err.Error()
+	}
+
+	return payload
+}
+
+func (s resultSource) describe() string {
+	switch s.mode {
+	case resultFromLastJSONLine:
+		return "last output line"
+	case resultFromFile:
+		return s.path
+	default:
+		return s.mode
+	}
+}
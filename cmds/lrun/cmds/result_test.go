@@ -0,0 +1,90 @@
+package cmds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func decodeResult(t *testing.T, result *anypb.Any) any {
+	t.Helper()
+
+	var value structpb.Value
+	require.NoError(t, result.UnmarshalTo(&value))
+
+	return value.AsInterface()
+}
+
+func TestResultSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "result.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"synced":3}`), 0o600))
+
+	for name, tc := range map[string]struct {
+		flag   string
+		stdout string
+		want   any
+	}{
+		"LastJSONLine": {
+			flag:   "last-json-line",
+			stdout: "syncing\ndone\n{\"synced\":3}\n\n",
+			want:   map[string]any{"synced": float64(3)},
+		},
+		"Stdout": {
+			flag:   "stdout",
+			stdout: "[1,\n2]\n",
+			want:   []any{float64(1), float64(2)},
+		},
+		"File": {
+			flag:   "file:" + path,
+			stdout: "not json",
+			want:   map[string]any{"synced": float64(3)},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			source, err := parseResultSource(tc.flag)
+			require.NoError(t, err)
+
+			result, err := source.extract(tc.stdout)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, decodeResult(t, result))
+		})
+	}
+}
+
+func TestResultSourceErrors(t *testing.T) {
+	source, err := parseResultSource("")
+	require.NoError(t, err)
+
+	// no result without --result-from.
+	result, err := source.extract(`{"a":1}`)
+	require.NoError(t, err)
+	require.Nil(t, result)
+
+	for _, flag := range []string{"stderr", "file:"} {
+		_, err := parseResultSource(flag)
+		require.Error(t, err, flag)
+	}
+
+	for name, tc := range map[string]struct {
+		flag   string
+		stdout string
+	}{
+		"LastLineNotJSON": {flag: "last-json-line", stdout: "{\"a\":1}\ndone\n"},
+		"StdoutNotJSON":   {flag: "stdout", stdout: "{\"a\":1}\ndone\n"},
+		"Empty":           {flag: "stdout", stdout: "\n"},
+		"MissingFile":     {flag: "file:" + filepath.Join(t.TempDir(), "missing.json")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			source, err := parseResultSource(tc.flag)
+			require.NoError(t, err)
+
+			_, err = source.extract(tc.stdout)
+			require.Error(t, err)
+		})
+	}
+}
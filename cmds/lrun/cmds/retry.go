@@ -0,0 +1,66 @@
+package cmds
+
+import (
+	"context"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// retryPolicy retries calls to the service that failed with a transient
+// error using an exponential backoff.
+type retryPolicy struct {
+	attempts         int
+	completeAttempts int
+	backoff          time.Duration
+	maxBackoff       time.Duration
+}
+
+// register adds the flags of the policy to f.
+func (p *retryPolicy) register(f *pflag.FlagSet) {
+	f.IntVar(&p.attempts, "retry-attempts", 5, "The number of attempts of calls to the service that failed with a transient error")
+	f.IntVar(&p.completeAttempts, "retry-complete-attempts", 20, "Like --retry-attempts but for completing the operation")
+	f.DurationVar(&p.backoff, "retry-backoff", 500*time.Millisecond, "The delay before the second attempt, doubled for each further attempt")
+	f.DurationVar(&p.maxBackoff, "retry-max-backoff", 30*time.Second, "The maximum delay between two attempts")
+}
+
+// do calls fn until it succeeds, fails with a permanent error, the given
+// number of attempts has been made or ctx is cancelled. The last error is
+// returned.
+func (p *retryPolicy) do(ctx context.Context, name string, attempts int, fn func(context.Context) error) error {
+	delay := p.backoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !transient(err) || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+
+		logrus.Warnf("failed to %s (attempt %d/%d), retrying in %s: %s", name, attempt, attempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, p.maxBackoff)
+	}
+}
+
+// transient reports whether err may go away when the call is retried, like
+// when the service is restarted.
+func transient(err error) bool {
+	switch connect.CodeOf(err) {
+	case connect.CodeUnavailable,
+		connect.CodeDeadlineExceeded,
+		connect.CodeResourceExhausted,
+		connect.CodeAborted,
+		connect.CodeUnknown:
+		return true
+	default:
+		return false
+	}
+}
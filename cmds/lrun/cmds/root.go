@@ -1,12 +1,15 @@
 package cmds
 
 import (
-	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,16 +20,42 @@ import (
 	"github.com/spf13/cobra"
 	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
 	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
+// minHeartbeatInterval is the lower bound of the interval derived from the
+// TTL of an operation so short TTLs do not flood the service.
+const minHeartbeatInterval = 2 * time.Second
+
+// statusInterval is the interval at which the output of a command is reported
+// for operations that never expire and are not kept alive otherwise.
+const statusInterval = 10 * time.Second
+
+// heartbeatInterval returns the interval at which an operation with the given
+// TTL is kept alive. If override is set it is used as is, otherwise the
+// interval is the fraction of the TTL. Zero is returned if the operation
+// never expires and no override is set.
+func heartbeatInterval(ttl time.Duration, fraction float64, override time.Duration) time.Duration {
+	if override > 0 {
+		return override
+	}
+
+	if ttl <= 0 {
+		return 0
+	}
+
+	return max(time.Duration(float64(ttl)*fraction), minHeartbeatInterval)
+}
+
 func GetRootCommand(root *cli.Root) {
 	// execution environment
 	var (
 		shell     = "/bin/bash"
 		shellArgs = "-c"
+		noShell   bool
 		dropEnv   bool
 		keepEnv   []string
 	)
@@ -39,28 +68,183 @@ func GetRootCommand(root *cli.Root) {
 		creator     string
 		ttl         time.Duration
 		gracePeriod time.Duration
+		annotations annotationFlags
+		params      paramFlags
+	)
+
+	// keep-alive and progress
+	var (
+		heartbeatFraction = 0.5
+		heartbeatEvery    time.Duration
+		reportStatus      = true
+		progressRegex     string
+	)
+
+	// output capture, in KiB
+	var (
+		captureHead = 32
+		captureTail = 32
+	)
+
+	// resilience
+	var (
+		retries    retryPolicy
+		bestEffort bool
 	)
 
-	root.Use = "run [flags] -- command"
-	root.Args = cobra.ExactArgs(1)
+	// sequential invocations
+	var (
+		attachTo     string
+		noComplete   bool
+		detachMode   bool
+		completeOnly completeOnlyFlags
+	)
+
+	var (
+		output            outputFlags
+		noAutoAnnotations bool
+	)
+
+	var (
+		killAfter     = 10 * time.Second
+		timeout       time.Duration
+		noCancelWatch bool
+		rerun         commandRetries
+		resultFrom    string
+	)
+
+	root.Use = "run [flags] -- command [args...]"
+	root.Args = func(cmd *cobra.Command, args []string) error {
+		// the defaults are applied before the arguments are validated since
+		// they depend on flags like --no-shell.
+		defaults, err := loadDefaults()
+		if err != nil {
+			return err
+		}
+
+		if err := defaults.check(cmd.Flags(), defaultable(root)); err != nil {
+			return err
+		}
+
+		if _, err := defaults.apply(cmd.Flags(), defaultable(root)); err != nil {
+			return err
+		}
+
+		// nothing is run when only registering or completing.
+		if detachMode || completeOnly.target != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+
+		// without a shell, the arguments are passed to the command as is.
+		if noShell {
+			return cobra.MinimumNArgs(1)(cmd, args)
+		}
+
+		return cobra.ExactArgs(1)(cmd, args)
+	}
 	root.Run = func(cmd *cobra.Command, args []string) {
-		parsedArgs, err := shlex.Split(shellArgs)
+		var err error
+
+		if err := output.apply(); err != nil {
+			logrus.Fatal(err.Error())
+		}
+
+		if heartbeatFraction <= 0 || heartbeatFraction >= 1 {
+			logrus.Fatalf("invalid heartbeat fraction %v: must be above 0 and below 1", heartbeatFraction)
+		}
+
+		source, err := parseResultSource(resultFrom)
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
+
+		if rerun.retries < 0 {
+			logrus.Fatalf("invalid --retries %d: must not be negative", rerun.retries)
+		}
+
+		if captureHead < 0 || captureTail < 0 {
+			logrus.Fatalf("invalid output capture: --capture-head and --capture-tail must not be negative")
+		}
+
+		if detachMode && (attachTo != "" || completeOnly.target != "") {
+			logrus.Fatalf("--detach cannot be combined with --attach or --complete-only")
+		}
+
+		if completeOnly.target != "" {
+			if attachTo != "" {
+				logrus.Fatalf("--complete-only cannot be combined with --attach")
+			}
+
+			code, err := runCompleteOnly(root, &completeOnly, &retries, source, &output, captureHead*1024, captureTail*1024)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			if code != 0 {
+				os.Exit(code)
+			}
+
+			return
+		}
+
+		regAnnotations, err := annotations.parse()
 		if err != nil {
-			logrus.Fatalf("failed to parse shell arguments: %s", err)
+			logrus.Fatal(err.Error())
 		}
 
-		parsedArgs = append(parsedArgs, args[0])
+		if !noAutoAnnotations {
+			if regAnnotations == nil {
+				regAnnotations = make(map[string]string)
+			}
 
-		stdout := new(bytes.Buffer)
-		stderr := new(bytes.Buffer)
+			maps.Copy(regAnnotations, autoAnnotations())
+		}
 
-		c := exec.CommandContext(root.Context(), shell, parsedArgs...)
+		regParams, err := params.parse("command", "shell", "shellArgs")
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
 
-		c.Stdout = io.MultiWriter(stdout, os.Stdout)
-		c.Stderr = io.MultiWriter(stderr, os.Stderr)
+		// commands cannot be started twice so each attempt gets its own, see
+		// --retries.
+		var command []string
+		switch {
+		case detachMode:
+			// the command is run by whoever takes over the operation.
 
+		case noShell:
+			regParams["command"] = structpb.NewStringValue(joinArgs(args))
+
+			command = args
+
+		default:
+			parsedArgs, err := shlex.Split(shellArgs)
+			if err != nil {
+				logrus.Fatalf("failed to parse shell arguments: %s", err)
+			}
+
+			regParams["command"] = structpb.NewStringValue(args[0])
+			regParams["shell"] = structpb.NewStringValue(shell)
+			regParams["shellArgs"] = structpb.NewStringValue(shellArgs)
+
+			command = append(append([]string{shell}, parsedArgs...), args[0])
+		}
+
+		prog := new(progress)
+		if progressRegex != "" {
+			prog.re, err = regexp.Compile(progressRegex)
+			if err != nil {
+				logrus.Fatalf("invalid progress regex: %s", err)
+			}
+
+			if prog.re.NumSubexp() < 1 {
+				logrus.Fatalf("invalid progress regex: the percentage must be captured by the first group")
+			}
+		}
+
+		var env []string
 		if dropEnv {
-			env := make([]string, 0)
+			env = make([]string, 0)
 
 			for _, e := range os.Environ() {
 				name, _, found := strings.Cut(e, "=")
@@ -73,11 +257,29 @@ func GetRootCommand(root *cli.Root) {
 					env = append(env, e)
 				}
 			}
+		}
+
+		// the output is only captured for the last attempt.
+		var stdout, stderr *capture
+
+		attempt := func(cancelled <-chan string, started func(pid int)) exitStatus {
+			stdout = newCapture(captureHead*1024, captureTail*1024)
+			stderr = newCapture(captureHead*1024, captureTail*1024)
 
+			c := exec.Command(command[0], command[1:]...)
 			c.Env = env
+			c.Stdout = io.MultiWriter(stdout, os.Stdout)
+			c.Stderr = io.MultiWriter(stderr, os.Stderr)
+
+			if reportStatus || prog.re != nil {
+				c.Stdout = io.MultiWriter(c.Stdout, prog.writer())
+				c.Stderr = io.MultiWriter(c.Stderr, prog.writer())
+			}
+
+			return runCommand(c, killAfter, timeout, cancelled, started)
 		}
 
-		cli := root.LongRunning()
+		cli := op.NewClient(root.HttpClient, root.Config().LongRunning)
 
 		var (
 			ttlpb         *durationpb.Duration
@@ -99,84 +301,234 @@ func GetRootCommand(root *cli.Root) {
 			GracePeriod:  gracePeriodPb,
 			Description:  description,
 			Kind:         kind,
+			Annotations:  regAnnotations,
 			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
-			Parameters: map[string]*structpb.Value{
-				"command":   structpb.NewStringValue(args[0]),
-				"shell":     structpb.NewStringValue(shell),
-				"shellArgs": structpb.NewStringValue(shellArgs),
-			},
+			Parameters:   regParams,
+		}
+
+		var res *connect.Response[longrunningv1.RegisterOperationResponse]
+
+		if attachTo != "" {
+			id, token, err := parseAttach("attach", attachTo)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			res, err = attach(root.Context(), cli, &retries, id, token)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+		} else {
+			// a registration whose response got lost is repeated, the
+			// duplicate is eventually marked as lost by the service.
+			err = retries.do(root.Context(), "register operation", retries.attempts, func(ctx context.Context) error {
+				var err error
+				res, err = cli.RegisterOperation(ctx, connect.NewRequest(regReq))
+
+				return err
+			})
 		}
 
-		res, err := cli.RegisterOperation(root.Context(), connect.NewRequest(regReq))
 		if err != nil {
-			logrus.Fatal(err.Error())
+			if !bestEffort {
+				logrus.Fatal(err.Error())
+			}
+
+			logrus.Errorf("failed to register operation, running the command without tracking: %s", err)
+
+			status, _ := rerun.run(func() exitStatus { return attempt(nil, nil) }, nil, nil)
+			output.report(nil, "", status.code)
+
+			// mirror the exit code of the command.
+			if status.code != 0 {
+				os.Exit(status.code)
+			}
+
+			return
+		}
+
+		if attachTo == "" {
+			if token := output.token(res.Msg.AuthToken); token != "" {
+				logrus.Infof("operation registered successfully: id=%s token=%s", res.Msg.Operation.UniqueId, token)
+			} else {
+				logrus.Infof("operation registered successfully: id=%s", res.Msg.Operation.UniqueId)
+			}
+		}
+
+		if detachMode {
+			output.detached(res.Msg)
+
+			return
 		}
-		logrus.Infof("operation registered successfully: id=%s token=%s", res.Msg.Operation.UniqueId, res.Msg.AuthToken)
 
 		ctx, cancel := context.WithCancel(root.Context())
 		defer cancel()
 
+		// the service may have applied a different TTL than requested.
+		interval := heartbeatInterval(res.Msg.Operation.GetTtl().AsDuration(), heartbeatFraction, heartbeatEvery)
+		if interval == 0 && (reportStatus || prog.re != nil) {
+			interval = statusInterval
+		}
+
 		var wg sync.WaitGroup
 
-		wg.Add(1)
+		if interval > 0 {
+			logrus.Infof("sending heartbeats every %s", interval)
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+
+				for {
+					req := &longrunningv1.UpdateOperationRequest{
+						UniqueId:  res.Msg.Operation.UniqueId,
+						AuthToken: res.Msg.GetAuthToken(),
+					}
+
+					// the output is reported at most once per heartbeat.
+					if line, percent, ok, changed := prog.snapshot(); changed {
+						var paths []string
+
+						if reportStatus {
+							req.StatusMessage = line
+							paths = append(paths, "status_message")
+						}
+
+						if ok {
+							req.PercentDone = percent
+							paths = append(paths, "percent_done")
+						}
+
+						if len(paths) > 0 {
+							req.UpdateMask = &fieldmaskpb.FieldMask{Paths: paths}
+						}
+					}
+
+					err := retries.do(ctx, "send heartbeat", retries.attempts, func(ctx context.Context) error {
+						_, err := cli.Heartbeat(ctx, connect.NewRequest(req))
+						return err
+					})
+					if err != nil && ctx.Err() == nil {
+						logrus.Errorf("failed to update operation: %s", err)
+					}
+
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+		}
+
+		cancelled := make(chan string, 1)
+		if !noCancelWatch {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				watchCancel(ctx, cli, &retries, res.Msg.Operation.UniqueId, cancelled)
+			}()
+		}
+
+		// the pid is only known once the command started, the other
+		// annotations are recorded again for operations that have been
+		// registered elsewhere, see --attach.
+		started := func(pid int) {
+			if noAutoAnnotations {
+				return
+			}
+
+			runAnnotations := autoAnnotations()
+			runAnnotations[op.LrunPIDAnnotation] = strconv.Itoa(pid)
+
+			wg.Add(1)
 
-		go func() {
-			defer wg.Done()
+			go func() {
+				defer wg.Done()
 
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-time.After(res.Msg.Operation.Ttl.AsDuration()):
+				if err := recordAnnotations(ctx, cli, &retries, res.Msg.Operation.UniqueId, res.Msg.GetAuthToken(), runAnnotations); err != nil && ctx.Err() == nil {
+					logrus.Errorf("failed to record pid: %s", err)
 				}
+			}()
+		}
+
+		status, codes := rerun.run(func() exitStatus { return attempt(cancelled, started) }, func(n, total int) {
+			msg := fmt.Sprintf("attempt %d/%d", n, total)
 
-				_, err := cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
-					UniqueId:  res.Msg.Operation.UniqueId,
-					AuthToken: res.Msg.GetAuthToken(),
-					Running:   true,
-					UpdateMask: &fieldmaskpb.FieldMask{
-						Paths: []string{"running"},
-					},
+			if err := retries.do(ctx, "report attempt", retries.attempts, func(ctx context.Context) error {
+				_, err := cli.Heartbeat(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+					UniqueId:      res.Msg.Operation.UniqueId,
+					AuthToken:     res.Msg.GetAuthToken(),
+					StatusMessage: msg,
+					UpdateMask:    &fieldmaskpb.FieldMask{Paths: []string{"status_message"}},
 				}))
-				if err != nil {
-					logrus.Errorf("failed to update operation: %s", err)
-				}
-			}
-		}()
 
-		err = c.Run()
+				return err
+			}); err != nil {
+				logrus.Errorf("failed to report attempt: %s", err)
+			}
+		}, cancelled)
 		cancel()
 
 		wg.Wait()
 
-		req := &longrunningv1.CompleteOperationRequest{
-			UniqueId:  res.Msg.GetOperation().GetUniqueId(),
-			AuthToken: res.Msg.GetAuthToken(),
+		// the result must be reported even if lrun is being stopped.
+		finalCtx := context.WithoutCancel(root.Context())
+
+		// the exit code is recorded before the completion since completed
+		// operations cannot be updated anymore.
+		exitAnnotations := status.annotations()
+		payload := source.payload(status, stdout.String(), exitAnnotations)
+		maps.Copy(exitAnnotations, captureAnnotations(stdout, stderr))
+
+		if rerun.retries > 0 {
+			exitAnnotations[op.ExitCodesAnnotation] = formatExitCodes(codes)
 		}
 
-		if err == nil {
-			req.Result = &longrunningv1.CompleteOperationRequest_Success{
-				Success: &longrunningv1.OperationSuccess{
-					Message: stdout.String(),
-				},
-			}
-		} else {
-			req.Result = &longrunningv1.CompleteOperationRequest_Error{
-				Error: &longrunningv1.OperationError{
-					Message: stderr.String(),
-				},
+		if err := recordAnnotations(finalCtx, cli, &retries, res.Msg.GetOperation().GetUniqueId(), res.Msg.GetAuthToken(), exitAnnotations); err != nil {
+			logrus.Errorf("failed to record exit code: %s", err)
+		}
+
+		// a later invocation completes the operation, see --attach.
+		if noComplete {
+			output.report(res.Msg.Operation, res.Msg.AuthToken, status.code)
+
+			if status.code != 0 {
+				os.Exit(status.code)
 			}
+
+			return
 		}
 
-		if _, err := cli.CompleteOperation(root.Context(), connect.NewRequest(req)); err != nil {
+		completed, err := completeOperation(finalCtx, cli, &retries, res.Msg.GetOperation().GetUniqueId(), res.Msg.GetAuthToken(), status, stdout.String(), stderr.String(), payload)
+		if err != nil {
 			logrus.Fatalf("failed to mark operation as complete: %s", err.Error())
 		}
+
+		output.reportCompleted(root.Print, completed, res.Msg.AuthToken, status.code)
+
+		// mirror the exit code of the command.
+		if status.code != 0 {
+			os.Exit(status.code)
+		}
 	}
 
 	f := root.Flags()
 	{
 		f.StringVar(&shell, "shell", "/bin/bash", "The shell to use when executing the command")
 		f.StringVar(&shellArgs, "shell-args", "-c", "The arguments to pass to the shell")
+		f.DurationVar(&timeout, "timeout", 0, "The maximum runtime of the command after which it is stopped and the operation fails. Unlike --ttl, which bounds the time between heartbeats, it bounds the command itself")
+		f.DurationVar(&killAfter, "kill-after", 10*time.Second, "The time the command gets to exit once lrun received SIGINT or SIGTERM or the timeout passed before it is killed")
+		rerun.register(f)
+		f.StringVar(&resultFrom, "result-from", "", "Where the JSON result of a successful command is read from: last-json-line, stdout or file:<path>. Results in stdout must fit into --capture-head or --capture-tail")
+		f.BoolVar(&noCancelWatch, "no-cancel-watch", false, "Keep running the command if cancellation of the operation is requested")
+		f.BoolVar(&noShell, "no-shell", false, "Execute the command and its arguments directly instead of passing them to the shell")
 
 		f.BoolVar(&dropEnv, "drop-env", false, "Drop all environment variables expect those specified by --keep-env")
 		f.StringSliceVar(&keepEnv, "keep-env", nil, "Environment variables to keep when using --drop-env")
@@ -187,10 +539,30 @@ func GetRootCommand(root *cli.Root) {
 		f.DurationVar(&ttl, "ttl", 0, "The TTL for the long-running operation")
 		f.DurationVar(&gracePeriod, "grace-period", 0, "The grace-period for the long running operation")
 		f.StringVarP(&description, "description", "d", "", "An optional description")
+		annotations.register(f)
+		f.BoolVar(&noAutoAnnotations, "no-auto-annotations", false, "Do not record the host, user and pid of the command and the version of lrun as annotations")
+		params.register(f)
+
+		f.Float64Var(&heartbeatFraction, "heartbeat-fraction", 0.5, "The fraction of the TTL after which heartbeats are sent")
+		f.DurationVar(&heartbeatEvery, "heartbeat-interval", 0, "The interval at which heartbeats are sent, overrides --heartbeat-fraction")
+		f.IntVar(&captureHead, "capture-head", 32, "The number of KiB at the beginning of stdout and stderr that are kept for the completion")
+		f.IntVar(&captureTail, "capture-tail", 32, "The number of KiB at the end of stdout and stderr that are kept for the completion")
+		f.BoolVar(&reportStatus, "status", true, "Report the most recent output line of the command as the status message")
+		f.StringVar(&progressRegex, "progress-regex", "", "A regular expression whose first group captures the percentage from output lines")
+
+		retries.register(f)
+		f.BoolVar(&bestEffort, "best-effort", false, "Run the command without tracking if the operation cannot be registered")
+
+		f.StringVar(&attachTo, "attach", "", "Keep an existing operation alive instead of registering one, in the form id:token")
+		output.register(f)
+		f.BoolVar(&detachMode, "detach", false, "Only register the operation and print its id and token, in the form id:token unless --output is json, for a worker that takes it over")
+		completeOnly.register(f)
+		f.BoolVar(&noComplete, "no-complete", false, "Leave the operation open once the command finished so a later invocation can complete it")
 	}
 
 	root.AddCommand(
 		GetRegisterCommand(root),
+		GetConfigCommand(root),
 	)
 }
 
@@ -202,13 +574,28 @@ func GetRegisterCommand(root *cli.Root) *cobra.Command {
 		creator     string
 		ttl         time.Duration
 		gracePeriod time.Duration
+		annotations annotationFlags
 	)
 
 	cmd := &cobra.Command{
 		Use: "register",
 		Run: func(cmd *cobra.Command, args []string) {
+			defaults, err := loadDefaults()
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			if _, err := defaults.apply(cmd.Flags(), defaultable(root)); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
 			cli := root.LongRunning()
 
+			regAnnotations, err := annotations.parse()
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
 			var (
 				ttlpb         *durationpb.Duration
 				gracePeriodPb *durationpb.Duration
@@ -229,6 +616,7 @@ func GetRegisterCommand(root *cli.Root) *cobra.Command {
 				GracePeriod: gracePeriodPb,
 				Description: description,
 				Kind:        kind,
+				Annotations: regAnnotations,
 			}
 
 			res, err := cli.RegisterOperation(root.Context(), connect.NewRequest(regReq))
@@ -248,6 +636,7 @@ func GetRegisterCommand(root *cli.Root) *cobra.Command {
 		f.DurationVar(&ttl, "ttl", 0, "The TTL for the long-running operation")
 		f.DurationVar(&gracePeriod, "grace-period", 0, "The grace-period for the long running operation")
 		f.StringVarP(&description, "description", "d", "", "An optional description")
+		annotations.register(f)
 	}
 	return cmd
 }
@@ -0,0 +1,144 @@
+package cmds
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runCommand runs c until it exits. SIGINT and SIGTERM received in the
+// meantime are forwarded to the process group of c, as is SIGTERM once the
+// command runs for longer than timeout, unless zero, or once cancellation of
+// the operation has been requested on cancelled, see watchCancel. If it does
+// not exit within killAfter, or another signal is received, it is killed.
+// The returned status records the signal that interrupted the command, the
+// timeout or the cancellation, if any. started is called with the process id
+// of the command once it has been started, if not nil.
+func runCommand(c *exec.Cmd, killAfter, timeout time.Duration, cancelled <-chan string, started func(pid int)) exitStatus {
+	// the command gets its own process group so the signal reaches all of
+	// its children, but only once lrun decided how to handle it.
+	setProcessGroup(c)
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		return exitStatus{code: 1, err: err}
+	}
+
+	if started != nil {
+		started(c.Process.Pid)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	var (
+		interrupted os.Signal
+		timedOut    bool
+		cancelledBy *string
+		kill        <-chan time.Time
+		killTimer   *time.Timer
+		deadline    <-chan time.Time
+	)
+
+	defer func() {
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}()
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		deadline = timer.C
+	}
+
+	// stop asks the command to exit and kills it after killAfter.
+	stop := func(sig os.Signal) {
+		signalProcessGroup(c, sig)
+
+		killTimer = time.NewTimer(killAfter)
+		kill = killTimer.C
+	}
+
+	for {
+		select {
+		case err := <-done:
+			status := exitStatusOf(err)
+			if timedOut {
+				status.timeout = timeout
+				status.elapsed = time.Since(start)
+
+				// like coreutils timeout.
+				if status.code == 0 {
+					status.code = 124
+				}
+			} else if cancelledBy != nil {
+				status.cancelled = true
+				status.cancelledBy = *cancelledBy
+
+				if status.code == 0 {
+					status.code = 128 + int(syscall.SIGTERM)
+				}
+			} else if interrupted != nil {
+				status.interrupted = interrupted.String()
+
+				// commands that exit cleanly on the signal were still
+				// interrupted.
+				if s, ok := interrupted.(syscall.Signal); ok && status.code == 0 {
+					status.code = 128 + int(s)
+				}
+			}
+
+			return status
+
+		case sig := <-sigs:
+			if interrupted != nil || timedOut || cancelledBy != nil {
+				logrus.Warnf("received %s again, killing command", sig)
+				killProcessGroup(c)
+
+				continue
+			}
+
+			interrupted = sig
+			logrus.Warnf("received %s, forwarding it to the command, killing it in %s", sig, killAfter)
+			stop(sig)
+
+		case by := <-cancelled:
+			cancelled = nil
+			if interrupted != nil || timedOut {
+				continue
+			}
+
+			cancelledBy = &by
+			logrus.Warnf("cancellation of the operation has been requested, stopping command, killing it in %s", killAfter)
+			stop(syscall.SIGTERM)
+
+		case <-deadline:
+			deadline = nil
+			if interrupted != nil || cancelledBy != nil {
+				continue
+			}
+
+			timedOut = true
+			logrus.Warnf("command exceeded its timeout of %s, killing it in %s", timeout, killAfter)
+			stop(syscall.SIGTERM)
+
+		case <-kill:
+			logrus.Warnf("command did not exit within %s, killing it", killAfter)
+			killProcessGroup(c)
+
+			kill = nil
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package cmds
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op, process groups are only supported on unix.
+func setProcessGroup(*exec.Cmd) {}
+
+// signalProcessGroup sends sig to the process of c.
+func signalProcessGroup(c *exec.Cmd, sig os.Signal) {
+	_ = c.Process.Signal(sig)
+}
+
+// killProcessGroup kills the process of c.
+func killProcessGroup(c *exec.Cmd) {
+	_ = c.Process.Kill()
+}
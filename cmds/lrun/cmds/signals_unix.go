@@ -0,0 +1,33 @@
+//go:build unix
+
+package cmds
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts c in a process group of its own.
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	c.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends sig to the process group of c.
+func signalProcessGroup(c *exec.Cmd, sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok {
+		_ = syscall.Kill(-c.Process.Pid, s)
+		return
+	}
+
+	_ = c.Process.Signal(sig)
+}
+
+// killProcessGroup kills the process group of c.
+func killProcessGroup(c *exec.Cmd) {
+	_ = syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"math/rand/v2"
@@ -25,7 +26,9 @@ import (
 	"github.com/tierklinik-dobersberg/apis/pkg/validator"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/config"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/privacy"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/service"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
 	"github.com/tierklinik-dobersberg/pbtype-server/pkg/resolver"
 	"google.golang.org/protobuf/reflect/protoregistry"
 )
@@ -74,7 +77,6 @@ func main() {
 		os.Exit(-1)
 	}
 
-	// TODO(ppacher): privacy-interceptor
 	interceptors := connect.WithInterceptors(
 		log.NewLoggingInterceptor(),
 		validator.NewInterceptor(protoValidator),
@@ -86,29 +88,46 @@ func main() {
 
 	interceptors = connect.WithOptions(interceptors, connect.WithCodec(c))
 
+	// the auth annotation interceptor requires a method descriptor, so it cannot
+	// be used for procedures that are not part of the LongRunningService
+	// definition.
+	extraInterceptors := interceptors
+
+	extractor := func(ctx context.Context, req connect.AnyRequest) (auth.RemoteUser, error) {
+		serverKey, _ := ctx.Value(serverContextKey).(string)
+
+		if serverKey == "admin" {
+			return auth.RemoteUser{
+				ID:          "service-account",
+				DisplayName: req.Peer().Addr,
+				RoleIDs:     []string{"idm_superuser"},
+				Admin:       true,
+			}, nil
+		}
+
+		return auth.RemoteHeaderExtractor(ctx, req)
+	}
+
+	var roleResolver auth.RoleResolverFunc
 	if roleClient, err := wellknown.RoleService.Create(ctx, catalog); err == nil {
+		roleResolver = auth.NewIDMRoleResolver(roleClient)
+
 		authInterceptor := auth.NewAuthAnnotationInterceptor(
 			protoregistry.GlobalFiles,
-			auth.NewIDMRoleResolver(roleClient),
-			func(ctx context.Context, req connect.AnyRequest) (auth.RemoteUser, error) {
-				serverKey, _ := ctx.Value(serverContextKey).(string)
-
-				if serverKey == "admin" {
-					return auth.RemoteUser{
-						ID:          "service-account",
-						DisplayName: req.Peer().Addr,
-						RoleIDs:     []string{"idm_superuser"},
-						Admin:       true,
-					}, nil
-				}
-
-				return auth.RemoteHeaderExtractor(ctx, req)
-			},
+			roleResolver,
+			extractor,
 		)
 
 		interceptors = connect.WithOptions(interceptors, connect.WithInterceptors(authInterceptor))
 	}
 
+	// the privacy interceptor is used for the extra procedures as well so
+	// watch streams are redacted, too.
+	privacyInterceptor := privacy.NewInterceptor(cfg.PrivacyPolicy(), extractor, roleResolver)
+
+	interceptors = connect.WithOptions(interceptors, connect.WithInterceptors(privacyInterceptor))
+	extraInterceptors = connect.WithOptions(extraInterceptors, connect.WithInterceptors(privacyInterceptor))
+
 	corsConfig := cors.Config{
 		AllowedOrigins:   cfg.AllowedOrigins,
 		AllowCredentials: true,
@@ -120,19 +139,65 @@ func main() {
 		os.Exit(-1)
 	}
 
-	// create a new manager that will handle lost operations
-	mng := manager.New(providers.Repo, nil, nil)
-	if err := mng.Start(ctx); err != nil {
-		slog.Error("failed to start manager", "error", err)
-		os.Exit(-1)
+	slog.Info("starting instance", "roles", cfg.Roles)
+
+	runManager := cfg.HasRole(config.RoleManager)
+
+	// create a new manager that will handle lost operations, only instances
+	// with the manager role run one.
+	var mng *manager.Manager
+	if runManager {
+		// providers.Metrics is a pointer so it must not be passed as a nil
+		// interface value.
+		var mngMetrics manager.Metrics
+		if providers.Metrics != nil {
+			mngMetrics = providers.Metrics
+		}
+
+		mng = manager.New(providers.Repo, cfg.ManagerInterval, nil, nil, mngMetrics)
+		mng.SetNamespaces(cfg.ManagerNamespaces...)
+		mng.SetExpiryWarning(cfg.ExpiryWarning)
+		mng.SetGraceWarning(cfg.ExpiryWarningAtTTL)
+		mng.SetLostRate(cfg.ManagerLostRate)
+		mng.SetLostConcurrency(cfg.ManagerLostConcurrency)
+		mng.SetDryRun(cfg.ManagerDryRun)
+		mng.SetRetries(providers.Repo)
+
+		if cfg.ManagerDowntimeThreshold > 0 {
+			mng.SetDowntimeGrace(providers.Repo, cfg.ManagerDowntimeThreshold)
+		}
+
+		if cfg.ManagerLeaseTTL > 0 {
+			hostname, _ := os.Hostname()
+			mng.SetLease(providers.Repo, fmt.Sprintf("%s-%d-%08x", hostname, os.Getpid(), rand.Uint32()), cfg.ManagerLeaseTTL)
+		}
+	} else {
+		slog.Warn("manager role disabled, lost detection, retries and templates are left to other instances")
 	}
 
 	svc := service.New(providers, mng)
+	if runManager {
+		if err := svc.StartManager(ctx); err != nil {
+			slog.Error("failed to start manager", "error", err)
+			os.Exit(-1)
+		}
+
+		svc.StartTemplates(ctx)
+	}
+
+	svc.StartOutbox(ctx)
+	svc.StartWebhooks(ctx)
+	svc.StartNotifications(ctx)
+	if cfg.WatchFanOut {
+		svc.StartFanOut(ctx)
+	}
 
 	serveMux := http.NewServeMux()
 
 	path, handler := longrunningv1connect.NewLongRunningServiceHandler(svc, interceptors)
 	serveMux.Handle(path, handler)
+	svc.HandleProcedures(serveMux, extractor, extraInterceptors)
+	serveMux.Handle(op.AttachmentsPath, svc.AttachmentsHandler())
 
 	loggingHandler := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -159,7 +224,28 @@ func main() {
 		os.Exit(-1)
 	}
 
-	adminSrv, err := server.CreateWithOptions(cfg.AdminListenAddress, wrapWithKey("admin", loggingHandler(serveMux)), server.WithCORS(corsConfig))
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/", serveMux)
+	adminMux.Handle("/admin/export", svc.ExportHandler())
+	adminMux.Handle("/admin/import", svc.ImportHandler())
+	svc.HandleAdminProcedures(adminMux, extractor, extraInterceptors)
+
+	if providers.MetricsSink != nil {
+		adminMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			data, err := providers.MetricsSink.DisplayMetrics(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(data); err != nil {
+				slog.Error("failed to encode metrics", "error", err)
+			}
+		})
+	}
+
+	adminSrv, err := server.CreateWithOptions(cfg.AdminListenAddress, wrapWithKey("admin", loggingHandler(adminMux)), server.WithCORS(corsConfig))
 	if err != nil {
 		slog.Error("failed to setup server", slog.Any("error", err.Error()))
 		os.Exit(-1)
@@ -174,8 +260,30 @@ func main() {
 		os.Exit(-1)
 	}
 
-	if err := server.Serve(ctx, srv, adminSrv); err != nil {
+	servers := []server.ServeAndShutdown{adminSrv}
+	if cfg.HasRole(config.RoleAPI) {
+		servers = append(servers, srv)
+	} else {
+		slog.Warn("api role disabled, only serving the admin listener", "admin", cfg.AdminListenAddress)
+	}
+
+	if err := server.Serve(ctx, servers...); err != nil {
 		slog.Error("failed to serve", slog.Any("error", err.Error()))
 		os.Exit(-1)
 	}
+
+	if mng == nil {
+		return
+	}
+
+	// give outstanding callbacks a chance to notify watchers about lost
+	// operations.
+	mng.Stop()
+
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelWait()
+
+	if err := mng.WaitAll(waitCtx); err != nil {
+		slog.Warn("manager callbacks did not finish in time", "error", err)
+	}
 }
@@ -3,12 +3,32 @@ package config
 import (
 	"context"
 	"fmt"
+	"path"
+	"slices"
+	"time"
 
+	gometrics "github.com/hashicorp/go-metrics"
 	"github.com/sethvargo/go-envconfig"
 	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1/eventsv1connect"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1/idmv1connect"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
 	"github.com/tierklinik-dobersberg/apis/pkg/discovery"
 	"github.com/tierklinik-dobersberg/apis/pkg/discovery/wellknown"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/metrics"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/privacy"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// The roles an instance may take, see Config.Roles.
+const (
+	// RoleAPI serves the public listener.
+	RoleAPI = "api"
+
+	// RoleManager runs the manager, which detects lost operations, starts
+	// scheduled ones and retries lost ones, and materializes templates.
+	RoleManager = "manager"
 )
 
 type Config struct {
@@ -16,8 +36,203 @@ type Config struct {
 	ListenAddress      string   `env:"LISTEN,default=:8081"`
 	AdminListenAddress string   `env:"ADMIN_LISTEN,default=:8082"`
 
+	// Roles are the roles of the instance, see RoleAPI and RoleManager.
+	// Replicas that only scale out read and watch traffic use "api". The
+	// admin listener is served by all instances.
+	Roles []string `env:"ROLES,default=api,manager"`
+
 	MongoURL string `env:"MONGO_URL,required"`
 	Database string `env:"DATABASE,default=cis"`
+
+	// PendingTimeout is the default timeout after which operations that are
+	// still in state PENDING are marked as lost. A zero value disables the timeout.
+	PendingTimeout time.Duration `env:"PENDING_TIMEOUT,default=0s"`
+
+	// MaxRuntime is the default maximum runtime after which operations are
+	// completed with an error, independent of their heartbeats. A zero value
+	// disables the limit.
+	MaxRuntime time.Duration `env:"MAX_RUNTIME,default=0s"`
+
+	// Size limits in bytes for operation parameters and annotations. The total
+	// size limits apply to all parameters or annotations of an operation while
+	// the value size limits apply to each individual key.
+	// A zero value disables the respective limit.
+	MaxParametersSize      int `env:"MAX_PARAMETERS_SIZE,default=1048576"`
+	MaxParameterValueSize  int `env:"MAX_PARAMETER_VALUE_SIZE,default=262144"`
+	MaxAnnotationsSize     int `env:"MAX_ANNOTATIONS_SIZE,default=262144"`
+	MaxAnnotationValueSize int `env:"MAX_ANNOTATION_VALUE_SIZE,default=65536"`
+
+	// MaxResultSize limits the serialized size in bytes of the success or
+	// error value of completed operations. Oversized result messages are
+	// truncated unless StrictResultSize is set, in which case the completion
+	// is rejected. A zero value disables the limit.
+	MaxResultSize    int  `env:"MAX_RESULT_SIZE,default=1048576"`
+	StrictResultSize bool `env:"STRICT_RESULT_SIZE,default=false"`
+
+	// Limits for attachments. MaxAttachmentSize only applies to attachments
+	// that are stored inside the service. AttachmentWindow specifies how long
+	// attachments may still be added after an operation has been completed.
+	MaxAttachments    int           `env:"MAX_ATTACHMENTS,default=16"`
+	MaxAttachmentSize int64         `env:"MAX_ATTACHMENT_SIZE,default=16777216"`
+	AttachmentWindow  time.Duration `env:"ATTACHMENT_WINDOW,default=5m"`
+
+	// MaxLinks limits the number of external links per operation.
+	MaxLinks int `env:"MAX_LINKS,default=16"`
+
+	// MaxStatusMessageSize limits the size in bytes of the status message of
+	// operations.
+	MaxStatusMessageSize int `env:"MAX_STATUS_MESSAGE_SIZE,default=1024"`
+
+	// Defaults and bounds for the TTL and grace period of new operations. A zero
+	// minimum or maximum disables the respective bound. If ClampDurations is
+	// set, out of bound values are adjusted to the nearest bound instead of
+	// rejecting the registration.
+	DefaultTTL         time.Duration `env:"DEFAULT_TTL,default=5m"`
+	MinTTL             time.Duration `env:"MIN_TTL,default=10s"`
+	MaxTTL             time.Duration `env:"MAX_TTL,default=24h"`
+	DefaultGracePeriod time.Duration `env:"DEFAULT_GRACE_PERIOD,default=5m"`
+	MinGracePeriod     time.Duration `env:"MIN_GRACE_PERIOD,default=0s"`
+	MaxGracePeriod     time.Duration `env:"MAX_GRACE_PERIOD,default=1h"`
+	ClampDurations     bool          `env:"CLAMP_DURATIONS,default=false"`
+
+	// KindDefaults holds per-kind defaults for the TTL, grace period, pending
+	// timeout and maximum runtime as a JSON object that maps kind patterns (like
+	// "tkd.backup.v1/*") to their defaults, see repo.KindDefaults. Values that
+	// are not specified fall back to the global defaults.
+	KindDefaults repo.KindDefaults `env:"KIND_DEFAULTS"`
+
+	// Quotas for active operations per owner and per kind. Operations
+	// registered via the admin listener are not subject to quotas. A zero value
+	// disables the respective quota.
+	MaxActivePerOwner int `env:"MAX_ACTIVE_PER_OWNER,default=1000"`
+	MaxActivePerKind  int `env:"MAX_ACTIVE_PER_KIND,default=0"`
+
+	// DefaultNamespace is the namespace used for operations that are registered
+	// without a namespace and for documents created before namespaces have been
+	// introduced. Non-admin users may only read operations of this namespace.
+	DefaultNamespace string `env:"DEFAULT_NAMESPACE,default=default"`
+
+	// ManagerNamespaces restricts the lost-detection of the manager to the
+	// specified namespaces. If empty, operations of all namespaces are checked.
+	ManagerNamespaces []string `env:"MANAGER_NAMESPACES"`
+
+	// ManagerInterval is the interval at which the manager checks operations
+	// for lost ones, due start times and exceeded runtimes. It should be well
+	// below the smallest TTL in use since operations may overshoot their
+	// deadline by up to one interval.
+	ManagerInterval time.Duration `env:"MANAGER_INTERVAL,default=30s"`
+
+	// AllowNoExpiry permits all registrations with an explicit TTL of zero,
+	// which are never marked as lost. Otherwise, clients must opt in using
+	// op.AllowNoExpiryHeader.
+	AllowNoExpiry bool `env:"ALLOW_NO_EXPIRY,default=false"`
+
+	// ManagerLeaseTTL enables leader election between multiple instances so
+	// only one of them checks operations. The leader holds a lease in mongodb
+	// for the given TTL and renews it at a third of it. If the leader dies,
+	// another instance takes over once the lease expired. Zero disables
+	// leader election, which is only safe with a single instance.
+	ManagerLeaseTTL time.Duration `env:"MANAGER_LEASE_TTL,default=15s"`
+
+	// ManagerDowntimeThreshold is the time without any check of operations
+	// after which the manager assumes the service has been down. Operations
+	// that have not been updated since then get one more TTL to send a
+	// heartbeat before they are marked as lost. Zero disables the detection.
+	ManagerDowntimeThreshold time.Duration `env:"MANAGER_DOWNTIME_THRESHOLD,default=5m"`
+
+	// ManagerLostRate is the maximum number of operations that are marked as
+	// lost per second. Zero disables the limit.
+	ManagerLostRate float64 `env:"MANAGER_LOST_RATE,default=10"`
+
+	// ManagerLostConcurrency is the number of expired operations that are
+	// marked as lost concurrently.
+	ManagerLostConcurrency int `env:"MANAGER_LOST_CONCURRENCY,default=4"`
+
+	// ManagerDryRun starts the manager in dry-run mode. Operations whose
+	// deadline passed are only reported instead of being marked as lost. The
+	// mode can be switched at runtime through the admin listener.
+	ManagerDryRun bool `env:"MANAGER_DRY_RUN,default=false"`
+
+	// ExpiryWarning is the fraction of the TTL and grace period after which
+	// watchers of a RUNNING operation that has not been updated are warned
+	// that it is about to be lost. Zero disables the warnings.
+	ExpiryWarning float64 `env:"EXPIRY_WARNING,default=0.8"`
+
+	// ExpiryWarningAtTTL warns once a RUNNING operation missed its TTL and
+	// entered its grace period instead of at the ExpiryWarning fraction.
+	// Operations without a grace period are not warned.
+	ExpiryWarningAtTTL bool `env:"EXPIRY_WARNING_AT_TTL,default=false"`
+
+	// Limits for concurrent watch streams per remote peer (IP address) and per
+	// operation. A zero value disables the respective limit.
+	MaxWatchersPerPeer      int `env:"MAX_WATCHERS_PER_PEER,default=32"`
+	MaxWatchersPerOperation int `env:"MAX_WATCHERS_PER_OPERATION,default=64"`
+
+	// WatchFanOut subscribes to the operation events of all service instances
+	// so watch streams also receive updates handled by other instances.
+	WatchFanOut bool `env:"WATCH_FANOUT,default=true"`
+
+	// WatchKeepalive is the interval after which WatchOperation streams repeat
+	// the last operation state if no update has been sent in the meantime.
+	// A zero value disables keepalives.
+	WatchKeepalive time.Duration `env:"WATCH_KEEPALIVE,default=30s"`
+
+	// WatchBufferSize is the number of updates that are buffered per watch
+	// stream. Once the buffer is full, WatchSlowConsumerPolicy decides which
+	// updates are dropped or whether the stream is disconnected. Terminal
+	// updates (COMPLETE or LOST) are never dropped.
+	WatchBufferSize         int                `env:"WATCH_BUFFER_SIZE,default=100"`
+	WatchSlowConsumerPolicy SlowConsumerPolicy `env:"WATCH_SLOW_CONSUMER_POLICY,default=drop-oldest"`
+
+	// PublishLegacyEvents publishes the bare operation to the events-service in
+	// addition to the lifecycle events (see op.EventType) so subscribers can
+	// migrate. It will be removed once all subscribers use lifecycle events.
+	PublishLegacyEvents bool `env:"PUBLISH_LEGACY_EVENTS,default=true"`
+
+	// Events are stored in an outbox and published in the background. Failed
+	// deliveries are retried with an exponential backoff between
+	// OutboxMinBackoff and OutboxMaxBackoff.
+	OutboxMinBackoff time.Duration `env:"OUTBOX_MIN_BACKOFF,default=1s"`
+	OutboxMaxBackoff time.Duration `env:"OUTBOX_MAX_BACKOFF,default=5m"`
+
+	// Lifecycle events are posted to webhooks in the background. Each request
+	// is bounded by WebhookTimeout. Failed deliveries are retried with an
+	// exponential backoff between WebhookMinBackoff and WebhookMaxBackoff and
+	// moved to the dead-letter log after WebhookMaxAttempts attempts. Webhooks
+	// are disabled after WebhookDisableAfter consecutive failed attempts. A
+	// zero value disables the respective limit.
+	WebhookTimeout      time.Duration `env:"WEBHOOK_TIMEOUT,default=10s"`
+	WebhookMinBackoff   time.Duration `env:"WEBHOOK_MIN_BACKOFF,default=10s"`
+	WebhookMaxBackoff   time.Duration `env:"WEBHOOK_MAX_BACKOFF,default=1h"`
+	WebhookMaxAttempts  int           `env:"WEBHOOK_MAX_ATTEMPTS,default=10"`
+	WebhookDisableAfter int           `env:"WEBHOOK_DISABLE_AFTER,default=50"`
+
+	// NotifyOwners sends a message to the owner of an operation through the
+	// notification service of the identity provider once the operation is
+	// lost or completed with an error. Owners are resolved by their user id or
+	// name. Kinds that match any of the NotifyExcludeKinds patterns (see
+	// path.Match) and the NotifyExcludeOwners are never notified. If set,
+	// NotifyLink is included as a deep link with "{id}" replaced by the id of
+	// the operation. Failed deliveries are retried with an exponential backoff
+	// starting at NotifyRetryBackoff until NotifyMaxAttempts attempts failed.
+	NotifyOwners        bool          `env:"NOTIFY_OWNERS,default=false"`
+	NotifyExcludeKinds  []string      `env:"NOTIFY_EXCLUDE_KINDS"`
+	NotifyExcludeOwners []string      `env:"NOTIFY_EXCLUDE_OWNERS"`
+	NotifyLink          string        `env:"NOTIFY_LINK"`
+	NotifyMaxAttempts   int           `env:"NOTIFY_MAX_ATTEMPTS,default=3"`
+	NotifyRetryBackoff  time.Duration `env:"NOTIFY_RETRY_BACKOFF,default=30s"`
+
+	// Parameters and annotations whose keys match any of the RedactParameters
+	// and RedactAnnotations patterns (see path.Match) are redacted for callers
+	// that have none of the UnredactedRoles (IDs or names) assigned. This
+	// applies to published events as well.
+	RedactParameters  []string `env:"REDACT_PARAMETERS"`
+	RedactAnnotations []string `env:"REDACT_ANNOTATIONS"`
+	UnredactedRoles   []string `env:"UNREDACTED_ROLES"`
+
+	// MetricsEnabled enables collecting in-memory metrics which are exposed
+	// on the admin listener.
+	MetricsEnabled bool `env:"METRICS_ENABLED,default=true"`
 }
 
 func LoadConfig(ctx context.Context) (*Config, error) {
@@ -27,16 +242,170 @@ func LoadConfig(ctx context.Context) (*Config, error) {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
+	// the defaults must be within the configured bounds themselves.
+	limits := cfg.DurationLimits()
+	limits.Clamp = false
+
+	if err := limits.CheckRegistration(&longrunningv1.RegisterOperationRequest{
+		Ttl:         durationpb.New(cfg.DefaultTTL),
+		GracePeriod: durationpb.New(cfg.DefaultGracePeriod),
+	}); err != nil {
+		return nil, fmt.Errorf("invalid config: default %w", err)
+	}
+
+	for _, kind := range cfg.KindDefaults {
+		defaults := limits.Defaults(kind.Pattern)
+
+		if err := limits.CheckRegistration(&longrunningv1.RegisterOperationRequest{
+			Ttl:         durationpb.New(defaults.TTL),
+			GracePeriod: durationpb.New(defaults.GracePeriod),
+		}); err != nil {
+			return nil, fmt.Errorf("invalid config: defaults of kind %q: %w", kind.Pattern, err)
+		}
+	}
+
+	if err := cfg.PrivacyPolicy().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if len(cfg.Roles) == 0 {
+		return nil, fmt.Errorf("invalid config: at least one role is required")
+	}
+
+	for _, role := range cfg.Roles {
+		if role != RoleAPI && role != RoleManager {
+			return nil, fmt.Errorf("invalid config: unknown role %q, expected %q or %q", role, RoleAPI, RoleManager)
+		}
+	}
+
+	if cfg.ManagerInterval < manager.MinInterval {
+		return nil, fmt.Errorf("invalid config: manager interval must be at least %s, got %s", manager.MinInterval, cfg.ManagerInterval)
+	}
+
+	if cfg.ManagerLeaseTTL != 0 && cfg.ManagerLeaseTTL < 3*manager.MinInterval {
+		return nil, fmt.Errorf("invalid config: manager lease ttl must be at least %s, got %s", 3*manager.MinInterval, cfg.ManagerLeaseTTL)
+	}
+
+	if cfg.ManagerDowntimeThreshold != 0 && cfg.ManagerDowntimeThreshold <= cfg.ManagerInterval {
+		return nil, fmt.Errorf("invalid config: manager downtime threshold must be above the manager interval of %s, got %s", cfg.ManagerInterval, cfg.ManagerDowntimeThreshold)
+	}
+
+	if cfg.ManagerLostRate < 0 {
+		return nil, fmt.Errorf("invalid config: manager lost rate must not be negative, got %v", cfg.ManagerLostRate)
+	}
+
+	if cfg.ManagerLostConcurrency < 1 {
+		return nil, fmt.Errorf("invalid config: manager lost concurrency must be at least 1, got %d", cfg.ManagerLostConcurrency)
+	}
+
+	for _, pattern := range cfg.NotifyExcludeKinds {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid config: notify exclude kinds: invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	if cfg.NotifyMaxAttempts < 1 {
+		return nil, fmt.Errorf("invalid config: notify max attempts must be at least 1, got %d", cfg.NotifyMaxAttempts)
+	}
+
+	if cfg.ExpiryWarning < 0 || cfg.ExpiryWarning >= 1 {
+		return nil, fmt.Errorf("invalid config: expiry warning must be at least 0 and below 1, got %v", cfg.ExpiryWarning)
+	}
+
 	return &cfg, nil
 }
 
+// PrivacyPolicy returns the configured redaction policy for operations.
+// HasRole reports whether role is one of the roles of the instance.
+func (cfg *Config) HasRole(role string) bool {
+	return slices.Contains(cfg.Roles, role)
+}
+
+func (cfg *Config) PrivacyPolicy() privacy.Policy {
+	return privacy.Policy{
+		Parameters:   cfg.RedactParameters,
+		Annotations:  cfg.RedactAnnotations,
+		AllowedRoles: cfg.UnredactedRoles,
+	}
+}
+
+// Limits returns the configured size limits for operation parameters,
+// annotations, results and attachments.
+func (cfg *Config) Limits() repo.Limits {
+	return repo.Limits{
+		MaxParametersSize:      cfg.MaxParametersSize,
+		MaxParameterValueSize:  cfg.MaxParameterValueSize,
+		MaxAnnotationsSize:     cfg.MaxAnnotationsSize,
+		MaxAnnotationValueSize: cfg.MaxAnnotationValueSize,
+		MaxAttachments:         cfg.MaxAttachments,
+		MaxAttachmentSize:      cfg.MaxAttachmentSize,
+		MaxLinks:               cfg.MaxLinks,
+		MaxStatusMessageSize:   cfg.MaxStatusMessageSize,
+		MaxResultSize:          cfg.MaxResultSize,
+		StrictResultSize:       cfg.StrictResultSize,
+	}
+}
+
+// DurationLimits returns the configured defaults and bounds for the TTL and
+// grace period of operations.
+func (cfg *Config) DurationLimits() repo.DurationLimits {
+	return repo.DurationLimits{
+		DefaultTTL:            cfg.DefaultTTL,
+		DefaultGracePeriod:    cfg.DefaultGracePeriod,
+		DefaultPendingTimeout: cfg.PendingTimeout,
+		DefaultMaxRuntime:     cfg.MaxRuntime,
+		Kinds:                 cfg.KindDefaults,
+		MinTTL:                cfg.MinTTL,
+		MaxTTL:                cfg.MaxTTL,
+		MinGracePeriod:        cfg.MinGracePeriod,
+		MaxGracePeriod:        cfg.MaxGracePeriod,
+		Clamp:                 cfg.ClampDurations,
+	}
+}
+
+// Quota returns the configured quotas for active operations.
+func (cfg *Config) Quota() repo.Quota {
+	return repo.Quota{
+		MaxPerOwner: cfg.MaxActivePerOwner,
+		MaxPerKind:  cfg.MaxActivePerKind,
+	}
+}
+
 func (cfg *Config) ConfigureProviders(ctx context.Context, catalog discovery.Discoverer) (*Providers, error) {
 	repo, err := repo.NewRepo(ctx, cfg.MongoURL, cfg.Database)
 	if err != nil {
 		return nil, err
 	}
 
-	var events eventsv1connect.EventServiceClient
+	repo.SetLimits(cfg.Limits())
+	repo.SetDurationLimits(cfg.DurationLimits())
+	repo.SetDefaultNamespace(cfg.DefaultNamespace)
+	repo.SetAttachmentWindow(cfg.AttachmentWindow)
+
+	var (
+		metricsSink *gometrics.InmemSink
+		recorder    *metrics.Recorder
+	)
+	if cfg.MetricsEnabled {
+		metricsSink = gometrics.NewInmemSink(10*time.Second, time.Minute)
+
+		metricsConfig := gometrics.DefaultConfig("longrunning-service")
+		metricsConfig.EnableHostname = false
+
+		m, err := gometrics.New(metricsConfig, metricsSink)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup metrics: %w", err)
+		}
+
+		recorder = metrics.New(m)
+		repo.SetMetrics(recorder)
+	}
+
+	var (
+		events eventsv1connect.EventServiceClient
+		users  idmv1connect.UserServiceClient
+		notify idmv1connect.NotifyServiceClient
+	)
 	if catalog != nil {
 		var err error
 
@@ -44,12 +413,28 @@ func (cfg *Config) ConfigureProviders(ctx context.Context, catalog discovery.Dis
 		if err != nil {
 			return nil, err
 		}
+
+		if cfg.NotifyOwners {
+			users, err = wellknown.UserService.Create(ctx, catalog)
+			if err != nil {
+				return nil, err
+			}
+
+			notify, err = wellknown.NotifyService.Create(ctx, catalog)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return &Providers{
-		Config:       cfg,
-		Repo:         repo,
-		Catalog:      catalog,
-		EventService: events,
+		Config:        cfg,
+		Repo:          repo,
+		Catalog:       catalog,
+		EventService:  events,
+		UserService:   users,
+		NotifyService: notify,
+		Metrics:       recorder,
+		MetricsSink:   metricsSink,
 	}, nil
 }
@@ -1,8 +1,11 @@
 package config
 
 import (
+	gometrics "github.com/hashicorp/go-metrics"
 	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1/eventsv1connect"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1/idmv1connect"
 	"github.com/tierklinik-dobersberg/apis/pkg/discovery"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/metrics"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
 )
 
@@ -14,4 +17,13 @@ type Providers struct {
 	Catalog discovery.Discoverer
 
 	EventService eventsv1connect.EventServiceClient
+
+	// UserService and NotifyService are nil unless Config.NotifyOwners is
+	// set.
+	UserService   idmv1connect.UserServiceClient
+	NotifyService idmv1connect.NotifyServiceClient
+
+	// Metrics and MetricsSink are nil if metrics are disabled.
+	Metrics     *metrics.Recorder
+	MetricsSink *gometrics.InmemSink
 }
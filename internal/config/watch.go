@@ -0,0 +1,30 @@
+package config
+
+import "fmt"
+
+// SlowConsumerPolicy decides how updates are handled once the buffer of a
+// watch stream is full.
+type SlowConsumerPolicy string
+
+const (
+	// DropOldest drops the oldest buffered update in favor of the new one.
+	DropOldest SlowConsumerPolicy = "drop-oldest"
+
+	// DropUpdate drops the new update and keeps the buffered ones.
+	DropUpdate SlowConsumerPolicy = "drop-update"
+
+	// Disconnect ends the watch stream so the client can reconnect and
+	// receive the current state of the operations.
+	Disconnect SlowConsumerPolicy = "disconnect"
+)
+
+// EnvDecode implements envconfig.Decoder.
+func (p *SlowConsumerPolicy) EnvDecode(val string) error {
+	switch policy := SlowConsumerPolicy(val); policy {
+	case DropOldest, DropUpdate, Disconnect:
+		*p = policy
+		return nil
+	}
+
+	return fmt.Errorf("invalid slow consumer policy %q, expected one of %q, %q or %q", val, DropOldest, DropUpdate, Disconnect)
+}
@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// MaxBackoff is the longest delay between two checks while the repository
+	// is failing, unless the interval itself is longer.
+	MaxBackoff = 10 * time.Minute
+
+	// failureThreshold is the number of consecutive failed checks after which
+	// they are reported as errors instead of warnings.
+	failureThreshold = 5
+)
+
+// runChecks checks operations at the interval of ticker until ctx is
+// cancelled. While checks fail, the delay is doubled after each failed check
+// and randomized so multiple instances do not hit the repository at the same
+// time once it recovers. The first successful check restores the interval.
+func (m *Manager) runChecks(ctx context.Context, ticker *time.Ticker) {
+	failures := 0
+
+	// resumed is set once the downtime before the first check, or before
+	// becoming the leader, has been evaluated.
+	resumed := false
+
+	for {
+		if m.Leader() {
+			if !resumed {
+				m.detectDowntime(ctx)
+				resumed = true
+			}
+
+			slog.Info("checking operation states")
+
+			switch {
+			case m.checkOperations(ctx):
+				m.recordCheck(ctx)
+
+				if failures > 0 {
+					slog.Info("operation checks recovered", "failures", failures)
+
+					ticker.Reset(m.interval)
+				}
+
+				failures = 0
+
+			case ctx.Err() == nil:
+				failures++
+			}
+		} else {
+			resumed = false
+		}
+
+		// the ticker is ignored while backing off.
+		var (
+			tick  = ticker.C
+			retry <-chan time.Time
+			timer *time.Timer
+		)
+
+		if failures > 0 {
+			delay := m.backoff(failures)
+
+			timer = m.timerFactory(delay)
+			retry = timer.C
+			tick = nil
+
+			if failures >= failureThreshold {
+				slog.Error("operation checks keep failing", "failures", failures, "retryIn", delay.String())
+
+				if m.metrics != nil {
+					m.metrics.IncrPersistentCheckFailures()
+				}
+			} else {
+				slog.Warn("operation check failed, backing off", "failures", failures, "retryIn", delay.String())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-m.wakeCheck:
+		case <-retry:
+		case <-tick:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// backoff returns the delay before the next check after the given number of
+// consecutive failed checks. The delay is between half and the full
+// exponential backoff.
+func (m *Manager) backoff(failures int) time.Duration {
+	delay := max(MaxBackoff, m.interval)
+	if shift := min(failures, 16); m.interval<<shift < delay {
+		delay = m.interval << shift
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
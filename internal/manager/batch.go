@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// DefaultLostConcurrency is the number of operations that are marked as lost
+// concurrently unless changed using SetLostConcurrency.
+const DefaultLostConcurrency = 4
+
+// lostOperation is an operation that is about to be marked as lost with
+// reason.
+type lostOperation struct {
+	op     *longrunningv1.Operation
+	reason *longrunningv1.OperationError
+}
+
+// SetLostConcurrency sets the number of operations that are marked as lost
+// concurrently once a check finds multiple of them, see
+// DefaultLostConcurrency. Values below 1 mark them one by one.
+// SetLostConcurrency must be called before Start.
+func (m *Manager) SetLostConcurrency(n int) {
+	m.lostConcurrency = max(n, 1)
+}
+
+// markAllAsLost marks the operations of batch as lost using up to
+// lostConcurrency workers. Failures do not abort the batch, they are logged
+// together with a summary once all operations are processed. It reports
+// whether all operations have been marked as lost.
+func (m *Manager) markAllAsLost(ctx context.Context, batch []lostOperation) bool {
+	if len(batch) == 0 {
+		return true
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errL sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, m.lostConcurrency)
+	)
+
+	for _, l := range batch {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := m.markAsLost(ctx, l.op, l.reason); err != nil {
+				errL.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", l.op.UniqueId, err))
+				errL.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		slog.Error("failed to mark some operations as lost", "expired", len(batch), "lost", len(batch)-len(errs), "failed", len(errs), "error", errors.Join(errs...))
+
+		return false
+	}
+
+	if m.dryRun.Load() {
+		slog.Info("expired operations would be lost (dry-run)", "expired", len(batch))
+		return true
+	}
+
+	slog.Info("marked expired operations as lost", "expired", len(batch), "lost", len(batch))
+
+	return true
+}
+
+// claimLost reserves the operation with the given id for being marked as
+// lost. It returns false if the operation is already being marked, so
+// operations that are considered expired by consecutive checks or by a check
+// and a deadline timer at the same time are only marked once.
+func (m *Manager) claimLost(id string) bool {
+	m.lostL.Lock()
+	defer m.lostL.Unlock()
+
+	if _, ok := m.marking[id]; ok {
+		return false
+	}
+
+	m.marking[id] = struct{}{}
+
+	return true
+}
+
+// releaseLost releases the reservation of claimLost.
+func (m *Manager) releaseLost(id string) {
+	m.lostL.Lock()
+	defer m.lostL.Unlock()
+
+	delete(m.marking, id)
+}
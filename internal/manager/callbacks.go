@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+type (
+	// Unsubscribe removes a callback registered with OnStateChange, OnLost,
+	// OnStarted, OnTimeout or OnExpiring. Once it returned, the callback is not invoked
+	// anymore but invocations that are already running are not interrupted.
+	// Calling it multiple times is safe.
+	Unsubscribe func()
+
+	// subscription wraps a callback so it can be identified for removal.
+	// Callbacks that only receive the current operation ignore old.
+	subscription struct {
+		fn func(old, new *longrunningv1.Operation)
+	}
+)
+
+// subscribe adds fn to the callbacks in list.
+func (m *Manager) subscribe(list *[]*subscription, fn func(old, new *longrunningv1.Operation)) Unsubscribe {
+	sub := &subscription{fn: fn}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	*list = append(*list, sub)
+
+	return func() {
+		m.l.Lock()
+		defer m.l.Unlock()
+
+		// notifications hold the read lock while iterating the list, so it is
+		// replaced instead of modified in place.
+		*list = slices.DeleteFunc(slices.Clone(*list), func(s *subscription) bool {
+			return s == sub
+		})
+	}
+}
+
+// current adapts a callback that only receives the current operation to
+// subscribe.
+func current(fn func(*longrunningv1.Operation)) func(old, new *longrunningv1.Operation) {
+	return func(_, op *longrunningv1.Operation) {
+		fn(op)
+	}
+}
+
+// callback describes a running OnStateChange, OnStarted, OnTimeout or
+// OnExpiring callback.
+type callback struct {
+	event string
+	id    string
+	start time.Time
+}
+
+// invoke calls fn with clones of old and op in a separate goroutine that is
+// tracked until it returns, see WaitAll. old may be nil. event names the kind
+// of callback for logging.
+func (m *Manager) invoke(event string, fn func(old, new *longrunningv1.Operation), old, op *longrunningv1.Operation) {
+	m.cbL.Lock()
+	m.cbSeq++
+	seq := m.cbSeq
+	m.callbacks[seq] = callback{
+		event: event,
+		id:    op.UniqueId,
+		start: time.Now(),
+	}
+	m.cbWg.Add(1)
+	m.cbL.Unlock()
+
+	go func() {
+		defer func() {
+			m.cbL.Lock()
+			delete(m.callbacks, seq)
+			m.cbL.Unlock()
+
+			m.cbWg.Done()
+		}()
+
+		if old != nil {
+			old = proto.Clone(old).(*longrunningv1.Operation)
+		}
+
+		fn(old, proto.Clone(op).(*longrunningv1.Operation))
+	}()
+}
+
+// WaitAll is like Wait but waits for outstanding OnStateChange, OnStarted,
+// OnTimeout and OnExpiring callbacks as well. If ctx is cancelled before, the
+// callbacks that are still running are logged and abandoned and the error of
+// ctx is returned.
+func (m *Manager) WaitAll(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		m.wg.Wait()
+		m.cbWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		m.cbL.Lock()
+		defer m.cbL.Unlock()
+
+		for _, cb := range m.callbacks {
+			slog.Warn("abandoning callback", "event", cb.event, "id", cb.id, "running", time.Since(cb.start).String())
+		}
+
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Unless a SinceFunc is passed to New, the manager does not compare the
+// lastUpdate of operations with its own clock, which might drift from the
+// clocks of other instances. Instead, the repository evaluates which
+// operations expired using the clock of the database, see
+// Repository.GetExpiredOperations. The offset of the database clock is
+// recorded as well so the deadline timers fire in time.
+
+// since returns the time that elapsed since t according to the database
+// clock, or to the SinceFunc passed to New.
+func (m *Manager) since(t time.Time) time.Duration {
+	return m.sinceFunc(t) + time.Duration(m.skew.Load())
+}
+
+// now returns the current time according to the same clock as since.
+func (m *Manager) now() time.Time {
+	now := time.Now()
+
+	return now.Add(m.since(now))
+}
+
+// markExpired marks the operations as lost whose TTL and grace period elapsed
+// according to the database clock. If ids is not empty, only operations with
+// these ids are considered. It returns the ids of the expired operations and
+// whether querying and marking them as lost succeeded.
+func (m *Manager) markExpired(ctx context.Context, ids []string) (map[string]bool, bool) {
+	ops, now, err := m.r.GetExpiredOperations(ctx, m.namespaces, ids)
+	if err != nil {
+		slog.Error("failed to query expired operations", "error", err)
+		m.incrCheckErrors("GetExpiredOperations")
+
+		return nil, false
+	}
+
+	m.skew.Store(int64(now.Sub(time.Now())))
+
+	expired := make(map[string]bool, len(ops))
+	batch := make([]lostOperation, 0, len(ops))
+
+	for _, op := range ops {
+		// observed again until the extra ttl after a downtime elapsed.
+		if m.graced(op) {
+			continue
+		}
+
+		expired[op.UniqueId] = true
+		batch = append(batch, lostOperation{op, ttlExpiredError(op, now.Sub(op.LastUpdate.AsTime()), m.affectedBy(op))})
+	}
+
+	return expired, m.markAllAsLost(ctx, batch)
+}
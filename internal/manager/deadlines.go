@@ -0,0 +1,314 @@
+package manager
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+type (
+	// deadline is the time at which a RUNNING operation is lost if it is not
+	// updated, that is its last update plus its TTL and grace period. If
+	// expiry warnings are enabled, see SetExpiryWarning, at is the time of
+	// the warning until it has been issued.
+	deadline struct {
+		id     string
+		at     time.Time
+		lost   time.Time
+		warn   time.Time
+		warned bool
+		index  int
+	}
+
+	// deadlineHeap is a min-heap of deadlines, see container/heap.
+	deadlineHeap []*deadline
+)
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x any) {
+	d := x.(*deadline)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	n := len(old)
+	d := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return d
+}
+
+// Observe records the latest known state of pbop so the operation is marked
+// as lost right when its deadline passes instead of at the next poll. It must
+// be called whenever an operation is registered or updated, including
+// heartbeats and updates received from other instances. Operations that are
+// not RUNNING, are paused or never expire are forgotten. An update that moves the deadline
+// re-arms the expiry warning of the operation.
+func (m *Manager) Observe(pbop *longrunningv1.Operation) {
+	m.forgetPendingLoss(pbop)
+
+	m.dl.Lock()
+	defer m.dl.Unlock()
+
+	existing := m.deadlines[pbop.UniqueId]
+
+	if pbop.State != longrunningv1.OperationState_OperationState_RUNNING || pbop.Annotations[op.PausedAtAnnotation] != "" || neverExpires(pbop) {
+		if existing != nil {
+			heap.Remove(&m.heap, existing.index)
+			delete(m.deadlines, pbop.UniqueId)
+			m.setWatched()
+		}
+
+		return
+	}
+
+	lost := m.lostAt(pbop)
+
+	switch {
+	case existing == nil:
+		d := &deadline{id: pbop.UniqueId}
+		m.arm(d, pbop, lost)
+		heap.Push(&m.heap, d)
+		m.deadlines[d.id] = d
+		m.setWatched()
+
+	case !existing.lost.Equal(lost):
+		m.arm(existing, pbop, lost)
+		heap.Fix(&m.heap, existing.index)
+
+	default:
+		return
+	}
+
+	// the earliest deadline might have changed.
+	select {
+	case m.wakeTimers <- struct{}{}:
+	default:
+	}
+}
+
+// arm resets d to the given lost deadline of pbop and, if expiry warnings are
+// enabled, schedules the warning first.
+func (m *Manager) arm(d *deadline, pbop *longrunningv1.Operation, lost time.Time) {
+	d.lost = lost
+	d.at = lost
+	d.warned = true
+
+	if after, ok := m.warnAfter(pbop); ok {
+		d.warn = pbop.LastUpdate.AsTime().Add(after)
+		d.at = d.warn
+		d.warned = false
+	}
+}
+
+// warnAfter returns the time after the last update of pbop at which the
+// OnExpiring callbacks are invoked, see SetExpiryWarning and
+// SetGraceWarning. It returns false if pbop is not warned at all.
+func (m *Manager) warnAfter(pbop *longrunningv1.Operation) (time.Duration, bool) {
+	ttl := pbop.Ttl.AsDuration()
+	grace := pbop.GracePeriod.AsDuration()
+
+	switch {
+	case m.warnAtTTL:
+		return ttl, grace > 0
+	case m.warnFraction > 0:
+		return time.Duration(float64(ttl+grace) * m.warnFraction), true
+	default:
+		return 0, false
+	}
+}
+
+// nextDeadline returns a timer that fires at the earliest deadline or nil if
+// there is none.
+func (m *Manager) nextDeadline() *time.Timer {
+	m.dl.Lock()
+	defer m.dl.Unlock()
+
+	if len(m.heap) == 0 {
+		return nil
+	}
+
+	return m.timerFactory(max(-m.since(m.heap[0].at), 0))
+}
+
+// popExpired removes all passed deadlines and returns their operation ids.
+// Operations whose warning time passed are returned in warn instead and
+// remain scheduled for their lost deadline.
+func (m *Manager) popExpired() (lost, warn []string) {
+	m.dl.Lock()
+	defer m.dl.Unlock()
+
+	for len(m.heap) > 0 && m.since(m.heap[0].at) >= 0 {
+		d := m.heap[0]
+
+		if !d.warned {
+			d.warned = true
+			d.at = d.lost
+			heap.Fix(&m.heap, d.index)
+
+			warn = append(warn, d.id)
+			continue
+		}
+
+		heap.Pop(&m.heap)
+		delete(m.deadlines, d.id)
+		m.setWatched()
+
+		lost = append(lost, d.id)
+	}
+
+	return lost, warn
+}
+
+// runTimers marks operations as lost once their deadline passed until ctx is
+// cancelled.
+func (m *Manager) runTimers(ctx context.Context) {
+	for {
+		var fired <-chan time.Time
+
+		timer := m.nextDeadline()
+		if timer != nil {
+			fired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+
+			return
+
+		case <-m.wakeTimers:
+			if timer != nil {
+				timer.Stop()
+			}
+
+		case <-fired:
+			lost, warn := m.popExpired()
+
+			// the leader takes care of them. The deadlines are observed
+			// again by the first scan once this instance becomes the leader.
+			if !m.Leader() {
+				continue
+			}
+
+			m.warnExpiring(ctx, warn)
+			m.expire(ctx, lost)
+		}
+	}
+}
+
+// expire reloads the operations with the given ids since they might have been
+// updated through another instance and marks those as lost whose deadline
+// actually passed. All others are observed again.
+func (m *Manager) expire(ctx context.Context, ids []string) {
+	var expired map[string]bool
+	if m.serverClock && len(ids) > 0 {
+		// the query failed, the operations are observed again by the next
+		// check.
+		if expired, _ = m.markExpired(ctx, ids); expired == nil {
+			return
+		}
+	}
+
+	var batch []lostOperation
+	for _, id := range ids {
+		if expired[id] {
+			continue
+		}
+
+		pbop, err := m.r.GetActiveOperation(ctx, m.namespaces, id)
+		if err != nil {
+			slog.Error("failed to load operation", "id", id, "error", err)
+			m.incrCheckErrors("GetActiveOperation")
+
+			continue
+		}
+
+		// completed, lost, paused or not managed by this instance.
+		if pbop == nil || neverExpires(pbop) {
+			continue
+		}
+
+		if !m.serverClock {
+			diff := m.sinceFunc(pbop.LastUpdate.AsTime())
+			if diff >= pbop.Ttl.AsDuration()+pbop.GracePeriod.AsDuration() && !m.graced(pbop) {
+				batch = append(batch, lostOperation{pbop, ttlExpiredError(pbop, diff, m.affectedBy(pbop))})
+				continue
+			}
+		}
+
+		m.Observe(pbop)
+	}
+
+	m.markAllAsLost(ctx, batch)
+}
+
+// warnExpiring reloads the operations with the given ids and invokes the
+// OnExpiring callbacks for those that have not been updated since their
+// warning has been scheduled. The remaining time until they are lost is
+// passed in the op.LostInAnnotation. Operations that have been updated in the
+// meantime are observed again.
+func (m *Manager) warnExpiring(ctx context.Context, ids []string) {
+	for _, id := range ids {
+		pbop, err := m.r.GetActiveOperation(ctx, m.namespaces, id)
+		if err != nil {
+			slog.Error("failed to load operation", "id", id, "error", err)
+			m.incrCheckErrors("GetActiveOperation")
+
+			continue
+		}
+
+		if pbop == nil || neverExpires(pbop) {
+			continue
+		}
+
+		total := pbop.Ttl.AsDuration() + pbop.GracePeriod.AsDuration()
+		after, _ := m.warnAfter(pbop)
+
+		diff := m.since(pbop.LastUpdate.AsTime())
+		if diff < after || diff >= total {
+			// either updated in the meantime or about to be marked as lost.
+			m.Observe(pbop)
+			continue
+		}
+
+		lostIn := m.lostAt(pbop).Sub(pbop.LastUpdate.AsTime()) - diff
+
+		slog.Info("operation about to expire", "id", pbop.UniqueId, "description", pbop.Description, "lostIn", lostIn.String())
+
+		if pbop.Annotations == nil {
+			pbop.Annotations = make(map[string]string)
+		}
+
+		pbop.Annotations[op.LostInAnnotation] = lostIn.Round(time.Second).String()
+
+		m.l.RLock()
+		for _, sub := range m.onExpiring {
+			m.invoke("expiring", sub.fn, nil, pbop)
+		}
+		m.l.RUnlock()
+	}
+}
+
+// neverExpires reports whether pbop has been registered without expiry, see
+// op.NoExpiryAnnotation.
+func neverExpires(pbop *longrunningv1.Operation) bool {
+	return pbop.Annotations[op.NoExpiryAnnotation] == "true"
+}
@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// Checkpoints is the interface required by the manager to detect that no
+// instance checked operations for a while, see SetDowntimeGrace.
+type Checkpoints interface {
+	// RecordCheck should record that operations have been checked by the
+	// manager with the given name.
+	RecordCheck(ctx context.Context, name string) error
+
+	// LastCheck should return the time recorded by the last RecordCheck for
+	// the manager with the given name, or the zero time if there is none,
+	// together with the current time of the same clock.
+	LastCheck(ctx context.Context, name string) (last, now time.Time, err error)
+}
+
+// downtime is a period in which no manager checked operations.
+type downtime struct {
+	start time.Time
+	end   time.Time
+}
+
+// SetDowntimeGrace enables the detection of downtimes. Once the manager
+// starts checking operations and the last recorded check is more than
+// threshold ago, all operations that have not been updated since then get one
+// more TTL to send a heartbeat before they are marked as lost. Otherwise, all
+// operations whose deadline passed while the service was stopped would be
+// lost at once even if their workers are still alive. Operations that do get
+// lost include the downtime in their error details. SetDowntimeGrace must be
+// called before Start.
+func (m *Manager) SetDowntimeGrace(checkpoints Checkpoints, threshold time.Duration) {
+	m.checkpoints = checkpoints
+	m.downtimeThreshold = threshold
+}
+
+// SetLostRate limits how many operations are marked as lost per second so a
+// burst of lost operations does not flood the subscribers of OnLost. Zero
+// disables the limit, this is the default. SetLostRate must be called before
+// Start.
+func (m *Manager) SetLostRate(perSecond float64) {
+	m.lostEvery = 0
+	if perSecond > 0 {
+		m.lostEvery = time.Duration(float64(time.Second) / perSecond)
+	}
+}
+
+// detectDowntime compares the last recorded check with the current time and
+// starts a grace period if it exceeds the threshold of SetDowntimeGrace.
+func (m *Manager) detectDowntime(ctx context.Context) {
+	if m.checkpoints == nil {
+		return
+	}
+
+	last, now, err := m.checkpoints.LastCheck(ctx, m.leaseName())
+	if err != nil {
+		slog.Error("failed to get last manager check", "error", err)
+		m.incrCheckErrors("LastCheck")
+
+		return
+	}
+
+	// the very first start of the manager.
+	if last.IsZero() {
+		return
+	}
+
+	gap := now.Sub(last)
+	if gap <= m.downtimeThreshold {
+		return
+	}
+
+	slog.Warn("operations have not been checked for a while, extending deadlines by one ttl", "downtime", gap.Round(time.Second).String(), "lastCheck", last)
+
+	m.downtimeL.Lock()
+	m.downtime = &downtime{start: last, end: now}
+	m.downtimeL.Unlock()
+}
+
+// recordCheck records a successful check, see SetDowntimeGrace.
+func (m *Manager) recordCheck(ctx context.Context) {
+	if m.checkpoints == nil {
+		return
+	}
+
+	if err := m.checkpoints.RecordCheck(ctx, m.leaseName()); err != nil {
+		slog.Error("failed to record manager check", "error", err)
+		m.incrCheckErrors("RecordCheck")
+	}
+}
+
+// affectedBy returns the last downtime if pbop has not been updated since.
+func (m *Manager) affectedBy(pbop *longrunningv1.Operation) *downtime {
+	m.downtimeL.Lock()
+	defer m.downtimeL.Unlock()
+
+	if m.downtime == nil || !pbop.LastUpdate.AsTime().Before(m.downtime.end) {
+		return nil
+	}
+
+	return m.downtime
+}
+
+// lostAt returns the time at which pbop is lost unless updated, taking an
+// extra TTL after the last downtime into account.
+func (m *Manager) lostAt(pbop *longrunningv1.Operation) time.Time {
+	lost := pbop.LastUpdate.AsTime().Add(pbop.Ttl.AsDuration() + pbop.GracePeriod.AsDuration())
+
+	if d := m.affectedBy(pbop); d != nil {
+		if extended := d.end.Add(pbop.Ttl.AsDuration()); extended.After(lost) {
+			return extended
+		}
+	}
+
+	return lost
+}
+
+// graced reports whether pbop must not be marked as lost yet because of the
+// extra TTL after the last downtime.
+func (m *Manager) graced(pbop *longrunningv1.Operation) bool {
+	d := m.affectedBy(pbop)
+
+	return d != nil && m.since(d.end) < pbop.Ttl.AsDuration()
+}
+
+// throttleLost blocks until the next operation may be marked as lost, see
+// SetLostRate. It returns false if ctx is cancelled in the meantime.
+func (m *Manager) throttleLost(ctx context.Context) bool {
+	if m.lostEvery <= 0 {
+		return true
+	}
+
+	m.lostL.Lock()
+	next := time.Now()
+	if m.nextLost.After(next) {
+		next = m.nextLost
+	}
+	m.nextLost = next.Add(m.lostEvery)
+	m.lostL.Unlock()
+
+	wait := time.Until(next)
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// PendingLoss is an operation that would have been marked as lost if the
+// manager was not in dry-run mode, see SetDryRun.
+type PendingLoss struct {
+	// Operation is the operation as it was when the loss was detected.
+	Operation *longrunningv1.Operation
+
+	// Reason is the error the operation would have been marked as lost with.
+	Reason *longrunningv1.OperationError
+
+	// Since is the time at which the loss has been detected first.
+	Since time.Time
+}
+
+// SetDryRun enables (true) or disables (false) the dry-run mode. In dry-run
+// mode, deadlines are evaluated as usual but operations are never marked as
+// lost and the OnLost callbacks are not invoked. Instead, the operations that
+// would have been lost are reported by PendingLosses. Unlike the other
+// setters, SetDryRun may be called while the manager is running. Once the
+// dry-run mode is disabled, the pending losses are dropped and the operations
+// are marked as lost by the next check.
+func (m *Manager) SetDryRun(enabled bool) {
+	if m.dryRun.Swap(enabled) == enabled {
+		return
+	}
+
+	slog.Info("manager dry-run mode changed", "enabled", enabled)
+
+	if enabled {
+		return
+	}
+
+	m.pendingL.Lock()
+	clear(m.pending)
+	m.pendingL.Unlock()
+
+	select {
+	case m.wakeCheck <- struct{}{}:
+	default:
+	}
+}
+
+// DryRun reports whether the dry-run mode is enabled, see SetDryRun.
+func (m *Manager) DryRun() bool {
+	return m.dryRun.Load()
+}
+
+// PendingLosses returns the operations that would have been marked as lost
+// since the dry-run mode has been enabled, ordered by the time of their
+// detection. Operations are removed again once they are updated. The returned
+// operations are cloned.
+func (m *Manager) PendingLosses() []PendingLoss {
+	m.pendingL.Lock()
+	defer m.pendingL.Unlock()
+
+	losses := make([]PendingLoss, 0, len(m.pending))
+	for _, loss := range m.pending {
+		losses = append(losses, PendingLoss{
+			Operation: proto.Clone(loss.Operation).(*longrunningv1.Operation),
+			Reason:    proto.Clone(loss.Reason).(*longrunningv1.OperationError),
+			Since:     loss.Since,
+		})
+	}
+
+	slices.SortFunc(losses, func(a, b PendingLoss) int {
+		if c := a.Since.Compare(b.Since); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.Operation.UniqueId, b.Operation.UniqueId)
+	})
+
+	return losses
+}
+
+// recordPendingLoss records that op would have been marked as lost with
+// reason in dry-run mode.
+func (m *Manager) recordPendingLoss(op *longrunningv1.Operation, reason *longrunningv1.OperationError) {
+	m.pendingL.Lock()
+	defer m.pendingL.Unlock()
+
+	since := time.Now()
+	if existing, ok := m.pending[op.UniqueId]; ok {
+		since = existing.Since
+	} else {
+		slog.Info("operation would be lost (dry-run)", "id", op.UniqueId, "description", op.Description, "previousState", op.State.String(), "reason", reason.Message)
+	}
+
+	m.pending[op.UniqueId] = PendingLoss{
+		Operation: proto.Clone(op).(*longrunningv1.Operation),
+		Reason:    reason,
+		Since:     since,
+	}
+}
+
+// forgetPendingLoss removes the pending loss of pbop if the operation has
+// been updated since the loss was detected.
+func (m *Manager) forgetPendingLoss(pbop *longrunningv1.Operation) {
+	m.pendingL.Lock()
+	defer m.pendingL.Unlock()
+
+	loss, ok := m.pending[pbop.UniqueId]
+	if !ok {
+		return
+	}
+
+	if loss.Operation.State != pbop.State || pbop.LastUpdate.AsTime().After(loss.Operation.LastUpdate.AsTime()) {
+		delete(m.pending, pbop.UniqueId)
+	}
+}
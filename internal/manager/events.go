@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"context"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// Events is the interface required by the manager to store the lifecycle
+// events of the operations it changes, see SetEvents.
+type Events interface {
+	// Transaction should run fn in a transaction that is committed if fn
+	// returns without an error. fn may be invoked more than once.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+
+	// StoreEvents should store a lifecycle event of type typ for each of ops
+	// as part of the transaction of ctx. changedFields is only used for
+	// op.EventUpdated.
+	StoreEvents(ctx context.Context, typ op.EventType, changedFields []string, ops ...*longrunningv1.Operation) error
+}
+
+// SetEvents lets the manager store the lifecycle events of the operations it
+// marks as lost, starts, times out or retries in the same transaction as the
+// change. The callbacks are only invoked once the transaction has been
+// committed. SetEvents must be called before Start.
+func (m *Manager) SetEvents(events Events) {
+	m.events = events
+}
+
+// write runs fn, which changes the operations it returns, and stores an event
+// of type typ for each of them in the same transaction, see SetEvents. Without
+// events, fn is run on it's own.
+func (m *Manager) write(ctx context.Context, typ op.EventType, changedFields []string, fn func(ctx context.Context) ([]*longrunningv1.Operation, error)) ([]*longrunningv1.Operation, error) {
+	if m.events == nil {
+		return fn(ctx)
+	}
+
+	var ops []*longrunningv1.Operation
+	err := m.events.Transaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		ops, err = fn(ctx)
+		if err != nil {
+			return err
+		}
+
+		return m.events.StoreEvents(ctx, typ, changedFields, ops...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ops, nil
+}
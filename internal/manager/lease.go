@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Lease is the interface required by the manager to elect a single instance
+// that checks operations, see SetLease.
+type Lease interface {
+	// AcquireLease should acquire the lease with the given name for holder,
+	// or renew it if holder already holds it, and report whether holder holds
+	// the lease afterwards. The lease must not be acquired by anyone else
+	// before ttl elapsed since the request has been sent.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease should release the lease with the given name if it is
+	// held by holder.
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
+
+// leaseName returns the name of the lease for the namespaces of the manager.
+// Managers restricted to different namespaces do not compete.
+func (m *Manager) leaseName() string {
+	if len(m.namespaces) == 0 {
+		return "manager"
+	}
+
+	namespaces := slices.Clone(m.namespaces)
+	slices.Sort(namespaces)
+
+	return "manager:" + strings.Join(slices.Compact(namespaces), ",")
+}
+
+// Leader reports whether the manager currently checks operations. Managers
+// without a lease are always the leader.
+func (m *Manager) Leader() bool {
+	if m.lease == nil {
+		return true
+	}
+
+	m.leaderL.Lock()
+	defer m.leaderL.Unlock()
+
+	return time.Now().Before(m.leaderUntil)
+}
+
+// runLease acquires and renews the lease at a third of its TTL until ctx is
+// cancelled. The lease is released afterwards so another instance can take
+// over right away.
+func (m *Manager) runLease(ctx context.Context) {
+	ticker := time.NewTicker(m.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		m.renewLease(ctx)
+
+		select {
+		case <-ctx.Done():
+			m.releaseLease(context.WithoutCancel(ctx))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewLease tries to acquire or renew the lease. If the lease is acquired,
+// operations are checked right away instead of at the next interval.
+func (m *Manager) renewLease(ctx context.Context) {
+	// the lease is held for at least ttl after the request has been sent,
+	// independent of the clock of the lease store and the request latency.
+	start := time.Now()
+
+	held, err := m.lease.AcquireLease(ctx, m.leaseName(), m.holder, m.leaseTTL)
+	if err != nil {
+		// the current term runs out on its own unless a later renewal
+		// succeeds.
+		if ctx.Err() == nil {
+			slog.Error("failed to renew manager lease", "error", err, "lease", m.leaseName())
+		}
+
+		return
+	}
+
+	m.leaderL.Lock()
+	wasLeader := start.Before(m.leaderUntil)
+	if held {
+		m.leaderUntil = start.Add(m.leaseTTL)
+	} else {
+		m.leaderUntil = time.Time{}
+	}
+	m.leaderL.Unlock()
+
+	switch {
+	case held && !wasLeader:
+		slog.Info("acquired manager lease", "lease", m.leaseName(), "holder", m.holder)
+
+		select {
+		case m.wakeCheck <- struct{}{}:
+		default:
+		}
+
+	case !held && wasLeader:
+		slog.Warn("lost manager lease", "lease", m.leaseName(), "holder", m.holder)
+	}
+}
+
+// releaseLease steps down and releases the lease.
+func (m *Manager) releaseLease(ctx context.Context) {
+	m.leaderL.Lock()
+	m.leaderUntil = time.Time{}
+	m.leaderL.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := m.lease.ReleaseLease(ctx, m.leaseName(), m.holder); err != nil {
+		slog.Error("failed to release manager lease", "error", err, "lease", m.leaseName())
+	}
+}
@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NewLostError returns the OperationError that is recorded when an operation is
+// marked as lost. The reason and all details are stored as a google.protobuf.Struct
+// in the error_details field.
+func NewLostError(reason string, message string, details map[string]any) *longrunningv1.OperationError {
+	fields := map[string]any{
+		op.LostReasonDetail: reason,
+	}
+
+	for key, value := range details {
+		fields[key] = value
+	}
+
+	res := &longrunningv1.OperationError{
+		Message: message,
+	}
+
+	s, err := structpb.NewStruct(fields)
+	if err == nil {
+		res.ErrorDetails, err = anypb.New(s)
+	}
+
+	if err != nil {
+		slog.Error("failed to encode lost operation details", "reason", reason, "error", err)
+	}
+
+	return res
+}
+
+// ttlExpiredError returns the error of an operation whose TTL and grace
+// period elapsed. If the operation has been given an extra TTL because of
+// the downtime d, the downtime is included.
+func ttlExpiredError(pbop *longrunningv1.Operation, elapsed time.Duration, d *downtime) *longrunningv1.OperationError {
+	ttl := pbop.Ttl.AsDuration()
+	grace := pbop.GracePeriod.AsDuration()
+	lastUpdate := pbop.LastUpdate.AsTime()
+
+	message := fmt.Sprintf("no update received for %s (ttl=%s, grace-period=%s)", elapsed.Round(time.Second), ttl, grace)
+	details := map[string]any{
+		"lastUpdate":  lastUpdate.Format(time.RFC3339),
+		"deadline":    lastUpdate.Add(ttl + grace).Format(time.RFC3339),
+		"elapsed":     elapsed.String(),
+		"ttl":         ttl.String(),
+		"gracePeriod": grace.String(),
+	}
+
+	if d != nil {
+		message += fmt.Sprintf(", including a downtime of the service of %s", d.end.Sub(d.start).Round(time.Second))
+
+		details["downtimeStart"] = d.start.Format(time.RFC3339)
+		details["downtimeEnd"] = d.end.Format(time.RFC3339)
+		details["downtime"] = d.end.Sub(d.start).String()
+	}
+
+	return NewLostError(op.LostReasonTTLExpired, message, details)
+}
+
+func maxRuntimeError(pbop *longrunningv1.Operation, now time.Time) *longrunningv1.OperationError {
+	deadline := pbop.Annotations[op.RuntimeDeadlineAnnotation]
+	createTime := pbop.CreateTime.AsTime()
+
+	details := map[string]any{
+		"createTime": createTime.Format(time.RFC3339),
+		"deadline":   deadline,
+		"elapsed":    now.Sub(createTime).String(),
+	}
+
+	message := "operation exceeded its maximum runtime"
+	if t, err := time.Parse(time.RFC3339, deadline); err == nil {
+		message = fmt.Sprintf("operation exceeded its maximum runtime by %s", now.Sub(t).Round(time.Second))
+	}
+
+	return NewLostError(op.ReasonMaxRuntimeExceeded, message, details)
+}
+
+func pendingTimeoutError(pbop *longrunningv1.Operation, elapsed time.Duration) *longrunningv1.OperationError {
+	return NewLostError(
+		op.LostReasonPendingTimeout,
+		fmt.Sprintf("operation has not been started within %s", elapsed.Round(time.Second)),
+		map[string]any{
+			"createTime": pbop.CreateTime.AsTime().Format(time.RFC3339),
+			"elapsed":    elapsed.String(),
+		},
+	)
+}
@@ -2,152 +2,657 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
-	"google.golang.org/protobuf/proto"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
 )
 
+const (
+	// DefaultInterval is the interval at which operations are checked if
+	// none is passed to New.
+	DefaultInterval = 30 * time.Second
+
+	// MinInterval is the smallest supported interval.
+	MinInterval = time.Second
+)
+
+// ErrRunning is returned by Start if the manager is already running.
+var ErrRunning = errors.New("manager is already running")
+
 type (
 	// TickerFactory is a function that creates a new time.Ticker.
 	// This is mainly used for testing the manager implementation and
 	// defaults to time.NewTicker
 	TickerFactory func(time.Duration) *time.Ticker
 
+	// TimerFactory is a function that creates a new time.Timer for the
+	// deadline of the next operation, see Manager.Observe. Like
+	// TickerFactory, this is mainly used for testing and defaults to
+	// time.NewTimer.
+	TimerFactory func(time.Duration) *time.Timer
+
 	// SinceFunc is a function that returns how mutch time has elapsed between
 	// now and the provided time value. This is mainy for testing the manager
-	// implementation and defaults to time.Since
+	// implementation. If none is set, the clock of the database is used, see
+	// Repository.GetExpiredOperations.
 	SinceFunc func(time.Time) time.Duration
 
 	// Repository is the interface required by the manager to query and mark active operations
 	// as lost.
 	Repository interface {
-		// GetActiveOperations should return all operations that are in state RUNNING.
-		GetActiveOperations(context.Context) ([]*longrunningv1.Operation, error)
+		// GetActiveOperations should return all operations that are in state RUNNING
+		// and belong to one of the given namespaces. Operations without expiry
+		// (see op.NoExpiryAnnotation) are ignored by the manager. If no namespaces are specified,
+		// operations of all namespaces should be returned.
+		GetActiveOperations(context.Context, []string) ([]*longrunningv1.Operation, error)
+
+		// GetActiveOperation should return the operation with the given id if
+		// it is RUNNING, not paused and belongs to one of the given
+		// namespaces, or nil otherwise.
+		GetActiveOperation(context.Context, []string, string) (*longrunningv1.Operation, error)
+
+		// GetExpiredOperations should return the active operations of the
+		// given namespaces whose TTL and grace period elapsed according to the
+		// clock of the database, restricted to the given ids if any, together
+		// with the current time of the database.
+		GetExpiredOperations(context.Context, []string, []string) ([]*longrunningv1.Operation, time.Time, error)
+
+		// GetExpiredPendingOperations should return all operations of the given namespaces that
+		// are in state PENDING and have not been started before their pending timeout elapsed
+		// at the given time.
+		GetExpiredPendingOperations(context.Context, []string, time.Time) ([]*longrunningv1.Operation, error)
 
 		// MarkAsLost marks an operation as lost by updating it's state to LOST.
-		MarkAsLost(context.Context, string) (*longrunningv1.Operation, error)
+		// The provided error describes why the operation has been lost and is
+		// stored as the operation result. repo.ErrNotLost should be returned
+		// if the operation is no longer active or has not expired.
+		MarkAsLost(context.Context, string, *longrunningv1.OperationError) (*longrunningv1.Operation, error)
+
+		// StartDueOperations should start all scheduled operations of the
+		// given namespaces whose start time has passed at the given time and
+		// return them.
+		StartDueOperations(context.Context, []string, time.Time) ([]*longrunningv1.Operation, error)
+
+		// GetExceededOperations should return all operations of the given
+		// namespaces that are neither COMPLETE nor LOST but exceeded their
+		// maximum runtime at the given time.
+		GetExceededOperations(context.Context, []string, time.Time) ([]*longrunningv1.Operation, error)
+
+		// CompleteExceededOperation completes an operation that exceeded its
+		// maximum runtime at the given time with the provided error.
+		CompleteExceededOperation(context.Context, string, *longrunningv1.OperationError, time.Time) (*longrunningv1.Operation, error)
 	}
 
 	Manager struct {
 		r             Repository
+		interval      time.Duration
 		wg            sync.WaitGroup
-		startOnce     sync.Once
 		tickerFactory TickerFactory
+		timerFactory  TimerFactory
 		sinceFunc     SinceFunc
+		serverClock   bool
+		skew          atomic.Int64
+		metrics       Metrics
+		namespaces    []string
+		warnFraction  float64
+		warnAtTTL     bool
+
+		// runL serializes Start and Stop. done is closed once the loops
+		// started by the last Start exited.
+		runL   sync.Mutex
+		cancel context.CancelFunc
+		done   chan struct{}
+
+		// lease elects the instance that checks operations, see SetLease.
+		// leaderUntil is the end of the current term and protected by
+		// leaderL. wakeCheck triggers a check once the lease is acquired.
+		lease       Lease
+		holder      string
+		leaseTTL    time.Duration
+		leaderL     sync.Mutex
+		leaderUntil time.Time
+		wakeCheck   chan struct{}
+
+		// checkpoints detect downtimes, see SetDowntimeGrace. downtime is
+		// the last one detected and protected by downtimeL.
+		checkpoints       Checkpoints
+		downtimeThreshold time.Duration
+		downtimeL         sync.Mutex
+		downtime          *downtime
+
+		// lostEvery throttles markAsLost, see SetLostRate. nextLost is
+		// protected by lostL.
+		lostEvery time.Duration
+		lostL     sync.Mutex
+		nextLost  time.Time
+
+		// lostConcurrency bounds markAllAsLost. marking holds the ids of the
+		// operations that are being marked as lost and is protected by
+		// lostL as well.
+		lostConcurrency int
+		marking         map[string]struct{}
+
+		// retries executes the retry policies of lost operations, see
+		// SetRetries.
+		retries Retries
+
+		// events stores the lifecycle events of the changes of the manager,
+		// see SetEvents.
+		events Events
+
+		// dryRun only records the operations that would be lost, see
+		// SetDryRun. pending is protected by pendingL.
+		dryRun   atomic.Bool
+		pendingL sync.Mutex
+		pending  map[string]PendingLoss
+
+		// dl protects the deadlines of RUNNING operations, see Observe.
+		dl         sync.Mutex
+		heap       deadlineHeap
+		deadlines  map[string]*deadline
+		wakeTimers chan struct{}
+
+		l             sync.RWMutex
+		onStateChange []*subscription
+		onStarted     []*subscription
+		onTimeout     []*subscription
+		onExpiring    []*subscription
+		onRetried     []*subscription
 
-		l      sync.RWMutex
-		onLost []func(*longrunningv1.Operation)
+		// cbL protects the running callbacks, see invoke.
+		cbL       sync.Mutex
+		cbWg      sync.WaitGroup
+		cbSeq     uint64
+		callbacks map[uint64]callback
 	}
 )
 
 // New returns a new manager that will watch active operations in r and eventually mark them
 // as lost if no update happens during the specified TTL and GracePeriod of the operation.
+// Operations are checked at the given interval, or DefaultInterval if it is zero. Intervals
+// below MinInterval are raised to MinInterval.
 // If tickerFactory is not nil, it will be used to create the ticker for the polling interval,
 // if nil, time.NewTicker is used.
 // If sinceFunc is not nil it will be used to get the amount of time that has ellapsed since
-// the last operation update. If nil, time.Since will be used.
-func New(r Repository, tickerFactory TickerFactory, sinceFunc SinceFunc) *Manager {
+// the last operation update. If nil, expired operations are determined by r using the clock
+// of the database.
+// If metrics is not nil, the manager reports lost operations, the duration of its checks and
+// failed repository calls to it.
+func New(r Repository, interval time.Duration, tickerFactory TickerFactory, sinceFunc SinceFunc, metrics Metrics) *Manager {
+	switch {
+	case interval == 0:
+		interval = DefaultInterval
+	case interval < MinInterval:
+		interval = MinInterval
+	}
+
 	if tickerFactory == nil {
 		tickerFactory = time.NewTicker
 	}
 
-	if sinceFunc == nil {
+	serverClock := sinceFunc == nil
+	if serverClock {
 		sinceFunc = time.Since
 	}
 
 	return &Manager{
 		r:             r,
+		interval:      interval,
 		tickerFactory: tickerFactory,
+		timerFactory:  time.NewTimer,
 		sinceFunc:     sinceFunc,
+		serverClock:   serverClock,
+		metrics:       metrics,
+		deadlines:     make(map[string]*deadline),
+		marking:       make(map[string]struct{}),
+		pending:       make(map[string]PendingLoss),
+		callbacks:     make(map[uint64]callback),
+		wakeTimers:    make(chan struct{}, 1),
+		wakeCheck:     make(chan struct{}, 1),
+
+		lostConcurrency: DefaultLostConcurrency,
 	}
 }
 
+// SetNamespaces restricts the manager to operations of the given namespaces.
+// If no namespaces are set, operations of all namespaces are checked.
+// SetNamespaces must be called before Start.
+func (m *Manager) SetNamespaces(namespaces ...string) {
+	m.namespaces = namespaces
+}
+
+// SetTimerFactory replaces the function used to create the timers for the
+// deadlines of operations. SetTimerFactory must be called before Start.
+func (m *Manager) SetTimerFactory(timerFactory TimerFactory) {
+	m.timerFactory = timerFactory
+}
+
+// SetLease enables leader election between multiple instances. Only the
+// instance that holds the lease checks operations, marks them as lost and
+// invokes the callbacks, all others wait for the lease to expire, for example
+// when the leader died. The lease is renewed at a third of ttl and released
+// once the manager is stopped. holder must identify the instance.
+// SetLease must be called before Start.
+func (m *Manager) SetLease(lease Lease, holder string, ttl time.Duration) {
+	m.lease = lease
+	m.holder = holder
+	m.leaseTTL = ttl
+}
+
+// SetExpiryWarning enables the OnExpiring callbacks. They are invoked once a
+// RUNNING operation has not been updated for the given fraction of its TTL
+// and grace period, which must be between 0 and 1. A fraction of 0 disables
+// the warnings, this is the default. SetExpiryWarning must be called before
+// Start.
+func (m *Manager) SetExpiryWarning(fraction float64) {
+	m.warnFraction = fraction
+}
+
+// SetGraceWarning invokes the OnExpiring callbacks once a RUNNING operation
+// missed its TTL and is burning through its grace period, instead of at the
+// fraction of SetExpiryWarning. Operations without a grace period are not
+// warned since they are lost right away. SetGraceWarning must be called
+// before Start.
+func (m *Manager) SetGraceWarning(enabled bool) {
+	m.warnAtTTL = enabled
+}
+
+// OnStateChange registers a callback function that will be invoked in a
+// separate goroutine whenever the state of an operation changed, see
+// NotifyStateChange. The manager reports operations it marked as lost or
+// completed because they exceeded their maximum runtime, the service reports
+// updates and completions of its clients. old is the operation before the
+// change, or nil if it is unknown.
+// The operations passed when fn is called are cloned and not shared with any
+// other so it's save to manipulate them.
+// The returned Unsubscribe removes the callback again.
+func (m *Manager) OnStateChange(fn func(old, new *longrunningv1.Operation)) Unsubscribe {
+	return m.subscribe(&m.onStateChange, fn)
+}
+
 // OnLost registers a callback function that will be invoked in a separate
-// goroutine whenever an operation is marked as lost.
-// The operation passed when fn is called is cloned and not shared with any
-// other so it's save to manipulate it.
-func (m *Manager) OnLost(fn func(*longrunningv1.Operation)) {
-	m.l.Lock()
-	defer m.l.Unlock()
+// goroutine whenever an operation is marked as lost. It is an OnStateChange
+// callback that ignores all other states.
+func (m *Manager) OnLost(fn func(*longrunningv1.Operation)) Unsubscribe {
+	return m.OnStateChange(func(_, op *longrunningv1.Operation) {
+		if op.State == longrunningv1.OperationState_OperationState_LOST {
+			fn(op)
+		}
+	})
+}
+
+// OnStarted registers a callback function that will be invoked in a separate
+// goroutine whenever a scheduled operation has been started because its start
+// time arrived. Like for OnLost, the operation is cloned for each callback.
+func (m *Manager) OnStarted(fn func(*longrunningv1.Operation)) Unsubscribe {
+	return m.subscribe(&m.onStarted, current(fn))
+}
 
-	m.onLost = append(m.onLost, fn)
+// OnTimeout registers a callback function that will be invoked in a separate
+// goroutine whenever an operation has been completed with an error because it
+// exceeded its maximum runtime. Like for OnLost, the operation is cloned for
+// each callback.
+func (m *Manager) OnTimeout(fn func(*longrunningv1.Operation)) Unsubscribe {
+	return m.subscribe(&m.onTimeout, current(fn))
 }
 
-// Start starts watching active operations.
-// If calleds multiple times, Start is a no-op.
+// OnExpiring registers a callback function that will be invoked in a separate
+// goroutine whenever a RUNNING operation is about to be marked as lost, see
+// SetExpiryWarning. It is invoked at most once per operation until the
+// operation is updated again. Like for OnLost, the operation is cloned for
+// each callback.
+func (m *Manager) OnExpiring(fn func(*longrunningv1.Operation)) Unsubscribe {
+	return m.subscribe(&m.onExpiring, current(fn))
+}
+
+// Start starts watching active operations. Operations are marked as lost by
+// per-operation timers once their deadline passed, see Observe. The periodic
+// scan at the configured interval catches updates that have not been observed
+// by this instance. If leader election is enabled, operations are only
+// checked while the manager holds the lease, see SetLease.
 //
-// To stop a running manager, cancel the context and
-// call Wait().
+// ErrRunning is returned if the manager is already running. To stop a running
+// manager, either call Stop or cancel the context and call Wait(). A stopped
+// manager may be started again.
 func (m *Manager) Start(ctx context.Context) error {
-	m.startOnce.Do(func() {
-		m.wg.Add(1)
-		ticker := m.tickerFactory(time.Second * 30)
+	m.runL.Lock()
+	defer m.runL.Unlock()
+
+	if m.running() {
+		return ErrRunning
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	m.cancel = cancel
+	m.done = done
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	m.wg.Add(1)
+
+	if m.lease != nil {
+		wg.Add(1)
 
 		go func() {
-			defer m.wg.Done()
-			defer ticker.Stop()
+			defer wg.Done()
+
+			m.runLease(ctx)
+		}()
+	}
+
+	go func() {
+		defer m.wg.Done()
+
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := m.tickerFactory(m.interval)
+
+	go func() {
+		defer wg.Done()
+
+		m.runTimers(ctx)
+	}()
+
+	slog.Info("starting manager", "interval", m.interval.String(), "namespaces", m.namespaces, "leaderElection", m.lease != nil)
+
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+
+		m.runChecks(ctx, ticker)
+	}()
+
+	return nil
+}
+
+// Stop stops a running manager and blocks until it exited. Stop is a no-op if
+// the manager is not running.
+func (m *Manager) Stop() {
+	m.runL.Lock()
+	defer m.runL.Unlock()
+
+	if m.done == nil {
+		return
+	}
+
+	m.cancel()
+	<-m.done
+
+	m.cancel = nil
+	m.done = nil
+
+	slog.Info("manager stopped")
+}
+
+// Running reports whether the manager is running.
+func (m *Manager) Running() bool {
+	m.runL.Lock()
+	defer m.runL.Unlock()
+
+	return m.running()
+}
+
+// running is like Running but expects runL to be held. A manager whose context
+// has been cancelled is no longer running.
+func (m *Manager) running() bool {
+	if m.done == nil {
+		return false
+	}
+
+	select {
+	case <-m.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// checkOperations checks all operations once and reports whether querying
+// the active operations and marking them as lost succeeded.
+func (m *Manager) checkOperations(ctx context.Context) bool {
+	if m.metrics != nil {
+		defer func(start time.Time) {
+			m.metrics.ObserveCheckDuration(time.Since(start))
+		}(time.Now())
+	}
 
-			for {
-				slog.Info("checking operation states")
+	m.startDueOperations(ctx)
+	m.completeExceededOperations(ctx)
+	m.retryPending(ctx)
 
-				m.checkOperations(ctx)
+	ok := true
 
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
+	ops, err := m.r.GetActiveOperations(ctx, m.namespaces)
+	if err != nil {
+		slog.Error("failed to query active operations", "error", err)
+		m.incrCheckErrors("GetActiveOperations")
+
+		ok = false
+	} else {
+		if len(ops) == 0 {
+			slog.Info("no active operations available, nothing to check")
+		}
+
+		var expired map[string]bool
+		if m.serverClock {
+			expired, ok = m.markExpired(ctx, nil)
+		}
+
+		// check each active operation
+		var batch []lostOperation
+		for _, op := range ops {
+			if neverExpires(op) || expired[op.UniqueId] {
+				continue
+			}
+
+			if !m.serverClock {
+				diff := m.sinceFunc(op.LastUpdate.AsTime())
+				if diff >= (op.Ttl.AsDuration()+op.GracePeriod.AsDuration()) && !m.graced(op) {
+					batch = append(batch, lostOperation{op, ttlExpiredError(op, diff, m.affectedBy(op))})
+					continue
 				}
 			}
-		}()
+
+			slog.Info("operation still in progress", "id", op.UniqueId, "description", op.Description)
+
+			m.Observe(op)
+		}
+
+		if !m.markAllAsLost(ctx, batch) {
+			ok = false
+		}
+	}
+
+	// check for pending operations that have never been started
+	pending, err := m.r.GetExpiredPendingOperations(ctx, m.namespaces, m.now())
+	if err != nil {
+		slog.Error("failed to query expired pending operations", "error", err)
+		m.incrCheckErrors("GetExpiredPendingOperations")
+
+		return ok
+	}
+
+	batch := make([]lostOperation, len(pending))
+	for idx, op := range pending {
+		batch[idx] = lostOperation{op, pendingTimeoutError(op, m.since(op.CreateTime.AsTime()))}
+	}
+
+	if !m.markAllAsLost(ctx, batch) {
+		ok = false
+	}
+
+	return ok
+}
+
+// startDueOperations starts all scheduled operations that are due.
+func (m *Manager) startDueOperations(ctx context.Context) {
+	started, err := m.write(ctx, op.EventUpdated, []string{"state", "last_update", "annotations"}, func(ctx context.Context) ([]*longrunningv1.Operation, error) {
+		return m.r.StartDueOperations(ctx, m.namespaces, m.now())
 	})
+	if err != nil {
+		slog.Error("failed to start scheduled operations", "error", err)
+		m.incrCheckErrors("StartDueOperations")
+	}
 
-	return nil
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	for _, op := range started {
+		slog.Info("scheduled operation started", "id", op.UniqueId, "description", op.Description, "state", op.State.String())
+
+		if m.metrics != nil {
+			m.metrics.IncrStartedOperations(op.Kind)
+		}
+
+		// the TTL of operations that have been started as RUNNING only
+		// starts now.
+		m.Observe(op)
+
+		for _, sub := range m.onStarted {
+			m.invoke("started", sub.fn, nil, op)
+		}
+	}
 }
 
-func (m *Manager) checkOperations(ctx context.Context) {
-	ops, err := m.r.GetActiveOperations(ctx)
+// completeExceededOperations completes all operations that exceeded their
+// maximum runtime, independent of their heartbeats.
+func (m *Manager) completeExceededOperations(ctx context.Context) {
+	now := m.now()
+
+	ops, err := m.r.GetExceededOperations(ctx, m.namespaces, now)
 	if err != nil {
-		slog.Error("failed to query active operations", "error", err)
+		slog.Error("failed to query operations that exceeded their maximum runtime", "error", err)
+		m.incrCheckErrors("GetExceededOperations")
+
 		return
 	}
 
-	if len(ops) == 0 {
-		slog.Info("no active operations available, nothing to check")
+	for _, pbop := range ops {
+		reason := maxRuntimeError(pbop, now)
+
+		res, err := m.write(ctx, op.EventCompleted, nil, func(ctx context.Context) ([]*longrunningv1.Operation, error) {
+			completed, err := m.r.CompleteExceededOperation(ctx, pbop.UniqueId, reason, now)
+			if err != nil {
+				return nil, err
+			}
+
+			return []*longrunningv1.Operation{completed}, nil
+		})
+		if err != nil {
+			slog.Error("failed to complete operation that exceeded its maximum runtime", "id", pbop.UniqueId, "description", pbop.Description, "error", err)
+			m.incrCheckErrors("CompleteExceededOperation")
+
+			continue
+		}
+
+		completed := res[0]
+
+		slog.Info("operation exceeded its maximum runtime", "id", pbop.UniqueId, "description", pbop.Description, "previousState", pbop.State.String(), "reason", reason.Message)
+
+		if m.metrics != nil {
+			m.metrics.IncrTimedOutOperations(completed.Kind)
+		}
+
+		m.Observe(completed)
+
+		m.l.RLock()
+		for _, sub := range m.onTimeout {
+			m.invoke("timeout", sub.fn, nil, completed)
+		}
+		m.l.RUnlock()
+
+		m.NotifyStateChange(pbop, completed)
 	}
+}
 
-	// check each active operation
-	for _, op := range ops {
-		lastUpdate := op.LastUpdate.AsTime()
+// markAsLost marks pbop as lost. Operations that are already being marked as
+// lost are skipped, see claimLost.
+func (m *Manager) markAsLost(ctx context.Context, pbop *longrunningv1.Operation, reason *longrunningv1.OperationError) error {
+	if !m.claimLost(pbop.UniqueId) {
+		return nil
+	}
+	defer m.releaseLost(pbop.UniqueId)
 
-		diff := m.sinceFunc(lastUpdate)
-		if diff >= (op.Ttl.AsDuration() + op.GracePeriod.AsDuration()) {
-			if _, err := m.r.MarkAsLost(ctx, op.UniqueId); err != nil {
-				slog.Error("failed to mark operation as lost", "id", op.UniqueId, "description", op.Description, "error", err)
-			} else {
-				slog.Info("operation lost", "id", op.UniqueId, "description", op.Description)
+	if m.dryRun.Load() {
+		m.recordPendingLoss(pbop, reason)
+		return nil
+	}
 
-				m.notifyLost(op)
-			}
-		} else {
-			slog.Info("operation still in progress", "id", op.UniqueId, "description", op.Description)
+	if !m.throttleLost(ctx) {
+		return ctx.Err()
+	}
+
+	res, err := m.write(ctx, op.EventLost, nil, func(ctx context.Context) ([]*longrunningv1.Operation, error) {
+		lost, err := m.r.MarkAsLost(ctx, pbop.UniqueId, reason)
+		if err != nil {
+			return nil, err
 		}
+
+		return []*longrunningv1.Operation{lost}, nil
+	})
+	if errors.Is(err, repo.ErrNotLost) {
+		// updated, completed or started concurrently.
+		slog.Debug("operation is no longer expired", "id", pbop.UniqueId, "description", pbop.Description)
+
+		return nil
+	}
+	if err != nil {
+		slog.Error("failed to mark operation as lost", "id", pbop.UniqueId, "description", pbop.Description, "error", err)
+		m.incrCheckErrors("MarkAsLost")
+
+		return err
+	}
+
+	lost := res[0]
+
+	slog.Info("operation lost", "id", pbop.UniqueId, "description", pbop.Description, "previousState", pbop.State.String(), "reason", reason.Message)
+
+	if m.metrics != nil {
+		m.metrics.IncrLostOperations(lost.Kind)
 	}
+
+	m.Observe(lost)
+
+	m.NotifyStateChange(pbop, lost)
+
+	m.RetryLost(ctx, lost)
+
+	return nil
+}
+
+// NotifyLost is like NotifyStateChange for an operation that has been marked
+// as lost by other means than the manager, like an administrator, if its
+// previous state is unknown.
+func (m *Manager) NotifyLost(op *longrunningv1.Operation) {
+	m.NotifyStateChange(nil, op)
 }
 
-func (m *Manager) notifyLost(op *longrunningv1.Operation) {
+// NotifyStateChange invokes the OnStateChange callbacks, including the OnLost
+// ones, for the operation new that has been changed from old. It is called by
+// the manager itself and must be called by everyone else that changes the
+// state of operations, like the service. old may be nil if the previous state
+// is unknown.
+func (m *Manager) NotifyStateChange(old, new *longrunningv1.Operation) {
 	m.l.RLock()
 	defer m.l.RUnlock()
 
-	for _, fn := range m.onLost {
-		go fn(proto.Clone(op).(*longrunningv1.Operation))
+	for _, sub := range m.onStateChange {
+		m.invoke("state-change", sub.fn, old, new)
 	}
 }
 
 // Wait waits for the manager to stop.
-// This does not wait for any outstanding OnLost callbacks.
+// This does not wait for any outstanding OnLost callbacks, see WaitAll.
 func (m *Manager) Wait() {
 	m.wg.Wait()
 }
@@ -0,0 +1,1756 @@
+package manager_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeRepo is an in-memory manager.Repository. The next fail calls of
+// GetActiveOperations return an error. The clock of the database is ahead of
+// the local one by skew.
+type fakeRepo struct {
+	l    sync.Mutex
+	ops  map[string]*longrunningv1.Operation
+	fail int
+	skew time.Duration
+
+	// lostDelay slows down MarkAsLost, lostFail lets it fail for the given
+	// ids and notLost reports them as no longer expired. marks counts the
+	// calls per id and maxMarking the number of concurrent calls.
+	lostDelay  time.Duration
+	lostFail   map[string]bool
+	notLost    map[string]bool
+	marks      map[string]int
+	marking    int
+	maxMarking int
+}
+
+func (f *fakeRepo) set(op *longrunningv1.Operation) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.ops[op.UniqueId] = proto.Clone(op).(*longrunningv1.Operation)
+}
+
+func (f *fakeRepo) state(id string) longrunningv1.OperationState {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	return f.ops[id].State
+}
+
+func (f *fakeRepo) GetActiveOperations(context.Context, []string) ([]*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.fail > 0 {
+		f.fail--
+		return nil, errors.New("database unavailable")
+	}
+
+	var res []*longrunningv1.Operation
+	for _, op := range f.ops {
+		if op.State == longrunningv1.OperationState_OperationState_RUNNING {
+			res = append(res, proto.Clone(op).(*longrunningv1.Operation))
+		}
+	}
+
+	return res, nil
+}
+
+func (f *fakeRepo) GetActiveOperation(_ context.Context, _ []string, id string) (*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	op, ok := f.ops[id]
+	if !ok || op.State != longrunningv1.OperationState_OperationState_RUNNING {
+		return nil, nil
+	}
+
+	return proto.Clone(op).(*longrunningv1.Operation), nil
+}
+
+func (f *fakeRepo) GetExpiredOperations(_ context.Context, _ []string, ids []string) ([]*longrunningv1.Operation, time.Time, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	now := time.Now().Add(f.skew)
+
+	var res []*longrunningv1.Operation
+	for id, pbop := range f.ops {
+		if len(ids) > 0 && !slices.Contains(ids, id) {
+			continue
+		}
+
+		if pbop.State != longrunningv1.OperationState_OperationState_RUNNING || pbop.Annotations[op.NoExpiryAnnotation] == "true" {
+			continue
+		}
+
+		if now.Sub(pbop.LastUpdate.AsTime()) >= pbop.Ttl.AsDuration()+pbop.GracePeriod.AsDuration() {
+			res = append(res, proto.Clone(pbop).(*longrunningv1.Operation))
+		}
+	}
+
+	return res, now, nil
+}
+
+func (f *fakeRepo) MarkAsLost(_ context.Context, id string, reason *longrunningv1.OperationError) (*longrunningv1.Operation, error) {
+	if f.lostDelay > 0 {
+		f.l.Lock()
+		f.marking++
+		f.maxMarking = max(f.maxMarking, f.marking)
+		f.l.Unlock()
+
+		time.Sleep(f.lostDelay)
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.lostDelay > 0 {
+		f.marking--
+	}
+
+	if f.marks != nil {
+		f.marks[id]++
+	}
+
+	if f.lostFail[id] {
+		return nil, errors.New("failed to mark as lost")
+	}
+
+	if f.notLost[id] {
+		return nil, repo.ErrNotLost
+	}
+
+	op := f.ops[id]
+	op.State = longrunningv1.OperationState_OperationState_LOST
+	op.Result = &longrunningv1.Operation_Error{Error: reason}
+
+	return proto.Clone(op).(*longrunningv1.Operation), nil
+}
+
+func (f *fakeRepo) GetExpiredPendingOperations(context.Context, []string, time.Time) ([]*longrunningv1.Operation, error) {
+	return nil, nil
+}
+
+// StartDueOperations starts the operations with the op.ScheduledAnnotation
+// whose op.StartTimeAnnotation passed. They are switched to RUNNING.
+func (f *fakeRepo) StartDueOperations(_ context.Context, _ []string, now time.Time) ([]*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	var res []*longrunningv1.Operation
+	for _, pbop := range f.ops {
+		start, err := time.Parse(time.RFC3339, pbop.Annotations[op.StartTimeAnnotation])
+		if pbop.Annotations[op.ScheduledAnnotation] != "true" || err != nil || start.After(now) {
+			continue
+		}
+
+		delete(pbop.Annotations, op.ScheduledAnnotation)
+		pbop.State = longrunningv1.OperationState_OperationState_RUNNING
+		pbop.LastUpdate = timestamppb.New(now)
+
+		res = append(res, proto.Clone(pbop).(*longrunningv1.Operation))
+	}
+
+	return res, nil
+}
+
+// GetExceededOperations returns the RUNNING operations whose
+// op.RuntimeDeadlineAnnotation passed.
+func (f *fakeRepo) GetExceededOperations(_ context.Context, _ []string, now time.Time) ([]*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	var res []*longrunningv1.Operation
+	for _, pbop := range f.ops {
+		deadline, err := time.Parse(time.RFC3339, pbop.Annotations[op.RuntimeDeadlineAnnotation])
+		if pbop.State != longrunningv1.OperationState_OperationState_RUNNING || err != nil || deadline.After(now) {
+			continue
+		}
+
+		res = append(res, proto.Clone(pbop).(*longrunningv1.Operation))
+	}
+
+	return res, nil
+}
+
+func (f *fakeRepo) CompleteExceededOperation(_ context.Context, id string, reason *longrunningv1.OperationError, now time.Time) (*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	pbop := f.ops[id]
+	pbop.State = longrunningv1.OperationState_OperationState_COMPLETE
+	pbop.Result = &longrunningv1.Operation_Error{Error: reason}
+	pbop.LastUpdate = timestamppb.New(now)
+
+	return proto.Clone(pbop).(*longrunningv1.Operation), nil
+}
+
+// retryable reports whether the lost operation pbop has attempts left but no
+// successor, emulating the retry marker of the repository.
+func retryable(pbop *longrunningv1.Operation) bool {
+	attempt, _ := strconv.Atoi(pbop.Annotations[op.AttemptAnnotation])
+	maxAttempts, _ := strconv.Atoi(pbop.Annotations[op.MaxAttemptsAnnotation])
+
+	return pbop.State == longrunningv1.OperationState_OperationState_LOST &&
+		pbop.Annotations[op.NextAttemptAnnotation] == "" &&
+		attempt < maxAttempts
+}
+
+func (f *fakeRepo) RetryOperation(_ context.Context, id string, _ time.Time) (*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	lost, ok := f.ops[id]
+	if !ok || !retryable(lost) {
+		return nil, nil
+	}
+
+	attempt, _ := strconv.Atoi(lost.Annotations[op.AttemptAnnotation])
+
+	next := proto.Clone(lost).(*longrunningv1.Operation)
+	next.UniqueId = fmt.Sprintf("%s-%d", id, attempt+1)
+	next.State = longrunningv1.OperationState_OperationState_PENDING
+	next.Annotations[op.AttemptAnnotation] = strconv.Itoa(attempt + 1)
+	f.ops[next.UniqueId] = next
+
+	lost.Annotations[op.NextAttemptAnnotation] = next.UniqueId
+
+	return proto.Clone(next).(*longrunningv1.Operation), nil
+}
+
+func (f *fakeRepo) GetPendingRetries(context.Context, []string) ([]*longrunningv1.Operation, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	var res []*longrunningv1.Operation
+	for _, op := range f.ops {
+		if retryable(op) {
+			res = append(res, proto.Clone(op).(*longrunningv1.Operation))
+		}
+	}
+
+	return res, nil
+}
+
+// fakeLease is an in-memory manager.Lease. Acquisitions of holders in failing
+// are rejected with an error, like for an instance that lost its database
+// connection.
+type fakeLease struct {
+	l       sync.Mutex
+	holder  string
+	expires time.Time
+	failing map[string]bool
+}
+
+func (f *fakeLease) fail(holder string, failing bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.failing[holder] = failing
+}
+
+func (f *fakeLease) AcquireLease(_ context.Context, _, holder string, ttl time.Duration) (bool, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.failing[holder] {
+		return false, errors.New("lease store unavailable")
+	}
+
+	now := time.Now()
+	if f.holder != holder && now.Before(f.expires) {
+		return false, nil
+	}
+
+	f.holder = holder
+	f.expires = now.Add(ttl)
+
+	return true, nil
+}
+
+func (f *fakeLease) ReleaseLease(_ context.Context, _, holder string) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.holder == holder {
+		f.holder = ""
+		f.expires = time.Time{}
+	}
+
+	return nil
+}
+
+// fakeEvents is an in-memory manager.Events that records the ids of the
+// stored operations per event type. Storing the events of operations in
+// failing fails, which aborts the transaction.
+type fakeEvents struct {
+	l       sync.Mutex
+	stored  map[op.EventType][]string
+	failing map[string]bool
+}
+
+func (f *fakeEvents) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (f *fakeEvents) StoreEvents(_ context.Context, typ op.EventType, _ []string, ops ...*longrunningv1.Operation) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	for _, pbop := range ops {
+		if f.failing[pbop.UniqueId] {
+			return errors.New("outbox unavailable")
+		}
+
+		f.stored[typ] = append(f.stored[typ], pbop.UniqueId)
+	}
+
+	return nil
+}
+
+// fakeMetrics is an in-memory manager.Metrics.
+type fakeMetrics struct {
+	l       sync.Mutex
+	lost    map[string]int
+	checks  int
+	watched int
+	errors  map[string]int
+
+	started  map[string]int
+	timedOut map[string]int
+
+	retriesScheduled map[string]int
+	retriesExhausted map[string]int
+
+	persistent int
+}
+
+func (f *fakeMetrics) IncrLostOperations(kind string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.lost[kind]++
+}
+
+func (f *fakeMetrics) IncrStartedOperations(kind string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.started == nil {
+		f.started = make(map[string]int)
+	}
+
+	f.started[kind]++
+}
+
+func (f *fakeMetrics) IncrTimedOutOperations(kind string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.timedOut == nil {
+		f.timedOut = make(map[string]int)
+	}
+
+	f.timedOut[kind]++
+}
+
+func (f *fakeMetrics) IncrRetriesScheduled(kind string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.retriesScheduled == nil {
+		f.retriesScheduled = make(map[string]int)
+	}
+
+	f.retriesScheduled[kind]++
+}
+
+func (f *fakeMetrics) IncrRetriesExhausted(kind string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.retriesExhausted == nil {
+		f.retriesExhausted = make(map[string]int)
+	}
+
+	f.retriesExhausted[kind]++
+}
+
+func (f *fakeMetrics) ObserveCheckDuration(time.Duration) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.checks++
+}
+
+func (f *fakeMetrics) SetWatchedOperations(count int) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.watched = count
+}
+
+func (f *fakeMetrics) IncrCheckErrors(call string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.errors[call]++
+}
+
+func (f *fakeMetrics) IncrPersistentCheckFailures() {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.persistent++
+}
+
+// fakeCheckpoints is an in-memory manager.Checkpoints.
+type fakeCheckpoints struct {
+	l       sync.Mutex
+	last    time.Time
+	records int
+}
+
+func (f *fakeCheckpoints) RecordCheck(context.Context, string) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.last = time.Now()
+	f.records++
+
+	return nil
+}
+
+func (f *fakeCheckpoints) LastCheck(context.Context, string) (time.Time, time.Time, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	return f.last, time.Now(), nil
+}
+
+func TestDeadlineTimers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	now := time.Now()
+	newOp := func(id string, lastUpdate time.Time) *longrunningv1.Operation {
+		return &longrunningv1.Operation{
+			UniqueId:   id,
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(lastUpdate),
+		}
+	}
+
+	// offset moves the clock of the manager forward.
+	var offset atomic.Int64
+	since := func(t time.Time) time.Duration {
+		return time.Since(t) + time.Duration(offset.Load())
+	}
+
+	// the periodic scan only runs once at startup.
+	ticker := func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}
+
+	timers := make(chan time.Duration, 16)
+
+	m := manager.New(r, 0, ticker, since, nil)
+	m.SetTimerFactory(func(d time.Duration) *time.Timer {
+		timers <- d
+
+		return time.NewTimer(d)
+	})
+
+	lost := make(chan *longrunningv1.Operation, 1)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op
+	})
+
+	r.set(newOp("a", now))
+	require.NoError(t, m.Start(ctx))
+
+	// waitTimer waits for a timer that fires after about want.
+	waitTimer := func(want time.Duration) {
+		t.Helper()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case d := <-timers:
+				if d > want-time.Second && d < want+time.Second {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no timer for %s has been created", want)
+			}
+		}
+	}
+
+	// the initial scan observes the operation and waits for its deadline.
+	waitTimer(time.Minute)
+
+	// a heartbeat moves the deadline.
+	m.Observe(newOp("a", now.Add(time.Minute)))
+	waitTimer(2 * time.Minute)
+
+	// once the deadline passed, the operation is lost right away.
+	offset.Store(int64(3 * time.Minute))
+	r.set(newOp("a", now.Add(time.Minute)))
+	m.Observe(newOp("b", now.Add(-time.Hour)))
+
+	select {
+	case op := <-lost:
+		// b is not known to the repository and thus ignored.
+		require.Equal(t, "a", op.UniqueId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation has not been marked as lost")
+	}
+
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, r.state("a"))
+
+	// operations that have been updated through another instance are
+	// observed again instead.
+	r.set(newOp("c", now.Add(3*time.Minute)))
+	m.Observe(newOp("c", now))
+
+	waitTimer(time.Minute)
+
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("c"))
+}
+
+func TestExpiring(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	now := time.Now()
+	newOp := func(id string, lastUpdate time.Time) *longrunningv1.Operation {
+		return &longrunningv1.Operation{
+			UniqueId:   id,
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(lastUpdate),
+		}
+	}
+
+	var offset atomic.Int64
+	since := func(t time.Time) time.Duration {
+		return time.Since(t) + time.Duration(offset.Load())
+	}
+
+	ticker := func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}
+
+	timers := make(chan time.Duration, 16)
+
+	m := manager.New(r, 0, ticker, since, nil)
+	m.SetExpiryWarning(0.5)
+	m.SetTimerFactory(func(d time.Duration) *time.Timer {
+		timers <- d
+
+		return time.NewTimer(d)
+	})
+
+	expiring := make(chan *longrunningv1.Operation, 4)
+	m.OnExpiring(func(op *longrunningv1.Operation) {
+		expiring <- op
+	})
+
+	lost := make(chan *longrunningv1.Operation, 1)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op
+	})
+
+	r.set(newOp("a", now))
+	require.NoError(t, m.Start(ctx))
+
+	waitTimer := func(want time.Duration) {
+		t.Helper()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case d := <-timers:
+				if d > want-time.Second && d < want+time.Second {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no timer for %s has been created", want)
+			}
+		}
+	}
+
+	waitExpiring := func() {
+		t.Helper()
+
+		select {
+		case op := <-expiring:
+			require.Equal(t, "a", op.UniqueId)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no expiry warning has been issued")
+		}
+	}
+
+	// wake re-evaluates the timers by observing an unknown operation.
+	wake := func(lastUpdate time.Time) {
+		m.Observe(newOp("b", lastUpdate))
+	}
+
+	// the warning is scheduled at half of the TTL.
+	waitTimer(30 * time.Second)
+
+	offset.Store(int64(40 * time.Second))
+	wake(now.Add(-time.Hour))
+	waitExpiring()
+
+	// the warning is only issued once, the operation is still lost at its
+	// deadline.
+	waitTimer(20 * time.Second)
+	wake(now.Add(-2 * time.Hour))
+	waitTimer(20 * time.Second)
+
+	select {
+	case <-expiring:
+		t.Fatal("expiry warning has been issued twice")
+	default:
+	}
+
+	// a heartbeat re-arms the warning.
+	r.set(newOp("a", now.Add(40*time.Second)))
+	m.Observe(newOp("a", now.Add(40*time.Second)))
+	waitTimer(30 * time.Second)
+
+	offset.Store(int64(80 * time.Second))
+	wake(now.Add(-3 * time.Hour))
+	waitExpiring()
+
+	offset.Store(int64(2 * time.Minute))
+	wake(now.Add(-4 * time.Hour))
+
+	select {
+	case op := <-lost:
+		require.Equal(t, "a", op.UniqueId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation has not been marked as lost")
+	}
+
+	require.Empty(t, expiring)
+}
+
+func TestLeaderElection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lease := &fakeLease{failing: make(map[string]bool)}
+
+	expired := func(id string) *longrunningv1.Operation {
+		return &longrunningv1.Operation{
+			UniqueId:   id,
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+		}
+	}
+
+	type instance struct {
+		m    *manager.Manager
+		r    *fakeRepo
+		lost chan *longrunningv1.Operation
+	}
+
+	// each instance has its own repository so an operation is only lost in
+	// the repository of the instance that checked it.
+	newInstance := func(holder string) *instance {
+		i := &instance{
+			r:    &fakeRepo{ops: make(map[string]*longrunningv1.Operation)},
+			lost: make(chan *longrunningv1.Operation, 4),
+		}
+
+		i.m = manager.New(i.r, 0, func(time.Duration) *time.Ticker {
+			return time.NewTicker(time.Hour)
+		}, nil, nil)
+		i.m.SetLease(lease, holder, 300*time.Millisecond)
+		i.m.OnLost(func(op *longrunningv1.Operation) {
+			i.lost <- op
+		})
+
+		i.r.set(expired("a"))
+
+		return i
+	}
+
+	waitLost := func(i *instance, id string) {
+		t.Helper()
+
+		select {
+		case op := <-i.lost:
+			require.Equal(t, id, op.UniqueId)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("operation %s has not been marked as lost", id)
+		}
+	}
+
+	first := newInstance("first")
+	require.NoError(t, first.m.Start(ctx))
+	waitLost(first, "a")
+	require.True(t, first.m.Leader())
+
+	// the second instance does not check operations while the first one
+	// holds the lease.
+	second := newInstance("second")
+	require.NoError(t, second.m.Start(ctx))
+
+	time.Sleep(200 * time.Millisecond)
+	require.False(t, second.m.Leader())
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, second.r.state("a"))
+
+	// once the leader cannot renew its lease, the second instance takes over
+	// after the lease expired. By then, the first one stepped down.
+	lease.fail("first", true)
+	waitLost(second, "a")
+
+	require.True(t, second.m.Leader())
+	require.False(t, first.m.Leader())
+
+	// a stopped leader releases the lease right away.
+	lease.fail("first", false)
+	first.r.set(expired("b"))
+	second.m.Stop()
+
+	waitLost(first, "b")
+	require.True(t, first.m.Leader())
+	require.False(t, second.m.Leader())
+
+	first.m.Stop()
+	require.Empty(t, first.lost)
+	require.Empty(t, second.lost)
+}
+
+func TestNoExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	r.set(&longrunningv1.Operation{
+		UniqueId:    "a",
+		State:       longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:         durationpb.New(0),
+		LastUpdate:  timestamppb.New(time.Now().Add(-time.Hour)),
+		Annotations: map[string]string{op.NoExpiryAnnotation: "true"},
+	})
+
+	metrics := &fakeMetrics{
+		lost:   make(map[string]int),
+		errors: make(map[string]int),
+	}
+
+	m := manager.New(r, 0, nil, nil, metrics)
+	require.NoError(t, m.Start(ctx))
+	m.Stop()
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+
+	// the operation is neither lost nor watched.
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("a"))
+	require.Equal(t, 1, metrics.checks)
+	require.Zero(t, metrics.watched)
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	metrics := &fakeMetrics{
+		lost:   make(map[string]int),
+		errors: make(map[string]int),
+	}
+
+	for id, lastUpdate := range map[string]time.Time{
+		"expired": time.Now().Add(-time.Hour),
+		"running": time.Now(),
+	} {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   id,
+			Kind:       "backup",
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(lastUpdate),
+		})
+	}
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, metrics)
+
+	lost := make(chan *longrunningv1.Operation, 1)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op
+	})
+
+	require.NoError(t, m.Start(ctx))
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation has not been marked as lost")
+	}
+
+	m.Stop()
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+
+	require.Equal(t, map[string]int{"backup": 1}, metrics.lost)
+	require.Equal(t, 1, metrics.watched)
+	require.Equal(t, 1, metrics.checks)
+	require.Empty(t, metrics.errors)
+}
+
+func TestBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first seven checks fail.
+	r := &fakeRepo{
+		ops:  make(map[string]*longrunningv1.Operation),
+		fail: 7,
+	}
+	metrics := &fakeMetrics{
+		lost:   make(map[string]int),
+		errors: make(map[string]int),
+	}
+
+	m := manager.New(r, 30*time.Second, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, metrics)
+
+	// there are no deadlines so all timers are created for retries. They
+	// fire right away.
+	timers := make(chan time.Duration)
+	m.SetTimerFactory(func(d time.Duration) *time.Timer {
+		timers <- d
+
+		return time.NewTimer(time.Millisecond)
+	})
+
+	require.NoError(t, m.Start(ctx))
+
+	waitRetry := func() time.Duration {
+		t.Helper()
+
+		select {
+		case d := <-timers:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("failed check has not been retried")
+			return 0
+		}
+	}
+
+	// the delay doubles after each failed check, randomized between half and
+	// the full delay, until it is capped.
+	for failures := range 7 {
+		backoff := min(30*time.Second<<(failures+1), manager.MaxBackoff)
+
+		d := waitRetry()
+		require.GreaterOrEqual(t, d, backoff/2, "failure %d", failures+1)
+		require.LessOrEqual(t, d, backoff, "failure %d", failures+1)
+	}
+
+	// the retry of the seventh check succeeds and restores the interval.
+	select {
+	case d := <-timers:
+		t.Fatalf("successful check has been retried after %s", d)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	m.Stop()
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+
+	require.Equal(t, 7, metrics.errors["GetActiveOperations"])
+	require.Equal(t, 3, metrics.persistent)
+}
+
+func TestStartStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	scans := make(chan struct{}, 16)
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		scans <- struct{}{}
+
+		return time.NewTicker(time.Hour)
+	}, nil, nil)
+
+	// stopping a manager that is not running is a no-op
+	m.Stop()
+	require.False(t, m.Running())
+
+	require.NoError(t, m.Start(ctx))
+	require.True(t, m.Running())
+	require.ErrorIs(t, m.Start(ctx), manager.ErrRunning)
+
+	m.Stop()
+	require.False(t, m.Running())
+
+	// a stopped manager can be started again
+	require.NoError(t, m.Start(ctx))
+	require.Len(t, scans, 2)
+
+	// concurrent calls are serialized
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = m.Start(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			m.Stop()
+		}()
+	}
+	wg.Wait()
+
+	m.Stop()
+	require.False(t, m.Running())
+
+	// cancelling the context stops the manager as well
+	require.NoError(t, m.Start(ctx))
+	cancel()
+	m.Wait()
+	require.False(t, m.Running())
+}
+
+func TestWaitAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	m := manager.New(r, 0, nil, nil, nil)
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	m.OnLost(func(*longrunningv1.Operation) {
+		<-release
+		close(finished)
+	})
+
+	require.NoError(t, m.Start(ctx))
+
+	m.NotifyLost(&longrunningv1.Operation{UniqueId: "slow", State: longrunningv1.OperationState_OperationState_LOST})
+	m.Stop()
+
+	// hung callbacks do not block forever
+	timeout, cancelTimeout := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelTimeout()
+
+	require.ErrorIs(t, m.WaitAll(timeout), context.DeadlineExceeded)
+
+	// once the callback returns, WaitAll does as well
+	close(release)
+	require.NoError(t, m.WaitAll(ctx))
+
+	select {
+	case <-finished:
+	default:
+		t.Fatal("WaitAll returned before the callback finished")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	m := manager.New(r, 0, nil, nil, nil)
+
+	var calls atomic.Int32
+	unsubscribe := m.OnLost(func(*longrunningv1.Operation) {
+		calls.Add(1)
+	})
+
+	kept := make(chan struct{}, 2)
+	m.OnLost(func(*longrunningv1.Operation) {
+		kept <- struct{}{}
+	})
+
+	m.NotifyLost(&longrunningv1.Operation{UniqueId: "a", State: longrunningv1.OperationState_OperationState_LOST})
+	<-kept
+
+	// removal is safe while notifications are in flight
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		unsubscribe()
+	}()
+	go func() {
+		defer wg.Done()
+		m.NotifyLost(&longrunningv1.Operation{UniqueId: "b", State: longrunningv1.OperationState_OperationState_LOST})
+	}()
+	wg.Wait()
+
+	<-kept
+	require.NoError(t, m.WaitAll(context.Background()))
+	before := calls.Load()
+
+	m.NotifyLost(&longrunningv1.Operation{UniqueId: "c", State: longrunningv1.OperationState_OperationState_LOST})
+	require.NoError(t, m.WaitAll(context.Background()))
+	require.Equal(t, before, calls.Load())
+
+	// unsubscribing twice is a no-op
+	unsubscribe()
+}
+
+func TestDatabaseClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the clock of the database is an hour ahead and used to stamp the last
+	// update of operations.
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation), skew: time.Hour}
+	dbNow := time.Now().Add(r.skew)
+
+	for id, lastUpdate := range map[string]time.Time{
+		"expired": dbNow.Add(-2 * time.Minute),
+		"running": dbNow.Add(-30 * time.Second),
+		"soon":    dbNow.Add(-time.Minute + 500*time.Millisecond),
+	} {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   id,
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(lastUpdate),
+		})
+	}
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, nil)
+
+	lost := make(chan *longrunningv1.Operation, 2)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op
+	})
+
+	require.NoError(t, m.Start(ctx))
+	defer m.Stop()
+
+	// only the expired operation is lost by the first check, the local clock
+	// would consider all of them lost.
+	select {
+	case op := <-lost:
+		require.Equal(t, "expired", op.UniqueId)
+	case <-time.After(time.Second):
+		t.Fatal("expected the expired operation to be lost")
+	}
+
+	// the deadline timer accounts for the offset of the database clock.
+	select {
+	case op := <-lost:
+		require.Equal(t, "soon", op.UniqueId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the operation to be lost once its deadline passed")
+	}
+
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("running"))
+}
+
+func TestScanClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	// both deadlines already passed according to the clock of the manager,
+	// which is an hour ahead.
+	r.set(&longrunningv1.Operation{
+		UniqueId:   "due",
+		State:      longrunningv1.OperationState_OperationState_PENDING,
+		Ttl:        durationpb.New(2 * time.Hour),
+		LastUpdate: timestamppb.Now(),
+		Annotations: map[string]string{
+			op.ScheduledAnnotation: "true",
+			op.StartTimeAnnotation: time.Now().Add(30 * time.Minute).Format(time.RFC3339),
+		},
+	})
+
+	r.set(&longrunningv1.Operation{
+		UniqueId:   "exceeded",
+		State:      longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:        durationpb.New(2 * time.Hour),
+		LastUpdate: timestamppb.Now(),
+		Annotations: map[string]string{
+			op.RuntimeDeadlineAnnotation: time.Now().Add(30 * time.Minute).Format(time.RFC3339),
+		},
+	})
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, func(t time.Time) time.Duration {
+		return time.Since(t) + time.Hour
+	}, nil)
+
+	require.NoError(t, m.Start(ctx))
+	m.Stop()
+
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("due"))
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, r.state("exceeded"))
+}
+
+func TestDowntimeGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newOp := func(id string, lastUpdate time.Time) *longrunningv1.Operation {
+		return &longrunningv1.Operation{
+			UniqueId:    id,
+			State:       longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:         durationpb.New(time.Second),
+			GracePeriod: durationpb.New(10 * time.Second),
+			LastUpdate:  timestamppb.New(lastUpdate),
+		}
+	}
+
+	start := func(t *testing.T, r *fakeRepo, checkpoints *fakeCheckpoints) (*manager.Manager, chan *longrunningv1.Operation) {
+		t.Helper()
+
+		m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+			return time.NewTicker(time.Hour)
+		}, nil, nil)
+		m.SetDowntimeGrace(checkpoints, time.Minute)
+
+		lost := make(chan *longrunningv1.Operation, 2)
+		m.OnLost(func(op *longrunningv1.Operation) {
+			lost <- op
+		})
+
+		require.NoError(t, m.Start(ctx))
+		t.Cleanup(m.Stop)
+
+		return m, lost
+	}
+
+	details := func(t *testing.T, pbop *longrunningv1.Operation) map[string]any {
+		t.Helper()
+
+		s := new(structpb.Struct)
+		require.NoError(t, pbop.GetError().GetErrorDetails().UnmarshalTo(s))
+
+		return s.AsMap()
+	}
+
+	t.Run("restart after downtime", func(t *testing.T) {
+		// the service has been stopped for 20 minutes, both operations
+		// expired in the meantime.
+		checkpoints := &fakeCheckpoints{last: time.Now().Add(-20 * time.Minute)}
+
+		r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+		r.set(newOp("alive", time.Now().Add(-10*time.Minute)))
+		r.set(newOp("dead", time.Now().Add(-10*time.Minute)))
+
+		m, lost := start(t, r, checkpoints)
+
+		// the worker of the first operation is still alive and sends a
+		// heartbeat during the extra ttl.
+		time.Sleep(300 * time.Millisecond)
+
+		alive := newOp("alive", time.Now())
+		r.set(alive)
+		m.Observe(alive)
+
+		select {
+		case op := <-lost:
+			require.Equal(t, "dead", op.UniqueId)
+			require.Contains(t, op.GetError().GetMessage(), "downtime")
+			require.Contains(t, details(t, op), "downtime")
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the operation to be lost after the extra ttl")
+		}
+
+		select {
+		case op := <-lost:
+			t.Fatalf("unexpected lost operation %s", op.UniqueId)
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("alive"))
+
+		checkpoints.l.Lock()
+		defer checkpoints.l.Unlock()
+
+		require.Positive(t, checkpoints.records)
+	})
+
+	t.Run("recent check", func(t *testing.T) {
+		checkpoints := &fakeCheckpoints{last: time.Now().Add(-10 * time.Second)}
+
+		r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+		r.set(newOp("dead", time.Now().Add(-10*time.Minute)))
+
+		_, lost := start(t, r, checkpoints)
+
+		select {
+		case op := <-lost:
+			require.Equal(t, "dead", op.UniqueId)
+			require.NotContains(t, details(t, op), "downtime")
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("expected the operation to be lost right away")
+		}
+	})
+}
+
+func TestNotLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{
+		ops:     make(map[string]*longrunningv1.Operation),
+		notLost: map[string]bool{"heartbeat": true},
+	}
+	metrics := &fakeMetrics{
+		lost:   make(map[string]int),
+		errors: make(map[string]int),
+	}
+
+	for _, id := range []string{"expired", "heartbeat"} {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   id,
+			Kind:       "backup",
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+		})
+	}
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, metrics)
+
+	require.NoError(t, m.Start(ctx))
+	m.Stop()
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+
+	// the heartbeat that raced the check is neither lost nor a failure.
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, r.state("expired"))
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("heartbeat"))
+	require.Equal(t, map[string]int{"backup": 1}, metrics.lost)
+	require.Empty(t, metrics.errors)
+}
+
+func TestLostRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	for _, id := range []string{"a", "b", "c"} {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   id,
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+		})
+	}
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, nil)
+	m.SetLostRate(10)
+
+	lost := make(chan time.Time, 3)
+	m.OnLost(func(*longrunningv1.Operation) {
+		lost <- time.Now()
+	})
+
+	require.NoError(t, m.Start(ctx))
+	defer m.Stop()
+
+	var times []time.Time
+	for range 3 {
+		select {
+		case at := <-lost:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected all operations to be lost")
+		}
+	}
+
+	slices.SortFunc(times, time.Time.Compare)
+
+	// the first one is marked right away, the others 100ms apart.
+	require.GreaterOrEqual(t, times[2].Sub(times[0]), 150*time.Millisecond)
+}
+
+func TestLostConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{
+		ops:       make(map[string]*longrunningv1.Operation),
+		lostDelay: 100 * time.Millisecond,
+		lostFail:  map[string]bool{"op-0": true},
+		marks:     make(map[string]int),
+	}
+
+	for idx := range 8 {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   fmt.Sprintf("op-%d", idx),
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+		})
+	}
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(20 * time.Millisecond)
+	}, nil, nil)
+	m.SetLostConcurrency(4)
+
+	lost := make(chan string, 8)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op.UniqueId
+	})
+
+	require.NoError(t, m.Start(ctx))
+	defer m.Stop()
+
+	// the failing operation does not abort the batch.
+	seen := make(map[string]bool)
+	for range 7 {
+		select {
+		case id := <-lost:
+			require.False(t, seen[id], "operation %s lost twice", id)
+			seen[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected all other operations to be lost")
+		}
+	}
+
+	require.False(t, seen["op-0"])
+
+	// give further checks the chance to mark operations again.
+	time.Sleep(300 * time.Millisecond)
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	require.Equal(t, 4, r.maxMarking)
+
+	for idx := 1; idx < 8; idx++ {
+		require.Equal(t, 1, r.marks[fmt.Sprintf("op-%d", idx)])
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	for _, id := range []string{"lost", "unstored"} {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   id,
+			State:      longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+		})
+	}
+
+	events := &fakeEvents{
+		stored:  make(map[op.EventType][]string),
+		failing: map[string]bool{"unstored": true},
+	}
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, nil)
+	m.SetEvents(events)
+
+	lost := make(chan string, 2)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op.UniqueId
+	})
+
+	require.NoError(t, m.Start(ctx))
+	m.Stop()
+
+	select {
+	case id := <-lost:
+		require.Equal(t, "lost", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the operation to be lost")
+	}
+
+	// the callbacks only run once the event has been stored.
+	select {
+	case id := <-lost:
+		t.Fatalf("unexpected loss of %q", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	events.l.Lock()
+	defer events.l.Unlock()
+
+	require.Equal(t, map[op.EventType][]string{op.EventLost: {"lost"}}, events.stored)
+}
+
+func TestOnStateChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+	r.set(&longrunningv1.Operation{
+		UniqueId:   "dead",
+		State:      longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:        durationpb.New(time.Minute),
+		LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+	})
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, nil, nil)
+
+	type change struct{ old, new *longrunningv1.Operation }
+
+	changes := make(chan change, 2)
+	m.OnStateChange(func(old, new *longrunningv1.Operation) {
+		changes <- change{old, new}
+	})
+
+	lost := make(chan string, 2)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op.UniqueId
+	})
+
+	require.NoError(t, m.Start(ctx))
+
+	select {
+	case c := <-changes:
+		require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, c.old.State)
+		require.Equal(t, longrunningv1.OperationState_OperationState_LOST, c.new.State)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a state change")
+	}
+
+	require.Equal(t, "dead", <-lost)
+
+	// completions are reported to OnStateChange but not to OnLost.
+	m.NotifyStateChange(
+		&longrunningv1.Operation{UniqueId: "done", State: longrunningv1.OperationState_OperationState_RUNNING},
+		&longrunningv1.Operation{UniqueId: "done", State: longrunningv1.OperationState_OperationState_COMPLETE},
+	)
+
+	c := <-changes
+	require.Equal(t, "done", c.new.UniqueId)
+
+	m.Stop()
+	require.NoError(t, m.WaitAll(ctx))
+	require.Empty(t, lost)
+}
+
+func TestDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{
+		ops:   make(map[string]*longrunningv1.Operation),
+		marks: make(map[string]int),
+	}
+
+	r.set(&longrunningv1.Operation{
+		UniqueId:   "dead",
+		State:      longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:        durationpb.New(time.Minute),
+		LastUpdate: timestamppb.New(time.Now().Add(-24 * time.Hour)),
+	})
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(20 * time.Millisecond)
+	}, nil, nil)
+	m.SetDryRun(true)
+
+	lost := make(chan string, 1)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op.UniqueId
+	})
+
+	require.NoError(t, m.Start(ctx))
+	defer m.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(m.PendingLosses()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// give further checks the chance to mark the operation.
+	time.Sleep(100 * time.Millisecond)
+
+	losses := m.PendingLosses()
+	require.Len(t, losses, 1)
+	require.Equal(t, "dead", losses[0].Operation.UniqueId)
+
+	reason := new(structpb.Struct)
+	require.NoError(t, losses[0].Reason.GetErrorDetails().UnmarshalTo(reason))
+	require.Equal(t, op.LostReasonTTLExpired, reason.AsMap()[op.LostReasonDetail])
+
+	r.l.Lock()
+	require.Empty(t, r.marks)
+	r.l.Unlock()
+
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("dead"))
+	require.Empty(t, lost)
+
+	// once disabled, the operation is marked as lost by the next check.
+	m.SetDryRun(false)
+
+	select {
+	case id := <-lost:
+		require.Equal(t, "dead", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the operation to be lost")
+	}
+
+	require.Empty(t, m.PendingLosses())
+}
+
+func TestGraceWarning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newOp := func(id string, lastUpdate time.Time, grace time.Duration) *longrunningv1.Operation {
+		return &longrunningv1.Operation{
+			UniqueId:    id,
+			State:       longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:         durationpb.New(time.Minute),
+			GracePeriod: durationpb.New(grace),
+			LastUpdate:  timestamppb.New(lastUpdate),
+		}
+	}
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	// missed its TTL and is in its grace period.
+	r.set(newOp("stalled", time.Now().Add(-90*time.Second), time.Minute))
+
+	// has no grace period and is thus never warned.
+	r.set(newOp("strict", time.Now().Add(-30*time.Second), 0))
+
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(20 * time.Millisecond)
+	}, time.Since, nil)
+	m.SetGraceWarning(true)
+
+	expiring := make(chan *longrunningv1.Operation, 4)
+	m.OnExpiring(func(op *longrunningv1.Operation) {
+		expiring <- op
+	})
+
+	require.NoError(t, m.Start(ctx))
+	defer m.Stop()
+
+	waitExpiring := func() *longrunningv1.Operation {
+		t.Helper()
+
+		select {
+		case op := <-expiring:
+			return op
+		case <-time.After(5 * time.Second):
+			t.Fatal("no expiry warning has been issued")
+			return nil
+		}
+	}
+
+	warned := waitExpiring()
+	require.Equal(t, "stalled", warned.UniqueId)
+
+	lostIn, err := time.ParseDuration(warned.Annotations[op.LostInAnnotation])
+	require.NoError(t, err)
+	require.InDelta(t, 30*time.Second, lostIn, float64(2*time.Second))
+
+	// further checks do not warn again.
+	time.Sleep(200 * time.Millisecond)
+	require.Empty(t, expiring)
+
+	// a heartbeat clears the warning so the next stall warns again.
+	stalled := newOp("stalled", time.Now().Add(-70*time.Second), time.Minute)
+	r.set(stalled)
+	m.Observe(stalled)
+
+	warned = waitExpiring()
+	require.Equal(t, "stalled", warned.UniqueId)
+}
+
+func TestScheduleAndRuntimeDeadlines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	longAgo := time.Now().Add(-2 * time.Hour)
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	// all operations have been registered long before their TTL.
+	newOp := func(id string, state longrunningv1.OperationState, annotations map[string]string) {
+		r.set(&longrunningv1.Operation{
+			UniqueId:    id,
+			Kind:        "test",
+			State:       state,
+			Ttl:         durationpb.New(time.Minute),
+			LastUpdate:  timestamppb.New(longAgo),
+			Annotations: annotations,
+		})
+	}
+
+	newOp("due", longrunningv1.OperationState_OperationState_PENDING, map[string]string{
+		op.ScheduledAnnotation: "true",
+		op.StartTimeAnnotation: time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+
+	newOp("future", longrunningv1.OperationState_OperationState_PENDING, map[string]string{
+		op.ScheduledAnnotation: "true",
+		op.StartTimeAnnotation: time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+
+	newOp("exceeded", longrunningv1.OperationState_OperationState_RUNNING, map[string]string{
+		op.RuntimeDeadlineAnnotation: time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+
+	metrics := &fakeMetrics{lost: make(map[string]int), errors: make(map[string]int)}
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, time.Since, metrics)
+
+	started := make(chan string, 2)
+	m.OnStarted(func(op *longrunningv1.Operation) {
+		started <- op.UniqueId
+	})
+
+	timedOut := make(chan string, 2)
+	m.OnTimeout(func(op *longrunningv1.Operation) {
+		timedOut <- op.UniqueId
+	})
+
+	lost := make(chan string, 3)
+	m.OnLost(func(op *longrunningv1.Operation) {
+		lost <- op.UniqueId
+	})
+
+	require.NoError(t, m.Start(ctx))
+
+	require.Equal(t, "due", <-started)
+	require.Equal(t, "exceeded", <-timedOut)
+
+	m.Stop()
+	require.NoError(t, m.WaitAll(ctx))
+
+	// neither the started nor the scheduled operation are lost and the
+	// completed one is not lost afterwards.
+	require.Empty(t, lost)
+	require.Empty(t, started)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, r.state("due"))
+	require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, r.state("future"))
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, r.state("exceeded"))
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+
+	require.Equal(t, 1, metrics.started["test"])
+	require.Equal(t, 1, metrics.timedOut["test"])
+	require.Zero(t, metrics.lost["test"])
+}
+
+func TestRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeRepo{ops: make(map[string]*longrunningv1.Operation)}
+
+	newOp := func(id string, state longrunningv1.OperationState, attempt, maxAttempts int) {
+		r.set(&longrunningv1.Operation{
+			UniqueId:   id,
+			Kind:       "test",
+			State:      state,
+			Ttl:        durationpb.New(time.Minute),
+			LastUpdate: timestamppb.New(time.Now().Add(-time.Hour)),
+			Annotations: map[string]string{
+				op.AttemptAnnotation:     strconv.Itoa(attempt),
+				op.MaxAttemptsAnnotation: strconv.Itoa(maxAttempts),
+			},
+		})
+	}
+
+	newOp("retry", longrunningv1.OperationState_OperationState_RUNNING, 1, 2)
+	newOp("exhausted", longrunningv1.OperationState_OperationState_RUNNING, 2, 2)
+
+	// lost by an instance that stopped before registering the successor.
+	newOp("orphan", longrunningv1.OperationState_OperationState_LOST, 1, 3)
+
+	metrics := &fakeMetrics{lost: make(map[string]int), errors: make(map[string]int)}
+	m := manager.New(r, 0, func(time.Duration) *time.Ticker {
+		return time.NewTicker(time.Hour)
+	}, time.Since, metrics)
+	m.SetRetries(r)
+
+	retried := make(chan [2]string, 3)
+	m.OnRetried(func(lost, next *longrunningv1.Operation) {
+		retried <- [2]string{lost.UniqueId, next.UniqueId}
+	})
+
+	require.NoError(t, m.Start(ctx))
+
+	var got [][2]string
+	for range 2 {
+		select {
+		case ids := <-retried:
+			got = append(got, ids)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a retry")
+		}
+	}
+
+	require.ElementsMatch(t, [][2]string{{"retry", "retry-2"}, {"orphan", "orphan-2"}}, got)
+
+	// each lost operation is only retried once.
+	m.RetryLost(ctx, &longrunningv1.Operation{UniqueId: "retry", Kind: "test"})
+
+	m.Stop()
+	require.NoError(t, m.WaitAll(ctx))
+	require.Empty(t, retried)
+
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, r.state("exhausted"))
+	require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, r.state("retry-2"))
+
+	metrics.l.Lock()
+	defer metrics.l.Unlock()
+
+	require.Equal(t, 2, metrics.retriesScheduled["test"])
+	require.Equal(t, 1, metrics.retriesExhausted["test"])
+	require.Equal(t, 2, metrics.lost["test"])
+}
@@ -0,0 +1,59 @@
+package manager
+
+import "time"
+
+// Metrics is used by the manager to record metrics about its checks.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncrLostOperations is invoked whenever the manager marked an operation
+	// of the given kind as lost.
+	IncrLostOperations(kind string)
+
+	// IncrStartedOperations is invoked whenever the manager started a
+	// scheduled operation of the given kind because its start time arrived.
+	IncrStartedOperations(kind string)
+
+	// IncrTimedOutOperations is invoked whenever the manager completed an
+	// operation of the given kind because it exceeded its maximum runtime.
+	IncrTimedOutOperations(kind string)
+
+	// IncrRetriesScheduled is invoked whenever the manager registered the
+	// successor of a lost operation of the given kind, see SetRetries.
+	IncrRetriesScheduled(kind string)
+
+	// IncrRetriesExhausted is invoked whenever an operation of the given
+	// kind has been lost without any attempts left.
+	IncrRetriesExhausted(kind string)
+
+	// ObserveCheckDuration is invoked after each periodic check of all
+	// operations.
+	ObserveCheckDuration(duration time.Duration)
+
+	// SetWatchedOperations is invoked with the number of RUNNING operations
+	// whose deadline is tracked by the manager whenever it changes.
+	SetWatchedOperations(count int)
+
+	// IncrCheckErrors is invoked whenever a repository call failed during a
+	// check. call names the repository method.
+	IncrCheckErrors(call string)
+
+	// IncrPersistentCheckFailures is invoked for each failed check once
+	// multiple checks failed in a row and the manager keeps backing off.
+	IncrPersistentCheckFailures()
+}
+
+// incrCheckErrors reports a failed repository call to the configured
+// metrics, if any.
+func (m *Manager) incrCheckErrors(call string) {
+	if m.metrics != nil {
+		m.metrics.IncrCheckErrors(call)
+	}
+}
+
+// setWatched reports the number of tracked deadlines. It expects dl to be
+// held.
+func (m *Manager) setWatched() {
+	if m.metrics != nil {
+		m.metrics.SetWatchedOperations(len(m.heap))
+	}
+}
@@ -0,0 +1,133 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// Retries is the interface required by the manager to execute the retry
+// policies of lost operations, see SetRetries.
+type Retries interface {
+	// RetryOperation should register the successor of the LOST operation
+	// with the given id if its retry policy has attempts left and return it.
+	// It should return nil if there is nothing to retry or the successor
+	// has already been registered, even by another instance.
+	RetryOperation(ctx context.Context, id string, now time.Time) (*longrunningv1.Operation, error)
+
+	// GetPendingRetries should return the LOST operations in the specified
+	// namespaces whose successor has not been registered yet.
+	GetPendingRetries(ctx context.Context, namespaces []string) ([]*longrunningv1.Operation, error)
+}
+
+// SetRetries enables the retry policies of operations. Once the manager
+// marked an operation as lost, the successor is registered using retries and
+// reported to the OnRetried callbacks. Each check retries operations whose
+// successor has not been registered yet, for example because the instance
+// that marked them stopped in between. SetRetries must be called before
+// Start.
+func (m *Manager) SetRetries(retries Retries) {
+	m.retries = retries
+}
+
+// OnRetried registers a callback function that will be invoked in a separate
+// goroutine whenever the successor next of the lost operation has been
+// registered according to its retry policy. Like for OnLost, the operations
+// are cloned for each callback.
+func (m *Manager) OnRetried(fn func(lost, next *longrunningv1.Operation)) Unsubscribe {
+	return m.subscribe(&m.onRetried, fn)
+}
+
+// RetryLost executes the retry policy of the lost operation, see SetRetries.
+// It is called by the manager itself and must be called by everyone else that
+// marks operations as lost, like the service. It is a no-op if retries are not
+// enabled.
+func (m *Manager) RetryLost(ctx context.Context, lost *longrunningv1.Operation) {
+	if m.retries == nil {
+		return
+	}
+
+	res, err := m.write(ctx, op.EventCreated, nil, func(ctx context.Context) ([]*longrunningv1.Operation, error) {
+		next, err := m.retries.RetryOperation(ctx, lost.UniqueId, m.now())
+		if next == nil || err != nil {
+			return nil, err
+		}
+
+		return []*longrunningv1.Operation{next}, nil
+	})
+	if err != nil {
+		slog.Error("failed to retry lost operation", "id", lost.UniqueId, "error", err)
+		m.incrCheckErrors("RetryOperation")
+
+		return
+	}
+
+	if len(res) == 0 {
+		if exhausted(lost) {
+			slog.Info("lost operation has no attempts left", "id", lost.UniqueId, "attempt", lost.Annotations[op.AttemptAnnotation], "kind", lost.Kind)
+
+			if m.metrics != nil {
+				m.metrics.IncrRetriesExhausted(lost.Kind)
+			}
+		}
+
+		return
+	}
+
+	next := res[0]
+
+	slog.Info("registered next attempt of lost operation", "id", next.UniqueId, "lost", lost.UniqueId, "attempt", next.Annotations[op.AttemptAnnotation], "kind", next.Kind)
+
+	if m.metrics != nil {
+		m.metrics.IncrRetriesScheduled(next.Kind)
+	}
+
+	m.Observe(next)
+
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	for _, sub := range m.onRetried {
+		m.invoke("retried", sub.fn, lost, next)
+	}
+}
+
+// retryPending retries all lost operations whose successor has not been
+// registered yet.
+func (m *Manager) retryPending(ctx context.Context) {
+	if m.retries == nil || m.dryRun.Load() {
+		return
+	}
+
+	ops, err := m.retries.GetPendingRetries(ctx, m.namespaces)
+	if err != nil {
+		slog.Error("failed to query pending retries", "error", err)
+		m.incrCheckErrors("GetPendingRetries")
+
+		return
+	}
+
+	for _, lost := range ops {
+		m.RetryLost(ctx, lost)
+	}
+}
+
+// exhausted reports whether the lost operation pbop had a retry policy
+// without any attempts left.
+func exhausted(pbop *longrunningv1.Operation) bool {
+	maxAttempts, err := strconv.Atoi(pbop.Annotations[op.MaxAttemptsAnnotation])
+	if err != nil {
+		return false
+	}
+
+	attempt, err := strconv.Atoi(pbop.Annotations[op.AttemptAnnotation])
+	if err != nil {
+		return false
+	}
+
+	return attempt >= maxAttempts
+}
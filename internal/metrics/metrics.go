@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"time"
+
+	gometrics "github.com/hashicorp/go-metrics"
+)
+
+// Recorder records service metrics using a go-metrics instance.
+type Recorder struct {
+	m *gometrics.Metrics
+}
+
+// New returns a new recorder that reports to m.
+func New(m *gometrics.Metrics) *Recorder {
+	return &Recorder{m: m}
+}
+
+// ObserveCall implements repo.Metrics.
+func (r *Recorder) ObserveCall(method string, duration time.Duration, resultSize int, err error) {
+	labels := []gometrics.Label{
+		{Name: "method", Value: method},
+	}
+
+	r.m.AddSampleWithLabels([]string{"repo", "call", "duration"}, float32(duration)/float32(time.Millisecond), labels)
+	r.m.AddSampleWithLabels([]string{"repo", "call", "result_size"}, float32(resultSize), labels)
+
+	if err != nil {
+		r.m.IncrCounterWithLabels([]string{"repo", "call", "errors"}, 1, labels)
+	}
+}
+
+// SetActiveWatchers records the number of active watch streams.
+func (r *Recorder) SetActiveWatchers(count int) {
+	r.m.SetGauge([]string{"service", "watchers", "active"}, float32(count))
+}
+
+// SetOutboxDepth records the number of events that have not been published to
+// the events-service yet.
+func (r *Recorder) SetOutboxDepth(count int64) {
+	r.m.SetGauge([]string{"service", "outbox", "depth"}, float32(count))
+}
+
+// IncrOutboxFailures counts a failed attempt to publish an event to the
+// events-service.
+func (r *Recorder) IncrOutboxFailures() {
+	r.m.IncrCounter([]string{"service", "outbox", "failures"}, 1)
+}
+
+// IncrWebhookFailures counts a failed attempt to deliver an event to a
+// webhook.
+func (r *Recorder) IncrWebhookFailures() {
+	r.m.IncrCounter([]string{"service", "webhooks", "failures"}, 1)
+}
+
+// IncrSlowWatchers counts an update that could not be buffered for a watch
+// stream and has been handled using the given slow-consumer policy.
+func (r *Recorder) IncrSlowWatchers(policy string) {
+	r.m.IncrCounterWithLabels([]string{"service", "watchers", "slow"}, 1, []gometrics.Label{
+		{Name: "policy", Value: policy},
+	})
+}
+
+// IncrLostOperations implements manager.Metrics.
+func (r *Recorder) IncrLostOperations(kind string) {
+	r.m.IncrCounterWithLabels([]string{"manager", "operations", "lost"}, 1, []gometrics.Label{
+		{Name: "kind", Value: kind},
+	})
+}
+
+// IncrStartedOperations implements manager.Metrics.
+func (r *Recorder) IncrStartedOperations(kind string) {
+	r.m.IncrCounterWithLabels([]string{"manager", "operations", "started"}, 1, []gometrics.Label{
+		{Name: "kind", Value: kind},
+	})
+}
+
+// IncrTimedOutOperations implements manager.Metrics.
+func (r *Recorder) IncrTimedOutOperations(kind string) {
+	r.m.IncrCounterWithLabels([]string{"manager", "operations", "timed_out"}, 1, []gometrics.Label{
+		{Name: "kind", Value: kind},
+	})
+}
+
+// IncrRetriesScheduled implements manager.Metrics.
+func (r *Recorder) IncrRetriesScheduled(kind string) {
+	r.m.IncrCounterWithLabels([]string{"manager", "retries", "scheduled"}, 1, []gometrics.Label{
+		{Name: "kind", Value: kind},
+	})
+}
+
+// IncrRetriesExhausted implements manager.Metrics.
+func (r *Recorder) IncrRetriesExhausted(kind string) {
+	r.m.IncrCounterWithLabels([]string{"manager", "retries", "exhausted"}, 1, []gometrics.Label{
+		{Name: "kind", Value: kind},
+	})
+}
+
+// ObserveCheckDuration implements manager.Metrics.
+func (r *Recorder) ObserveCheckDuration(duration time.Duration) {
+	r.m.AddSample([]string{"manager", "check", "duration"}, float32(duration)/float32(time.Millisecond))
+}
+
+// SetWatchedOperations implements manager.Metrics.
+func (r *Recorder) SetWatchedOperations(count int) {
+	r.m.SetGauge([]string{"manager", "operations", "watched"}, float32(count))
+}
+
+// IncrCheckErrors implements manager.Metrics.
+func (r *Recorder) IncrCheckErrors(call string) {
+	r.m.IncrCounterWithLabels([]string{"manager", "check", "errors"}, 1, []gometrics.Label{
+		{Name: "call", Value: call},
+	})
+}
+
+// IncrPersistentCheckFailures implements manager.Metrics.
+func (r *Recorder) IncrPersistentCheckFailures() {
+	r.m.IncrCounter([]string{"manager", "check", "persistent_failures"}, 1)
+}
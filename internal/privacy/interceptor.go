@@ -0,0 +1,177 @@
+package privacy
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Interceptor redacts the operations in responses and server streams
+// according to a Policy, based on the roles of the caller.
+//
+// The auth interceptor only handles unary RPCs so the caller is determined
+// using the same extractor instead of auth.From. Role IDs are resolved to their
+// names so AllowedRoles may hold either of them.
+type Interceptor struct {
+	policy    Policy
+	extractor auth.ExtractorFunc
+	resolver  auth.RoleResolverFunc
+
+	rolesLock sync.RWMutex
+	roles     map[string]string
+}
+
+// NewInterceptor returns a new interceptor for policy. If extractor is nil,
+// auth.RemoteHeaderExtractor is used. resolver may be nil in which case only
+// role IDs are matched against the allowed roles.
+func NewInterceptor(policy Policy, extractor auth.ExtractorFunc, resolver auth.RoleResolverFunc) *Interceptor {
+	if extractor == nil {
+		extractor = auth.RemoteHeaderExtractor
+	}
+
+	return &Interceptor{
+		policy:    policy,
+		extractor: extractor,
+		resolver:  resolver,
+		roles:     make(map[string]string),
+	}
+}
+
+func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		res, err := next(ctx, req)
+		if err != nil || res == nil || !i.policy.Enabled() || i.allowed(ctx, req) {
+			return res, err
+		}
+
+		switch res.Any().(type) {
+		case *longrunningv1.Operation:
+			return redactResponse[longrunningv1.Operation](i.policy, res), nil
+		case *longrunningv1.QueryOperationsResponse:
+			return redactResponse[longrunningv1.QueryOperationsResponse](i.policy, res), nil
+		case *longrunningv1.RegisterOperationResponse:
+			return redactResponse[longrunningv1.RegisterOperationResponse](i.policy, res), nil
+		}
+
+		return res, nil
+	}
+}
+
+func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *Interceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		if !i.policy.Enabled() {
+			return next(ctx, conn)
+		}
+
+		// the extractor requires a request so the headers of the stream are
+		// copied to an empty one.
+		req := connect.NewRequest(&emptypb.Empty{})
+		for key, values := range conn.RequestHeader() {
+			req.Header()[key] = values
+		}
+
+		if i.allowed(ctx, req) {
+			return next(ctx, conn)
+		}
+
+		return next(ctx, &redactingConn{
+			StreamingHandlerConn: conn,
+			policy:               i.policy,
+		})
+	}
+}
+
+// allowed reports whether the caller of req may see unredacted operations.
+func (i *Interceptor) allowed(ctx context.Context, req connect.AnyRequest) bool {
+	usr, err := i.extractor(ctx, req)
+	if err != nil {
+		return false
+	}
+
+	if usr.Admin {
+		return true
+	}
+
+	for _, id := range usr.RoleIDs {
+		if i.policy.Allowed(id, i.roleName(ctx, id)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roleName returns the name of the role with the given id or an empty string
+// if it cannot be resolved.
+func (i *Interceptor) roleName(ctx context.Context, id string) string {
+	if i.resolver == nil {
+		return ""
+	}
+
+	i.rolesLock.RLock()
+	name, ok := i.roles[id]
+	i.rolesLock.RUnlock()
+
+	if ok {
+		return name
+	}
+
+	role, err := i.resolver(ctx, id)
+	if err != nil {
+		slog.Error("failed to resolve role", "error", err, "roleId", id)
+		return ""
+	}
+
+	i.rolesLock.Lock()
+	i.roles[id] = role.GetName()
+	i.rolesLock.Unlock()
+
+	return role.GetName()
+}
+
+// redactResponse returns a copy of res with a redacted message.
+func redactResponse[T any, PT interface {
+	*T
+	proto.Message
+}](policy Policy, res connect.AnyResponse) connect.AnyResponse {
+	typed, ok := res.(*connect.Response[T])
+	if !ok {
+		return res
+	}
+
+	redacted := connect.NewResponse((*T)(Redact(policy, PT(typed.Msg))))
+
+	for key, values := range typed.Header() {
+		redacted.Header()[key] = values
+	}
+
+	for key, values := range typed.Trailer() {
+		redacted.Trailer()[key] = values
+	}
+
+	return redacted
+}
+
+type redactingConn struct {
+	connect.StreamingHandlerConn
+
+	policy Policy
+}
+
+func (c *redactingConn) Send(msg any) error {
+	if pb, ok := msg.(proto.Message); ok {
+		msg = Redact(c.policy, pb)
+	}
+
+	return c.StreamingHandlerConn.Send(msg)
+}
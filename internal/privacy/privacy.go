@@ -0,0 +1,144 @@
+// Package privacy redacts sensitive parameters and annotations from operations
+// before they are returned to callers that are not permitted to see them.
+package privacy
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Policy configures which parameters and annotations of an operation are
+// redacted. Keys are matched using path.Match patterns, like "customer.*".
+type Policy struct {
+	// Parameters and Annotations hold the key patterns of the parameters and
+	// annotations that are redacted.
+	Parameters  []string
+	Annotations []string
+
+	// AllowedRoles holds the IDs or names of the roles that may see unredacted
+	// operations. Administrators may always see unredacted operations.
+	AllowedRoles []string
+}
+
+// Validate returns an error if any of the key patterns is malformed.
+func (p Policy) Validate() error {
+	for _, pattern := range slices.Concat(p.Parameters, p.Annotations) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Enabled reports whether p redacts anything at all.
+func (p Policy) Enabled() bool {
+	return len(p.Parameters) > 0 || len(p.Annotations) > 0
+}
+
+// Allowed reports whether a caller with any of the given roles may see
+// unredacted operations. roles may hold role IDs as well as role names.
+func (p Policy) Allowed(roles ...string) bool {
+	for _, role := range roles {
+		if slices.Contains(p.AllowedRoles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Redact returns a copy of msg with all operations redacted. msg is returned
+// as is if nothing has to be redacted.
+//
+// msg itself is never changed since operations are shared between watchers.
+func Redact[T proto.Message](p Policy, msg T) T {
+	if !p.Enabled() || !p.matches(msg.ProtoReflect()) {
+		return msg
+	}
+
+	clone := proto.Clone(msg).(T)
+	p.walk(clone.ProtoReflect(), p.redactOperation)
+
+	return clone
+}
+
+// matches reports whether any of the operations in m has a key that must be
+// redacted.
+func (p Policy) matches(m protoreflect.Message) bool {
+	found := false
+
+	p.walk(m, func(pbop *longrunningv1.Operation) {
+		for key := range pbop.Parameters {
+			found = found || match(p.Parameters, key)
+		}
+
+		for key := range pbop.Annotations {
+			found = found || match(p.Annotations, key)
+		}
+	})
+
+	return found
+}
+
+func (p Policy) redactOperation(pbop *longrunningv1.Operation) {
+	for key := range pbop.Parameters {
+		if match(p.Parameters, key) {
+			pbop.Parameters[key] = structpb.NewStringValue(op.RedactedValue)
+		}
+	}
+
+	for key := range pbop.Annotations {
+		if match(p.Annotations, key) {
+			pbop.Annotations[key] = op.RedactedValue
+		}
+	}
+}
+
+// walk calls fn for each operation that is contained in m, including m
+// itself.
+func (p Policy) walk(m protoreflect.Message, fn func(*longrunningv1.Operation)) {
+	if pbop, ok := m.Interface().(*longrunningv1.Operation); ok {
+		fn(pbop)
+		return
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				p.walk(list.Get(i).Message(), fn)
+			}
+
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				p.walk(v.Message(), fn)
+				return true
+			})
+
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			p.walk(v.Message(), fn)
+		}
+
+		return true
+	})
+}
+
+func match(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		// patterns are validated by Policy.Validate
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+
+	return false
+}
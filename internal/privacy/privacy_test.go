@@ -0,0 +1,91 @@
+package privacy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+	idmv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/privacy"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func testOperation() *longrunningv1.Operation {
+	return &longrunningv1.Operation{
+		UniqueId: "1",
+		Parameters: map[string]*structpb.Value{
+			"customer.email": structpb.NewStringValue("alice@example.com"),
+			"count":          structpb.NewNumberValue(3),
+		},
+		Annotations: map[string]string{
+			"path": "/home/alice/export.csv",
+			"kind": "export",
+		},
+	}
+}
+
+var policy = privacy.Policy{
+	Parameters:   []string{"customer.*"},
+	Annotations:  []string{"path"},
+	AllowedRoles: []string{"support"},
+}
+
+func TestRedact(t *testing.T) {
+	require.NoError(t, policy.Validate())
+	require.Error(t, privacy.Policy{Parameters: []string{"["}}.Validate())
+
+	pbop := testOperation()
+
+	res := privacy.Redact(policy, &longrunningv1.QueryOperationsResponse{
+		Operation: []*longrunningv1.Operation{pbop},
+	})
+
+	redacted := res.Operation[0]
+	require.Equal(t, op.RedactedValue, redacted.Parameters["customer.email"].GetStringValue())
+	require.Equal(t, float64(3), redacted.Parameters["count"].GetNumberValue())
+	require.Equal(t, op.RedactedValue, redacted.Annotations["path"])
+	require.Equal(t, "export", redacted.Annotations["kind"])
+
+	// the original operation is not modified
+	require.Equal(t, "alice@example.com", pbop.Parameters["customer.email"].GetStringValue())
+	require.Equal(t, "/home/alice/export.csv", pbop.Annotations["path"])
+
+	// messages without sensitive values are returned as is
+	clean := &longrunningv1.Operation{UniqueId: "2"}
+	require.Same(t, clean, privacy.Redact(policy, clean))
+}
+
+func TestInterceptor(t *testing.T) {
+	resolver := func(_ context.Context, id string) (*idmv1.Role, error) {
+		return &idmv1.Role{Id: id, Name: map[string]string{"role-1": "support"}[id]}, nil
+	}
+
+	interceptor := privacy.NewInterceptor(policy, nil, resolver)
+
+	handler := interceptor.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return connect.NewResponse(testOperation()), nil
+	})
+
+	call := func(roles ...string) *longrunningv1.Operation {
+		req := connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: "1"})
+		req.Header().Set("X-Remote-User-ID", "bob")
+		for _, role := range roles {
+			req.Header().Add("X-Remote-Role", role)
+		}
+
+		res, err := handler(context.Background(), req)
+		require.NoError(t, err)
+
+		return res.Any().(*longrunningv1.Operation)
+	}
+
+	require.Equal(t, op.RedactedValue, call().Annotations["path"])
+	require.Equal(t, op.RedactedValue, call("role-2").Annotations["path"])
+
+	// roles are matched by ID and by name
+	require.Equal(t, "/home/alice/export.csv", call("support").Annotations["path"])
+	require.Equal(t, "/home/alice/export.csv", call("role-1").Annotations["path"])
+}
@@ -0,0 +1,39 @@
+package repo
+
+import (
+	"context"
+	"maps"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mergeAnnotations returns the stored annotations of the operation with the
+// given id combined with annotations, see UpdateOptions.MergeAnnotations.
+// Keys with an empty value are removed. It must be called inside the
+// transaction of the update so concurrent writers are serialized.
+func (r *Repo) mergeAnnotations(ctx context.Context, id primitive.ObjectID, annotations map[string]string) (map[string]string, error) {
+	model, err := r.findOperation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := maps.Clone(model.Annotations)
+	if merged == nil {
+		merged = make(map[string]string, len(annotations))
+	}
+
+	for key, value := range annotations {
+		if value == "" {
+			delete(merged, key)
+			continue
+		}
+
+		merged[key] = value
+	}
+
+	if err := r.limits.CheckAnnotations(merged); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,220 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrAttachmentExists   = errors.New("attachment already exists")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// SetAttachmentWindow configures how long attachments may still be added after
+// an operation has been completed or lost. A zero value rejects attachments on
+// terminated operations.
+func (r *Repo) SetAttachmentWindow(d time.Duration) {
+	r.attachmentWindow = d
+}
+
+// AddAttachment adds att to the operation with the given id. If content is not
+// nil it is stored inside the service and the size of att is set to the number
+// of bytes read. Otherwise att must reference an external URL.
+// Attachments may only be added using the auth token of the operation.
+func (r *Repo) AddAttachment(ctx context.Context, id string, authToken string, att Attachment, content io.Reader) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("AddAttachment", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := r.findOperation(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	if model.AuthToken != authToken {
+		return nil, ErrInvalidAuthToken
+	}
+
+	if err := r.canAttach(&model.Operation, att.Name); err != nil {
+		return nil, err
+	}
+
+	att.CreateTime = time.Now().Truncate(time.Millisecond)
+
+	if content != nil {
+		blobID, size, err := r.storeBlob(id+"/"+att.Name, content)
+		if err != nil {
+			return nil, err
+		}
+
+		att.BlobID = &blobID
+		att.Size = size
+	}
+
+	// re-check the name and the number of attachments as part of the update so
+	// concurrent uploads cannot exceed the limits.
+	filter := bson.M{
+		"_id": oid,
+		"attachments.name": bson.M{
+			"$ne": att.Name,
+		},
+	}
+
+	if max := r.limits.MaxAttachments; max > 0 {
+		filter[fmt.Sprintf("attachments.%d", max-1)] = bson.M{
+			"$exists": false,
+		}
+	}
+
+	res := r.col.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$push": bson.M{"attachments": att}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"authToken": 0}),
+	)
+
+	if err := res.Err(); err != nil {
+		r.deleteBlob(att.BlobID)
+
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, r.canAttach(&model.Operation, att.Name)
+		}
+
+		return nil, err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return op.toProto(nil, r.limits)
+}
+
+// GetAttachment returns the attachment name of the operation with the given id.
+// If the content of the attachment is stored inside the service, a reader for
+// it is returned as well which must be closed by the caller.
+func (r *Repo) GetAttachment(ctx context.Context, id string, name string) (_ *Attachment, _ io.ReadCloser, err error) {
+	defer r.observe("GetAttachment", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := r.col.FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"attachments": 1}))
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil, ErrNotFound
+		}
+
+		return nil, nil, err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	idx := slices.IndexFunc(op.Attachments, func(a Attachment) bool { return a.Name == name })
+	if idx < 0 {
+		return nil, nil, fmt.Errorf("%w: %q", ErrAttachmentNotFound, name)
+	}
+
+	att := op.Attachments[idx]
+	if att.BlobID == nil {
+		return &att, nil, nil
+	}
+
+	stream, err := r.blobs.OpenDownloadStream(*att.BlobID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open attachment content: %w", err)
+	}
+
+	return &att, stream, nil
+}
+
+// canAttach validates that an attachment with the given name may be added
+// to op.
+func (r *Repo) canAttach(op *Operation, name string) error {
+	terminated := op.State == longrunningv1.OperationState_OperationState_COMPLETE ||
+		op.State == longrunningv1.OperationState_OperationState_LOST
+
+	if terminated && time.Since(op.LastUpdate) > r.attachmentWindow {
+		return ErrOperationCompleted
+	}
+
+	if slices.ContainsFunc(op.Attachments, func(a Attachment) bool { return a.Name == name }) {
+		return fmt.Errorf("%w: %q", ErrAttachmentExists, name)
+	}
+
+	if max := r.limits.MaxAttachments; max > 0 && len(op.Attachments) >= max {
+		return fmt.Errorf("%w: operation already has %d attachments", ErrSizeLimitExceeded, max)
+	}
+
+	return nil
+}
+
+// storeBlob stores content in the attachment bucket and returns the id of the
+// blob together with it's size. Content that exceeds the configured
+// MaxAttachmentSize is rejected.
+func (r *Repo) storeBlob(filename string, content io.Reader) (primitive.ObjectID, int64, error) {
+	if max := r.limits.MaxAttachmentSize; max > 0 {
+		content = io.LimitReader(content, max+1)
+	}
+
+	stream, err := r.blobs.OpenUploadStream(filename)
+	if err != nil {
+		return primitive.NilObjectID, 0, fmt.Errorf("failed to open upload stream: %w", err)
+	}
+
+	blobID := stream.FileID.(primitive.ObjectID)
+
+	size, err := io.Copy(stream, content)
+	if err != nil {
+		stream.Abort()
+
+		return primitive.NilObjectID, 0, fmt.Errorf("failed to store attachment: %w", err)
+	}
+
+	if err := stream.Close(); err != nil {
+		return primitive.NilObjectID, 0, fmt.Errorf("failed to store attachment: %w", err)
+	}
+
+	if max := r.limits.MaxAttachmentSize; max > 0 && size > max {
+		r.deleteBlob(&blobID)
+
+		return primitive.NilObjectID, 0, fmt.Errorf("%w: attachment exceeds the maximum size of %d bytes", ErrSizeLimitExceeded, max)
+	}
+
+	return blobID, size, nil
+}
+
+// deleteBlob deletes the blob with the given id, if any. Errors are only
+// logged since it's only used to clean up after failed uploads.
+func (r *Repo) deleteBlob(id *primitive.ObjectID) {
+	if id == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := r.blobs.DeleteContext(ctx, *id); err != nil {
+		slog.Error("failed to delete attachment content", "blobId", id.Hex(), "error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RecordCheck records that the manager with the given name checked
+// operations. The time of the mongodb server is recorded, see LastCheck.
+func (r *Repo) RecordCheck(ctx context.Context, name string) (err error) {
+	defer r.observe("RecordCheck", time.Now(), nil, &err)
+
+	if _, err := r.checkpoints.UpdateOne(ctx, bson.M{"_id": name}, bson.M{
+		"$currentDate": bson.M{"lastCheck": true},
+	}, options.Update().SetUpsert(true)); err != nil {
+		return fmt.Errorf("failed to record check of %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// LastCheck returns the time of the last check recorded for the manager with
+// the given name, or the zero time if none has been recorded, together with
+// the current time of the mongodb server.
+func (r *Repo) LastCheck(ctx context.Context, name string) (last, now time.Time, err error) {
+	defer r.observe("LastCheck", time.Now(), nil, &err)
+
+	var checkpoint struct {
+		LastCheck time.Time `bson:"lastCheck"`
+	}
+
+	if err := r.checkpoints.FindOne(ctx, bson.M{"_id": name}).Decode(&checkpoint); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to get last check of %q: %w", name, err)
+	}
+
+	now, err = r.serverTime(ctx)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return checkpoint.LastCheck, now, nil
+}
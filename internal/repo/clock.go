@@ -0,0 +1,230 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The lastUpdate of operations is stamped using the clock of the mongodb
+// server rather than the one of the instance that applies the update. Together
+// with GetExpiredOperations, deadlines only depend on a single clock even if
+// the instances of the service drift apart.
+
+// stampLastUpdate replaces the lastUpdate of the $set stage of update, if
+// any, by a $currentDate so the time of the server is recorded.
+func stampLastUpdate(update bson.M) bson.M {
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		return update
+	}
+
+	if _, ok := set["lastUpdate"]; !ok {
+		return update
+	}
+
+	delete(set, "lastUpdate")
+
+	currentDate, ok := update["$currentDate"].(bson.M)
+	if !ok {
+		currentDate = bson.M{}
+		update["$currentDate"] = currentDate
+	}
+
+	currentDate["lastUpdate"] = true
+
+	return update
+}
+
+// insertOperations inserts the operation documents, stamping their
+// lastUpdate with the time of the server. Each document is upserted by its
+// id so unique indexes are enforced like for an insert. The stored operations
+// are returned in the order of docs.
+func (r *Repo) insertOperations(ctx context.Context, docs []any) ([]Operation, error) {
+	writes := make([]mongo.WriteModel, len(docs))
+	ids := make([]any, len(docs))
+
+	for idx, doc := range docs {
+		blob, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode operation: %w", err)
+		}
+
+		var fields bson.D
+		if err := bson.Unmarshal(blob, &fields); err != nil {
+			return nil, fmt.Errorf("failed to encode operation: %w", err)
+		}
+
+		var (
+			id     any
+			insert = make(bson.D, 0, len(fields))
+		)
+
+		for _, e := range fields {
+			switch e.Key {
+			case "_id":
+				id = e.Value
+			case "lastUpdate":
+			default:
+				insert = append(insert, e)
+			}
+		}
+
+		ids[idx] = id
+		writes[idx] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{
+				"$setOnInsert": insert,
+				"$currentDate": bson.M{"lastUpdate": true},
+			}).
+			SetUpsert(true)
+	}
+
+	if _, err := r.col.BulkWrite(ctx, writes); err != nil {
+		return nil, err
+	}
+
+	return r.findInserted(ctx, ids)
+}
+
+// findInserted returns the operations with the given ids in the same order,
+// as stored by insertOperations.
+func (r *Repo) findInserted(ctx context.Context, ids []any) ([]Operation, error) {
+	cursor, err := r.col.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"authToken": 0}))
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []Operation
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode operations: %w", err)
+	}
+
+	byID := make(map[primitive.ObjectID]Operation, len(stored))
+	for _, op := range stored {
+		byID[op.ID] = op
+	}
+
+	ops := make([]Operation, len(ids))
+	for idx, id := range ids {
+		op, ok := byID[id.(primitive.ObjectID)]
+		if !ok {
+			return nil, fmt.Errorf("inserted operation %v not found", id)
+		}
+
+		ops[idx] = op
+	}
+
+	return ops, nil
+}
+
+// GetExpiredOperations returns the RUNNING operations in the specified
+// namespaces that are neither paused nor without expiry and whose lastUpdate
+// is older than their TTL plus grace period. Unlike comparing the lastUpdate
+// of GetActiveOperations with the local clock, the deadline is evaluated by
+// the server. If ids is not empty, only the operations with these ids are
+// considered. If namespaces is empty, operations of all namespaces are
+// returned.
+//
+// The current time of the server is returned as well so callers can report
+// by how much the operations missed their deadline.
+func (r *Repo) GetExpiredOperations(ctx context.Context, namespaces []string, ids []string) (ops []*longrunningv1.Operation, now time.Time, err error) {
+	defer r.observe("GetExpiredOperations", time.Now(), func() int { return len(ops) }, &err)
+
+	filter := bson.M{
+		"state":    longrunningv1.OperationState_OperationState_RUNNING,
+		"pausedAt": pausedFilter(false),
+		"noExpiry": bson.M{"$ne": true},
+	}
+
+	if len(ids) > 0 {
+		oids := make([]primitive.ObjectID, len(ids))
+		for idx, id := range ids {
+			oids[idx], err = parseID(id)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+		}
+
+		filter["_id"] = bson.M{"$in": oids}
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	filter["$expr"] = expiredExpr()
+
+	cursor, err := r.col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.M{"authToken": 0}}},
+	}, options.Aggregate())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var models []Operation
+	if err := cursor.All(ctx, &models); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode operations: %w", err)
+	}
+
+	now, err = r.serverTime(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ops = make([]*longrunningv1.Operation, 0, len(models))
+	for _, m := range models {
+		pb, err := m.toProto(nil, r.limits)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to convert operation with id %q: %w", m.ID.Hex(), err)
+		}
+
+		ops = append(ops, pb)
+	}
+
+	return ops, now, nil
+}
+
+// serverTime returns the current time of the mongodb server.
+func (r *Repo) serverTime(ctx context.Context) (time.Time, error) {
+	var hello struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+
+	if err := r.col.Database().RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello); err != nil {
+		return time.Time{}, fmt.Errorf("failed to get server time: %w", err)
+	}
+
+	return hello.LocalTime, nil
+}
+
+// expiredExpr returns an aggregation expression that matches operations whose
+// TTL and grace period elapsed since their last update according to the
+// database clock.
+func expiredExpr() bson.M {
+	// ttl and gracePeriod are stored in nanoseconds while dates are added
+	// in milliseconds.
+	return bson.M{
+		"$lte": bson.A{
+			bson.M{
+				"$add": bson.A{
+					"$lastUpdate",
+					bson.M{
+						"$toLong": bson.M{
+							"$divide": bson.A{
+								bson.M{"$add": bson.A{"$ttl", "$gracePeriod"}},
+								int64(time.Millisecond),
+							},
+						},
+					},
+				},
+			},
+			"$$NOW",
+		},
+	}
+}
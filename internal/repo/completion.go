@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var (
+	ErrNotCompleted   = errors.New("operation is not completed")
+	ErrResultConflict = errors.New("operation already completed with a different result")
+)
+
+// ReplayCompletion returns the COMPLETE operation of upd if it has been
+// completed with an equivalent result, so a CompleteOperation call that is
+// retried after a client-side timeout succeeds. upd is authorized like
+// CompleteOperation but the operation is not modified. An error wrapping
+// ErrResultConflict is returned if the stored result differs and
+// ErrNotCompleted if the operation is not COMPLETE.
+func (r *Repo) ReplayCompletion(ctx context.Context, upd *longrunningv1.CompleteOperationRequest, opts UpdateOptions) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("ReplayCompletion", time.Now(), nil, &err)
+
+	id, err := parseID(upd.UniqueId)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := r.findOperation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// authorize would reject the terminal operation, so validate the
+	// credentials on their own.
+	if upd.AuthToken != "" || (opts.Identity == "" && !opts.Admin) {
+		if model.AuthToken != upd.AuthToken {
+			return nil, ErrInvalidAuthToken
+		}
+	} else if _, err := model.authorizeIdentity(opts, "complete"); err != nil {
+		return nil, err
+	}
+
+	if model.State != longrunningv1.OperationState_OperationState_COMPLETE {
+		return nil, ErrNotCompleted
+	}
+
+	if err := model.checkResult(upd); err != nil {
+		return nil, err
+	}
+
+	return model.toProto(nil, r.limits)
+}
+
+// checkResult returns an error wrapping ErrResultConflict if the result of
+// upd is not equivalent to the stored result of op.
+func (op *Operation) checkResult(upd *longrunningv1.CompleteOperationRequest) error {
+	switch v := upd.Result.(type) {
+	case *longrunningv1.CompleteOperationRequest_Error:
+		if op.Error == nil {
+			return fmt.Errorf("%w: completed successfully, got an error result", ErrResultConflict)
+		}
+
+		if op.Error.Message != v.Error.Message || !equalAny(op.Error.Details, v.Error.ErrorDetails) {
+			return fmt.Errorf("%w: error differs from the stored one", ErrResultConflict)
+		}
+
+	case *longrunningv1.CompleteOperationRequest_Success:
+		if op.Success == nil {
+			return fmt.Errorf("%w: completed with an error, got a success result", ErrResultConflict)
+		}
+
+		if op.Success.Message != v.Success.Message || !equalAny(op.Success.Result, v.Success.Result) {
+			return fmt.Errorf("%w: success differs from the stored one", ErrResultConflict)
+		}
+
+	default:
+		return ErrMissingResult
+	}
+
+	return nil
+}
+
+// equalAny reports whether a and b hold the same message. The encoding of
+// messages is not deterministic (for example for maps) so the contents are
+// compared if the encoded values differ and the type is known.
+func equalAny(a, b *anypb.Any) bool {
+	if a.GetTypeUrl() != b.GetTypeUrl() {
+		return false
+	}
+
+	if bytes.Equal(a.GetValue(), b.GetValue()) {
+		return true
+	}
+
+	am, err := a.UnmarshalNew()
+	if err != nil {
+		return false
+	}
+
+	bm, err := b.UnmarshalNew()
+	if err != nil {
+		return false
+	}
+
+	return proto.Equal(am, bm)
+}
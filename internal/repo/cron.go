@@ -0,0 +1,188 @@
+package repo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchLimit bounds the search for the next occurrence of a schedule so
+// expressions that never match, like "0 0 31 2 *", do not loop forever.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronShortcuts are the supported predefined schedules.
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a parsed cron expression with the five standard fields
+// minute, hour, day of month, month and day of week. Each field is stored as
+// a bit set of the matching values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny record whether the day fields are unrestricted. Like
+	// in cron, a day matches either field if both are restricted.
+	domAny, dowAny bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses a cron expression. Each field supports "*", single
+// values, ranges ("1-5"), steps ("*/15", "1-30/2") and comma separated lists
+// of them. A day of week of 7 is sunday, just like 0.
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if shortcut, ok := cronShortcuts[expr]; ok {
+		expr = shortcut
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields but got %d", len(cronFields), len(parts))
+	}
+
+	var sets [5]uint64
+	for idx, part := range parts {
+		set, err := parseCronField(part, cronFields[idx])
+		if err != nil {
+			return nil, err
+		}
+
+		sets[idx] = set
+	}
+
+	// sunday may be specified as both, 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: parts[2] == "*",
+		dowAny: parts[4] == "*",
+	}, nil
+}
+
+func parseCronField(value string, field cronField) (uint64, error) {
+	var set uint64
+
+	for _, item := range strings.Split(value, ",") {
+		rng, stepValue, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepValue)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q for %s", stepValue, field.name)
+			}
+
+			step = n
+		}
+
+		start, end := field.min, field.max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+
+			var err error
+			if start, err = parseCronValue(from, field); err != nil {
+				return 0, err
+			}
+
+			end = start
+			if isRange {
+				if end, err = parseCronValue(to, field); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = field.max
+			}
+
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q for %s", rng, field.name)
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+func parseCronValue(value string, field cronField) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < field.min || n > field.max {
+		return 0, fmt.Errorf("invalid value %q for %s, expected %d-%d", value, field.name, field.min, field.max)
+	}
+
+	return n, nil
+}
+
+// next returns the first occurrence of the schedule strictly after t in the
+// location of t. The zero time is returned if there is none within
+// cronSearchLimit.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DashboardOptions selects the sections of a Dashboard. Sections with a zero
+// limit are omitted.
+type DashboardOptions struct {
+	// Since is the start of the time window. Failed operations and terminal
+	// operations included in the state counts must have been updated since.
+	Since time.Time
+
+	// Namespaces restricts the dashboard to the given namespaces. If empty,
+	// operations of all namespaces are included.
+	Namespaces []string
+
+	// Viewer may be set to only include operations that are visible to the
+	// viewer.
+	Viewer *Viewer
+
+	FailedLimit  int
+	LostLimit    int
+	RunningLimit int
+}
+
+// Dashboard is an overview of the operations for monitoring purposes.
+type Dashboard struct {
+	// Failed holds the most recent operations that completed with an error,
+	// newest first.
+	Failed []*longrunningv1.Operation
+
+	// Lost holds the currently LOST operations, most recently lost first.
+	Lost []*longrunningv1.Operation
+
+	// Running holds the running operations with the highest priority, oldest
+	// first.
+	Running []*longrunningv1.Operation
+
+	// StateCounts holds the number of operations per state. Operations that
+	// are not COMPLETE are always counted, completed ones only if they have
+	// been updated within the time window.
+	StateCounts map[longrunningv1.OperationState]int64
+}
+
+// Dashboard returns the dashboard selected by opts. Each section is loaded
+// using a separate query so they can use the (namespace, state) index.
+func (r *Repo) Dashboard(ctx context.Context, opts DashboardOptions) (_ *Dashboard, err error) {
+	defer r.observe("Dashboard", time.Now(), nil, &err)
+
+	filter := func(f bson.M) bson.M {
+		r.addNamespaceFilter(f, opts.Namespaces)
+		addVisibilityFilter(f, opts.Viewer)
+		return f
+	}
+
+	section := func(limit int, f bson.M, sort bson.D) ([]*longrunningv1.Operation, error) {
+		if limit <= 0 {
+			return nil, nil
+		}
+
+		return r.findWithOptions(ctx, filter(f), nil, options.Find().
+			SetSort(sort).
+			SetLimit(int64(limit)))
+	}
+
+	result := &Dashboard{
+		StateCounts: make(map[longrunningv1.OperationState]int64),
+	}
+
+	result.Failed, err = section(opts.FailedLimit, bson.M{
+		"state": longrunningv1.OperationState_OperationState_COMPLETE,
+		"error": bson.M{"$exists": true},
+		"lastUpdate": bson.M{
+			"$gte": opts.Since,
+		},
+	}, bson.D{{Key: "lastUpdate", Value: -1}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load failed operations: %w", err)
+	}
+
+	result.Lost, err = section(opts.LostLimit, bson.M{
+		"state": longrunningv1.OperationState_OperationState_LOST,
+	}, bson.D{{Key: "lastUpdate", Value: -1}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lost operations: %w", err)
+	}
+
+	result.Running, err = section(opts.RunningLimit, bson.M{
+		"state": longrunningv1.OperationState_OperationState_RUNNING,
+	}, bson.D{{Key: "priority", Value: -1}, {Key: "createTime", Value: 1}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load running operations: %w", err)
+	}
+
+	res, err := r.col.Aggregate(ctx, bson.A{
+		bson.M{
+			"$match": filter(bson.M{
+				"$or": bson.A{
+					bson.M{"state": bson.M{"$ne": longrunningv1.OperationState_OperationState_COMPLETE}},
+					bson.M{"lastUpdate": bson.M{"$gte": opts.Since}},
+				},
+			}),
+		},
+		bson.M{
+			"$group": bson.M{
+				"_id":   "$state",
+				"count": bson.M{"$sum": 1},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count operations: %w", err)
+	}
+
+	var counts []struct {
+		State longrunningv1.OperationState `bson:"_id"`
+		Count int64                        `bson:"count"`
+	}
+	if err := res.All(ctx, &counts); err != nil {
+		return nil, fmt.Errorf("failed to decode operation counts: %w", err)
+	}
+
+	for _, c := range counts {
+		result.StateCounts[c.State] = c.Count
+	}
+
+	return result, nil
+}
@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func (r *Repo) setupDedup(ctx context.Context) error {
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "kind", Value: 1},
+			{Key: "owner", Value: 1},
+			{Key: "fingerprint", Value: 1},
+			{Key: "createTime", Value: 1},
+		},
+		Options: options.Index().SetPartialFilterExpression(bson.M{
+			"fingerprint": bson.M{
+				"$exists": true,
+			},
+		}),
+	}); err != nil {
+		return fmt.Errorf("failed to create fingerprint index: %w", err)
+	}
+
+	return nil
+}
+
+// fingerprint returns a stable hash of params. The parameters are encoded as
+// JSON which sorts object keys so the hash does not depend on the order of the
+// parameters.
+func fingerprint(params map[string]*structpb.Value) (string, error) {
+	values := make(map[string]any, len(params))
+	for key, value := range params {
+		values[key] = value.AsInterface()
+	}
+
+	blob, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode parameters: %w", err)
+	}
+
+	sum := sha256.Sum256(blob)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// findDuplicate returns the oldest active operation of the same namespace,
+// kind, owner and parameters as model that has been created within the
+// window. If before is not nil, only operations with a smaller id are
+// considered. nil is returned if there is no duplicate.
+func (r *Repo) findDuplicate(ctx context.Context, model *Operation, within time.Duration, before *primitive.ObjectID) (*Operation, error) {
+	filter := bson.M{
+		"namespace":   model.Namespace,
+		"kind":        model.Kind,
+		"owner":       model.Owner,
+		"fingerprint": model.Fingerprint,
+		"state": bson.M{
+			"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+		},
+		"createTime": bson.M{
+			"$gte": model.CreateTime.Add(-within),
+		},
+	}
+
+	if before != nil {
+		filter["_id"] = bson.M{"$lt": *before}
+	}
+
+	res := r.col.FindOne(ctx, filter, options.FindOne().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"authToken": 0}))
+
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return &op, nil
+}
@@ -0,0 +1,230 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var ErrInvalidDependency = errors.New("invalid dependency")
+
+// parseDependencies parses and validates the dependencies of a new operation.
+// All dependencies must already exist. Since the id of an operation is only
+// generated during registration and dependencies cannot be changed afterwards,
+// this also rejects any dependency cycle, including self-references.
+func (r *Repo) parseDependencies(ctx context.Context, ids []string) ([]primitive.ObjectID, error) {
+	var oids []primitive.ObjectID
+
+	for _, id := range ids {
+		oid, err := parseID(id)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidDependency, err)
+		}
+
+		if !slices.Contains(oids, oid) {
+			oids = append(oids, oid)
+		}
+	}
+
+	count, err := r.col.CountDocuments(ctx, bson.M{
+		"_id": bson.M{
+			"$in": oids,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if int(count) != len(oids) {
+		return nil, fmt.Errorf("%w: unknown operation in %v", ErrInvalidDependency, ids)
+	}
+
+	return oids, nil
+}
+
+// EvaluateDependents evaluates the dependencies of all PENDING operations that
+// depend on the operation with the given id. It should be called whenever an
+// operation terminates and returns all operations that have been started or
+// completed, see EvaluateDependencies.
+func (r *Repo) EvaluateDependents(ctx context.Context, id string) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("EvaluateDependents", time.Now(), func() int { return len(ops) }, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.col.Find(ctx, bson.M{
+		"dependsOn": oid,
+		"state":     longrunningv1.OperationState_OperationState_PENDING,
+	}, options.Find().SetProjection(bson.M{"authToken": 0}))
+	if err != nil {
+		return nil, err
+	}
+
+	var models []Operation
+	if err := res.All(ctx, &models); err != nil {
+		return nil, fmt.Errorf("failed to decode operations: %w", err)
+	}
+
+	for idx := range models {
+		op, err := r.evaluateDependencies(ctx, &models[idx])
+		if err != nil {
+			slog.Error("failed to evaluate operation dependencies", "id", models[idx].ID.Hex(), "error", err)
+			continue
+		}
+
+		if op != nil {
+			ops = append(ops, op)
+		}
+	}
+
+	return ops, nil
+}
+
+// EvaluateDependencies checks the dependencies of the PENDING operation with
+// the given id. If all dependencies completed successfully the operation is
+// switched to RUNNING. If any dependency failed, has been lost or does not
+// exist anymore, the operation is completed with an error that references the
+// dependency. The updated operation is returned or nil if the operation is
+// still waiting for it's dependencies.
+func (r *Repo) EvaluateDependencies(ctx context.Context, id string) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("EvaluateDependencies", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := r.findOperation(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	if model.State != longrunningv1.OperationState_OperationState_PENDING {
+		return nil, nil
+	}
+
+	return r.evaluateDependencies(ctx, &model.Operation)
+}
+
+func (r *Repo) evaluateDependencies(ctx context.Context, model *Operation) (*longrunningv1.Operation, error) {
+	if len(model.DependsOn) == 0 {
+		return nil, nil
+	}
+
+	res, err := r.col.Find(ctx, bson.M{
+		"_id": bson.M{
+			"$in": model.DependsOn,
+		},
+	}, options.Find().SetProjection(bson.M{"_id": 1, "state": 1, "error": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var deps []Operation
+	if err := res.All(ctx, &deps); err != nil {
+		return nil, fmt.Errorf("failed to decode dependencies: %w", err)
+	}
+
+	failed := func(dep primitive.ObjectID, reason string) (*longrunningv1.Operation, error) {
+		return r.transitionPending(ctx, model.ID, bson.M{
+			"state":       longrunningv1.OperationState_OperationState_COMPLETE,
+			"percentDone": 100,
+			"error":       dependencyError(dep, reason),
+		})
+	}
+
+	waiting := false
+	for _, oid := range model.DependsOn {
+		idx := slices.IndexFunc(deps, func(dep Operation) bool { return dep.ID == oid })
+		if idx < 0 {
+			return failed(oid, "not found")
+		}
+
+		switch dep := deps[idx]; {
+		case dep.State == longrunningv1.OperationState_OperationState_LOST:
+			return failed(oid, "lost")
+
+		case dep.State == longrunningv1.OperationState_OperationState_COMPLETE && dep.Error != nil:
+			return failed(oid, "failed")
+
+		case dep.State != longrunningv1.OperationState_OperationState_COMPLETE:
+			waiting = true
+		}
+	}
+
+	if waiting {
+		return nil, nil
+	}
+
+	return r.transitionPending(ctx, model.ID, bson.M{
+		"state": longrunningv1.OperationState_OperationState_RUNNING,
+	})
+}
+
+// transitionPending applies updDoc to the operation with the given id if it is
+// still PENDING. Nil is returned if the operation has been changed in the
+// meantime.
+func (r *Repo) transitionPending(ctx context.Context, id primitive.ObjectID, updDoc bson.M) (*longrunningv1.Operation, error) {
+	updDoc["lastUpdate"] = time.Now()
+
+	res := r.col.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":   id,
+			"state": longrunningv1.OperationState_OperationState_PENDING,
+		},
+		stampLastUpdate(bson.M{"$set": updDoc}),
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"authToken": 0}),
+	)
+
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return op.toProto(nil, r.limits)
+}
+
+// dependencyError returns the error that is recorded for operations whose
+// dependency did not complete successfully. The id of the dependency is stored
+// in the "dependency" key of the error details.
+func dependencyError(dep primitive.ObjectID, reason string) Error {
+	res := Error{
+		Message: fmt.Sprintf("dependency %q %s", dep.Hex(), reason),
+	}
+
+	s, err := structpb.NewStruct(map[string]any{
+		"dependency": dep.Hex(),
+		"reason":     reason,
+	})
+	if err == nil {
+		res.Details, err = anypb.New(s)
+	}
+
+	if err != nil {
+		slog.Error("failed to encode dependency error details", "dependency", dep.Hex(), "error", err)
+	}
+
+	return res
+}
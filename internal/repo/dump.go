@@ -0,0 +1,103 @@
+package repo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDumpLineSize is the maximum size of a single line when importing a dump.
+const maxDumpLineSize = 64 << 20
+
+// ExportOperations writes all operations matching query and opts to w as
+// newline-delimited JSON. Each line holds the stored document of an operation
+// encoded as canonical MongoDB Extended JSON so all fields, including those
+// that are not part of the API definition, survive a round-trip through
+// ImportOperations. Auth tokens are only exported if includeAuthTokens is set.
+// The number of exported operations is returned.
+func (r *Repo) ExportOperations(ctx context.Context, w io.Writer, query *longrunningv1.QueryOperationsRequest, opts QueryOptions, includeAuthTokens bool) (count int, err error) {
+	defer r.observe("ExportOperations", time.Now(), func() int { return count }, &err)
+
+	cursor, err := r.col.Find(ctx, r.queryFilter(query, opts), options.Find().SetSort(bson.D{
+		{Key: "_id", Value: 1},
+	}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var op document
+		if err := cursor.Decode(&op); err != nil {
+			return count, fmt.Errorf("failed to decode operation: %w", err)
+		}
+
+		if !includeAuthTokens {
+			op.AuthToken = ""
+		}
+
+		blob, err := bson.MarshalExtJSON(op, true, false)
+		if err != nil {
+			return count, fmt.Errorf("failed to marshal operation with id %q: %w", op.ID.Hex(), err)
+		}
+
+		if _, err := w.Write(append(blob, '\n')); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, cursor.Err()
+}
+
+// ImportOperations reads a dump created by ExportOperations from rd and
+// upserts all operations by their ID. The number of imported operations is
+// returned.
+func (r *Repo) ImportOperations(ctx context.Context, rd io.Reader) (count int, err error) {
+	defer r.observe("ImportOperations", time.Now(), func() int { return count }, &err)
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, maxDumpLineSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		model, err := operationFromDump(scanner.Bytes())
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if _, err := r.col.ReplaceOne(ctx, bson.M{"_id": model.ID}, model, options.Replace().SetUpsert(true)); err != nil {
+			return count, fmt.Errorf("line %d: failed to store operation: %w", line, err)
+		}
+
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+func operationFromDump(line []byte) (*document, error) {
+	var model document
+	if err := bson.UnmarshalExtJSON(line, true, &model); err != nil {
+		return nil, fmt.Errorf("invalid operation: %w", err)
+	}
+
+	if model.ID.IsZero() {
+		return nil, fmt.Errorf("invalid operation: missing id")
+	}
+
+	return &model, nil
+}
@@ -0,0 +1,247 @@
+package repo
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var ErrInvalidDuration = errors.New("invalid duration")
+
+// DurationLimits holds the defaults and bounds for the TTL and grace period of
+// new operations. A zero minimum or maximum disables the respective bound.
+type DurationLimits struct {
+	// DefaultTTL, DefaultGracePeriod, DefaultPendingTimeout and
+	// DefaultMaxRuntime are used if a registration request does not specify
+	// the respective value and there's no matching entry in Kinds.
+	DefaultTTL            time.Duration
+	DefaultGracePeriod    time.Duration
+	DefaultPendingTimeout time.Duration
+	DefaultMaxRuntime     time.Duration
+
+	// Kinds holds per-kind defaults that take precedence over the global ones.
+	Kinds KindDefaults
+
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	MinGracePeriod time.Duration
+	MaxGracePeriod time.Duration
+
+	// Clamp adjusts values that are out of bounds to the nearest bound instead
+	// of rejecting them.
+	Clamp bool
+}
+
+// SetDurationLimits configures the default TTL and grace period of operations
+// that are registered without them, see DurationLimits.Defaults.
+func (r *Repo) SetDurationLimits(limits DurationLimits) {
+	r.durations = limits
+}
+
+// Defaults returns the effective defaults for operations of kind. Values that
+// are not configured for kind are taken from the global defaults. The Pattern
+// of the result is empty if no per-kind defaults matched.
+func (l DurationLimits) Defaults(kind string) KindDefault {
+	res, _ := l.Kinds.Lookup(kind)
+
+	if res.TTL == 0 {
+		res.TTL = l.DefaultTTL
+	}
+
+	if res.GracePeriod == 0 {
+		res.GracePeriod = l.DefaultGracePeriod
+	}
+
+	if res.PendingTimeout == 0 {
+		res.PendingTimeout = l.DefaultPendingTimeout
+	}
+
+	if res.MaxRuntime == 0 {
+		res.MaxRuntime = l.DefaultMaxRuntime
+	}
+
+	return res
+}
+
+// CheckRegistration validates the TTL and grace period of req against the
+// configured bounds. If Clamp is enabled, out of bound values are adjusted in
+// req instead. Negative durations are always rejected. The returned error
+// wraps ErrInvalidDuration and names the allowed range. An explicit TTL of
+// zero is not subject to the bounds since it disables the expiry, see
+// RegisterOptions.AllowNoExpiry.
+func (l DurationLimits) CheckRegistration(req *longrunningv1.RegisterOperationRequest) error {
+	var err error
+
+	if req.Ttl == nil || !req.Ttl.IsValid() || req.Ttl.AsDuration() != 0 {
+		req.Ttl, err = l.check("ttl", req.Ttl, l.MinTTL, l.MaxTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	req.GracePeriod, err = l.check("grace_period", req.GracePeriod, l.MinGracePeriod, l.MaxGracePeriod)
+
+	return err
+}
+
+func (l DurationLimits) check(field string, value *durationpb.Duration, min, max time.Duration) (*durationpb.Duration, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	if err := value.CheckValid(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidDuration, field, err)
+	}
+
+	d := value.AsDuration()
+	if d < 0 {
+		return nil, fmt.Errorf("%w: %s must not be negative", ErrInvalidDuration, field)
+	}
+
+	var bound time.Duration
+	switch {
+	case min > 0 && d < min:
+		bound = min
+	case max > 0 && d > max:
+		bound = max
+	default:
+		return value, nil
+	}
+
+	if l.Clamp {
+		return durationpb.New(bound), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s %s is out of range, allowed range is %s", ErrInvalidDuration, field, d, formatRange(min, max))
+}
+
+func formatRange(min, max time.Duration) string {
+	if max > 0 {
+		return fmt.Sprintf("[%s, %s]", min, max)
+	}
+
+	return fmt.Sprintf("[%s, unbounded]", min)
+}
+
+// KindDefault holds the defaults for operations whose kind matches Pattern.
+// Zero values are not configured and fall back to the global defaults.
+type KindDefault struct {
+	Pattern        string
+	TTL            time.Duration
+	GracePeriod    time.Duration
+	PendingTimeout time.Duration
+	MaxRuntime     time.Duration
+}
+
+// matches reports whether kind matches the pattern of d. Patterns are either
+// a kind or a prefix followed by "*", like "tkd.backup.v1/*".
+func (d KindDefault) matches(kind string) bool {
+	if prefix, ok := strings.CutSuffix(d.Pattern, "*"); ok {
+		return strings.HasPrefix(kind, prefix)
+	}
+
+	return d.Pattern == kind
+}
+
+// KindDefaults holds per-kind defaults ordered by specificity. It can be
+// decoded from a JSON object that maps kind patterns to their defaults:
+//
+//	{"tkd.notify.v1/*": {"ttl": "30s", "gracePeriod": "30s"}, "tkd.backup.v1/create": {"ttl": "1h", "pendingTimeout": "10m", "maxRuntime": "6h"}}
+type KindDefaults []KindDefault
+
+// Lookup returns the most specific defaults that match kind. Exact patterns
+// take precedence over prefix patterns and longer prefixes over shorter ones.
+func (k KindDefaults) Lookup(kind string) (KindDefault, bool) {
+	for _, d := range k {
+		if d.matches(kind) {
+			return d, true
+		}
+	}
+
+	return KindDefault{}, false
+}
+
+// EnvDecode implements envconfig.Decoder.
+func (k *KindDefaults) EnvDecode(val string) error {
+	if strings.TrimSpace(val) == "" {
+		*k = nil
+		return nil
+	}
+
+	var raw map[string]struct {
+		TTL            string `json:"ttl"`
+		GracePeriod    string `json:"gracePeriod"`
+		PendingTimeout string `json:"pendingTimeout"`
+		MaxRuntime     string `json:"maxRuntime"`
+	}
+
+	if err := json.Unmarshal([]byte(val), &raw); err != nil {
+		return fmt.Errorf("invalid kind defaults: %w", err)
+	}
+
+	parse := func(pattern, field, value string) (time.Duration, error) {
+		if value == "" {
+			return 0, nil
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid kind defaults: %s of %q: invalid duration %q", field, pattern, value)
+		}
+
+		return d, nil
+	}
+
+	result := make(KindDefaults, 0, len(raw))
+	for pattern, v := range raw {
+		if idx := strings.Index(pattern, "*"); pattern == "" || (idx >= 0 && idx != len(pattern)-1) {
+			return fmt.Errorf("invalid kind defaults: invalid pattern %q", pattern)
+		}
+
+		d := KindDefault{Pattern: pattern}
+
+		var err error
+		if d.TTL, err = parse(pattern, "ttl", v.TTL); err != nil {
+			return err
+		}
+
+		if d.GracePeriod, err = parse(pattern, "gracePeriod", v.GracePeriod); err != nil {
+			return err
+		}
+
+		if d.PendingTimeout, err = parse(pattern, "pendingTimeout", v.PendingTimeout); err != nil {
+			return err
+		}
+
+		if d.MaxRuntime, err = parse(pattern, "maxRuntime", v.MaxRuntime); err != nil {
+			return err
+		}
+
+		result = append(result, d)
+	}
+
+	slices.SortFunc(result, func(a, b KindDefault) int {
+		aPrefix, bPrefix := strings.HasSuffix(a.Pattern, "*"), strings.HasSuffix(b.Pattern, "*")
+
+		switch {
+		case aPrefix != bPrefix && !aPrefix:
+			return -1
+		case aPrefix != bPrefix:
+			return 1
+		}
+
+		// longer patterns are more specific
+		return cmp.Compare(len(b.Pattern), len(a.Pattern))
+	})
+
+	*k = result
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lease is a named lease that is held by at most one holder at a time, for
+// example to elect the instance that runs the manager.
+type Lease struct {
+	Name       string    `bson:"_id"`
+	Holder     string    `bson:"holder"`
+	AcquiredAt time.Time `bson:"acquiredAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+// AcquireLease acquires the lease with the given name for holder, or renews
+// it if holder already holds it, and reports whether holder is the holder
+// afterwards. The lease is held until ttl elapsed without a renewal or until
+// the holder releases it, see ReleaseLease. A lease that is held by someone
+// else is only taken over once it expired.
+//
+// Both the expiry and the takeover are evaluated using the clock of the
+// mongodb server so the clocks of the holders do not need to be in sync. The
+// expiry is never before the time the request has been sent plus ttl, so a
+// holder can safely assume to hold the lease until then.
+func (r *Repo) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (_ bool, err error) {
+	defer r.observe("AcquireLease", time.Now(), nil, &err)
+
+	if holder == "" {
+		return false, errors.New("missing lease holder")
+	}
+
+	if ttl < time.Millisecond {
+		return false, fmt.Errorf("lease ttl must be at least 1ms, got %s", ttl)
+	}
+
+	filter := bson.M{
+		"_id": name,
+		"$or": bson.A{
+			bson.M{"holder": holder},
+			bson.M{"$expr": bson.M{"$lte": bson.A{"$expiresAt", "$$NOW"}}},
+		},
+	}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			// keep the acquisition time on renewals.
+			"acquiredAt": bson.M{
+				"$cond": bson.A{
+					bson.M{"$eq": bson.A{"$holder", holder}},
+					"$acquiredAt",
+					"$$NOW",
+				},
+			},
+			"holder":    holder,
+			"expiresAt": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+		}}},
+	}
+
+	res, err := r.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		// the lease exists but is held by someone else.
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to acquire lease %q: %w", name, err)
+	}
+
+	return res.MatchedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+// ReleaseLease releases the lease with the given name if it is held by
+// holder so it can be acquired by others right away.
+func (r *Repo) ReleaseLease(ctx context.Context, name, holder string) (err error) {
+	defer r.observe("ReleaseLease", time.Now(), nil, &err)
+
+	if _, err := r.leases.DeleteOne(ctx, bson.M{"_id": name, "holder": holder}); err != nil {
+		return fmt.Errorf("failed to release lease %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// GetLease returns the lease with the given name. ErrNotFound is returned if
+// it has never been acquired or has been released. The lease may have
+// expired already.
+func (r *Repo) GetLease(ctx context.Context, name string) (_ *Lease, err error) {
+	defer r.observe("GetLease", time.Now(), nil, &err)
+
+	var lease Lease
+	if err := r.leases.FindOne(ctx, bson.M{"_id": name}).Decode(&lease); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("failed to get lease %q: %w", name, err)
+	}
+
+	return &lease, nil
+}
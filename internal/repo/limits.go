@@ -0,0 +1,257 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"unicode/utf8"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	ErrSizeLimitExceeded = errors.New("size limit exceeded")
+	ErrInvalidProgress   = errors.New("invalid progress")
+)
+
+// Limits holds size limits in bytes for operation parameters and annotations
+// as well as the limits for attachments. A zero value disables the respective
+// limit.
+type Limits struct {
+	// MaxParametersSize is the maximum serialized size of all parameters.
+	MaxParametersSize int
+
+	// MaxParameterValueSize is the maximum serialized size of a single parameter value.
+	MaxParameterValueSize int
+
+	// MaxAnnotationsSize is the maximum size of all annotation keys and values.
+	MaxAnnotationsSize int
+
+	// MaxAnnotationValueSize is the maximum size of a single annotation value.
+	MaxAnnotationValueSize int
+
+	// MaxAttachments is the maximum number of attachments per operation.
+	MaxAttachments int
+
+	// MaxAttachmentSize is the maximum size of an attachment that is stored
+	// inside the service.
+	MaxAttachmentSize int64
+
+	// MaxLinks is the maximum number of links per operation.
+	MaxLinks int
+
+	// MaxStatusMessageSize is the maximum size of the status message.
+	MaxStatusMessageSize int
+
+	// MaxResultSize is the maximum serialized size of the success or error
+	// value an operation is completed with.
+	MaxResultSize int
+
+	// StrictResultSize rejects results that exceed MaxResultSize instead of
+	// truncating them, see LimitResult.
+	StrictResultSize bool
+}
+
+// resultTruncationMarker replaces the omitted part of a truncated result
+// message. The verb is replaced by the number of omitted bytes.
+const resultTruncationMarker = "\n\n[... %d bytes truncated ...]\n\n"
+
+// resultMessageOverhead is the maximum number of bytes used to encode the tag
+// and length of the message field of a result.
+const resultMessageOverhead = 6
+
+// CheckParameters validates params against the configured limits. The returned
+// error wraps ErrSizeLimitExceeded and names the offending key.
+func (l Limits) CheckParameters(params map[string]*structpb.Value) error {
+	total := 0
+
+	for key, value := range params {
+		size := proto.Size(value)
+
+		if l.MaxParameterValueSize > 0 && size > l.MaxParameterValueSize {
+			return fmt.Errorf("%w: parameter %q has %d bytes, maximum is %d", ErrSizeLimitExceeded, key, size, l.MaxParameterValueSize)
+		}
+
+		total += len(key) + size
+
+		if l.MaxParametersSize > 0 && total > l.MaxParametersSize {
+			return fmt.Errorf("%w: parameters exceed the maximum total size of %d bytes at key %q", ErrSizeLimitExceeded, l.MaxParametersSize, key)
+		}
+	}
+
+	return nil
+}
+
+// CheckAnnotations validates annotations against the configured limits. The returned
+// error wraps ErrSizeLimitExceeded and names the offending key.
+func (l Limits) CheckAnnotations(annotations map[string]string) error {
+	total := 0
+
+	for key, value := range annotations {
+		if l.MaxAnnotationValueSize > 0 && len(value) > l.MaxAnnotationValueSize {
+			return fmt.Errorf("%w: annotation %q has %d bytes, maximum is %d", ErrSizeLimitExceeded, key, len(value), l.MaxAnnotationValueSize)
+		}
+
+		total += len(key) + len(value)
+
+		if l.MaxAnnotationsSize > 0 && total > l.MaxAnnotationsSize {
+			return fmt.Errorf("%w: annotations exceed the maximum total size of %d bytes at key %q", ErrSizeLimitExceeded, l.MaxAnnotationsSize, key)
+		}
+	}
+
+	return nil
+}
+
+// CheckProgress validates the percent_done and status_message of a
+// registration or update. percent must be between 0 and 100, oversized status
+// messages are rejected with ErrSizeLimitExceeded.
+func (l Limits) CheckProgress(percent int32, statusMessage string) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("%w: percent_done must be between 0 and 100, got %d", ErrInvalidProgress, percent)
+	}
+
+	if l.MaxStatusMessageSize > 0 && len(statusMessage) > l.MaxStatusMessageSize {
+		return fmt.Errorf("%w: status message has %d bytes, maximum is %d", ErrSizeLimitExceeded, len(statusMessage), l.MaxStatusMessageSize)
+	}
+
+	return nil
+}
+
+// LimitResult enforces MaxResultSize on the result of upd and returns the
+// original size of the result if it has been truncated, or zero otherwise.
+//
+// Oversized results are rejected with ErrSizeLimitExceeded if StrictResultSize
+// is set. Otherwise, the middle of the message is replaced by a truncation
+// marker so the beginning and end of the output are preserved. The result or
+// error details are dropped if they do not leave enough room for the marker.
+func (l Limits) LimitResult(upd *longrunningv1.CompleteOperationRequest) (int, error) {
+	var (
+		msg     proto.Message
+		message *string
+		details **anypb.Any
+	)
+
+	switch v := upd.Result.(type) {
+	case *longrunningv1.CompleteOperationRequest_Error:
+		msg, message, details = v.Error, &v.Error.Message, &v.Error.ErrorDetails
+
+	case *longrunningv1.CompleteOperationRequest_Success:
+		msg, message, details = v.Success, &v.Success.Message, &v.Success.Result
+
+	default:
+		return 0, nil
+	}
+
+	size := proto.Size(msg)
+	if l.MaxResultSize <= 0 || size <= l.MaxResultSize {
+		return 0, nil
+	}
+
+	if l.StrictResultSize {
+		return 0, fmt.Errorf("%w: result has %d bytes, maximum is %d", ErrSizeLimitExceeded, size, l.MaxResultSize)
+	}
+
+	original := *message
+	*message = ""
+
+	// the marker uses at most as many digits as the length of the original
+	// message.
+	markerSize := len(fmt.Sprintf(resultTruncationMarker, len(original)))
+
+	if proto.Size(msg)+resultMessageOverhead+markerSize > l.MaxResultSize {
+		*details = nil
+	}
+
+	keep := l.MaxResultSize - proto.Size(msg) - resultMessageOverhead - markerSize
+	if keep < 0 {
+		keep = 0
+	}
+
+	head := truncateString(original, keep/2)
+	tail := truncateStringHead(original[len(head):], keep-len(head))
+
+	*message = head + fmt.Sprintf(resultTruncationMarker, len(original)-len(head)-len(tail)) + tail
+
+	return size, nil
+}
+
+// truncateParameters drops parameter values that exceed the configured limits.
+// It is used when reading documents that have been stored before the limits
+// have been enforced so a single oversized document does not fail a whole query.
+func (l Limits) truncateParameters(id string, params map[string]*structpb.Value) {
+	total := 0
+
+	for key, value := range params {
+		size := proto.Size(value)
+
+		if (l.MaxParameterValueSize > 0 && size > l.MaxParameterValueSize) || (l.MaxParametersSize > 0 && total+len(key)+size > l.MaxParametersSize) {
+			slog.Warn("truncating oversized operation parameter", "id", id, "key", key, "size", size)
+
+			params[key] = structpb.NewStringValue(fmt.Sprintf("<truncated: %d bytes>", size))
+			continue
+		}
+
+		total += len(key) + size
+	}
+}
+
+// truncateAnnotations shortens annotation values that exceed the configured limits.
+// See truncateParameters for more information.
+func (l Limits) truncateAnnotations(id string, annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return annotations
+	}
+
+	result := make(map[string]string, len(annotations))
+	total := 0
+
+	for key, value := range annotations {
+		if l.MaxAnnotationValueSize > 0 && len(value) > l.MaxAnnotationValueSize {
+			slog.Warn("truncating oversized operation annotation", "id", id, "key", key, "size", len(value))
+
+			value = truncateString(value, l.MaxAnnotationValueSize)
+		}
+
+		if l.MaxAnnotationsSize > 0 && total+len(key)+len(value) > l.MaxAnnotationsSize {
+			slog.Warn("dropping operation annotation exceeding the total size limit", "id", id, "key", key)
+			continue
+		}
+
+		total += len(key) + len(value)
+		result[key] = value
+	}
+
+	return result
+}
+
+// truncateString truncates s to at most n bytes without splitting a
+// multi-byte character.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// truncateStringHead removes bytes from the beginning of s so at most n bytes
+// are left, without splitting a multi-byte character.
+func truncateStringHead(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	start := len(s) - n
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+
+	return s[start:]
+}
@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidLink = errors.New("invalid link")
+
+// Link references an external resource of an operation, like the dashboard
+// of the job or the location of a produced report.
+type Link struct {
+	Title string `bson:"title"`
+	URL   string `bson:"url"`
+
+	// Icon is an optional hint for user interfaces, like "grafana" or
+	// "ticket".
+	Icon string `bson:"icon,omitempty"`
+}
+
+// validateLink validates that link has a title and an absolute http or https
+// URL.
+func validateLink(link Link) error {
+	if strings.TrimSpace(link.Title) == "" {
+		return fmt.Errorf("%w: missing title", ErrInvalidLink)
+	}
+
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidLink, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q must be an absolute http or https URL", ErrInvalidLink, link.URL)
+	}
+
+	return nil
+}
+
+// CheckLinks validates links against the configured limits, see validateLink.
+func (l Limits) CheckLinks(links []Link) error {
+	if l.MaxLinks > 0 && len(links) > l.MaxLinks {
+		return fmt.Errorf("%w: operations may have at most %d links", ErrSizeLimitExceeded, l.MaxLinks)
+	}
+
+	for _, link := range links {
+		if err := validateLink(link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddLink appends link to the operation with the given id. Links may only be
+// added to active operations using the auth token of the operation.
+func (r *Repo) AddLink(ctx context.Context, id string, authToken string, link Link) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("AddLink", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateLink(link); err != nil {
+		return nil, err
+	}
+
+	model, err := r.findOperation(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := model.CanUpdate(authToken); err != nil {
+		return nil, err
+	}
+
+	// re-check the state and the number of links as part of the update so
+	// concurrent calls cannot exceed the limit.
+	filter := bson.M{
+		"_id": oid,
+		"state": bson.M{
+			"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+		},
+	}
+
+	if max := r.limits.MaxLinks; max > 0 {
+		filter[fmt.Sprintf("links.%d", max-1)] = bson.M{
+			"$exists": false,
+		}
+	}
+
+	res := r.col.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$push": bson.M{"links": link}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"authToken": 0}),
+	)
+
+	if err := res.Err(); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+
+		model, err := r.findOperation(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := model.checkActive(); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w: operation already has %d links", ErrSizeLimitExceeded, r.limits.MaxLinks)
+	}
+
+	var result Operation
+	if err := res.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return result.toProto(nil, r.limits)
+}
+
+// addLinksAnnotation adds the computed op.LinksAnnotation to pbop if the
+// operation has links.
+func addLinksAnnotation(pbop *longrunningv1.Operation, links []Link) {
+	if len(links) == 0 {
+		return
+	}
+
+	list := make([]op.Link, len(links))
+	for idx, l := range links {
+		list[idx] = op.Link{
+			Title: l.Title,
+			URL:   l.URL,
+			Icon:  l.Icon,
+		}
+	}
+
+	blob, err := json.Marshal(list)
+	if err != nil {
+		slog.Error("failed to encode links", "id", pbop.UniqueId, "error", err)
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.LinksAnnotation] = string(blob)
+}
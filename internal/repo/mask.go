@@ -0,0 +1,100 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrInvalidReadMask = errors.New("invalid read mask")
+
+// readMaskFields maps the supported field paths of longrunningv1.Operation
+// to the document fields that must be loaded.
+var readMaskFields = map[string][]string{
+	"unique_id":      {"_id"},
+	"create_time":    {"createTime"},
+	"owner":          {"owner"},
+	"creator":        {"creator"},
+	"state":          {"state"},
+	"ttl":            {"ttl"},
+	"grace_period":   {"gracePeriod"},
+	"description":    {"description"},
+	"result":         {"success", "error"},
+	"success":        {"success", "error"},
+	"error":          {"success", "error"},
+	"last_update":    {"lastUpdate"},
+	"parameters":     {"encodedParameters", "parameters"},
+	"annotations":    {"annotations", "cancelRequest", "externalRef", "dependsOn", "attachments", "progress", "lastUpdatedBy", "audit", "originalResultSize", "notes", "tags", "links", "visibleTo", "pausedAt", "noExpiry", "priority", "startTime", "scheduled", "template", "runtimeDeadline", "retry", "attempt", "rootId", "nextAttempt"},
+	"kind":           {"kind"},
+	"percent_done":   {"percentDone"},
+	"status_message": {"statusMessage"},
+}
+
+// ReadMask restricts the fields of an operation that are loaded from the
+// database and populated in the protobuf representation.
+// A nil ReadMask selects all fields.
+type ReadMask struct {
+	paths map[string]struct{}
+}
+
+// NewReadMask returns a new read mask for the field paths of longrunningv1.Operation.
+// If paths is empty, nil is returned which selects all fields.
+func NewReadMask(paths []string) (*ReadMask, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	m := &ReadMask{
+		paths: make(map[string]struct{}, len(paths)),
+	}
+
+	for _, p := range paths {
+		if _, ok := readMaskFields[p]; !ok {
+			return nil, fmt.Errorf("%w: unsupported field path %q", ErrInvalidReadMask, p)
+		}
+
+		// success and error are part of the result oneof and are always
+		// selected together.
+		if p == "success" || p == "error" {
+			p = "result"
+		}
+
+		m.paths[p] = struct{}{}
+	}
+
+	return m, nil
+}
+
+func (m *ReadMask) has(path string) bool {
+	if m == nil {
+		return true
+	}
+
+	_, ok := m.paths[path]
+
+	return ok
+}
+
+// projection returns the mongo projection document for m. _id and state are
+// always included while the auth token is never loaded.
+func (m *ReadMask) projection() bson.M {
+	if m == nil {
+		return bson.M{
+			"authToken": 0,
+		}
+	}
+
+	proj := bson.M{
+		"_id":   1,
+		"state": 1,
+	}
+
+	for p := range m.paths {
+		for _, field := range readMaskFields[p] {
+			proj[field] = 1
+		}
+	}
+
+	return proj
+}
@@ -0,0 +1,40 @@
+package repo
+
+import "time"
+
+// Metrics is used by the repository to record metrics about database calls.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveCall is invoked whenever a repository method returns. resultSize
+	// holds the number of operations returned or written by the call.
+	ObserveCall(method string, duration time.Duration, resultSize int, err error)
+}
+
+// SetMetrics configures where the repository reports metrics. A nil value
+// disables metrics.
+func (r *Repo) SetMetrics(m Metrics) {
+	r.metrics = m
+}
+
+// observe reports a call to method to the configured metrics. It is meant to be
+// deferred using the named results of the method:
+//
+//	defer r.observe("Method", time.Now(), func() int { return len(res) }, &err)
+//
+// If size is nil, a successful call is reported with a result size of one.
+func (r *Repo) observe(method string, start time.Time, size func() int, err *error) {
+	if r.metrics == nil {
+		return
+	}
+
+	n := 0
+	switch {
+	case *err != nil:
+	case size != nil:
+		n = size()
+	default:
+		n = 1
+	}
+
+	r.metrics.ObserveCall(method, time.Since(start), n, *err)
+}
@@ -1,11 +1,16 @@
 package repo
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -23,6 +28,9 @@ type Operation struct {
 	// LastUpdate holds the time at which the operation was last updated (i.e. pinged)
 	LastUpdate time.Time `bson:"lastUpdate"`
 
+	// Namespace is the namespace (i.e. tenant) the operation belongs to.
+	Namespace string `bson:"namespace"`
+
 	// Owner is the owner of the operation.
 	Owner string `bson:"owner"`
 
@@ -43,7 +51,12 @@ type Operation struct {
 	Description string `bson:"description"`
 
 	// Parameters holds additional parameters that were used to create the operation.
-	Parameters map[string]any `bson:"parameters"`
+	// Each value is encoded using protojson to preserve the structpb.Value kinds.
+	Parameters map[string]string `bson:"encodedParameters,omitempty"`
+
+	// LegacyParameters holds parameters of documents that have been created before
+	// parameters have been stored using their protojson encoding.
+	LegacyParameters map[string]any `bson:"parameters,omitempty"`
 
 	// Annotations holds service specific annotations for this operation.
 	Annotations map[string]string `bson:"annotations"`
@@ -59,10 +72,167 @@ type Operation struct {
 	Success *Success `bson:"success,omitempty"`
 	Error   *Error   `bson:"error,omitempty"`
 
-	AuthToken string `bson:"authToken"`
+	// OriginalResultSize holds the serialized size of the result the operation
+	// has been completed with if it has been truncated to the size limits.
+	OriginalResultSize int `bson:"originalResultSize,omitempty"`
 
 	PercentDone   int    `bson:"percentDone"`
 	StatusMessage string `bson:"statusMessage"`
+
+	// Progress holds the last percent_done updates of the operation which are
+	// used to estimate its completion time.
+	Progress []ProgressSample `bson:"progress,omitempty"`
+
+	// PendingTimeout holds the timeout after which the operation is considered
+	// lost if it is still in state PENDING. A zero value disables the timeout.
+	PendingTimeout time.Duration `bson:"pendingTimeout"`
+
+	// PendingDeadline is set to CreateTime + PendingTimeout if a pending timeout
+	// is configured.
+	PendingDeadline *time.Time `bson:"pendingDeadline,omitempty"`
+
+	// Fingerprint holds a hash of the parameters the operation has been
+	// registered with, see RegisterOptions.SuppressDuplicatesWithin.
+	Fingerprint string `bson:"fingerprint,omitempty"`
+
+	// ExternalRef holds the client supplied reference of the operation, if any.
+	// It is unique per kind for all operations that are neither COMPLETE nor
+	// LOST.
+	ExternalRef string `bson:"externalRef,omitempty"`
+
+	// DependsOn holds the ids of operations that must complete successfully
+	// before this operation is started.
+	DependsOn []primitive.ObjectID `bson:"dependsOn,omitempty"`
+
+	// Attachments holds artifacts that have been produced by the operation.
+	Attachments []Attachment `bson:"attachments,omitempty"`
+
+	// CancelRequest is set once cancellation of the operation has been requested.
+	CancelRequest *CancelRequest `bson:"cancelRequest,omitempty"`
+
+	// LastUpdatedBy holds the ID of the user that performed the last update,
+	// completion or resumption of the operation, if known.
+	LastUpdatedBy string `bson:"lastUpdatedBy,omitempty"`
+
+	// Audit holds the state transitions of the operation and all mutations
+	// that have been performed without the auth token.
+	Audit []AuditEntry `bson:"audit,omitempty"`
+
+	// Notes holds the most recent comments of users on the operation.
+	Notes []Note `bson:"notes,omitempty"`
+
+	// Tags holds the normalized labels of the operation, see NormalizeTags.
+	Tags []string `bson:"tags,omitempty"`
+
+	// Links holds references to external resources of the operation.
+	Links []Link `bson:"links,omitempty"`
+
+	// VisibleTo holds the IDs of the users that may see the operation in
+	// addition to the owner and the creator, see Viewer. If empty, the
+	// operation is visible to everyone.
+	VisibleTo []string `bson:"visibleTo,omitempty"`
+
+	// PausedAt is set while a RUNNING operation is paused, see
+	// UpdateOptions.Pause.
+	PausedAt *time.Time `bson:"pausedAt,omitempty"`
+
+	// NoExpiry is set for operations that have been registered with an
+	// explicit TTL of zero, see RegisterOptions.AllowNoExpiry. They are never
+	// marked as lost because of missing updates.
+	NoExpiry bool `bson:"noExpiry,omitempty"`
+
+	// Priority orders operations on the dashboard and in queries that sort
+	// by priority, see QueryOptions.SortByPriority. Higher values are more
+	// important.
+	Priority int `bson:"priority,omitempty"`
+
+	// StartTime is the time the operation has been scheduled for. Scheduled
+	// is set until the operation has been started at the start time and
+	// AutoStart records whether it is switched to RUNNING at that time.
+	StartTime *time.Time `bson:"startTime,omitempty"`
+	Scheduled bool       `bson:"scheduled,omitempty"`
+	AutoStart bool       `bson:"autoStart,omitempty"`
+
+	// Template is the id of the template the operation has been created
+	// from and Occurrence the scheduled time it has been created for, see
+	// MaterializeDueTemplates.
+	Template   *primitive.ObjectID `bson:"template,omitempty"`
+	Occurrence *time.Time          `bson:"occurrence,omitempty"`
+
+	// MaxRuntime is the maximum runtime of the operation. Once
+	// RuntimeDeadline passed, the operation is completed with an error
+	// independent of its heartbeats, see GetExceededOperations.
+	MaxRuntime      time.Duration `bson:"maxRuntime,omitempty"`
+	RuntimeDeadline *time.Time    `bson:"runtimeDeadline,omitempty"`
+
+	// Retry is the retry policy of the operation, see RetryOperation.
+	// Attempt is the 1-based attempt of the operation, RootID the id of the
+	// first attempt and NextAttempt the id of the successor, if any.
+	// RetryPending is set together with the LOST state if attempts are left
+	// and cleared once the successor has been registered.
+	Retry        *RetryPolicy        `bson:"retry,omitempty"`
+	Attempt      int                 `bson:"attempt,omitempty"`
+	RootID       *primitive.ObjectID `bson:"rootId,omitempty"`
+	NextAttempt  *primitive.ObjectID `bson:"nextAttempt,omitempty"`
+	RetryPending bool                `bson:"retryPending,omitempty"`
+}
+
+type AuditEntry struct {
+	// Time holds the time of the mutation.
+	Time time.Time `bson:"time"`
+
+	// Actor holds the ID of the user that performed the mutation.
+	Actor string `bson:"actor"`
+
+	// Action describes the mutation, like "update" or "complete".
+	Action string `bson:"action"`
+
+	// Reason describes why the mutation has been authorized, like
+	// "auth-token", "owner" or "admin".
+	Reason string `bson:"reason"`
+
+	// State holds the state the operation transitioned to, if the mutation
+	// changed the state.
+	State longrunningv1.OperationState `bson:"state,omitempty"`
+}
+
+// document is the stored representation of an operation. It adds the fields
+// that must never leave the repository to the Operation read model. Only
+// Operation can be converted to it's protobuf representation so secrets like
+// the auth token cannot be returned by accident.
+type document struct {
+	Operation `bson:",inline"`
+
+	AuthToken string `bson:"authToken"`
+}
+
+type Attachment struct {
+	// Name is the name of the attachment and unique per operation.
+	Name string `bson:"name"`
+
+	// MediaType holds the media type of the attachment.
+	MediaType string `bson:"mediaType"`
+
+	// Size holds the size of the attachment in bytes, if known.
+	Size int64 `bson:"size"`
+
+	// URL is set for attachments that are stored outside of the service.
+	URL string `bson:"url,omitempty"`
+
+	// BlobID references the content of attachments that are stored inside the
+	// service.
+	BlobID *primitive.ObjectID `bson:"blobId,omitempty"`
+
+	// CreateTime holds the time the attachment has been added.
+	CreateTime time.Time `bson:"createTime"`
+}
+
+type CancelRequest struct {
+	// Requester holds the ID of the user that requested cancellation, if known.
+	Requester string `bson:"requester"`
+
+	// Time holds the time at which cancellation has been requested.
+	Time time.Time `bson:"time"`
 }
 
 type Success struct {
@@ -76,36 +246,96 @@ type Error struct {
 }
 
 func (op *Operation) ToProto() (*longrunningv1.Operation, error) {
+	return op.toProto(nil, Limits{})
+}
+
+func (op *Operation) toProto(mask *ReadMask, limits Limits) (*longrunningv1.Operation, error) {
+	// unique_id and state are always populated, independent of the read mask.
 	pbop := &longrunningv1.Operation{
-		UniqueId:      op.ID.Hex(),
-		CreateTime:    timestamppb.New(op.CreateTime),
-		Owner:         op.Owner,
-		Creator:       op.Creator,
-		State:         op.State,
-		Ttl:           durationpb.New(op.Ttl),
-		GracePeriod:   durationpb.New(op.GracePeriod),
-		Description:   op.Description,
-		LastUpdate:    timestamppb.New(op.LastUpdate),
-		Annotations:   op.Annotations,
-		Kind:          op.Kind,
-		StatusMessage: op.StatusMessage,
-		PercentDone:   int32(op.PercentDone),
-	}
-
-	if len(op.Parameters) > 0 {
+		UniqueId: op.ID.Hex(),
+		State:    op.State,
+	}
+
+	if mask.has("create_time") {
+		pbop.CreateTime = timestamppb.New(op.CreateTime)
+	}
+	if mask.has("owner") {
+		pbop.Owner = op.Owner
+	}
+	if mask.has("creator") {
+		pbop.Creator = op.Creator
+	}
+	if mask.has("ttl") {
+		pbop.Ttl = durationpb.New(op.Ttl)
+	}
+	if mask.has("grace_period") {
+		pbop.GracePeriod = durationpb.New(op.GracePeriod)
+	}
+	if mask.has("description") {
+		pbop.Description = op.Description
+	}
+	if mask.has("last_update") {
+		pbop.LastUpdate = timestamppb.New(op.LastUpdate)
+	}
+	if mask.has("annotations") {
+		pbop.Annotations = limits.truncateAnnotations(pbop.UniqueId, op.Annotations)
+		addCancelAnnotations(pbop, op.CancelRequest)
+		addExternalRefAnnotation(pbop, op.ExternalRef)
+		addDependsOnAnnotation(pbop, op.DependsOn)
+		addAttachmentsAnnotation(pbop, op.Attachments)
+		addEstimatedCompletionAnnotation(pbop, op.Progress)
+		addAuditAnnotations(pbop, op.LastUpdatedBy, op.Audit)
+		addResultSizeAnnotation(pbop, op.OriginalResultSize)
+		addNotesAnnotation(pbop, op.Notes)
+		addTagsAnnotation(pbop, op.Tags)
+		addLinksAnnotation(pbop, op.Links)
+		addVisibleToAnnotation(pbop, op.VisibleTo)
+		addPausedAnnotation(pbop, op.PausedAt)
+		addNoExpiryAnnotation(pbop, op.NoExpiry)
+		addPriorityAnnotation(pbop, op.Priority)
+		addScheduleAnnotations(pbop, op.StartTime, op.Scheduled)
+		addTemplateAnnotation(pbop, op.Template)
+		addRuntimeAnnotations(pbop, op.RuntimeDeadline, time.Now())
+		addRetryAnnotations(pbop, op.Retry, op.Attempt, op.RootID, op.NextAttempt)
+	}
+	if mask.has("kind") {
+		pbop.Kind = op.Kind
+	}
+	if mask.has("status_message") {
+		pbop.StatusMessage = op.StatusMessage
+	}
+	if mask.has("percent_done") {
+		pbop.PercentDone = int32(op.PercentDone)
+	}
+
+	if (len(op.Parameters) > 0 || len(op.LegacyParameters) > 0) && mask.has("parameters") {
 		pbop.Parameters = make(map[string]*structpb.Value)
 
-		for key, val := range op.Parameters {
-			pb, err := structpb.NewValue(val)
+		for key, val := range op.LegacyParameters {
+			pb, err := valueFromBSON(val)
 			if err != nil {
 				return nil, fmt.Errorf("failed to convert parameter value to structpb.Value: key=%q, error=%w", key, err)
 			}
 
 			pbop.Parameters[key] = pb
 		}
+
+		for key, blob := range op.Parameters {
+			pb, err := decodeParameter(key, blob)
+			if err != nil {
+				return nil, err
+			}
+
+			pbop.Parameters[key] = pb
+		}
+
+		limits.truncateParameters(pbop.UniqueId, pbop.Parameters)
 	}
 
 	switch {
+	case !mask.has("result"):
+		// result has not been requested
+
 	case op.Success != nil && op.Error != nil:
 		return nil, fmt.Errorf("operation has success and error value")
 
@@ -129,52 +359,364 @@ func (op *Operation) ToProto() (*longrunningv1.Operation, error) {
 	return pbop, nil
 }
 
-func operationFromRegistrationRequest(op *longrunningv1.RegisterOperationRequest) (*Operation, error) {
-	ttl := time.Minute * 5
+// deduplicated returns the registration response for a registration that has
+// been suppressed as a duplicate of op. The response never holds an auth token.
+func (op *Operation) deduplicated(limits Limits) (*longrunningv1.RegisterOperationResponse, error) {
+	pb, err := op.toProto(nil, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	return &longrunningv1.RegisterOperationResponse{
+		Operation: pb,
+	}, nil
+}
+
+func operationFromRegistrationRequest(op *longrunningv1.RegisterOperationRequest, opts RegisterOptions, durations DurationLimits) (*Operation, error) {
+	defaults := durations.Defaults(op.Kind)
+
+	// an explicit zero TTL disables the expiry while an absent one falls
+	// back to the default.
+	ttl := defaults.TTL
+	noExpiry := false
 	if op.Ttl.IsValid() {
 		ttl = op.Ttl.AsDuration()
+
+		if ttl == 0 {
+			if !opts.AllowNoExpiry {
+				return nil, fmt.Errorf("%w: ttl must not be zero unless operations without expiry are allowed", ErrInvalidDuration)
+			}
+
+			noExpiry = true
+		}
 	}
 
-	grace := time.Minute * 5
+	grace := defaults.GracePeriod
 	if op.GracePeriod.IsValid() {
 		grace = op.GracePeriod.AsDuration()
 	}
 
-	params := make(map[string]any, len(op.Parameters))
-	for key, value := range op.Parameters {
-		params[key] = value.AsInterface()
+	params, err := encodeParameters(op.Parameters)
+	if err != nil {
+		return nil, err
 	}
 
+	// mongo only stores timestamps with millisecond precision
+	now := time.Now().Truncate(time.Millisecond)
+
 	o := &Operation{
-		Owner:       op.Owner,
-		Creator:     op.Creator,
-		Ttl:         ttl,
-		GracePeriod: grace,
-		Description: op.Description,
-		Parameters:  params,
-		Kind:        op.Kind,
-		State:       op.InitialState,
-		CreateTime:  time.Now(),
-		LastUpdate:  time.Now(),
-		Annotations: op.Annotations,
+		Owner:          op.Owner,
+		Creator:        op.Creator,
+		Ttl:            ttl,
+		NoExpiry:       noExpiry,
+		GracePeriod:    grace,
+		Description:    op.Description,
+		Parameters:     params,
+		Kind:           op.Kind,
+		State:          op.InitialState,
+		CreateTime:     now,
+		LastUpdate:     now,
+		Annotations:    op.Annotations,
+		PendingTimeout: opts.PendingTimeout,
+		Namespace:      opts.Namespace,
+		ExternalRef:    opts.ExternalRef,
+		Links:          opts.Links,
+		VisibleTo:      opts.VisibleTo,
+		PercentDone:    opts.PercentDone,
+		StatusMessage:  opts.StatusMessage,
+		Priority:       opts.Priority,
+		Retry:          opts.Retry,
+	}
+
+	if opts.Retry != nil {
+		o.Attempt = 1
+	}
+
+	// the initial progress is the first sample for the estimated completion.
+	if opts.PercentDone > 0 {
+		o.Progress = []ProgressSample{
+			{Time: now, PercentDone: opts.PercentDone},
+		}
+	}
+
+	if opts.PendingTimeout > 0 {
+		deadline := now.Add(opts.PendingTimeout)
+		o.PendingDeadline = &deadline
+	}
+
+	applySchedule(o, opts.StartTime, now)
+
+	// the runtime of scheduled operations starts at their start time.
+	o.MaxRuntime = opts.MaxRuntime
+	if o.Scheduled {
+		o.RuntimeDeadline = runtimeDeadline(*o.StartTime, opts.MaxRuntime)
+	} else {
+		o.RuntimeDeadline = runtimeDeadline(now, opts.MaxRuntime)
+	}
+
+	if opts.occurrence != nil {
+		o.Template = &opts.occurrence.template
+		o.Occurrence = &opts.occurrence.time
 	}
 
 	return o, nil
 }
 
+// addLostInAnnotation adds the computed op.LostInAnnotation to RUNNING operations.
+// The annotation is only added if the annotations and all fields required to
+// calculate the deadline have been loaded.
+func addLostInAnnotation(pbop *longrunningv1.Operation, now time.Time) {
+	if pbop.State != longrunningv1.OperationState_OperationState_RUNNING {
+		return
+	}
+
+	if pbop.LastUpdate == nil || pbop.Ttl == nil || pbop.GracePeriod == nil {
+		return
+	}
+
+	// paused operations and those without expiry are not checked for TTL
+	// expiry.
+	if _, ok := pbop.Annotations[op.PausedAtAnnotation]; ok {
+		return
+	}
+
+	if _, ok := pbop.Annotations[op.NoExpiryAnnotation]; ok {
+		return
+	}
+
+	deadline := pbop.LastUpdate.AsTime().Add(pbop.Ttl.AsDuration() + pbop.GracePeriod.AsDuration())
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.LostInAnnotation] = deadline.Sub(now).Round(time.Second).String()
+}
+
+// addNoExpiryAnnotation adds the computed op.NoExpiryAnnotation to operations
+// that never expire.
+func addNoExpiryAnnotation(pbop *longrunningv1.Operation, noExpiry bool) {
+	if !noExpiry {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.NoExpiryAnnotation] = "true"
+}
+
+// addCancelAnnotations adds the computed cancel-requested annotations to pbop
+// if cancellation has been requested.
+func addCancelAnnotations(pbop *longrunningv1.Operation, req *CancelRequest) {
+	if req == nil {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.CancelRequestedAnnotation] = "true"
+	pbop.Annotations[op.CancelRequestedAtAnnotation] = req.Time.Format(time.RFC3339)
+
+	if req.Requester != "" {
+		pbop.Annotations[op.CancelRequestedByAnnotation] = req.Requester
+	}
+}
+
+// addExternalRefAnnotation adds the computed op.ExternalRefAnnotation to pbop
+// if ref is set.
+func addExternalRefAnnotation(pbop *longrunningv1.Operation, ref string) {
+	if ref == "" {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.ExternalRefAnnotation] = ref
+}
+
+// addDependsOnAnnotation adds the computed op.DependsOnAnnotation to pbop if the
+// operation has dependencies.
+func addDependsOnAnnotation(pbop *longrunningv1.Operation, deps []primitive.ObjectID) {
+	if len(deps) == 0 {
+		return
+	}
+
+	ids := make([]string, len(deps))
+	for idx, dep := range deps {
+		ids[idx] = dep.Hex()
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.DependsOnAnnotation] = strings.Join(ids, ",")
+}
+
+// addAttachmentsAnnotation adds the computed op.AttachmentsAnnotation to pbop
+// if the operation has attachments.
+func addAttachmentsAnnotation(pbop *longrunningv1.Operation, attachments []Attachment) {
+	if len(attachments) == 0 {
+		return
+	}
+
+	list := make([]op.AttachmentInfo, len(attachments))
+	for idx, a := range attachments {
+		list[idx] = op.AttachmentInfo{
+			Name:       a.Name,
+			MediaType:  a.MediaType,
+			Size:       a.Size,
+			URL:        a.URL,
+			CreateTime: a.CreateTime,
+		}
+	}
+
+	blob, err := json.Marshal(list)
+	if err != nil {
+		slog.Error("failed to encode attachments", "id", pbop.UniqueId, "error", err)
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.AttachmentsAnnotation] = string(blob)
+}
+
 var (
 	ErrInvalidAuthToken   = errors.New("invalid auth_token")
 	ErrOperationCompleted = errors.New("operation already completed")
+	ErrOperationLost      = errors.New("operation has been lost")
+	ErrNotLost            = errors.New("operation is not lost")
 )
 
-func (op Operation) CanUpdate(authToken string) error {
+// CanUpdate validates authToken and that the operation has neither been
+// completed nor lost.
+func (op document) CanUpdate(authToken string) error {
 	if op.AuthToken != authToken {
 		return ErrInvalidAuthToken
 	}
 
-	if op.State == longrunningv1.OperationState_OperationState_COMPLETE {
+	return op.checkActive()
+}
+
+// checkActive returns ErrOperationCompleted or ErrOperationLost if the
+// operation reached the respective terminal state.
+func (op document) checkActive() error {
+	switch op.State {
+	case longrunningv1.OperationState_OperationState_COMPLETE:
 		return ErrOperationCompleted
+	case longrunningv1.OperationState_OperationState_LOST:
+		return ErrOperationLost
 	}
 
 	return nil
 }
+
+// authorize validates that the operation may be mutated and returns the audit
+// entry for action. If authToken is empty the mutation is authorized using the
+// trusted identity in opts.
+func (op document) authorize(authToken string, opts UpdateOptions, action string) (*AuditEntry, error) {
+	if authToken != "" || (opts.Identity == "" && !opts.Admin) {
+		if err := op.CanUpdate(authToken); err != nil {
+			return nil, err
+		}
+
+		return &AuditEntry{
+			Time:   time.Now(),
+			Actor:  opts.Identity,
+			Action: action,
+			Reason: "auth-token",
+		}, nil
+	}
+
+	if err := op.checkActive(); err != nil {
+		return nil, err
+	}
+
+	return op.authorizeIdentity(opts, action)
+}
+
+// authorizeIdentity authorizes a mutation using the trusted identity in opts,
+// independent of the operation state, and returns the audit entry for action.
+func (op document) authorizeIdentity(opts UpdateOptions, action string) (*AuditEntry, error) {
+	var reason string
+	switch {
+	case opts.Identity != "" && opts.Identity == op.Owner:
+		reason = "owner"
+	case opts.Admin:
+		reason = "admin"
+	default:
+		return nil, ErrInvalidAuthToken
+	}
+
+	return &AuditEntry{
+		Time:   time.Now(),
+		Actor:  opts.Identity,
+		Action: action,
+		Reason: reason,
+	}, nil
+}
+
+// addAuditAnnotations adds the computed op.LastUpdatedByAnnotation and
+// op.AuditAnnotation to pbop.
+func addAuditAnnotations(pbop *longrunningv1.Operation, lastUpdatedBy string, audit []AuditEntry) {
+	if lastUpdatedBy == "" && len(audit) == 0 {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	if lastUpdatedBy != "" {
+		pbop.Annotations[op.LastUpdatedByAnnotation] = lastUpdatedBy
+	}
+
+	if len(audit) == 0 {
+		return
+	}
+
+	list := make([]op.AuditEntry, len(audit))
+	for idx, e := range audit {
+		list[idx] = op.AuditEntry{
+			Time:   e.Time,
+			Actor:  e.Actor,
+			Action: e.Action,
+			Reason: e.Reason,
+		}
+
+		if e.State != longrunningv1.OperationState_OperationState_UNSPECIFIED {
+			list[idx].State = e.State.String()
+		}
+	}
+
+	blob, err := json.Marshal(list)
+	if err != nil {
+		slog.Error("failed to encode audit log", "id", pbop.UniqueId, "error", err)
+		return
+	}
+
+	pbop.Annotations[op.AuditAnnotation] = string(blob)
+}
+
+// addResultSizeAnnotation adds the computed op.ResultOriginalSizeAnnotation to
+// pbop if the result has been truncated.
+func addResultSizeAnnotation(pbop *longrunningv1.Operation, size int) {
+	if size <= 0 {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.ResultOriginalSizeAnnotation] = strconv.Itoa(size)
+}
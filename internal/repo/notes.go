@@ -0,0 +1,110 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrInvalidNote = errors.New("invalid note")
+
+const (
+	// maxNotes is the number of notes that are kept per operation. Older
+	// notes are dropped once the limit is reached.
+	maxNotes = 50
+
+	// maxNoteSize is the maximum size of the text of a note in bytes.
+	maxNoteSize = 4096
+)
+
+// Note is a free text comment that has been added to an operation by a
+// user, like "customer called, don't retry".
+type Note struct {
+	Time   time.Time `bson:"time"`
+	Author string    `bson:"author"`
+	Text   string    `bson:"text"`
+}
+
+// AddNote appends a note with the given text to the operation. Notes may be
+// added independent of the state of the operation, only the last maxNotes
+// notes are kept. ErrNotFound is returned if the operation is not visible to
+// viewer.
+func (r *Repo) AddNote(ctx context.Context, uniqueId string, author string, text string, viewer *Viewer) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("AddNote", time.Now(), nil, &err)
+
+	id, err := parseID(uniqueId)
+	if err != nil {
+		return nil, err
+	}
+
+	text = strings.TrimSpace(text)
+
+	switch {
+	case author == "":
+		return nil, fmt.Errorf("%w: missing author", ErrInvalidNote)
+	case text == "":
+		return nil, fmt.Errorf("%w: missing text", ErrInvalidNote)
+	case len(text) > maxNoteSize:
+		return nil, fmt.Errorf("%w: note has %d bytes, maximum is %d", ErrSizeLimitExceeded, len(text), maxNoteSize)
+	}
+
+	filter := bson.M{"_id": id}
+	addVisibilityFilter(filter, viewer)
+
+	result, err := r.findAndApplyFilteredUpdate(ctx, filter, bson.M{
+		"$push": bson.M{
+			"notes": bson.M{
+				"$each": []Note{
+					{Time: time.Now(), Author: author, Text: text},
+				},
+				"$slice": -maxNotes,
+			},
+		},
+	})
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return result.toProto(nil, r.limits)
+}
+
+// addNotesAnnotation adds the computed op.NotesAnnotation to pbop.
+func addNotesAnnotation(pbop *longrunningv1.Operation, notes []Note) {
+	if len(notes) == 0 {
+		return
+	}
+
+	list := make([]op.Note, len(notes))
+	for idx, n := range notes {
+		list[idx] = op.Note{
+			Time:   n.Time,
+			Author: n.Author,
+			Text:   n.Text,
+		}
+	}
+
+	blob, err := json.Marshal(list)
+	if err != nil {
+		slog.Error("failed to encode notes", "id", pbop.UniqueId, "error", err)
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.NotesAnnotation] = string(blob)
+}
@@ -0,0 +1,235 @@
+package repo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// outboxRetention is how long delivered events are kept in the outbox before
+// they are removed by mongodb.
+const outboxRetention = 24 * time.Hour
+
+// OutboxEntry is an event that is waiting to be published to the
+// events-service.
+type OutboxEntry struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	CreateTime time.Time          `bson:"createTime"`
+	Event      *anypb.Any         `bson:"event"`
+
+	// Delivered is set once the event has been published. DeliveredAt is used
+	// to expire delivered events.
+	Delivered   bool       `bson:"delivered"`
+	DeliveredAt *time.Time `bson:"deliveredAt,omitempty"`
+
+	// Attempts holds the number of failed delivery attempts and LastError the
+	// error of the last one.
+	Attempts  int    `bson:"attempts"`
+	LastError string `bson:"lastError,omitempty"`
+
+	// LockedUntil is the time until the event is claimed by a publisher or
+	// delayed after a failed delivery. ClaimToken identifies the claim.
+	LockedUntil time.Time `bson:"lockedUntil"`
+	ClaimToken  string    `bson:"claimToken,omitempty"`
+}
+
+func (r *Repo) setupOutbox(ctx context.Context) error {
+	if _, err := r.outbox.Indexes().CreateMany(ctx, outboxIndexes()); err != nil {
+		return fmt.Errorf("failed to create outbox indexes: %w", err)
+	}
+
+	return nil
+}
+
+// outboxIndexes returns the indexes required by claimEntries and for expiring
+// delivered entries.
+func outboxIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "delivered", Value: 1},
+				{Key: "_id", Value: 1},
+			},
+		},
+		{
+			Keys:    bson.D{{Key: "deliveredAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+		},
+	}
+}
+
+// EnqueueEvents stores events in the outbox so they are published by
+// ClaimEvents callers, even if the service is restarted in the meantime.
+// Events are claimed in the order they have been enqueued.
+func (r *Repo) EnqueueEvents(ctx context.Context, events []*anypb.Any) (err error) {
+	defer r.observe("EnqueueEvents", time.Now(), func() int { return len(events) }, &err)
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+
+	entries := make([]any, len(events))
+	for idx, evt := range events {
+		entries[idx] = OutboxEntry{
+			ID:          primitive.NewObjectID(),
+			CreateTime:  now,
+			Event:       evt,
+			LockedUntil: now,
+		}
+	}
+
+	if _, err := r.outbox.InsertMany(ctx, entries); err != nil {
+		return fmt.Errorf("failed to store events: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimEvents claims up to limit undelivered events for lease so they are not
+// published by other service instances at the same time. Events of publishers
+// that crashed or failed to report the delivery are claimed again once their
+// lease expired. Events are returned in the order they have been enqueued.
+func (r *Repo) ClaimEvents(ctx context.Context, limit int, lease time.Duration) (entries []OutboxEntry, err error) {
+	defer r.observe("ClaimEvents", time.Now(), func() int { return len(entries) }, &err)
+
+	return claimEntries[OutboxEntry](ctx, r.outbox, limit, lease)
+}
+
+// MarkEventDelivered marks the outbox entry with the given id as delivered.
+func (r *Repo) MarkEventDelivered(ctx context.Context, id primitive.ObjectID) (err error) {
+	defer r.observe("MarkEventDelivered", time.Now(), nil, &err)
+
+	return markEntryDelivered(ctx, r.outbox, id)
+}
+
+// MarkEventFailed records a failed delivery of the outbox entry with the given
+// id. The entry is not claimed again before retryAt.
+func (r *Repo) MarkEventFailed(ctx context.Context, id primitive.ObjectID, deliveryErr error, retryAt time.Time) (err error) {
+	defer r.observe("MarkEventFailed", time.Now(), nil, &err)
+
+	return markEntryFailed(ctx, r.outbox, id, deliveryErr, retryAt)
+}
+
+// claimEntries claims up to limit undelivered entries of col for lease, see
+// ClaimEvents. The documents of col must have the delivered, lockedUntil and
+// claimToken fields of OutboxEntry.
+func claimEntries[T any](ctx context.Context, col *mongo.Collection, limit int, lease time.Duration) ([]T, error) {
+	now := time.Now()
+
+	available := bson.M{
+		"delivered": false,
+		"lockedUntil": bson.M{
+			"$lte": now,
+		},
+	}
+
+	res, err := col.Find(ctx, available, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := res.All(ctx, &candidates); err != nil {
+		return nil, fmt.Errorf("failed to decode %s entries: %w", col.Name(), err)
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(candidates))
+	for idx, c := range candidates {
+		ids[idx] = c.ID
+	}
+
+	var tokenBytes [16]byte
+	if _, err := rand.Read(tokenBytes[:]); err != nil {
+		return nil, err
+	}
+
+	token := hex.EncodeToString(tokenBytes[:])
+
+	// another publisher might have claimed some of the candidates in the
+	// meantime so only those that are still available are claimed.
+	available["_id"] = bson.M{"$in": ids}
+
+	if _, err := col.UpdateMany(ctx, available, bson.M{
+		"$set": bson.M{
+			"lockedUntil": now.Add(lease),
+			"claimToken":  token,
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to claim %s entries: %w", col.Name(), err)
+	}
+
+	res, err = col.Find(ctx, bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+		"claimToken": token,
+	}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []T
+	if err := res.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode %s entries: %w", col.Name(), err)
+	}
+
+	return entries, nil
+}
+
+func markEntryDelivered(ctx context.Context, col *mongo.Collection, id primitive.ObjectID) error {
+	_, err := col.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{
+			"delivered":   true,
+			"deliveredAt": time.Now(),
+		},
+		"$unset": bson.M{
+			"claimToken": "",
+		},
+	})
+
+	return err
+}
+
+func markEntryFailed(ctx context.Context, col *mongo.Collection, id primitive.ObjectID, deliveryErr error, retryAt time.Time) error {
+	_, err := col.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{
+			"lastError":   deliveryErr.Error(),
+			"lockedUntil": retryAt,
+		},
+		"$inc": bson.M{
+			"attempts": 1,
+		},
+		"$unset": bson.M{
+			"claimToken": "",
+		},
+	})
+
+	return err
+}
+
+// CountPendingEvents returns the number of events in the outbox that have not
+// been delivered yet.
+func (r *Repo) CountPendingEvents(ctx context.Context) (_ int64, err error) {
+	defer r.observe("CountPendingEvents", time.Now(), nil, &err)
+
+	return r.outbox.CountDocuments(ctx, bson.M{"delivered": false})
+}
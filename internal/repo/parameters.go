@@ -0,0 +1,98 @@
+package repo
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// encodeParameters encodes each parameter value using protojson so the
+// exact structpb.Value kinds survive the round-trip through mongo.
+func encodeParameters(params map[string]*structpb.Value) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	result := make(map[string]string, len(params))
+
+	for key, value := range params {
+		if value == nil {
+			value = structpb.NewNullValue()
+		}
+
+		blob, err := protojson.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode parameter %q: %w", key, err)
+		}
+
+		result[key] = string(blob)
+	}
+
+	return result, nil
+}
+
+func decodeParameter(key string, blob string) (*structpb.Value, error) {
+	var value structpb.Value
+
+	if err := protojson.Unmarshal([]byte(blob), &value); err != nil {
+		return nil, fmt.Errorf("failed to decode parameter value: key=%q, error=%w", key, err)
+	}
+
+	return &value, nil
+}
+
+// valueFromBSON converts a parameter value of a legacy document, that stored
+// parameters using their native representation, to a structpb.Value.
+func valueFromBSON(val any) (*structpb.Value, error) {
+	switch v := val.(type) {
+	case primitive.A:
+		list := &structpb.ListValue{
+			Values: make([]*structpb.Value, len(v)),
+		}
+
+		for idx, elem := range v {
+			pb, err := valueFromBSON(elem)
+			if err != nil {
+				return nil, err
+			}
+
+			list.Values[idx] = pb
+		}
+
+		return structpb.NewListValue(list), nil
+
+	case primitive.D:
+		return valueFromBSON(v.Map())
+
+	case primitive.M:
+		return valueFromBSON(map[string]any(v))
+
+	case map[string]any:
+		s := &structpb.Struct{
+			Fields: make(map[string]*structpb.Value, len(v)),
+		}
+
+		for key, elem := range v {
+			pb, err := valueFromBSON(elem)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Fields[key] = pb
+		}
+
+		return structpb.NewStructValue(s), nil
+
+	case primitive.DateTime:
+		return structpb.NewStringValue(v.Time().Format(time.RFC3339Nano)), nil
+
+	case primitive.ObjectID:
+		return structpb.NewStringValue(v.Hex()), nil
+
+	default:
+		return structpb.NewValue(val)
+	}
+}
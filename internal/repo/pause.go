@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"errors"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrInvalidPause = errors.New("only running operations can be paused")
+
+// applyPause adds pausing or un-pausing the operation to update, see
+// UpdateOptions.Pause. state is the state selected by the update, if any.
+// Paused operations are not checked for TTL expiry, un-pausing them resets
+// the last_update which is always set by the update.
+func applyPause(update bson.M, pause *bool, state longrunningv1.OperationState, now time.Time) error {
+	switch {
+	// operations that are switched back to PENDING are no longer paused.
+	case pause == nil && state == longrunningv1.OperationState_OperationState_PENDING:
+		unsetField(update, "pausedAt")
+
+	case pause == nil:
+		return nil
+
+	case *pause:
+		if state != longrunningv1.OperationState_OperationState_RUNNING {
+			return ErrInvalidPause
+		}
+
+		update["$set"].(bson.M)["pausedAt"] = now
+
+	default:
+		unsetField(update, "pausedAt")
+	}
+
+	return nil
+}
+
+// pausedFilter returns the mongo filter for QueryOptions.Paused.
+func pausedFilter(paused bool) bson.M {
+	return bson.M{
+		"$exists": paused,
+	}
+}
+
+func addPausedAnnotation(pbop *longrunningv1.Operation, pausedAt *time.Time) {
+	if pausedAt == nil || pbop.State != longrunningv1.OperationState_OperationState_RUNNING {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.PausedAtAnnotation] = pausedAt.Format(time.RFC3339)
+}
@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrInvalidPriority = errors.New("invalid priority")
+
+// CheckPriority returns an error wrapping ErrInvalidPriority if priority is
+// negative. Zero is the default priority and is never stored, so documents
+// without a priority sort the same as those with the default one.
+func CheckPriority(priority int) error {
+	if priority < 0 {
+		return fmt.Errorf("%w: priority must not be negative, got %d", ErrInvalidPriority, priority)
+	}
+
+	return nil
+}
+
+// sort returns the mongo sort document for the sort order of opts.
+func (opts QueryOptions) sort() bson.D {
+	if !opts.RootID.IsZero() {
+		return bson.D{
+			{Key: "attempt", Value: 1},
+		}
+	}
+
+	if opts.SortByPriority {
+		return bson.D{
+			{Key: "priority", Value: -1},
+			{Key: "createTime", Value: -1},
+		}
+	}
+
+	return bson.D{
+		{Key: "createTime", Value: -1},
+	}
+}
+
+// applyPriority adds changing the priority to update, see
+// UpdateOptions.Priority. The default priority is unset instead of being
+// stored.
+func applyPriority(update bson.M, priority *int) {
+	switch {
+	case priority == nil:
+	case *priority == 0:
+		unsetField(update, "priority")
+	default:
+		update["$set"].(bson.M)["priority"] = *priority
+	}
+}
+
+func addPriorityAnnotation(pbop *longrunningv1.Operation, priority int) {
+	if priority == 0 {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.PriorityAnnotation] = strconv.Itoa(priority)
+}
@@ -0,0 +1,119 @@
+package repo
+
+import (
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// progressSamples is the number of progress samples that are kept per
+// operation to estimate its completion time.
+const progressSamples = 10
+
+// ProgressSample records the percent_done of an operation at a point in time.
+type ProgressSample struct {
+	Time        time.Time `bson:"time"`
+	PercentDone int       `bson:"percentDone"`
+}
+
+// withProgressSample returns the update document that sets the fields in set.
+// If set updates the percentDone field, a progress sample is appended to the
+// history of the operation as well, keeping only the last progressSamples.
+func withProgressSample(set bson.M, now time.Time) bson.M {
+	update := bson.M{
+		"$set": set,
+	}
+
+	percent, ok := set["percentDone"].(int)
+	if !ok {
+		return update
+	}
+
+	update["$push"] = bson.M{
+		"progress": bson.M{
+			"$each": []ProgressSample{
+				{Time: now, PercentDone: percent},
+			},
+			"$slice": -progressSamples,
+		},
+	}
+
+	return update
+}
+
+// appendProgressSample applies the $push of withProgressSample to samples.
+func appendProgressSample(samples []ProgressSample, sample ProgressSample) []ProgressSample {
+	samples = append(samples, sample)
+
+	if len(samples) > progressSamples {
+		samples = samples[len(samples)-progressSamples:]
+	}
+
+	return samples
+}
+
+// estimateCompletion estimates when an operation reaches 100 percent based on
+// the rate of its progress samples. No estimate is returned for terminal
+// operations, for less than two samples or if the progress has not increased
+// within the samples.
+func estimateCompletion(state longrunningv1.OperationState, samples []ProgressSample) (time.Time, bool) {
+	if state == longrunningv1.OperationState_OperationState_COMPLETE || state == longrunningv1.OperationState_OperationState_LOST {
+		return time.Time{}, false
+	}
+
+	if len(samples) < 2 {
+		return time.Time{}, false
+	}
+
+	last := samples[len(samples)-1]
+	if last.PercentDone >= 100 || last.PercentDone <= samples[0].PercentDone {
+		return time.Time{}, false
+	}
+
+	// fit percent = a + rate*t using least squares so the rate is smoothed
+	// over all samples. t is relative to the first sample, in seconds.
+	var sumT, sumP, sumTT, sumTP float64
+	for _, s := range samples {
+		t := s.Time.Sub(samples[0].Time).Seconds()
+		p := float64(s.PercentDone)
+
+		sumT += t
+		sumP += p
+		sumTT += t * t
+		sumTP += t * p
+	}
+
+	n := float64(len(samples))
+
+	denom := n*sumTT - sumT*sumT
+	if denom <= 0 {
+		return time.Time{}, false
+	}
+
+	rate := (n*sumTP - sumT*sumP) / denom
+	if rate <= 0 {
+		return time.Time{}, false
+	}
+
+	remaining := time.Duration(float64(100-last.PercentDone) / rate * float64(time.Second))
+
+	return last.Time.Add(remaining), true
+}
+
+// addEstimatedCompletionAnnotation adds the computed
+// op.EstimatedCompletionAnnotation to pbop if the completion time can be
+// estimated, see estimateCompletion.
+func addEstimatedCompletionAnnotation(pbop *longrunningv1.Operation, samples []ProgressSample) {
+	eta, ok := estimateCompletion(pbop.State, samples)
+	if !ok {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.EstimatedCompletionAnnotation] = eta.Format(time.RFC3339)
+}
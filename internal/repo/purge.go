@@ -0,0 +1,138 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidPurge = errors.New("invalid purge request")
+
+// purgeBatchSize is the number of operations that are deleted at once by
+// PurgeOperations.
+const purgeBatchSize = 100
+
+// PurgeOptions holds additional options for PurgeOperations.
+type PurgeOptions struct {
+	QueryOptions
+
+	// DryRun only counts the matching operations without deleting them.
+	DryRun bool
+
+	// SampleSize is the maximum number of operation ids that are returned for
+	// a dry run.
+	SampleSize int
+}
+
+// PurgeResult is returned by PurgeOperations.
+type PurgeResult struct {
+	// Count holds the number of deleted operations, or the number of
+	// operations that would be deleted for a dry run.
+	Count int64
+
+	// Sample holds the ids of some of the matching operations for a dry
+	// run.
+	Sample []string
+}
+
+// PurgeOperations deletes all operations that match query and opts together
+// with the content of their attachments. The state of query must be set to
+// either COMPLETE or LOST so active operations can never be purged.
+// The read mask and sort order of opts are ignored.
+func (r *Repo) PurgeOperations(ctx context.Context, query *longrunningv1.QueryOperationsRequest, opts PurgeOptions) (res PurgeResult, err error) {
+	defer r.observe("PurgeOperations", time.Now(), func() int { return int(res.Count) }, &err)
+
+	switch query.State {
+	case longrunningv1.OperationState_OperationState_COMPLETE, longrunningv1.OperationState_OperationState_LOST:
+	default:
+		return res, fmt.Errorf("%w: state must be either COMPLETE or LOST", ErrInvalidPurge)
+	}
+
+	filter := r.queryFilter(query, opts.QueryOptions)
+
+	if opts.DryRun {
+		return r.countPurge(ctx, filter, opts.SampleSize)
+	}
+
+	for {
+		cursor, err := r.col.Find(ctx, filter, options.Find().
+			SetProjection(bson.M{"_id": 1, "attachments": 1}).
+			SetLimit(purgeBatchSize))
+		if err != nil {
+			return res, err
+		}
+
+		var batch []Operation
+		if err := cursor.All(ctx, &batch); err != nil {
+			return res, fmt.Errorf("failed to decode operations: %w", err)
+		}
+
+		if len(batch) == 0 {
+			return res, nil
+		}
+
+		ids := make([]primitive.ObjectID, len(batch))
+		for idx, model := range batch {
+			ids[idx] = model.ID
+		}
+
+		deleted, err := r.col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return res, fmt.Errorf("failed to delete operations: %w", err)
+		}
+
+		res.Count += deleted.DeletedCount
+
+		if deleted.DeletedCount == 0 {
+			return res, nil
+		}
+
+		// the operations are gone already so errors are only logged by
+		// deleteBlob.
+		for _, model := range batch {
+			for _, att := range model.Attachments {
+				r.deleteBlob(att.BlobID)
+			}
+		}
+	}
+}
+
+func (r *Repo) countPurge(ctx context.Context, filter bson.M, sampleSize int) (PurgeResult, error) {
+	count, err := r.col.CountDocuments(ctx, filter)
+	if err != nil {
+		return PurgeResult{}, fmt.Errorf("failed to count operations: %w", err)
+	}
+
+	res := PurgeResult{
+		Count: count,
+	}
+
+	if sampleSize <= 0 || count == 0 {
+		return res, nil
+	}
+
+	cursor, err := r.col.Find(ctx, filter, options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.D{{Key: "createTime", Value: -1}}).
+		SetLimit(int64(sampleSize)))
+	if err != nil {
+		return res, err
+	}
+
+	var sample []Operation
+	if err := cursor.All(ctx, &sample); err != nil {
+		return res, fmt.Errorf("failed to decode operations: %w", err)
+	}
+
+	for _, model := range sample {
+		res.Sample = append(res.Sample, model.ID.Hex())
+	}
+
+	return res, nil
+}
@@ -0,0 +1,134 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the number of active operations, i.e. operations that are
+// neither COMPLETE nor LOST. A zero value disables the respective limit.
+//
+// Quotas are checked before operations are inserted and verified again
+// afterwards. If the verification fails, the inserted operations are removed
+// again. The verification only counts operations whose id is not greater than
+// the id of the inserted ones so concurrent registrations are decided in the
+// order of their ids and cannot exceed the quota together. Registrations may
+// however be rejected even though the quota is not exceeded if they race with
+// a registration that is rejected itself.
+type Quota struct {
+	MaxPerOwner int
+	MaxPerKind  int
+}
+
+func (r *Repo) setupQuota(ctx context.Context) error {
+	if _, err := r.col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "owner", Value: 1},
+				{Key: "state", Value: 1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{Key: "kind", Value: 1},
+				{Key: "state", Value: 1},
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create quota indexes: %w", err)
+	}
+
+	return nil
+}
+
+// checkQuota validates that adding the operations in models does not exceed
+// quota. If until is not nil, models have already been inserted and only
+// operations with an id less than or equal to until are counted.
+func (r *Repo) checkQuota(ctx context.Context, quota Quota, models []any, until *primitive.ObjectID) error {
+	owners := make(map[string]int)
+	kinds := make(map[string]int)
+
+	for _, m := range models {
+		doc := m.(document)
+
+		owners[doc.Owner]++
+		kinds[doc.Kind]++
+	}
+
+	if err := r.checkQuotaOf(ctx, "owner", owners, quota.MaxPerOwner, until); err != nil {
+		return err
+	}
+
+	return r.checkQuotaOf(ctx, "kind", kinds, quota.MaxPerKind, until)
+}
+
+func (r *Repo) checkQuotaOf(ctx context.Context, field string, additional map[string]int, max int, until *primitive.ObjectID) error {
+	if max <= 0 {
+		return nil
+	}
+
+	for value, n := range additional {
+		filter := bson.M{
+			field: value,
+			"state": bson.M{
+				"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+			},
+		}
+
+		if until != nil {
+			filter["_id"] = bson.M{"$lte": *until}
+
+			// the inserted operations are already counted.
+			n = 0
+		}
+
+		count, err := r.col.CountDocuments(ctx, filter)
+		if err != nil {
+			return fmt.Errorf("failed to count active operations: %w", err)
+		}
+
+		if int(count)+n > max {
+			return fmt.Errorf("%w: %s %q exceeds the maximum of %d active operations", ErrQuotaExceeded, field, value, max)
+		}
+	}
+
+	return nil
+}
+
+// verifyQuota is called after models have been inserted and removes them again
+// if they exceed quota, see Quota.
+func (r *Repo) verifyQuota(ctx context.Context, quota Quota, models []any) error {
+	if quota.MaxPerOwner <= 0 && quota.MaxPerKind <= 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, len(models))
+	for idx, m := range models {
+		ids[idx] = m.(document).ID
+	}
+
+	until := slices.MaxFunc(ids, func(a, b primitive.ObjectID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	err := r.checkQuota(ctx, quota, models, &until)
+	if err == nil {
+		return nil
+	}
+
+	if _, derr := r.col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); derr != nil {
+		return fmt.Errorf("failed to remove operations exceeding the quota: %w", derr)
+	}
+
+	return err
+}
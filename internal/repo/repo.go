@@ -6,6 +6,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"regexp"
+	"slices"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -13,205 +15,1482 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var ErrNotFound = errors.New("operation not found")
+var (
+	ErrNotFound          = errors.New("operation not found")
+	ErrInvalidID         = errors.New("invalid operation id")
+	ErrInvalidUpdateMask = errors.New("invalid field in update mask")
+	ErrMissingResult     = errors.New("missing result value")
+	ErrAlreadyExists     = errors.New("operation already exists")
+)
+
+// AlreadyExistsError is returned when registering an operation with the kind
+// and external reference of an operation that is neither COMPLETE nor LOST.
+type AlreadyExistsError struct {
+	// Existing holds the operation that is already registered.
+	Existing *longrunningv1.Operation
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrAlreadyExists, e.Existing.UniqueId)
+}
+
+func (e *AlreadyExistsError) Unwrap() error {
+	return ErrAlreadyExists
+}
+
+// parseID parses the unique id of an operation.
+func parseID(uniqueId string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(uniqueId)
+	if err != nil {
+		return id, fmt.Errorf("%w: %q", ErrInvalidID, uniqueId)
+	}
+
+	return id, nil
+}
 
 type Repo struct {
-	col *mongo.Collection
-	cli *mongo.Client
+	col       *mongo.Collection
+	outbox    *mongo.Collection
+	webhooks  *mongo.Collection
+	templates *mongo.Collection
+	leases    *mongo.Collection
+	cli       *mongo.Client
+	blobs     *gridfs.Bucket
+	limits    Limits
+	durations DurationLimits
+	metrics   Metrics
+
+	deliveries  *mongo.Collection
+	deadLetters *mongo.Collection
+	checkpoints *mongo.Collection
+
+	defaultNamespace string
+	attachmentWindow time.Duration
+}
+
+func NewRepo(ctx context.Context, url string, db string) (*Repo, error) {
+	clientOptions := options.Client().ApplyURI(url)
+
+	cli, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRepoWithClient(ctx, cli, db)
+}
+
+func NewRepoWithClient(ctx context.Context, cli *mongo.Client, db string) (*Repo, error) {
+	blobs, err := gridfs.NewBucket(cli.Database(db), options.GridFSBucket().SetName("operation-attachments"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attachment bucket: %w", err)
+	}
+
+	r := &Repo{
+		col:       cli.Database(db).Collection("long-running-operations"),
+		outbox:    cli.Database(db).Collection("long-running-operations-outbox"),
+		webhooks:  cli.Database(db).Collection("long-running-operations-webhooks"),
+		templates: cli.Database(db).Collection("long-running-operations-templates"),
+		leases:    cli.Database(db).Collection("long-running-operations-leases"),
+		cli:       cli,
+		blobs:     blobs,
+
+		deliveries:  cli.Database(db).Collection("long-running-operations-webhook-deliveries"),
+		deadLetters: cli.Database(db).Collection("long-running-operations-webhook-dead-letters"),
+		checkpoints: cli.Database(db).Collection("long-running-operations-checkpoints"),
+	}
+
+	if err := r.setup(ctx); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Repo) setup(ctx context.Context) error {
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "namespace", Value: 1},
+			{Key: "state", Value: 1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create namespace index: %w", err)
+	}
+
+	// external references must only be unique for operations that are still
+	// active so a reference can be re-used once the operation terminated.
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "kind", Value: 1},
+			{Key: "externalRef", Value: 1},
+		},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"externalRef": bson.M{
+				"$exists": true,
+			},
+			"state": bson.M{
+				"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+			},
+		}),
+	}); err != nil {
+		return fmt.Errorf("failed to create external reference index: %w", err)
+	}
+
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "tags", Value: 1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create tags index: %w", err)
+	}
+
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "visibleTo", Value: 1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create viewers index: %w", err)
+	}
+
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "priority", Value: -1},
+			{Key: "createTime", Value: -1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create priority index: %w", err)
+	}
+
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "startTime", Value: 1},
+		},
+		Options: options.Index().SetSparse(true),
+	}); err != nil {
+		return fmt.Errorf("failed to create start time index: %w", err)
+	}
+
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "runtimeDeadline", Value: 1},
+		},
+		Options: options.Index().SetSparse(true),
+	}); err != nil {
+		return fmt.Errorf("failed to create runtime deadline index: %w", err)
+	}
+
+	if err := r.setupQuota(ctx); err != nil {
+		return err
+	}
+
+	if err := r.setupDedup(ctx); err != nil {
+		return err
+	}
+
+	if err := r.setupWebhooks(ctx); err != nil {
+		return err
+	}
+
+	if err := r.setupTemplates(ctx); err != nil {
+		return err
+	}
+
+	if err := r.setupRetries(ctx); err != nil {
+		return err
+	}
+
+	return r.setupOutbox(ctx)
+}
+
+// RegisterOptions holds additional options for registering a new operation
+// that are not part of the RegisterOperationRequest.
+type RegisterOptions struct {
+	// PendingTimeout is the timeout after which the operation is considered lost
+	// if it has not been switched to RUNNING. A zero value disables the timeout.
+	PendingTimeout time.Duration
+
+	// Namespace is the namespace the operation belongs to. If empty, the default
+	// namespace is used.
+	Namespace string
+
+	// ExternalRef is an optional, client supplied reference of the operation.
+	ExternalRef string
+
+	// Links holds references to external resources of the operation, see
+	// Limits.CheckLinks.
+	Links []Link
+
+	// VisibleTo restricts the visibility of the operation to its owner, its
+	// creator and the listed users, see Viewer and NormalizeViewers.
+	VisibleTo []string
+
+	// StartTime may be set to schedule the operation. It stays PENDING until
+	// the start time and is not considered lost before, see
+	// StartDueOperations. Scheduled operations must not have dependencies.
+	StartTime *time.Time
+
+	// Priority is the priority of the operation, higher values are more
+	// important. The default priority is zero, see CheckPriority.
+	Priority int
+
+	// MaxRuntime may be set to complete the operation with an error once it
+	// has been running for longer, independent of its heartbeats. A zero
+	// value disables the limit.
+	MaxRuntime time.Duration
+
+	// Retry may be set to register a successor once the operation has been
+	// lost, see RetryOperation and CheckRetryPolicy.
+	Retry *RetryPolicy
+
+	// PercentDone and StatusMessage hold the initial progress of the
+	// operation, see Limits.CheckProgress.
+	PercentDone   int
+	StatusMessage string
+
+	// DependsOn holds the ids of existing operations that must complete
+	// successfully before the operation is started. Operations with
+	// dependencies are always registered as PENDING and their pending timeout
+	// is not enforced.
+	DependsOn []string
+
+	// Quota limits the number of active operations per owner and kind.
+	Quota Quota
+
+	// SuppressDuplicatesWithin enables duplicate suppression if greater than
+	// zero. Instead of registering a new operation, an active operation of the
+	// same namespace, kind, owner and parameters that has been created within
+	// the window is returned without an auth token.
+	SuppressDuplicatesWithin time.Duration
+
+	// AllowNoExpiry permits registrations with an explicit TTL of zero. Such
+	// operations are never marked as lost because of missing updates. An
+	// explicit zero TTL is rejected with ErrInvalidDuration otherwise while
+	// an absent TTL falls back to the default.
+	AllowNoExpiry bool
+
+	// ValidateOnly runs all checks of the registration, including the quota
+	// and the uniqueness of the external reference, without storing
+	// anything. The returned operations have neither a unique id nor an auth
+	// token.
+	ValidateOnly bool
+
+	// occurrence links the operation to a template, see
+	// MaterializeDueTemplates.
+	occurrence *templateOccurrence
+}
+
+// UpdateOptions holds additional options for mutating an operation.
+type UpdateOptions struct {
+	// Identity is the ID of the calling user as asserted by the auth
+	// interceptor. If the request does not carry an auth token, the mutation
+	// is permitted if Identity is the owner of the operation.
+	Identity string
+
+	// Admin permits the mutation without an auth token, independent of the
+	// owner of the operation.
+	Admin bool
+
+	// Priority may be set on UpdateOperation to change the priority of the
+	// operation.
+	Priority *int
+
+	// Pause may be set on UpdateOperation to pause (true) or un-pause (false)
+	// the operation. Only operations that are RUNNING after the update may
+	// be paused.
+	Pause *bool
+
+	// MergeAnnotations may be set on UpdateOperation to combine the
+	// annotations of the update with the stored ones instead of replacing
+	// them. Keys with an empty value are removed.
+	MergeAnnotations bool
+
+	// OriginalResultSize holds the size of the result before it has been
+	// truncated, see Limits.LimitResult. It is only used by CompleteOperation.
+	OriginalResultSize int
+}
+
+// SetDefaultNamespace configures the namespace that is used for operations that
+// are registered without a namespace. Documents that have been stored before
+// namespaces have been introduced are treated as part of the default namespace.
+func (r *Repo) SetDefaultNamespace(ns string) {
+	r.defaultNamespace = ns
+}
+
+// SetLimits configures the size limits that are applied when reading operations
+// which have been stored before the limits have been enforced.
+func (r *Repo) SetLimits(limits Limits) {
+	r.limits = limits
+}
+
+func (r *Repo) RegisterOperation(ctx context.Context, reg *longrunningv1.RegisterOperationRequest, opts RegisterOptions) (string, string, error) {
+	res, err := r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{reg}, opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	return res[0].Operation.UniqueId, res[0].AuthToken, nil
+}
+
+// RegisterOperations registers all operations in regs using a single insert and
+// returns the registered operations and their auth tokens in the same order as regs.
+//
+// Registration is all-or-nothing: if more than one operation is registered the
+// insert is performed inside a transaction and no operation is stored if any of
+// them fails.
+//
+// If opts.SuppressDuplicatesWithin is set, duplicates of existing operations
+// are not inserted and returned without an auth token instead. Concurrent
+// duplicates are detected after the insert in which case the operation with the
+// smaller id wins and the other one is removed again.
+//
+// If opts.ValidateOnly is set, the operations are validated and returned as
+// they would be registered but nothing is stored.
+func (r *Repo) RegisterOperations(ctx context.Context, regs []*longrunningv1.RegisterOperationRequest, opts RegisterOptions) (_ []*longrunningv1.RegisterOperationResponse, err error) {
+	defer r.observe("RegisterOperations", time.Now(), func() int { return len(regs) }, &err)
+
+	models := make([]any, 0, len(regs))
+	result := make([]*longrunningv1.RegisterOperationResponse, len(regs))
+
+	// indices holds the index in regs of each entry in models.
+	indices := make([]int, 0, len(regs))
+
+	if err := r.limits.CheckLinks(opts.Links); err != nil {
+		return nil, err
+	}
+
+	if err := CheckPriority(opts.Priority); err != nil {
+		return nil, err
+	}
+
+	if err := CheckRetryPolicy(opts.Retry); err != nil {
+		return nil, err
+	}
+
+	if opts.MaxRuntime < 0 {
+		return nil, fmt.Errorf("%w: max_runtime must not be negative", ErrInvalidDuration)
+	}
+
+	if opts.StartTime != nil && len(opts.DependsOn) > 0 {
+		return nil, fmt.Errorf("%w: scheduled operations must not have dependencies", ErrInvalidSchedule)
+	}
+
+	var deps []primitive.ObjectID
+	if len(opts.DependsOn) > 0 {
+		deps, err = r.parseDependencies(ctx, opts.DependsOn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for idx, reg := range regs {
+		var authCode string
+		if !opts.ValidateOnly {
+			authCode, err = newAuthToken()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		model, err := operationFromRegistrationRequest(reg, opts, r.durations)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", idx, err)
+		}
+
+		if model.Namespace == "" {
+			model.Namespace = r.defaultNamespace
+		}
+
+		model.ID = primitive.NewObjectID()
+
+		// the first attempt is the root of all of its retries.
+		if model.Retry != nil && !opts.ValidateOnly {
+			root := model.ID
+			model.RootID = &root
+		}
+
+		if model.State == longrunningv1.OperationState_OperationState_UNSPECIFIED {
+			model.State = longrunningv1.OperationState_OperationState_PENDING
+		}
+
+		if len(deps) > 0 {
+			model.DependsOn = deps
+			model.State = longrunningv1.OperationState_OperationState_PENDING
+			model.PendingDeadline = nil
+		}
+
+		model.Fingerprint, err = fingerprint(reg.Parameters)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", idx, err)
+		}
+
+		if opts.SuppressDuplicatesWithin > 0 {
+			dup, err := r.findDuplicate(ctx, model, opts.SuppressDuplicatesWithin, nil)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", idx, err)
+			}
+
+			if dup != nil {
+				if result[idx], err = dup.deduplicated(r.limits); err != nil {
+					return nil, fmt.Errorf("operation %d: %w", idx, err)
+				}
+
+				continue
+			}
+		}
+
+		pb, err := model.toProto(nil, r.limits)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", idx, err)
+		}
+
+		if opts.ValidateOnly {
+			pb.UniqueId = ""
+		}
+
+		models = append(models, document{
+			Operation: *model,
+			AuthToken: authCode,
+		})
+		indices = append(indices, idx)
+
+		result[idx] = &longrunningv1.RegisterOperationResponse{
+			Operation: pb,
+			AuthToken: authCode,
+		}
+	}
+
+	if len(models) == 0 {
+		return result, nil
+	}
+
+	if err := r.checkQuota(ctx, opts.Quota, models, nil); err != nil {
+		return nil, err
+	}
+
+	if opts.ValidateOnly {
+		if opts.ExternalRef != "" {
+			if err := r.checkExternalRef(ctx, regs, opts.ExternalRef); err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	}
+
+	var stored []Operation
+	switch len(models) {
+	case 1:
+		stored, err = r.insertOperations(ctx, models)
+
+	default:
+		stored, err = run(ctx, r, func(sc mongo.SessionContext) ([]Operation, error) {
+			return r.insertOperations(sc, models)
+		})
+	}
+
+	if mongo.IsDuplicateKeyError(err) && opts.ExternalRef != "" {
+		return nil, r.alreadyExists(ctx, regs, opts.ExternalRef)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the lastUpdate has been stamped by the server.
+	for i := range stored {
+		if result[indices[i]].Operation, err = stored[i].toProto(nil, r.limits); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.verifyQuota(ctx, opts.Quota, models); err != nil {
+		return nil, err
+	}
+
+	if opts.SuppressDuplicatesWithin > 0 {
+		if err := r.resolveDuplicates(ctx, models, indices, result, opts.SuppressDuplicatesWithin); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// resolveDuplicates replaces inserted models that have been registered
+// concurrently with an older duplicate by the older one, see
+// RegisterOperations.
+func (r *Repo) resolveDuplicates(ctx context.Context, models []any, indices []int, result []*longrunningv1.RegisterOperationResponse, within time.Duration) error {
+	for i, m := range models {
+		doc := m.(document)
+
+		dup, err := r.findDuplicate(ctx, &doc.Operation, within, &doc.ID)
+		if err != nil {
+			return err
+		}
+
+		if dup == nil {
+			continue
+		}
+
+		if _, err := r.col.DeleteOne(ctx, bson.M{"_id": doc.ID}); err != nil {
+			return fmt.Errorf("failed to remove duplicate operation: %w", err)
+		}
+
+		if result[indices[i]], err = dup.deduplicated(r.limits); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alreadyExists returns an AlreadyExistsError for the active operation that
+// conflicts with the registration of regs using ref. ErrAlreadyExists is
+// returned if regs conflict with each other.
+func (r *Repo) alreadyExists(ctx context.Context, regs []*longrunningv1.RegisterOperationRequest, ref string) error {
+	kinds := make([]string, len(regs))
+	for idx, reg := range regs {
+		kinds[idx] = reg.Kind
+	}
+
+	ops, err := r.find(ctx, bson.M{
+		"kind": bson.M{
+			"$in": kinds,
+		},
+		"externalRef": ref,
+		"state": bson.M{
+			"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(ops) == 0 {
+		return fmt.Errorf("%w: duplicate external reference %q", ErrAlreadyExists, ref)
+	}
+
+	return &AlreadyExistsError{Existing: ops[0]}
+}
+
+// checkExternalRef returns the error of alreadyExists if registering regs
+// using ref would conflict with an active operation or with each other.
+func (r *Repo) checkExternalRef(ctx context.Context, regs []*longrunningv1.RegisterOperationRequest, ref string) error {
+	kinds := make([]string, 0, len(regs))
+	for _, reg := range regs {
+		if slices.Contains(kinds, reg.Kind) {
+			return fmt.Errorf("%w: duplicate external reference %q", ErrAlreadyExists, ref)
+		}
+
+		kinds = append(kinds, reg.Kind)
+	}
+
+	count, err := r.col.CountDocuments(ctx, bson.M{
+		"kind": bson.M{
+			"$in": kinds,
+		},
+		"externalRef": ref,
+		"state": bson.M{
+			"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	return r.alreadyExists(ctx, regs, ref)
+}
+
+// ResolveExternalRef returns the id of the most recent operation of kind that
+// has been registered with the external reference ref.
+func (r *Repo) ResolveExternalRef(ctx context.Context, kind, ref string) (_ string, err error) {
+	defer r.observe("ResolveExternalRef", time.Now(), nil, &err)
+
+	findOpts := options.FindOne().
+		SetSort(bson.D{{Key: "createTime", Value: -1}, {Key: "_id", Value: -1}}).
+		SetProjection(bson.M{"_id": 1})
+
+	res := r.col.FindOne(ctx, bson.M{"kind": kind, "externalRef": ref}, findOpts)
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", ErrNotFound
+		}
+
+		return "", err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return "", fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return op.ID.Hex(), nil
+}
+
+// GetActiveOperations returns all RUNNING operations in the specified namespaces
+// that are neither paused nor without expiry, highest priority first. If namespaces is empty,
+// operations of all namespaces are returned.
+func (r *Repo) GetActiveOperations(ctx context.Context, namespaces []string) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("GetActiveOperations", time.Now(), func() int { return len(ops) }, &err)
+
+	filter := bson.M{
+		"state":    longrunningv1.OperationState_OperationState_RUNNING,
+		"pausedAt": pausedFilter(false),
+		"noExpiry": bson.M{"$ne": true},
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	return r.findWithOptions(ctx, filter, nil, options.Find().SetSort(QueryOptions{SortByPriority: true}.sort()))
+}
+
+// GetActiveOperation returns the operation with the given id if it is RUNNING,
+// neither paused nor without expiry and belongs to one of the specified
+// namespaces. Nil is returned
+// without an error otherwise. If namespaces is empty, operations of all
+// namespaces are considered.
+func (r *Repo) GetActiveOperation(ctx context.Context, namespaces []string, id string) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("GetActiveOperation", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{
+		"_id":      oid,
+		"state":    longrunningv1.OperationState_OperationState_RUNNING,
+		"pausedAt": pausedFilter(false),
+		"noExpiry": bson.M{"$ne": true},
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	ops, err := r.find(ctx, filter, nil)
+	if err != nil || len(ops) == 0 {
+		return nil, err
+	}
+
+	return ops[0], nil
+}
+
+// GetExpiredPendingOperations returns all operations in the specified namespaces
+// that are still in state PENDING but whose pending deadline has passed at now.
+// If namespaces is empty, operations of all namespaces are returned.
+func (r *Repo) GetExpiredPendingOperations(ctx context.Context, namespaces []string, now time.Time) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("GetExpiredPendingOperations", time.Now(), func() int { return len(ops) }, &err)
+
+	filter := bson.M{
+		"state": longrunningv1.OperationState_OperationState_PENDING,
+		"pendingDeadline": bson.M{
+			"$lte": now,
+		},
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	return r.find(ctx, filter, nil)
+}
+
+// MarkAsLost updates the state of the operation to LOST and stores reason as
+// the operation error. If the operation has attempts left, it is marked for a
+// retry in the same update, see GetPendingRetries.
+//
+// Only running operations whose TTL and grace period elapsed and pending
+// operations whose pending deadline passed are marked as lost, both according
+// to the database clock. ErrNotLost is returned for any other operation so a
+// stale check cannot overwrite a concurrent heartbeat or completion.
+func (r *Repo) MarkAsLost(ctx context.Context, id string, reason *longrunningv1.OperationError) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("MarkAsLost", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	updDoc := bson.M{
+		"lastUpdate": time.Now(),
+		"state":      longrunningv1.OperationState_OperationState_LOST,
+	}
+
+	if reason != nil {
+		updDoc["error"] = Error{
+			Message: reason.Message,
+			Details: reason.ErrorDetails,
+		}
+	}
+
+	return run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
+		model, err := r.findOperation(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+
+		if model.retryable() {
+			updDoc["retryPending"] = true
+		}
+
+		filter := bson.M{
+			"_id": oid,
+			"$or": bson.A{
+				bson.M{
+					"state":    longrunningv1.OperationState_OperationState_RUNNING,
+					"pausedAt": pausedFilter(false),
+					"noExpiry": bson.M{"$ne": true},
+					"$expr":    expiredExpr(),
+				},
+				bson.M{
+					"state":           longrunningv1.OperationState_OperationState_PENDING,
+					"pendingDeadline": bson.M{"$ne": nil},
+					"$expr":           bson.M{"$lte": bson.A{"$pendingDeadline", "$$NOW"}},
+				},
+			},
+		}
+
+		result, err := r.findAndApplyFilteredUpdate(ctx, filter, bson.M{"$set": updDoc})
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotLost
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return result.toProto(nil, r.limits)
+	})
+}
+
+// ForceMarkAsLost is like MarkAsLost but used by administrators to mark an
+// operation as lost before its TTL expired. The actor is recorded in the
+// audit log. ErrOperationCompleted or ErrOperationLost is returned if the
+// operation already reached a terminal state.
+func (r *Repo) ForceMarkAsLost(ctx context.Context, id string, reason *longrunningv1.OperationError, actor string) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("ForceMarkAsLost", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
+		model, err := r.findOperation(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := model.checkActive(); err != nil {
+			return nil, err
+		}
+
+		set := bson.M{
+			"lastUpdate":    now,
+			"lastUpdatedBy": actor,
+			"state":         longrunningv1.OperationState_OperationState_LOST,
+			"error": Error{
+				Message: reason.Message,
+				Details: reason.ErrorDetails,
+			},
+		}
+
+		if model.retryable() {
+			set["retryPending"] = true
+		}
+
+		result, err := r.findAndApplyUpdate(ctx, oid, bson.M{
+			"$set": set,
+			"$push": bson.M{
+				"audit": AuditEntry{
+					Time:   now,
+					Actor:  actor,
+					Action: "mark-lost",
+					Reason: "admin",
+					State:  longrunningv1.OperationState_OperationState_LOST,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return result.toProto(nil, r.limits)
+	})
 }
 
-func NewRepo(ctx context.Context, url string, db string) (*Repo, error) {
-	clientOptions := options.Client().ApplyURI(url)
+// CompleteOperation marks the operation as complete. The request must either
+// carry the auth token of the operation or be authorized by opts. The
+// operation is returned as it was before the completion as well.
+func (r *Repo) CompleteOperation(ctx context.Context, upd *longrunningv1.CompleteOperationRequest, opts UpdateOptions) (_, previous *longrunningv1.Operation, err error) {
+	defer r.observe("CompleteOperation", time.Now(), nil, &err)
+
+	id, err := parseID(upd.UniqueId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updDoc := bson.M{
+		"lastUpdate":    time.Now(),
+		"lastUpdatedBy": opts.Identity,
+		"state":         longrunningv1.OperationState_OperationState_COMPLETE,
+		"percentDone":   100,
+	}
+
+	switch v := upd.Result.(type) {
+	case *longrunningv1.CompleteOperationRequest_Error:
+		updDoc["error"] = Error{
+			Message: v.Error.Message,
+			Details: v.Error.ErrorDetails,
+		}
+
+	case *longrunningv1.CompleteOperationRequest_Success:
+		updDoc["success"] = Success{
+			Message: v.Success.Message,
+			Result:  v.Success.Result,
+		}
+
+	default:
+		return nil, nil, ErrMissingResult
+	}
+
+	if opts.OriginalResultSize > 0 {
+		updDoc["originalResultSize"] = opts.OriginalResultSize
+	}
+
+	completed, err := run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
+		// first, query the operation to validate the update request.
+		prev, err := r.validateUpdate(ctx, id, upd.AuthToken, opts, "complete", longrunningv1.OperationState_OperationState_COMPLETE)
+		if err != nil {
+			return nil, err
+		}
+
+		if previous, err = prev.toProto(nil, r.limits); err != nil {
+			return nil, err
+		}
+
+		op, err := r.findAndUpdateOperation(ctx, id, updDoc)
+		if err != nil {
+			return nil, err
+		}
+
+		return op.toProto(nil, r.limits)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return completed, previous, nil
+}
+
+// GetOperation returns the operation requested by req. If mask is not nil, only
+// the selected fields will be loaded and populated.
+func (r *Repo) GetOperation(ctx context.Context, req *longrunningv1.GetOperationRequest, mask *ReadMask) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("GetOperation", time.Now(), nil, &err)
+
+	return r.getOperation(ctx, req, mask, nil)
+}
+
+// getOperation loads the operation of req if it is visible to viewer.
+func (r *Repo) getOperation(ctx context.Context, req *longrunningv1.GetOperationRequest, mask *ReadMask, viewer *Viewer) (*longrunningv1.Operation, error) {
+	id, err := parseID(req.UniqueId)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"_id": id}
+	addVisibilityFilter(filter, viewer)
+
+	res := r.col.FindOne(ctx, filter, options.FindOne().SetProjection(mask.projection()))
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return op.toProto(mask, r.limits)
+}
+
+// GetNamespace returns the namespace of the operation with the specified id.
+// Operations without a namespace belong to the default namespace.
+func (r *Repo) GetNamespace(ctx context.Context, uniqueId string) (_ string, err error) {
+	defer r.observe("GetNamespace", time.Now(), nil, &err)
+
+	id, err := parseID(uniqueId)
+	if err != nil {
+		return "", err
+	}
+
+	res := r.col.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"namespace": 1}))
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", ErrNotFound
+		}
+
+		return "", err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return "", fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	if op.Namespace == "" {
+		return r.defaultNamespace, nil
+	}
+
+	return op.Namespace, nil
+}
+
+// QueryOptions holds additional query options that are not part of the
+// QueryOperationsRequest.
+type QueryOptions struct {
+	// ReadMask may be set to only load and populate the selected fields.
+	ReadMask *ReadMask
+
+	// InvolvedUser may be set to only return operations where the user is
+	// either the creator or the owner.
+	InvolvedUser string
+
+	// LastUpdateBefore may be set to only return operations that have not been
+	// updated since the specified time.
+	LastUpdateBefore time.Time
+
+	// Namespaces restricts the query to operations of the specified namespaces.
+	// If empty, operations of all namespaces are returned.
+	Namespaces []string
+
+	// KindPrefix treats the kind of the query as a prefix instead of an exact
+	// value.
+	KindPrefix bool
+
+	// ExternalRef may be set to only return operations with the specified
+	// external reference.
+	ExternalRef string
+
+	// Tags may be set to only return operations that have all of the
+	// specified tags. The tags must be normalized, see NormalizeTags.
+	Tags []string
+
+	// Viewer may be set to only return operations that are visible to the
+	// viewer.
+	Viewer *Viewer
+
+	// Paused may be set to only return operations that are (true) or are not
+	// (false) paused.
+	Paused *bool
+
+	// DueBefore may be set to only return scheduled operations with a start
+	// time before or at the specified time.
+	DueBefore time.Time
+
+	// SortByPriority returns the operations with the highest priority first
+	// instead of the most recently created ones. Operations of the same
+	// priority are still sorted by their creation time.
+	SortByPriority bool
+
+	// RootID may be set to only return the attempts of the operation with
+	// the given id, see RetryOperation. The attempts are returned in order.
+	RootID primitive.ObjectID
+}
+
+// QueryOperations returns all operations that match query and opts.
+func (r *Repo) QueryOperations(ctx context.Context, query *longrunningv1.QueryOperationsRequest, opts QueryOptions) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("QueryOperations", time.Now(), func() int { return len(ops) }, &err)
+
+	ops, err = r.findWithOptions(ctx, r.queryFilter(query, opts), opts.ReadMask, options.Find().SetSort(opts.sort()))
+
+	if opts.ReadMask.has("annotations") {
+		now := time.Now()
+		for _, op := range ops {
+			addLostInAnnotation(op, now)
+		}
+	}
+
+	return ops, err
+}
+
+// listBatchSize is the number of documents fetched per cursor batch by
+// ListOperations.
+const listBatchSize = 100
+
+// ListOperations calls fn for each operation that matches query and opts using
+// the same sort order as QueryOperations. In contrast to QueryOperations the
+// result is never materialized in memory but decoded one document at a time
+// from a database cursor. Iteration stops at the first error returned by fn.
+func (r *Repo) ListOperations(ctx context.Context, query *longrunningv1.QueryOperationsRequest, opts QueryOptions, fn func(*longrunningv1.Operation) error) (err error) {
+	count := 0
+	defer r.observe("ListOperations", time.Now(), func() int { return count }, &err)
+
+	findOpts := options.Find().
+		SetSort(opts.sort()).
+		SetProjection(opts.ReadMask.projection()).
+		SetBatchSize(listBatchSize)
+
+	cursor, err := r.col.Find(ctx, r.queryFilter(query, opts), findOpts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var model Operation
+		if err := cursor.Decode(&model); err != nil {
+			return fmt.Errorf("failed to decode operation: %w", err)
+		}
+
+		pb, err := model.toProto(opts.ReadMask, r.limits)
+		if err != nil {
+			return fmt.Errorf("failed to convert operation with id %q: %w", model.ID.Hex(), err)
+		}
+
+		if opts.ReadMask.has("annotations") {
+			addLostInAnnotation(pb, time.Now())
+		}
+
+		if err := fn(pb); err != nil {
+			return err
+		}
+
+		count++
+
+		// check for cancellation before the next batch is fetched.
+		if cursor.RemainingBatchLength() == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cursor.Err()
+}
+
+// queryFilter returns the mongo filter document for query and opts.
+func (r *Repo) queryFilter(query *longrunningv1.QueryOperationsRequest, opts QueryOptions) bson.M {
+	filter := bson.M{}
+
+	if u := opts.InvolvedUser; u != "" {
+		filter["$or"] = bson.A{
+			bson.M{"creator": u},
+			bson.M{"owner": u},
+		}
+	}
+
+	if c := query.Creator; c != "" {
+		filter["creator"] = c
+	}
+
+	if o := query.Owner; o != "" {
+		filter["owner"] = o
+	}
+
+	if s := query.State; s != longrunningv1.OperationState_OperationState_UNSPECIFIED {
+		filter["state"] = s
+	}
+
+	if k := query.Kind; k != "" {
+		if opts.KindPrefix {
+			filter["kind"] = bson.M{
+				"$regex": "^" + regexp.QuoteMeta(k),
+			}
+		} else {
+			filter["kind"] = k
+		}
+	}
+
+	if ref := opts.ExternalRef; ref != "" {
+		filter["externalRef"] = ref
+	}
 
-	cli, err := mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		return nil, err
+	if len(opts.Tags) > 0 {
+		filter["tags"] = bson.M{
+			"$all": opts.Tags,
+		}
 	}
 
-	return NewRepoWithClient(ctx, cli, db)
-}
+	if opts.Paused != nil {
+		filter["pausedAt"] = pausedFilter(*opts.Paused)
+	}
 
-func NewRepoWithClient(ctx context.Context, cli *mongo.Client, db string) (*Repo, error) {
-	r := &Repo{
-		col: cli.Database(db).Collection("long-running-operations"),
-		cli: cli,
+	if !opts.RootID.IsZero() {
+		filter["rootId"] = opts.RootID
 	}
 
-	return r, nil
-}
+	if !opts.DueBefore.IsZero() {
+		filter["startTime"] = bson.M{
+			"$lte": opts.DueBefore,
+		}
+	}
 
-func (r *Repo) RegisterOperation(ctx context.Context, reg *longrunningv1.RegisterOperationRequest) (string, string, error) {
-	var authCodeBytes [32]byte
-	if _, err := rand.Read(authCodeBytes[:]); err != nil {
-		return "", "", err
+	if !opts.LastUpdateBefore.IsZero() {
+		filter["lastUpdate"] = bson.M{
+			"$lte": opts.LastUpdateBefore,
+		}
 	}
 
-	authCode := hex.EncodeToString(authCodeBytes[:])
+	r.addNamespaceFilter(filter, opts.Namespaces)
+	addVisibilityFilter(filter, opts.Viewer)
+
+	return filter
+}
+
+// UpdateOperation updates the operation. The request must either carry the
+// auth token of the operation or be authorized by opts. The operation is
+// returned as it was before the update as well.
+func (r *Repo) UpdateOperation(ctx context.Context, upd *longrunningv1.UpdateOperationRequest, opts UpdateOptions) (_, previous *longrunningv1.Operation, err error) {
+	defer r.observe("UpdateOperation", time.Now(), nil, &err)
 
-	model, err := operationFromRegistrationRequest(reg)
+	id, err := parseID(upd.UniqueId)
 	if err != nil {
-		return "", "", err
+		return nil, nil, err
 	}
 
-	model.ID = primitive.NewObjectID()
-	model.AuthToken = authCode
+	now := time.Now()
+	updDoc := bson.M{
+		"lastUpdate":    now,
+		"lastUpdatedBy": opts.Identity,
+	}
 
-	if model.State == longrunningv1.OperationState_OperationState_UNSPECIFIED {
-		model.State = longrunningv1.OperationState_OperationState_PENDING
+	paths := []string{"running", "annotations", "status_message", "percent_done"}
+	if um := upd.GetUpdateMask().GetPaths(); len(um) > 0 {
+		paths = um
 	}
 
-	if _, err := r.col.InsertOne(ctx, model); err != nil {
-		return "", "", err
+	if opts.Priority != nil {
+		if err := CheckPriority(*opts.Priority); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return model.ID.Hex(), authCode, nil
-}
+	for _, p := range paths {
+		switch p {
+		case "running":
+			var s longrunningv1.OperationState
+			if upd.Running {
+				s = longrunningv1.OperationState_OperationState_RUNNING
+			} else {
+				s = longrunningv1.OperationState_OperationState_PENDING
+			}
 
-func (r *Repo) GetActiveOperations(ctx context.Context) ([]*longrunningv1.Operation, error) {
-	return r.find(ctx, bson.M{
-		"state": longrunningv1.OperationState_OperationState_RUNNING,
-	})
-}
+			updDoc["state"] = s
 
-func (r *Repo) MarkAsLost(ctx context.Context, id string) (*longrunningv1.Operation, error) {
-	oid, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		return nil, err
-	}
+		case "annotations":
+			updDoc["annotations"] = upd.Annotations
 
-	updDoc := bson.M{
-		"lastUpdate": time.Now(),
-		"state":      longrunningv1.OperationState_OperationState_LOST,
+		case "status_message":
+			updDoc["statusMessage"] = upd.StatusMessage
+
+		case "percent_done":
+			updDoc["percentDone"] = int(upd.PercentDone)
+
+		default:
+			return nil, nil, fmt.Errorf("%w: %q", ErrInvalidUpdateMask, p)
+		}
 	}
 
-	return run(ctx, r, func(sc mongo.SessionContext) (*longrunningv1.Operation, error) {
-		result, err := r.findAndUpdateOperation(ctx, oid, updDoc)
+	updated, err := run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
+		// first, query the operation to validate the update request.
+		state, _ := updDoc["state"].(longrunningv1.OperationState)
+
+		prev, err := r.validateUpdate(ctx, id, upd.AuthToken, opts, "update", state)
+		if err != nil {
+			return nil, err
+		}
+
+		if previous, err = prev.toProto(nil, r.limits); err != nil {
+			return nil, err
+		}
+
+		if _, ok := updDoc["annotations"]; ok && opts.MergeAnnotations {
+			merged, err := r.mergeAnnotations(ctx, id, upd.Annotations)
+			if err != nil {
+				return nil, err
+			}
+
+			updDoc["annotations"] = merged
+		}
+
+		update := withProgressSample(updDoc, now)
+		if err := applyPause(update, opts.Pause, state, now); err != nil {
+			return nil, err
+		}
+
+		applyPriority(update, opts.Priority)
+
+		// operations that are started before their start time are no longer
+		// scheduled.
+		if state == longrunningv1.OperationState_OperationState_RUNNING {
+			unsetField(update, "scheduled")
+		}
+
+		// Perform the actual update.
+		result, err := r.findAndApplyUpdate(ctx, id, update)
 		if err != nil {
 			return nil, err
 		}
 
-		return result.ToProto()
+		return result.toProto(nil, r.limits)
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return updated, previous, nil
 }
 
-func (r *Repo) CompleteOperation(ctx context.Context, upd *longrunningv1.CompleteOperationRequest) (*longrunningv1.Operation, error) {
-	id, err := primitive.ObjectIDFromHex(upd.UniqueId)
+// RequestCancel records that cancellation of the operation has been requested.
+// The request must be authorized using the auth token of the operation or the
+// trusted identity in opts, see document.authorize, and the operation must be
+// visible to viewer. Requesting cancellation multiple times is a no-op and
+// returns the operation as it is. Operations in a terminal state cannot be
+// cancelled.
+func (r *Repo) RequestCancel(ctx context.Context, uniqueId string, authToken string, opts UpdateOptions, viewer *Viewer) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("RequestCancel", time.Now(), nil, &err)
+
+	id, err := parseID(uniqueId)
 	if err != nil {
 		return nil, err
 	}
 
-	updDoc := bson.M{
-		"lastUpdate":  time.Now(),
-		"state":       longrunningv1.OperationState_OperationState_COMPLETE,
-		"percentDone": 100,
-	}
+	return run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
+		op, err := r.findVisibleOperation(ctx, id, viewer)
+		if err != nil {
+			return nil, err
+		}
 
-	switch v := upd.Result.(type) {
-	case *longrunningv1.CompleteOperationRequest_Error:
-		updDoc["error"] = Error{
-			Message: v.Error.Message,
-			Details: v.Error.ErrorDetails,
+		if op.State == longrunningv1.OperationState_OperationState_COMPLETE || op.State == longrunningv1.OperationState_OperationState_LOST {
+			return nil, ErrOperationCompleted
 		}
 
-	case *longrunningv1.CompleteOperationRequest_Success:
-		updDoc["success"] = Success{
-			Message: v.Success.Message,
-			Result:  v.Success.Result,
+		entry, err := op.authorize(authToken, opts, "cancel")
+		if err != nil {
+			return nil, err
 		}
 
-	default:
-		return nil, fmt.Errorf("missing result value")
-	}
+		if op.CancelRequest != nil {
+			return op.toProto(nil, r.limits)
+		}
 
-	return run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
-		// first, query the operation to validate the update request.
-		if _, err := r.getAndValidateUpdate(ctx, id, upd.AuthToken); err != nil {
-			return nil, err
+		update := bson.M{
+			"$set": bson.M{
+				"cancelRequest": CancelRequest{
+					Requester: opts.Identity,
+					Time:      time.Now(),
+				},
+			},
 		}
 
-		op, err := r.findAndUpdateOperation(ctx, id, updDoc)
+		if entry.Reason != "auth-token" {
+			update["$push"] = bson.M{"audit": entry}
+		}
+
+		result, err := r.findAndApplyUpdate(ctx, id, update)
 		if err != nil {
 			return nil, err
 		}
 
-		return op.ToProto()
+		return result.toProto(nil, r.limits)
 	})
 }
 
-func (r *Repo) GetOperation(ctx context.Context, req *longrunningv1.GetOperationRequest) (*longrunningv1.Operation, error) {
-	id, err := primitive.ObjectIDFromHex(req.UniqueId)
+// AcquireOperation takes over the LOST operation with the given id, for
+// example when a replacement worker resumes the job of a crashed one. PENDING
+// operations that have been created by the service itself, from a template or
+// as a retry, can be acquired as well since nobody holds their auth token.
+// The operation is switched to RUNNING with a new auth token which is
+// returned together with the operation. Only the owner of the operation or an
+// administrator may acquire it and the takeover is recorded in the audit log.
+//
+// Concurrent attempts are serialized by the state filter of the update so only
+// one caller wins while all others fail with ErrNotLost.
+func (r *Repo) AcquireOperation(ctx context.Context, uniqueId string, opts UpdateOptions) (_ *longrunningv1.RegisterOperationResponse, err error) {
+	defer r.observe("AcquireOperation", time.Now(), nil, &err)
+
+	id, err := parseID(uniqueId)
 	if err != nil {
 		return nil, err
 	}
 
-	res := r.col.FindOne(ctx, bson.M{"_id": id})
-	if err := res.Err(); err != nil {
+	model, err := r.findOperation(ctx, id)
+	if err != nil {
 		return nil, err
 	}
 
-	var op Operation
-	if err := res.Decode(&op); err != nil {
-		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	switch model.State {
+	case longrunningv1.OperationState_OperationState_COMPLETE:
+		return nil, ErrOperationCompleted
+	case longrunningv1.OperationState_OperationState_LOST:
+	case longrunningv1.OperationState_OperationState_PENDING:
+		if !model.unclaimed() {
+			return nil, ErrNotLost
+		}
+	default:
+		return nil, ErrNotLost
+	}
+
+	// the auth token of a lost operation must not be used to acquire it.
+	entry, err := model.authorizeIdentity(opts, "acquire")
+	if err != nil {
+		return nil, err
+	}
+
+	authToken, err := newAuthToken()
+	if err != nil {
+		return nil, err
+	}
+
+	pb, err := r.revive(ctx, model, entry, bson.M{"authToken": authToken})
+	if err != nil {
+		return nil, err
 	}
 
-	return op.ToProto()
+	return &longrunningv1.RegisterOperationResponse{
+		Operation: pb,
+		AuthToken: authToken,
+	}, nil
 }
 
-func (r *Repo) QueryOperations(ctx context.Context, query *longrunningv1.QueryOperationsRequest) ([]*longrunningv1.Operation, error) {
-	filter := bson.M{}
+// ResumeOperation switches the LOST operation with the given id back to
+// RUNNING, for example when a worker lost it's network connection for longer
+// than the TTL and grace period of the operation. The request must either carry
+// the auth token of the operation or be authorized by opts. The resumption is
+// recorded in the audit log. ErrNotLost is returned if the operation has not
+// been lost or has been resumed concurrently.
+func (r *Repo) ResumeOperation(ctx context.Context, uniqueId string, authToken string, opts UpdateOptions) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("ResumeOperation", time.Now(), nil, &err)
 
-	if c := query.Creator; c != "" {
-		filter["creator"] = c
+	id, err := parseID(uniqueId)
+	if err != nil {
+		return nil, err
 	}
 
-	if o := query.Owner; o != "" {
-		filter["owner"] = o
+	model, err := r.findOperation(ctx, id)
+	if err != nil {
+		return nil, err
 	}
 
-	if s := query.State; s != longrunningv1.OperationState_OperationState_UNSPECIFIED {
-		filter["state"] = s
+	entry := &AuditEntry{
+		Time:   time.Now(),
+		Actor:  opts.Identity,
+		Action: "resume",
+		Reason: "auth-token",
 	}
 
-	if k := query.Kind; k != "" {
-		filter["kind"] = k
+	switch {
+	case authToken != "" && authToken != model.AuthToken:
+		return nil, ErrInvalidAuthToken
+
+	case authToken == "":
+		entry, err = model.authorizeIdentity(opts, "resume")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch model.State {
+	case longrunningv1.OperationState_OperationState_COMPLETE:
+		return nil, ErrOperationCompleted
+	case longrunningv1.OperationState_OperationState_LOST:
+	default:
+		return nil, ErrNotLost
 	}
 
-	return r.find(ctx, filter)
+	return r.revive(ctx, model, entry, nil)
 }
 
-func (r *Repo) UpdateOperation(ctx context.Context, upd *longrunningv1.UpdateOperationRequest) (*longrunningv1.Operation, error) {
-	id, err := primitive.ObjectIDFromHex(upd.UniqueId)
-	if err != nil {
-		return nil, err
-	}
+// revive switches the LOST, or acquired PENDING, operation model to RUNNING,
+// clears the error that has been recorded when it was lost and applies the
+// additional fields in set. The audit entry is recorded with the update.
+// ErrNotLost is returned if the operation has been changed concurrently.
+func (r *Repo) revive(ctx context.Context, model *document, entry *AuditEntry, set bson.M) (*longrunningv1.Operation, error) {
+	entry.State = longrunningv1.OperationState_OperationState_RUNNING
 
 	updDoc := bson.M{
-		"lastUpdate": time.Now(),
+		"state":         longrunningv1.OperationState_OperationState_RUNNING,
+		"lastUpdate":    time.Now(),
+		"lastUpdatedBy": entry.Actor,
 	}
 
-	paths := []string{"running", "annotations", "status_message", "percent_done"}
-	if um := upd.GetUpdateMask().GetPaths(); len(um) > 0 {
-		paths = um
+	for key, value := range set {
+		updDoc[key] = value
 	}
 
-	for _, p := range paths {
-		switch p {
-		case "running":
-			var s longrunningv1.OperationState
-			if upd.Running {
-				s = longrunningv1.OperationState_OperationState_RUNNING
-			} else {
-				s = longrunningv1.OperationState_OperationState_PENDING
-			}
+	res := r.col.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":   model.ID,
+			"state": model.State,
+		},
+		stampLastUpdate(bson.M{
+			"$set": updDoc,
+			"$unset": bson.M{
+				"error":              "",
+				"pendingDeadline":    "",
+				"originalResultSize": "",
+			},
+			"$push": bson.M{
+				"audit": entry,
+			},
+		}),
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"authToken": 0}),
+	)
 
-			updDoc["state"] = s
+	if err := res.Err(); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, ErrNotLost
+
+		case mongo.IsDuplicateKeyError(err):
+			// another operation with the same external reference has been
+			// registered in the meantime.
+			return nil, fmt.Errorf("%w: duplicate external reference %q", ErrAlreadyExists, model.ExternalRef)
+		}
 
-		case "annotations":
-			updDoc["annotations"] = upd.Annotations
+		return nil, err
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return op.toProto(nil, r.limits)
+}
+
+// Heartbeat bumps the lastUpdate time of an operation using a single
+// findOneAndUpdate. upd.UpdateMask may select "percent_done" and
+// "status_message" which are updated as well. In contrast to UpdateOperation,
+// the operation state is never touched.
+//
+// changed reports whether any of the progress values has actually been
+// changed by the heartbeat.
+func (r *Repo) Heartbeat(ctx context.Context, upd *longrunningv1.UpdateOperationRequest) (_ *longrunningv1.Operation, changed bool, err error) {
+	defer r.observe("Heartbeat", time.Now(), nil, &err)
+
+	id, err := parseID(upd.UniqueId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	updDoc := bson.M{
+		"lastUpdate": now,
+	}
 
+	for _, p := range upd.GetUpdateMask().GetPaths() {
+		switch p {
 		case "status_message":
 			updDoc["statusMessage"] = upd.StatusMessage
 
@@ -219,33 +1498,109 @@ func (r *Repo) UpdateOperation(ctx context.Context, upd *longrunningv1.UpdateOpe
 			updDoc["percentDone"] = int(upd.PercentDone)
 
 		default:
-			return nil, fmt.Errorf("invalid field in update mask")
+			return nil, false, fmt.Errorf("%w: %q", ErrInvalidUpdateMask, p)
 		}
 	}
 
-	return run(ctx, r, func(ctx mongo.SessionContext) (*longrunningv1.Operation, error) {
-		// first, query the operation to validate the update request.
-		if _, err := r.getAndValidateUpdate(ctx, id, upd.AuthToken); err != nil {
-			return nil, err
+	// validating the auth token and the state as part of the filter saves us
+	// the additional round-trip of validateUpdate.
+	filter := bson.M{
+		"_id":       id,
+		"authToken": upd.AuthToken,
+		"state": bson.M{
+			"$nin": []longrunningv1.OperationState{
+				longrunningv1.OperationState_OperationState_COMPLETE,
+				longrunningv1.OperationState_OperationState_LOST,
+			},
+		},
+	}
+
+	res := r.col.FindOneAndUpdate(
+		ctx,
+		filter,
+		stampLastUpdate(withProgressSample(updDoc, now)),
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	)
+
+	if err := res.Err(); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, false, err
 		}
 
-		// Perform the actual update.
-		result, err := r.findAndUpdateOperation(ctx, id, updDoc)
-		if err != nil {
-			return nil, err
+		// figure out why the filter did not match.
+		if _, err := r.validateUpdate(ctx, id, upd.AuthToken, UpdateOptions{}, "heartbeat", longrunningv1.OperationState_OperationState_UNSPECIFIED); err != nil {
+			return nil, false, err
 		}
 
-		return result.ToProto()
-	})
+		return nil, false, fmt.Errorf("operation %s has been changed concurrently", upd.UniqueId)
+	}
+
+	var op Operation
+	if err := res.Decode(&op); err != nil {
+		return nil, false, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	// apply the update to the previous document so we can tell whether the
+	// progress values changed.
+	if v, ok := updDoc["statusMessage"].(string); ok && v != op.StatusMessage {
+		op.StatusMessage = v
+		changed = true
+	}
+
+	if v, ok := updDoc["percentDone"].(int); ok {
+		if v != op.PercentDone {
+			op.PercentDone = v
+			changed = true
+		}
+
+		op.Progress = appendProgressSample(op.Progress, ProgressSample{Time: now, PercentDone: v})
+	}
+
+	op.LastUpdate = now
+
+	pb, err := op.toProto(nil, r.limits)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return pb, changed, nil
+}
+
+// addNamespaceFilter restricts filter to the given namespaces. Documents without
+// a namespace match the default namespace.
+func (r *Repo) addNamespaceFilter(filter bson.M, namespaces []string) {
+	if len(namespaces) == 0 {
+		return
+	}
+
+	values := make(bson.A, 0, len(namespaces)+1)
+	for _, ns := range namespaces {
+		values = append(values, ns)
+
+		if ns == r.defaultNamespace {
+			// matches documents where the namespace field does not exist
+			values = append(values, nil)
+		}
+	}
+
+	filter["namespace"] = bson.M{
+		"$in": values,
+	}
 }
 
-func (r *Repo) find(ctx context.Context, filter bson.M) ([]*longrunningv1.Operation, error) {
-	res, err := r.col.Find(ctx, filter, options.Find().SetSort(bson.D{
+func (r *Repo) find(ctx context.Context, filter bson.M, mask *ReadMask) ([]*longrunningv1.Operation, error) {
+	return r.findWithOptions(ctx, filter, mask, options.Find().SetSort(bson.D{
 		{
 			Key:   "createTime",
 			Value: -1,
 		},
 	}))
+}
+
+// findWithOptions is like find but uses opts to sort and limit the result.
+// The projection of opts is replaced by the one of mask.
+func (r *Repo) findWithOptions(ctx context.Context, filter bson.M, mask *ReadMask, opts *options.FindOptions) ([]*longrunningv1.Operation, error) {
+	res, err := r.col.Find(ctx, filter, opts.SetProjection(mask.projection()))
 	if err != nil {
 		return nil, err
 	}
@@ -260,7 +1615,7 @@ func (r *Repo) find(ctx context.Context, filter bson.M) ([]*longrunningv1.Operat
 	errs := new(multierror.Error)
 	pbRes := make([]*longrunningv1.Operation, 0, len(models))
 	for _, m := range models {
-		pb, err := m.ToProto()
+		pb, err := m.toProto(mask, r.limits)
 		if err != nil {
 			errs.Errors = append(errs.Errors, fmt.Errorf("failed to convert operation with id %q: %w", m.ID.Hex(), err))
 		} else {
@@ -271,13 +1626,19 @@ func (r *Repo) find(ctx context.Context, filter bson.M) ([]*longrunningv1.Operat
 	return pbRes, errs.ErrorOrNil()
 }
 
-func (r *Repo) findOperation(ctx context.Context, id primitive.ObjectID) (*Operation, error) {
+// findOperation loads the stored document of an operation, including it's auth
+// token. Use it only to validate mutations.
+func (r *Repo) findOperation(ctx context.Context, id primitive.ObjectID) (*document, error) {
 	bsonDoc := r.col.FindOne(ctx, bson.M{"_id": id})
 	if err := bsonDoc.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
 		return nil, err
 	}
 
-	var op Operation
+	var op document
 	if err := bsonDoc.Decode(&op); err != nil {
 		return nil, fmt.Errorf("failed to decode operation: %w", err)
 	}
@@ -285,26 +1646,53 @@ func (r *Repo) findOperation(ctx context.Context, id primitive.ObjectID) (*Opera
 	return &op, nil
 }
 
-func (r *Repo) getAndValidateUpdate(ctx context.Context, id primitive.ObjectID, authToken string) (*Operation, error) {
-	// first, query the operation to validate the update request.
+// validateUpdate validates that the operation may be mutated, see
+// Operation.authorize. Mutations that transition the operation to state and
+// mutations that have been authorized without the auth token are recorded in
+// the audit log of the operation. state may be
+// OperationState_UNSPECIFIED if the mutation does not change the state.
+func (r *Repo) validateUpdate(ctx context.Context, id primitive.ObjectID, authToken string, opts UpdateOptions, action string, state longrunningv1.OperationState) (*document, error) {
 	op, err := r.findOperation(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	// Validate that we are allowed to update the operation.
-	if err := op.CanUpdate(authToken); err != nil {
+	entry, err := op.authorize(authToken, opts, action)
+	if err != nil {
 		return nil, err
 	}
 
+	if state != longrunningv1.OperationState_OperationState_UNSPECIFIED && state != op.State {
+		entry.State = state
+	}
+
+	if entry.Reason != "auth-token" || entry.State != longrunningv1.OperationState_OperationState_UNSPECIFIED {
+		if _, err := r.col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$push": bson.M{"audit": entry}}); err != nil {
+			return nil, fmt.Errorf("failed to record audit entry: %w", err)
+		}
+	}
+
 	return op, nil
 }
 
 func (r *Repo) findAndUpdateOperation(ctx context.Context, id primitive.ObjectID, updDoc any) (*Operation, error) {
+	return r.findAndApplyUpdate(ctx, id, bson.M{"$set": updDoc})
+}
+
+// findAndApplyUpdate is like findAndUpdateOperation but accepts a complete
+// update document instead of the fields to set.
+func (r *Repo) findAndApplyUpdate(ctx context.Context, id primitive.ObjectID, update bson.M) (*Operation, error) {
+	return r.findAndApplyFilteredUpdate(ctx, bson.M{"_id": id}, update)
+}
+
+// findAndApplyFilteredUpdate is like findAndApplyUpdate but updates the
+// operation matching filter. mongo.ErrNoDocuments is returned if there is
+// none.
+func (r *Repo) findAndApplyFilteredUpdate(ctx context.Context, filter bson.M, update bson.M) (*Operation, error) {
 	res := r.col.FindOneAndUpdate(
 		ctx,
-		bson.M{"_id": id},
-		bson.M{"$set": updDoc},
+		filter,
+		stampLastUpdate(update),
 		options.FindOneAndUpdate().SetReturnDocument(options.After),
 	)
 
@@ -320,9 +1708,48 @@ func (r *Repo) findAndUpdateOperation(ctx context.Context, id primitive.ObjectID
 	return &op, nil
 }
 
+// unsetField adds an $unset of field to update.
+func unsetField(update bson.M, field string) {
+	unset, ok := update["$unset"].(bson.M)
+	if !ok {
+		unset = bson.M{}
+		update["$unset"] = unset
+	}
+
+	unset[field] = ""
+}
+
+// newAuthToken returns a new random auth token for an operation.
+func newAuthToken() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Transaction runs fn in a transaction that is committed if fn returns
+// without an error. All methods of the repository that are called with the
+// context passed to fn are part of the transaction. fn may be invoked again
+// if the transaction is aborted due to a transient error.
+func (r *Repo) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	_, err := run(ctx, r, func(ctx mongo.SessionContext) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+
+	return err
+}
+
+// run runs fn in a transaction. If ctx belongs to a transaction already, see
+// Transaction, fn is run as part of it.
 func run[T any](ctx context.Context, r *Repo, fn func(mongo.SessionContext) (T, error)) (T, error) {
 	var empty T
 
+	if session := mongo.SessionFromContext(ctx); session != nil {
+		return fn(mongo.NewSessionContext(ctx, session))
+	}
+
 	session, err := r.cli.StartSession()
 	if err != nil {
 		return empty, fmt.Errorf("failed to start session: %w", err)
@@ -1,15 +1,26 @@
 package repo_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
 	"github.com/tierklinik-dobersberg/apis/pkg/mongotest"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"google.golang.org/protobuf/types/known/structpb"
@@ -43,14 +54,14 @@ func TestRepository(t *testing.T) {
 				"foo": "bar",
 			},
 			Kind: "test-op",
-		})
+		}, repo.RegisterOptions{})
 		require.NoError(t, err)
 		require.NotEmpty(t, id)
 		require.NotEmpty(t, auth)
 
 		op, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{
 			UniqueId: id,
-		})
+		}, nil)
 		require.NoError(t, err)
 		require.NotNil(t, op)
 		require.NotNil(t, op.CreateTime)
@@ -84,8 +95,28 @@ func TestRepository(t *testing.T) {
 		}
 	})
 
+	t.Run("GetOperation_ReadMask", func(t *testing.T) {
+		mask, err := repo.NewReadMask([]string{"kind", "percent_done"})
+		require.NoError(t, err)
+
+		op, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{
+			UniqueId: id,
+		}, mask)
+		require.NoError(t, err)
+
+		require.Equal(t, id, op.UniqueId)
+		require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, op.State)
+		require.Equal(t, "test-op", op.Kind)
+		require.Empty(t, op.Owner)
+		require.Nil(t, op.CreateTime)
+		require.Nil(t, op.Parameters)
+
+		_, err = repo.NewReadMask([]string{"auth_token"})
+		require.ErrorIs(t, err, repo.ErrInvalidReadMask)
+	})
+
 	t.Run("UpdateOperation", func(t *testing.T) {
-		op, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		op, _, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
 			UniqueId:  id,
 			Running:   false,
 			AuthToken: auth,
@@ -97,28 +128,51 @@ func TestRepository(t *testing.T) {
 					"running",
 				},
 			},
-		})
+		}, repo.UpdateOptions{})
 		require.NoError(t, err)
 
 		require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, op.State)
 		require.Equal(t, map[string]string{"foo": "bar"}, op.Annotations) // should not have been updated
 
-		op, err = r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		op, previous, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
 			UniqueId:  id,
 			AuthToken: auth,
 			Running:   true,
 			Annotations: map[string]string{
 				"bar": "foo",
 			},
-		})
+		}, repo.UpdateOptions{})
 		require.NoError(t, err)
 
+		require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, previous.State)
 		require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, op.State)
 		require.Equal(t, map[string]string{"bar": "foo"}, op.Annotations) // should not have been updated
 	})
 
+	t.Run("RegisterOperations", func(t *testing.T) {
+		res, err := r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{
+			{Owner: "test", Kind: "bulk-1"},
+			{Owner: "test", Kind: "bulk-2"},
+			{Owner: "test", Kind: "bulk-3"},
+		}, repo.RegisterOptions{})
+		require.NoError(t, err)
+		require.Len(t, res, 3)
+
+		for idx, reg := range res {
+			require.NotEmpty(t, reg.AuthToken)
+			require.Equal(t, fmt.Sprintf("bulk-%d", idx+1), reg.Operation.Kind)
+			require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, reg.Operation.State)
+		}
+
+		op, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{
+			UniqueId: res[1].Operation.UniqueId,
+		}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "bulk-2", op.Kind)
+	})
+
 	t.Run("UpdateOperation_NoAuthToken", func(t *testing.T) {
-		op, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		op, _, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
 			UniqueId: id,
 			Running:  false,
 			Annotations: map[string]string{
@@ -129,8 +183,1808 @@ func TestRepository(t *testing.T) {
 					"running",
 				},
 			},
-		})
+		}, repo.UpdateOptions{})
 		require.Error(t, err)
 		require.Nil(t, op)
 	})
+
+	t.Run("UpdateOperation_OwnerWithoutAuthToken", func(t *testing.T) {
+		upd := &longrunningv1.UpdateOperationRequest{
+			UniqueId:      id,
+			StatusMessage: "updated by owner",
+			UpdateMask: &fieldmaskpb.FieldMask{
+				Paths: []string{
+					"status_message",
+				},
+			},
+		}
+
+		_, _, err := r.UpdateOperation(ctx, upd, repo.UpdateOptions{Identity: "someone-else"})
+		require.ErrorIs(t, err, repo.ErrInvalidAuthToken)
+
+		op, _, err := r.UpdateOperation(ctx, upd, repo.UpdateOptions{Identity: "test"})
+		require.NoError(t, err)
+		require.Equal(t, "updated by owner", op.StatusMessage)
+	})
+}
+
+func TestParameterRoundTrip(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	nested, err := structpb.NewValue(map[string]any{
+		"list": []any{
+			"foo",
+			float64(1),
+			[]any{true, nil},
+			map[string]any{"bar": false},
+		},
+	})
+	require.NoError(t, err)
+
+	params := map[string]*structpb.Value{
+		// 2^60 + 2^10 is above 2^53 but still exactly representable as a double.
+		"id":     structpb.NewNumberValue(float64(int64(1<<60 + 1<<10))),
+		"count":  structpb.NewNumberValue(3),
+		"enable": structpb.NewBoolValue(true),
+		"none":   structpb.NewNullValue(),
+		"list": structpb.NewListValue(&structpb.ListValue{
+			Values: []*structpb.Value{
+				structpb.NewNumberValue(1),
+				structpb.NewListValue(&structpb.ListValue{
+					Values: []*structpb.Value{structpb.NewNullValue()},
+				}),
+			},
+		}),
+		"nested": nested,
+	}
+
+	id, _, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:      "test",
+		Kind:       "test-op",
+		Parameters: params,
+	}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	op, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}, nil)
+	require.NoError(t, err)
+
+	require.Len(t, op.Parameters, len(params))
+	for key, expected := range params {
+		require.Truef(t, proto.Equal(expected, op.Parameters[key]), "parameter %q: expected %v, got %v", key, expected, op.Parameters[key])
+	}
+
+	require.Equal(t, int64(1<<60+1<<10), int64(op.Parameters["id"].GetNumberValue()))
+}
+
+func TestExportImport(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	source, err := repo.NewRepoWithClient(ctx, cli, "export-db")
+	require.NoError(t, err)
+
+	target, err := repo.NewRepoWithClient(ctx, cli, "import-db")
+	require.NoError(t, err)
+
+	id, auth, err := source.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Parameters: map[string]*structpb.Value{
+			"count": structpb.NewNumberValue(3),
+			"list":  structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewBoolValue(true)}}),
+		},
+		Annotations: map[string]string{
+			"foo": "bar",
+		},
+		Kind: "test-op",
+	}, repo.RegisterOptions{Namespace: "clinic-a"})
+	require.NoError(t, err)
+
+	result, err := anypb.New(durationpb.New(time.Hour))
+	require.NoError(t, err)
+
+	_, _, err = source.CompleteOperation(ctx, &longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: auth,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: "done",
+				Result:  result,
+			},
+		},
+	}, repo.UpdateOptions{})
+	require.NoError(t, err)
+
+	// operations with fields that are not part of the API definition.
+	running, runningAuth, err := source.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+	}, repo.RegisterOptions{
+		ExternalRef: "ticket-1",
+		Links:       []repo.Link{{Title: "Ticket", URL: "https://example.com/tickets/1"}},
+		Priority:    5,
+		MaxRuntime:  time.Hour,
+	})
+	require.NoError(t, err)
+
+	_, err = source.AddNote(ctx, running, "alice", "looks good", nil)
+	require.NoError(t, err)
+
+	_, err = source.AddAttachment(ctx, running, runningAuth, repo.Attachment{
+		Name:      "report",
+		MediaType: "text/plain",
+		URL:       "https://example.com/report.txt",
+	}, nil)
+	require.NoError(t, err)
+
+	// updates without the auth token are recorded in the audit log.
+	_, _, err = source.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		UniqueId:      running,
+		Running:       true,
+		StatusMessage: "halfway",
+	}, repo.UpdateOptions{Identity: "test"})
+	require.NoError(t, err)
+
+	pause := true
+	_, _, err = source.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		UniqueId:  running,
+		AuthToken: runningAuth,
+		Running:   true,
+	}, repo.UpdateOptions{Pause: &pause})
+	require.NoError(t, err)
+
+	startTime := time.Now().Add(time.Hour)
+	scheduled, scheduledAuth, err := source.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Ttl:   durationpb.New(0),
+		Kind:  "test-op",
+	}, repo.RegisterOptions{
+		StartTime:     &startTime,
+		AllowNoExpiry: true,
+	})
+	require.NoError(t, err)
+
+	dependent, dependentAuth, err := source.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "test-op",
+	}, repo.RegisterOptions{
+		DependsOn: []string{running},
+		VisibleTo: []string{"carol"},
+		Retry:     &repo.RetryPolicy{MaxAttempts: 3, Backoff: time.Minute},
+	})
+	require.NoError(t, err)
+
+	_, err = source.AddTags(ctx, dependent, []string{"nightly"}, nil)
+	require.NoError(t, err)
+
+	ids := []string{id, running, scheduled, dependent}
+
+	rawDocument := func(db string, id string) bson.M {
+		oid, err := primitive.ObjectIDFromHex(id)
+		require.NoError(t, err)
+
+		var doc bson.M
+		require.NoError(t, cli.Database(db).Collection("long-running-operations").FindOne(ctx, bson.M{"_id": oid}).Decode(&doc))
+
+		return doc
+	}
+
+	// keys returns the fields of doc that are set to a non-null value.
+	keys := func(doc bson.M) []string {
+		result := make([]string, 0, len(doc))
+		for key, value := range doc {
+			if value != nil {
+				result = append(result, key)
+			}
+		}
+
+		return result
+	}
+
+	t.Run("ExcludesAuthTokens", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+
+		count, err := source.ExportOperations(ctx, buf, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{}, false)
+		require.NoError(t, err)
+		require.Equal(t, len(ids), count)
+
+		for _, token := range []string{auth, runningAuth, scheduledAuth, dependentAuth} {
+			require.NotContains(t, buf.String(), token)
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+
+		count, err := source.ExportOperations(ctx, buf, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{}, true)
+		require.NoError(t, err)
+		require.Equal(t, len(ids), count)
+		require.Contains(t, buf.String(), auth)
+
+		// importing twice must upsert the existing operations
+		for i := 0; i < 2; i++ {
+			count, err = target.ImportOperations(ctx, bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, len(ids), count)
+		}
+
+		for _, id := range ids {
+			expected, err := source.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+			require.NoError(t, err)
+
+			actual, err := target.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+			require.NoError(t, err)
+
+			if !proto.Equal(expected, actual) {
+				expectedBlob, _ := protojson.MarshalOptions{Indent: "  "}.Marshal(expected)
+				actualBlob, _ := protojson.MarshalOptions{Indent: "  "}.Marshal(actual)
+
+				t.Errorf("got unexpected result:\n\texpected:\n%s\nactual:\n%s", string(expectedBlob), string(actualBlob))
+			}
+
+			// the stored documents must match as well, including the fields
+			// that are not part of the API and without the computed
+			// annotations being written back.
+			expectedDoc := rawDocument("export-db", id)
+			actualDoc := rawDocument("import-db", id)
+
+			require.ElementsMatch(t, keys(expectedDoc), keys(actualDoc), id)
+			require.Equal(t, expectedDoc["annotations"], actualDoc["annotations"], id)
+			require.Equal(t, expectedDoc["authToken"], actualDoc["authToken"], id)
+		}
+
+		ops, err := target.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{Namespaces: []string{"clinic-a"}})
+		require.NoError(t, err)
+		require.Len(t, ops, 1)
+
+		// imported operations keep their viewers.
+		_, err = target.GetVisibleOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: dependent}, nil, repo.Viewer{ID: "mallory"})
+		require.ErrorIs(t, err, repo.ErrNotFound)
+
+		_, err = target.GetVisibleOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: dependent}, nil, repo.Viewer{ID: "carol"})
+		require.NoError(t, err)
+	})
+}
+
+func TestListOperations(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	const count = 3000
+
+	regs := make([]*longrunningv1.RegisterOperationRequest, count)
+	for idx := range regs {
+		kind := "even"
+		if idx%2 == 1 {
+			kind = "odd"
+		}
+
+		regs[idx] = &longrunningv1.RegisterOperationRequest{
+			Owner: "test",
+			Kind:  kind,
+		}
+	}
+
+	_, err = r.RegisterOperations(ctx, regs, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	var (
+		streamed int
+		last     time.Time
+	)
+	err = r.ListOperations(ctx, &longrunningv1.QueryOperationsRequest{Kind: "odd"}, repo.QueryOptions{}, func(op *longrunningv1.Operation) error {
+		require.Equal(t, "odd", op.Kind)
+
+		// operations are sorted by their create time in descending order
+		if streamed > 0 {
+			require.False(t, op.CreateTime.AsTime().After(last))
+		}
+		last = op.CreateTime.AsTime()
+
+		streamed++
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, count/2, streamed)
+
+	// iteration stops at the first error
+	stop := fmt.Errorf("stop")
+	streamed = 0
+	err = r.ListOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{}, func(op *longrunningv1.Operation) error {
+		streamed++
+		if streamed == 10 {
+			return stop
+		}
+
+		return nil
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, 10, streamed)
+}
+
+func TestExternalRef(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	reg := &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "tkd.customer.v1/import-job",
+	}
+	opts := repo.RegisterOptions{ExternalRef: "batch-1"}
+
+	id, auth, err := r.RegisterOperation(ctx, reg, opts)
+	require.NoError(t, err)
+
+	// the same reference may be used for other kinds
+	_, _, err = r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "tkd.customer.v1/export-job",
+	}, opts)
+	require.NoError(t, err)
+
+	// but not for a second active operation of the same kind
+	_, _, err = r.RegisterOperation(ctx, reg, opts)
+	require.ErrorIs(t, err, repo.ErrAlreadyExists)
+
+	var existsErr *repo.AlreadyExistsError
+	require.ErrorAs(t, err, &existsErr)
+	require.Equal(t, id, existsErr.Existing.UniqueId)
+
+	resolved, err := r.ResolveExternalRef(ctx, reg.Kind, "batch-1")
+	require.NoError(t, err)
+	require.Equal(t, id, resolved)
+
+	_, err = r.ResolveExternalRef(ctx, reg.Kind, "batch-2")
+	require.ErrorIs(t, err, repo.ErrNotFound)
+
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{ExternalRef: "batch-1"})
+	require.NoError(t, err)
+	require.Len(t, ops, 2)
+	require.Equal(t, "batch-1", ops[0].Annotations["tkd.longrunning.v1/external-ref"])
+
+	// the reference can be re-used once the operation completed
+	_, _, err = r.CompleteOperation(ctx, &longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: auth,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}, repo.UpdateOptions{})
+	require.NoError(t, err)
+
+	second, _, err := r.RegisterOperation(ctx, reg, opts)
+	require.NoError(t, err)
+
+	resolved, err = r.ResolveExternalRef(ctx, reg.Kind, "batch-1")
+	require.NoError(t, err)
+	require.Equal(t, second, resolved)
+}
+
+func TestOutbox(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	var events []*anypb.Any
+	for _, msg := range []string{"first", "second", "third"} {
+		evt, err := anypb.New(structpb.NewStringValue(msg))
+		require.NoError(t, err)
+
+		events = append(events, evt)
+	}
+
+	require.NoError(t, r.EnqueueEvents(ctx, events))
+
+	count, err := r.CountPendingEvents(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), count)
+
+	claimed, err := r.ClaimEvents(ctx, 2, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	require.True(t, proto.Equal(events[0], claimed[0].Event))
+	require.True(t, proto.Equal(events[1], claimed[1].Event))
+
+	// claimed events are not returned again while the lease is active
+	rest, err := r.ClaimEvents(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	require.True(t, proto.Equal(events[2], rest[0].Event))
+
+	require.NoError(t, r.MarkEventDelivered(ctx, claimed[0].ID))
+	require.NoError(t, r.MarkEventFailed(ctx, claimed[1].ID, fmt.Errorf("unavailable"), time.Now().Add(-time.Second)))
+
+	count, err = r.CountPendingEvents(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+
+	// failed events are claimed again once retryAt passed
+	retried, err := r.ClaimEvents(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, retried, 1)
+	require.Equal(t, claimed[1].ID, retried[0].ID)
+	require.Equal(t, 1, retried[0].Attempts)
+	require.Equal(t, "unavailable", retried[0].LastError)
+}
+
+func TestKindDefaults(t *testing.T) {
+	var kinds repo.KindDefaults
+
+	require.NoError(t, kinds.EnvDecode(`{
+		"tkd.backup.v1/*": {"ttl": "1h", "gracePeriod": "10m"},
+		"tkd.backup.v1/verify*": {"ttl": "10m"},
+		"tkd.backup.v1/create": {"pendingTimeout": "5m"},
+		"*": {"ttl": "2m"}
+	}`))
+
+	limits := repo.DurationLimits{
+		DefaultTTL:         5 * time.Minute,
+		DefaultGracePeriod: 5 * time.Minute,
+		Kinds:              kinds,
+	}
+
+	cases := map[string]repo.KindDefault{
+		"tkd.backup.v1/prune":      {Pattern: "tkd.backup.v1/*", TTL: time.Hour, GracePeriod: 10 * time.Minute},
+		"tkd.backup.v1/verify-all": {Pattern: "tkd.backup.v1/verify*", TTL: 10 * time.Minute, GracePeriod: 5 * time.Minute},
+		"tkd.backup.v1/create":     {Pattern: "tkd.backup.v1/create", TTL: 5 * time.Minute, GracePeriod: 5 * time.Minute, PendingTimeout: 5 * time.Minute},
+		"tkd.notify.v1/send-mails": {Pattern: "*", TTL: 2 * time.Minute, GracePeriod: 5 * time.Minute},
+	}
+
+	for kind, expected := range cases {
+		require.Equal(t, expected, limits.Defaults(kind), kind)
+	}
+
+	// without per-kind defaults the global ones apply
+	limits.Kinds = nil
+	require.Equal(t, repo.KindDefault{TTL: 5 * time.Minute, GracePeriod: 5 * time.Minute}, limits.Defaults("tkd.backup.v1/create"))
+
+	require.Error(t, kinds.EnvDecode(`{"tkd.*.v1/create": {"ttl": "1h"}}`))
+	require.Error(t, kinds.EnvDecode(`{"tkd.backup.v1/*": {"ttl": "-1h"}}`))
+	require.Error(t, kinds.EnvDecode(`not json`))
+}
+
+func TestQuota(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	opts := repo.RegisterOptions{
+		Quota: repo.Quota{MaxPerOwner: 3, MaxPerKind: 4},
+	}
+
+	reg := func(owner, kind string) *longrunningv1.RegisterOperationRequest {
+		return &longrunningv1.RegisterOperationRequest{
+			Owner:        owner,
+			Kind:         kind,
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		}
+	}
+
+	var ids, tokens []string
+	for range 3 {
+		id, auth, err := r.RegisterOperation(ctx, reg("alice", "tkd.test.v1/job"), opts)
+		require.NoError(t, err)
+
+		ids = append(ids, id)
+		tokens = append(tokens, auth)
+	}
+
+	_, _, err = r.RegisterOperation(ctx, reg("alice", "tkd.test.v1/other"), opts)
+	require.ErrorIs(t, err, repo.ErrQuotaExceeded)
+
+	// batches are rejected as a whole
+	_, err = r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{
+		reg("bob", "tkd.test.v1/job"),
+		reg("carol", "tkd.test.v1/job"),
+	}, opts)
+	require.ErrorIs(t, err, repo.ErrQuotaExceeded)
+
+	_, _, err = r.RegisterOperation(ctx, reg("bob", "tkd.test.v1/job"), opts)
+	require.NoError(t, err)
+
+	// a zero quota is not enforced
+	_, _, err = r.RegisterOperation(ctx, reg("alice", "tkd.test.v1/job"), repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	// completed operations do not count against the quota
+	for idx := range 2 {
+		_, _, err = r.CompleteOperation(ctx, &longrunningv1.CompleteOperationRequest{
+			UniqueId:  ids[idx],
+			AuthToken: tokens[idx],
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}, repo.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	_, _, err = r.RegisterOperation(ctx, reg("alice", "tkd.test.v1/other"), opts)
+	require.NoError(t, err)
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	const limit = 5
+
+	opts := repo.RegisterOptions{
+		Quota: repo.Quota{MaxPerOwner: limit},
+	}
+
+	var wg sync.WaitGroup
+	for range 4 * limit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, _, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+				Owner:        "alice",
+				InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			}, opts)
+			if err != nil {
+				require.ErrorIs(t, err, repo.ErrQuotaExceeded)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{})
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(ops), limit)
+	require.NotEmpty(t, ops)
+}
+
+func TestEstimatedCompletion(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	samples := func(percents ...int) []repo.ProgressSample {
+		res := make([]repo.ProgressSample, len(percents))
+		for idx, p := range percents {
+			res[idx] = repo.ProgressSample{
+				Time:        start.Add(time.Duration(idx) * time.Minute),
+				PercentDone: p,
+			}
+		}
+
+		return res
+	}
+
+	eta := func(state longrunningv1.OperationState, progress []repo.ProgressSample) string {
+		model := repo.Operation{
+			State:    state,
+			Progress: progress,
+		}
+
+		pb, err := model.ToProto()
+		require.NoError(t, err)
+
+		return pb.Annotations[op.EstimatedCompletionAnnotation]
+	}
+
+	running := longrunningv1.OperationState_OperationState_RUNNING
+
+	// 10 percent per minute, 60 percent remaining at 12:03
+	require.Equal(t, "2024-01-01T12:09:00Z", eta(running, samples(10, 20, 30, 40)))
+
+	require.Empty(t, eta(running, nil))
+	require.Empty(t, eta(running, samples(10)))
+	require.Empty(t, eta(running, samples(40, 40, 40)))
+	require.Empty(t, eta(longrunningv1.OperationState_OperationState_COMPLETE, samples(10, 20, 30)))
+	require.Empty(t, eta(longrunningv1.OperationState_OperationState_LOST, samples(10, 20, 30)))
+}
+
+func TestAudit(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	id, auth, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "alice",
+		InitialState: longrunningv1.OperationState_OperationState_PENDING,
+	}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	worker := repo.UpdateOptions{Identity: "cron-runner"}
+
+	// state transitions are recorded even if authorized by the auth token
+	pb, _, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		UniqueId:   id,
+		AuthToken:  auth,
+		Running:    true,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"running"}},
+	}, worker)
+	require.NoError(t, err)
+	require.Equal(t, "cron-runner", pb.Annotations[op.LastUpdatedByAnnotation])
+
+	// other token authorized updates are not
+	_, _, err = r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     auth,
+		StatusMessage: "working",
+		UpdateMask:    &fieldmaskpb.FieldMask{Paths: []string{"status_message"}},
+	}, worker)
+	require.NoError(t, err)
+
+	pb, _, err = r.CompleteOperation(ctx, &longrunningv1.CompleteOperationRequest{
+		UniqueId: id,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}, repo.UpdateOptions{Identity: "alice"})
+	require.NoError(t, err)
+	require.Equal(t, "alice", pb.Annotations[op.LastUpdatedByAnnotation])
+
+	audit, err := op.ParseAudit(pb)
+	require.NoError(t, err)
+	require.Len(t, audit, 2)
+
+	require.Equal(t, "cron-runner", audit[0].Actor)
+	require.Equal(t, "update", audit[0].Action)
+	require.Equal(t, "auth-token", audit[0].Reason)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING.String(), audit[0].State)
+
+	require.Equal(t, "alice", audit[1].Actor)
+	require.Equal(t, "complete", audit[1].Action)
+	require.Equal(t, "owner", audit[1].Reason)
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE.String(), audit[1].State)
+}
+
+func TestSuppressDuplicates(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	reg := func(params map[string]any) *longrunningv1.RegisterOperationRequest {
+		s, err := structpb.NewStruct(params)
+		require.NoError(t, err)
+
+		return &longrunningv1.RegisterOperationRequest{
+			Owner:        "cron",
+			Kind:         "tkd.backup.v1/create",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Parameters:   s.Fields,
+		}
+	}
+
+	opts := repo.RegisterOptions{SuppressDuplicatesWithin: time.Minute}
+
+	params := map[string]any{"target": "s3", "full": true}
+
+	id, auth, err := r.RegisterOperation(ctx, reg(params), opts)
+	require.NoError(t, err)
+	require.NotEmpty(t, auth)
+
+	// duplicates are returned without an auth token
+	dupID, dupAuth, err := r.RegisterOperation(ctx, reg(map[string]any{"full": true, "target": "s3"}), opts)
+	require.NoError(t, err)
+	require.Equal(t, id, dupID)
+	require.Empty(t, dupAuth)
+
+	// different parameters are not a duplicate
+	otherID, _, err := r.RegisterOperation(ctx, reg(map[string]any{"target": "local"}), opts)
+	require.NoError(t, err)
+	require.NotEqual(t, id, otherID)
+
+	// duplicates are only suppressed if requested
+	freshID, _, err := r.RegisterOperation(ctx, reg(params), repo.RegisterOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, id, freshID)
+
+	// completed operations are not considered
+	for _, opID := range []string{id, freshID} {
+		_, _, err = r.CompleteOperation(ctx, &longrunningv1.CompleteOperationRequest{
+			UniqueId: opID,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}, repo.UpdateOptions{Admin: true})
+		require.NoError(t, err)
+	}
+
+	newID, newAuth, err := r.RegisterOperation(ctx, reg(params), opts)
+	require.NoError(t, err)
+	require.NotEqual(t, id, newID)
+	require.NotEmpty(t, newAuth)
+}
+
+func TestLimitResult(t *testing.T) {
+	limits := repo.Limits{
+		MaxResultSize: 1024,
+	}
+
+	complete := func(message string, result *anypb.Any) *longrunningv1.CompleteOperationRequest {
+		return &longrunningv1.CompleteOperationRequest{
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{
+					Message: message,
+					Result:  result,
+				},
+			},
+		}
+	}
+
+	// results within the limit are not changed
+	req := complete("ok", nil)
+	size, err := limits.LimitResult(req)
+	require.NoError(t, err)
+	require.Zero(t, size)
+	require.Equal(t, "ok", req.GetSuccess().Message)
+
+	// oversized messages keep their beginning and end
+	message := "head" + strings.Repeat("ä", 2048) + "tail"
+	result, err := anypb.New(structpb.NewStringValue("result"))
+	require.NoError(t, err)
+
+	req = complete(message, result)
+	original := proto.Size(req.GetSuccess())
+
+	size, err = limits.LimitResult(req)
+	require.NoError(t, err)
+	require.Equal(t, original, size)
+	require.LessOrEqual(t, proto.Size(req.GetSuccess()), limits.MaxResultSize)
+	require.True(t, utf8.ValidString(req.GetSuccess().Message))
+	require.True(t, strings.HasPrefix(req.GetSuccess().Message, "head"))
+	require.True(t, strings.HasSuffix(req.GetSuccess().Message, "tail"))
+	require.Contains(t, req.GetSuccess().Message, "bytes truncated")
+	require.NotNil(t, req.GetSuccess().Result)
+
+	// results that do not leave room for the message are dropped
+	large, err := anypb.New(structpb.NewStringValue(strings.Repeat("x", 2048)))
+	require.NoError(t, err)
+
+	req = complete(message, large)
+	_, err = limits.LimitResult(req)
+	require.NoError(t, err)
+	require.Nil(t, req.GetSuccess().Result)
+	require.LessOrEqual(t, proto.Size(req.GetSuccess()), limits.MaxResultSize)
+
+	// strict mode rejects oversized results
+	limits.StrictResultSize = true
+
+	req = complete(message, nil)
+	_, err = limits.LimitResult(req)
+	require.ErrorIs(t, err, repo.ErrSizeLimitExceeded)
+	require.Equal(t, message, req.GetSuccess().Message)
+}
+
+func TestPurgeOperations(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	register := func(kind string, complete bool) string {
+		id, auth, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Kind:         kind,
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		}, repo.RegisterOptions{})
+		require.NoError(t, err)
+
+		_, err = r.AddAttachment(ctx, id, auth, repo.Attachment{Name: "log.txt", MediaType: "text/plain"}, strings.NewReader("junk"))
+		require.NoError(t, err)
+
+		if complete {
+			_, _, err = r.CompleteOperation(ctx, &longrunningv1.CompleteOperationRequest{
+				UniqueId:  id,
+				AuthToken: auth,
+				Result: &longrunningv1.CompleteOperationRequest_Success{
+					Success: &longrunningv1.OperationSuccess{},
+				},
+			}, repo.UpdateOptions{})
+			require.NoError(t, err)
+		}
+
+		return id
+	}
+
+	junk := []string{register("junk", true), register("junk", true)}
+	running := register("junk", false)
+	keep := register("keep", true)
+
+	query := &longrunningv1.QueryOperationsRequest{
+		Kind:  "junk",
+		State: longrunningv1.OperationState_OperationState_COMPLETE,
+	}
+
+	// active operations can never be purged
+	_, err = r.PurgeOperations(ctx, &longrunningv1.QueryOperationsRequest{Kind: "junk"}, repo.PurgeOptions{})
+	require.ErrorIs(t, err, repo.ErrInvalidPurge)
+
+	res, err := r.PurgeOperations(ctx, query, repo.PurgeOptions{DryRun: true, SampleSize: 10})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Count)
+	require.ElementsMatch(t, junk, res.Sample)
+
+	for _, id := range junk {
+		_, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+		require.NoError(t, err)
+	}
+
+	res, err = r.PurgeOperations(ctx, query, repo.PurgeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Count)
+	require.Empty(t, res.Sample)
+
+	for _, id := range junk {
+		_, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+		require.ErrorIs(t, err, repo.ErrNotFound)
+	}
+
+	for _, id := range []string{running, keep} {
+		_, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+		require.NoError(t, err)
+	}
+
+	// only the attachment content of the remaining operations is kept
+	files, err := cli.Database("test-db").Collection("operation-attachments.files").CountDocuments(ctx, bson.M{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), files)
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := repo.NormalizeTags([]string{" Needs-Review ", "", "needs-review", "Customer-Escalation"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"needs-review", "customer-escalation"}, tags)
+
+	_, err = repo.NormalizeTags([]string{strings.Repeat("x", 65)})
+	require.ErrorIs(t, err, repo.ErrInvalidTag)
+
+	_, err = repo.NormalizeTags([]string{"a,b"})
+	require.ErrorIs(t, err, repo.ErrInvalidTag)
+}
+
+func TestTags(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	register := func() string {
+		id, _, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+			Owner: "test",
+			Kind:  "test-op",
+			Ttl:   durationpb.New(time.Minute),
+		}, repo.RegisterOptions{})
+		require.NoError(t, err)
+
+		return id
+	}
+
+	first, second := register(), register()
+
+	res, err := r.AddTags(ctx, first, []string{"Needs-Review", "escalation"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "needs-review,escalation", res.Annotations[op.TagsAnnotation])
+
+	_, err = r.AddTags(ctx, second, []string{"needs-review"}, nil)
+	require.NoError(t, err)
+
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{
+		Tags: []string{"needs-review", "escalation"},
+	})
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.Equal(t, first, ops[0].UniqueId)
+
+	res, err = r.RemoveTags(ctx, first, []string{"needs-review"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "escalation", res.Annotations[op.TagsAnnotation])
+
+	// the number of tags is limited
+	var tags []string
+	for i := 0; i < 20; i++ {
+		tags = append(tags, fmt.Sprintf("tag-%d", i))
+	}
+
+	_, err = r.AddTags(ctx, first, tags, nil)
+	require.ErrorIs(t, err, repo.ErrSizeLimitExceeded)
+
+	_, err = r.AddTags(ctx, "0123456789abcdef01234567", []string{"unknown"}, nil)
+	require.ErrorIs(t, err, repo.ErrNotFound)
+}
+
+func TestVisibility(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	public, _, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "alice",
+		Kind:  "test-op",
+		Ttl:   durationpb.New(time.Minute),
+	}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	restricted, _, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:   "alice",
+		Creator: "bob",
+		Kind:    "test-op",
+		Ttl:     durationpb.New(time.Minute),
+	}, repo.RegisterOptions{
+		VisibleTo: []string{"carol"},
+	})
+	require.NoError(t, err)
+
+	visible := func(viewer repo.Viewer) []string {
+		ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{
+			Viewer: &viewer,
+		})
+		require.NoError(t, err)
+
+		var ids []string
+		for _, pbop := range ops {
+			ids = append(ids, pbop.UniqueId)
+		}
+
+		return ids
+	}
+
+	for _, viewer := range []repo.Viewer{{ID: "alice"}, {ID: "bob"}, {ID: "carol"}, {ID: "admin", Admin: true}} {
+		require.ElementsMatch(t, []string{public, restricted}, visible(viewer), viewer.ID)
+
+		_, err := r.GetVisibleOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: restricted}, nil, viewer)
+		require.NoError(t, err, viewer.ID)
+	}
+
+	for _, viewer := range []repo.Viewer{{ID: "mallory"}, {}} {
+		require.Equal(t, []string{public}, visible(viewer))
+
+		_, err := r.GetVisibleOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: restricted}, nil, viewer)
+		require.ErrorIs(t, err, repo.ErrNotFound)
+	}
+
+	res, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: restricted}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "carol", res.Annotations[op.VisibleToAnnotation])
+}
+
+func TestPause(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	id, token, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+	}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	pause := func(paused bool, running bool) (*longrunningv1.Operation, error) {
+		op, _, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+			UniqueId:   id,
+			AuthToken:  token,
+			Running:    running,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"running"}},
+		}, repo.UpdateOptions{Pause: &paused})
+
+		return op, err
+	}
+
+	// only running operations can be paused
+	_, err = pause(true, false)
+	require.ErrorIs(t, err, repo.ErrInvalidPause)
+
+	res, err := pause(true, true)
+	require.NoError(t, err)
+	require.Contains(t, res.Annotations, op.PausedAtAnnotation)
+
+	// paused operations are not checked for TTL expiry
+	active, err := r.GetActiveOperations(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, active)
+
+	paused := true
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{Paused: &paused})
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.NotContains(t, ops[0].Annotations, op.LostInAnnotation)
+
+	res, err = pause(false, true)
+	require.NoError(t, err)
+	require.NotContains(t, res.Annotations, op.PausedAtAnnotation)
+
+	active, err = r.GetActiveOperations(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+
+	ops, err = r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{Paused: &paused})
+	require.NoError(t, err)
+	require.Empty(t, ops)
+}
+
+func TestPriority(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	register := func(priority int) (string, string) {
+		id, token, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Kind:         "test-op",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+		}, repo.RegisterOptions{Priority: priority})
+		require.NoError(t, err)
+
+		return id, token
+	}
+
+	low, _ := register(0)
+	high, _ := register(10)
+	medium, token := register(5)
+
+	_, _, err = r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "test-op",
+	}, repo.RegisterOptions{Priority: -1})
+	require.ErrorIs(t, err, repo.ErrInvalidPriority)
+
+	ids := func(ops []*longrunningv1.Operation) []string {
+		var res []string
+		for _, pbop := range ops {
+			res = append(res, pbop.UniqueId)
+		}
+
+		return res
+	}
+
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{SortByPriority: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{high, medium, low}, ids(ops))
+	require.Equal(t, "10", ops[0].Annotations[op.PriorityAnnotation])
+	require.NotContains(t, ops[2].Annotations, op.PriorityAnnotation)
+
+	// the default sort order is unchanged
+	ops, err = r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{medium, high, low}, ids(ops))
+
+	priority := 20
+	_, _, err = r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		UniqueId:   medium,
+		AuthToken:  token,
+		Running:    true,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"running"}},
+	}, repo.UpdateOptions{Priority: &priority})
+	require.NoError(t, err)
+
+	active, err := r.GetActiveOperations(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{medium, high, low}, ids(active))
+
+	dashboard, err := r.Dashboard(ctx, repo.DashboardOptions{RunningLimit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{medium, high}, ids(dashboard.Running))
+}
+
+func TestSchedule(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	id, _, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+	}, repo.RegisterOptions{StartTime: &start})
+	require.NoError(t, err)
+
+	pbop, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, pbop.State)
+	require.Equal(t, "true", pbop.Annotations[op.ScheduledAnnotation])
+	require.Equal(t, start.Format(time.RFC3339), pbop.Annotations[op.StartTimeAnnotation])
+
+	active, err := r.GetActiveOperations(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, active)
+
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{DueBefore: start.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+
+	ops, err = r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{DueBefore: start.Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Empty(t, ops)
+
+	// not due yet
+	started, err := r.StartDueOperations(ctx, nil, time.Now())
+	require.NoError(t, err)
+	require.Empty(t, started)
+
+	started, err = r.StartDueOperations(ctx, nil, start.Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, started, 1)
+	require.Equal(t, id, started[0].UniqueId)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, started[0].State)
+	require.NotContains(t, started[0].Annotations, op.ScheduledAnnotation)
+
+	// operations are started only once
+	started, err = r.StartDueOperations(ctx, nil, start.Add(time.Second))
+	require.NoError(t, err)
+	require.Empty(t, started)
+}
+
+func TestTemplates(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	_, err = r.CreateTemplate(ctx, repo.Template{
+		Kind:     "nightly-backup",
+		Owner:    "backup-service",
+		Schedule: "0 25 * * *",
+	}, nil)
+	require.ErrorIs(t, err, repo.ErrInvalidTemplate)
+
+	tmpl, err := r.CreateTemplate(ctx, repo.Template{
+		Kind:     "nightly-backup",
+		Owner:    "backup-service",
+		Schedule: "30 2 * * *",
+		Ttl:      time.Minute,
+	}, map[string]*structpb.Value{
+		"target": structpb.NewStringValue("s3"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, string(op.OverlapSkip), tmpl.Overlap)
+	require.Equal(t, 2, tmpl.NextRun.Hour())
+	require.Equal(t, 30, tmpl.NextRun.Minute())
+	require.True(t, tmpl.NextRun.After(time.Now()))
+
+	// not due yet
+	ops, err := r.MaterializeDueTemplates(ctx, time.Now())
+	require.NoError(t, err)
+	require.Empty(t, ops)
+
+	due := tmpl.NextRun.Add(time.Minute)
+
+	ops, err = r.MaterializeDueTemplates(ctx, due)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, ops[0].State)
+	require.Equal(t, "nightly-backup", ops[0].Kind)
+	require.Equal(t, tmpl.ID.Hex(), ops[0].Annotations[op.TemplateAnnotation])
+	require.Equal(t, "s3", ops[0].Parameters["target"].GetStringValue())
+
+	// the occurrence is only registered once
+	ops, err = r.MaterializeDueTemplates(ctx, due)
+	require.NoError(t, err)
+	require.Empty(t, ops)
+
+	list, err := r.ListTemplates(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, tmpl.NextRun.Add(24*time.Hour), list[0].NextRun)
+	require.NotNil(t, list[0].LastOperation)
+
+	// the previous occurrence is still pending so the next one is skipped
+	ops, err = r.MaterializeDueTemplates(ctx, list[0].NextRun)
+	require.NoError(t, err)
+	require.Empty(t, ops)
+
+	// nobody holds the auth token of the operation so the owner acquires it
+	res, err := r.AcquireOperation(ctx, list[0].LastOperation.Hex(), repo.UpdateOptions{Identity: "backup-service"})
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, res.Operation.State)
+
+	require.NoError(t, r.DeleteTemplate(ctx, tmpl.ID.Hex()))
+	require.ErrorIs(t, r.DeleteTemplate(ctx, tmpl.ID.Hex()), repo.ErrTemplateNotFound)
+}
+
+func TestMaxRuntime(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	res, err := r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+	}}, repo.RegisterOptions{MaxRuntime: time.Hour})
+	require.NoError(t, err)
+
+	id := res[0].Operation.UniqueId
+	require.Contains(t, res[0].Operation.Annotations, op.RuntimeDeadlineAnnotation)
+	require.Contains(t, res[0].Operation.Annotations, op.RemainingRuntimeAnnotation)
+
+	_, _, err = r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "test-op",
+	}, repo.RegisterOptions{MaxRuntime: -time.Hour})
+	require.ErrorIs(t, err, repo.ErrInvalidDuration)
+
+	exceeded, err := r.GetExceededOperations(ctx, nil, time.Now())
+	require.NoError(t, err)
+	require.Empty(t, exceeded)
+
+	later := time.Now().Add(2 * time.Hour)
+
+	exceeded, err = r.GetExceededOperations(ctx, nil, later)
+	require.NoError(t, err)
+	require.Len(t, exceeded, 1)
+	require.Equal(t, id, exceeded[0].UniqueId)
+
+	completed, err := r.CompleteExceededOperation(ctx, id, &longrunningv1.OperationError{Message: "timeout"}, later)
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, completed.State)
+	require.Equal(t, "timeout", completed.GetError().GetMessage())
+	require.NotContains(t, completed.Annotations, op.RemainingRuntimeAnnotation)
+
+	// operations are only completed once
+	_, err = r.CompleteExceededOperation(ctx, id, &longrunningv1.OperationError{Message: "timeout"}, later)
+	require.ErrorIs(t, err, repo.ErrNotFound)
+
+	exceeded, err = r.GetExceededOperations(ctx, nil, later)
+	require.NoError(t, err)
+	require.Empty(t, exceeded)
+}
+
+func TestRetry(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	_, _, err = r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "test-op",
+	}, repo.RegisterOptions{Retry: &repo.RetryPolicy{MaxAttempts: 0}})
+	require.ErrorIs(t, err, repo.ErrInvalidRetryPolicy)
+
+	res, err := r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(200 * time.Millisecond),
+		GracePeriod:  durationpb.New(0),
+	}}, repo.RegisterOptions{Retry: &repo.RetryPolicy{MaxAttempts: 2}})
+	require.NoError(t, err)
+
+	root := res[0].Operation.UniqueId
+
+	// operations are only lost once their ttl expired
+	_, err = r.MarkAsLost(ctx, root, &longrunningv1.OperationError{Message: "lost"})
+	require.ErrorIs(t, err, repo.ErrNotLost)
+	require.Equal(t, "1", res[0].Operation.Annotations[op.AttemptAnnotation])
+	require.Equal(t, "2", res[0].Operation.Annotations[op.MaxAttemptsAnnotation])
+
+	// operations that are not lost are not retried
+	next, err := r.RetryOperation(ctx, root, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, next)
+
+	time.Sleep(300 * time.Millisecond)
+
+	_, err = r.MarkAsLost(ctx, root, &longrunningv1.OperationError{Message: "lost"})
+	require.NoError(t, err)
+
+	// lost operations are not lost again
+	_, err = r.MarkAsLost(ctx, root, &longrunningv1.OperationError{Message: "lost"})
+	require.ErrorIs(t, err, repo.ErrNotLost)
+
+	// the retry is marked together with the lost state
+	pending, err := r.GetPendingRetries(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, root, pending[0].UniqueId)
+
+	next, err = r.RetryOperation(ctx, root, time.Now())
+	require.NoError(t, err)
+	require.NotNil(t, next)
+
+	pending, err = r.GetPendingRetries(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+	require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, next.State)
+	require.Equal(t, "2", next.Annotations[op.AttemptAnnotation])
+	require.Equal(t, root, next.Annotations[op.RootOperationAnnotation])
+
+	// each attempt is only retried once
+	again, err := r.RetryOperation(ctx, root, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, again)
+
+	rootID, err := primitive.ObjectIDFromHex(root)
+	require.NoError(t, err)
+
+	ops, err := r.QueryOperations(ctx, &longrunningv1.QueryOperationsRequest{}, repo.QueryOptions{RootID: rootID})
+	require.NoError(t, err)
+	require.Len(t, ops, 2)
+	require.Equal(t, root, ops[0].UniqueId)
+	require.Equal(t, next.UniqueId, ops[0].Annotations[op.NextAttemptAnnotation])
+	require.Equal(t, next.UniqueId, ops[1].UniqueId)
+
+	// nobody holds the auth token of the successor so the owner acquires it
+	acquired, err := r.AcquireOperation(ctx, next.UniqueId, repo.UpdateOptions{Identity: "test"})
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, acquired.Operation.State)
+
+	time.Sleep(300 * time.Millisecond)
+
+	_, err = r.MarkAsLost(ctx, next.UniqueId, &longrunningv1.OperationError{Message: "lost"})
+	require.NoError(t, err)
+
+	// all attempts have been made
+	pending, err = r.GetPendingRetries(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	next, err = r.RetryOperation(ctx, next.UniqueId, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, next)
+}
+
+func TestReplayCompletion(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	id, token, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+	}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	complete := func(result map[string]any) *longrunningv1.CompleteOperationRequest {
+		s, err := structpb.NewStruct(result)
+		require.NoError(t, err)
+
+		a, err := anypb.New(s)
+		require.NoError(t, err)
+
+		return &longrunningv1.CompleteOperationRequest{
+			UniqueId:  id,
+			AuthToken: token,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{
+					Message: "done",
+					Result:  a,
+				},
+			},
+		}
+	}
+
+	result := map[string]any{"a": 1, "b": "two", "c": true}
+
+	_, err = r.ReplayCompletion(ctx, complete(result), repo.UpdateOptions{})
+	require.ErrorIs(t, err, repo.ErrNotCompleted)
+
+	_, _, err = r.CompleteOperation(ctx, complete(result), repo.UpdateOptions{})
+	require.NoError(t, err)
+
+	_, _, err = r.CompleteOperation(ctx, complete(result), repo.UpdateOptions{})
+	require.ErrorIs(t, err, repo.ErrOperationCompleted)
+
+	// the same result is accepted, independent of the encoding of the map
+	replayed, err := r.ReplayCompletion(ctx, complete(result), repo.UpdateOptions{})
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, replayed.State)
+	require.Equal(t, "done", replayed.GetSuccess().GetMessage())
+
+	_, err = r.ReplayCompletion(ctx, complete(map[string]any{"a": 2}), repo.UpdateOptions{})
+	require.ErrorIs(t, err, repo.ErrResultConflict)
+
+	failed := complete(result)
+	failed.Result = &longrunningv1.CompleteOperationRequest_Error{
+		Error: &longrunningv1.OperationError{Message: "done"},
+	}
+
+	_, err = r.ReplayCompletion(ctx, failed, repo.UpdateOptions{})
+	require.ErrorIs(t, err, repo.ErrResultConflict)
+
+	wrongToken := complete(result)
+	wrongToken.AuthToken = "wrong"
+
+	_, err = r.ReplayCompletion(ctx, wrongToken, repo.UpdateOptions{})
+	require.ErrorIs(t, err, repo.ErrInvalidAuthToken)
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	id, token, err := r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Annotations: map[string]string{
+			"ui.acknowledged": "true",
+		},
+	}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	merge := func(annotations map[string]string) error {
+		_, _, err := r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+			UniqueId:    id,
+			AuthToken:   token,
+			Annotations: annotations,
+			UpdateMask: &fieldmaskpb.FieldMask{
+				Paths: []string{"annotations"},
+			},
+		}, repo.UpdateOptions{MergeAnnotations: true})
+
+		return err
+	}
+
+	// concurrent writers only touch their own keys
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			require.NoError(t, merge(map[string]string{
+				fmt.Sprintf("worker-%d", i): "ping",
+			}))
+		}()
+	}
+	wg.Wait()
+
+	pb, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "true", pb.Annotations["ui.acknowledged"])
+	for i := range 10 {
+		require.Equal(t, "ping", pb.Annotations[fmt.Sprintf("worker-%d", i)])
+	}
+
+	// empty values remove keys
+	require.NoError(t, merge(map[string]string{"ui.acknowledged": ""}))
+
+	pb, err = r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.NoError(t, err)
+	require.NotContains(t, pb.Annotations, "ui.acknowledged")
+	require.Contains(t, pb.Annotations, "worker-0")
+
+	// without merging, the annotations are replaced
+	_, _, err = r.UpdateOperation(ctx, &longrunningv1.UpdateOperationRequest{
+		UniqueId:    id,
+		AuthToken:   token,
+		Annotations: map[string]string{"only": "this"},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"annotations"},
+		},
+	}, repo.UpdateOptions{})
+	require.NoError(t, err)
+
+	pb, err = r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "this", pb.Annotations["only"])
+	require.NotContains(t, pb.Annotations, "worker-0")
+}
+
+func TestTransaction(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	register := func(ctx context.Context, fail bool) (string, error) {
+		var id string
+
+		err := r.Transaction(ctx, func(ctx context.Context) error {
+			var err error
+
+			id, _, err = r.RegisterOperation(ctx, &longrunningv1.RegisterOperationRequest{
+				Owner: "test",
+				Kind:  "test-op",
+			}, repo.RegisterOptions{})
+			if err != nil {
+				return err
+			}
+
+			evt, err := anypb.New(&longrunningv1.Operation{UniqueId: id})
+			if err != nil {
+				return err
+			}
+
+			if err := r.EnqueueEvents(ctx, []*anypb.Any{evt}); err != nil {
+				return err
+			}
+
+			if fail {
+				return fmt.Errorf("failed")
+			}
+
+			return nil
+		})
+
+		return id, err
+	}
+
+	// the operation and it's event are stored together
+	id, err := register(ctx, false)
+	require.NoError(t, err)
+
+	_, err = r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.NoError(t, err)
+
+	count, err := r.CountPendingEvents(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// or not at all
+	id, err = register(ctx, true)
+	require.ErrorContains(t, err, "failed")
+
+	_, err = r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.ErrorIs(t, err, repo.ErrNotFound)
+
+	count, err = r.CountPendingEvents(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
+func TestLease(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	ttl := 500 * time.Millisecond
+
+	_, err = r.GetLease(ctx, "manager")
+	require.ErrorIs(t, err, repo.ErrNotFound)
+
+	// acquisition
+	held, err := r.AcquireLease(ctx, "manager", "a", ttl)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	held, err = r.AcquireLease(ctx, "manager", "b", ttl)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	// leases with other names are independent
+	held, err = r.AcquireLease(ctx, "manager:ns", "b", ttl)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	// the expiry is computed by the server, independent of the clocks of
+	// the holders.
+	acquired, err := r.GetLease(ctx, "manager")
+	require.NoError(t, err)
+	require.Equal(t, "a", acquired.Holder)
+	require.Equal(t, ttl, acquired.ExpiresAt.Sub(acquired.AcquiredAt))
+
+	// renewal extends the expiry but keeps the acquisition time
+	time.Sleep(100 * time.Millisecond)
+
+	held, err = r.AcquireLease(ctx, "manager", "a", ttl)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	renewed, err := r.GetLease(ctx, "manager")
+	require.NoError(t, err)
+	require.Equal(t, "a", renewed.Holder)
+	require.True(t, renewed.ExpiresAt.After(acquired.ExpiresAt))
+	require.Equal(t, acquired.AcquiredAt, renewed.AcquiredAt)
+
+	// expiry: once expired, exactly one of the competing holders acquires
+	// the lease.
+	time.Sleep(ttl + 100*time.Millisecond)
+
+	var (
+		wg      sync.WaitGroup
+		winners atomic.Int32
+	)
+
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			held, err := r.AcquireLease(ctx, "manager", fmt.Sprintf("holder-%d", i), ttl)
+			require.NoError(t, err)
+
+			if held {
+				winners.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	require.Equal(t, int32(1), winners.Load())
+
+	// split-brain: the previous holder can neither renew the lease nor
+	// release it.
+	held, err = r.AcquireLease(ctx, "manager", "a", ttl)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	require.NoError(t, r.ReleaseLease(ctx, "manager", "a"))
+
+	current, err := r.GetLease(ctx, "manager")
+	require.NoError(t, err)
+	require.NotEqual(t, "a", current.Holder)
+
+	// once released, the lease can be acquired right away
+	require.NoError(t, r.ReleaseLease(ctx, "manager", current.Holder))
+
+	held, err = r.AcquireLease(ctx, "manager", "a", ttl)
+	require.NoError(t, err)
+	require.True(t, held)
+}
+
+func TestNoExpiry(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	r.SetDurationLimits(repo.DurationLimits{DefaultTTL: 5 * time.Minute, MinTTL: time.Minute})
+
+	reg := func() *longrunningv1.RegisterOperationRequest {
+		return &longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Kind:         "test-op",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(0),
+		}
+	}
+
+	// an explicit zero TTL must be allowed
+	_, _, err = r.RegisterOperation(ctx, reg(), repo.RegisterOptions{})
+	require.ErrorIs(t, err, repo.ErrInvalidDuration)
+
+	// zero is not subject to the bounds
+	require.NoError(t, repo.DurationLimits{MinTTL: time.Minute}.CheckRegistration(reg()))
+
+	id, _, err := r.RegisterOperation(ctx, reg(), repo.RegisterOptions{AllowNoExpiry: true})
+	require.NoError(t, err)
+
+	pbop, err := r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil)
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), pbop.Ttl.AsDuration())
+	require.Equal(t, "true", pbop.Annotations[op.NoExpiryAnnotation])
+	require.NotContains(t, pbop.Annotations, op.LostInAnnotation)
+
+	// an absent TTL falls back to the default
+	withDefault := reg()
+	withDefault.Ttl = nil
+
+	defaultID, _, err := r.RegisterOperation(ctx, withDefault, repo.RegisterOptions{AllowNoExpiry: true})
+	require.NoError(t, err)
+
+	pbop, err = r.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: defaultID}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, pbop.Ttl.AsDuration())
+	require.NotContains(t, pbop.Annotations, op.NoExpiryAnnotation)
+
+	// operations without expiry are not checked by the manager
+	active, err := r.GetActiveOperations(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	require.Equal(t, defaultID, active[0].UniqueId)
+
+	pbop, err = r.GetActiveOperation(ctx, nil, id)
+	require.NoError(t, err)
+	require.Nil(t, pbop)
+}
+
+func TestGetExpiredOperations(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	reg := &longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Kind:         "test-op",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		GracePeriod:  durationpb.New(time.Minute),
+	}
+
+	expiredID, _, err := r.RegisterOperation(ctx, reg, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	res, err := r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{reg}, repo.RegisterOptions{})
+	require.NoError(t, err)
+
+	activeID := res[0].Operation.UniqueId
+
+	// lastUpdate is stamped by the server and returned as stored
+	var stamped struct {
+		LastUpdate time.Time `bson:"lastUpdate"`
+	}
+	oid, err := primitive.ObjectIDFromHex(activeID)
+	require.NoError(t, err)
+	col := cli.Database("test-db").Collection("long-running-operations")
+	require.NoError(t, col.FindOne(ctx, bson.M{"_id": oid}).Decode(&stamped))
+	require.WithinDuration(t, time.Now(), stamped.LastUpdate, 10*time.Second)
+	require.True(t, stamped.LastUpdate.Equal(res[0].Operation.LastUpdate.AsTime()))
+
+	// move the last update of the first operation past its TTL and grace period
+	oid, err = primitive.ObjectIDFromHex(expiredID)
+	require.NoError(t, err)
+	_, err = col.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"lastUpdate": time.Now().Add(-3 * time.Minute)}})
+	require.NoError(t, err)
+
+	expired, now, err := r.GetExpiredOperations(ctx, nil, nil)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), now, 10*time.Second)
+	require.Len(t, expired, 1)
+	require.Equal(t, expiredID, expired[0].UniqueId)
+
+	expired, _, err = r.GetExpiredOperations(ctx, nil, []string{activeID})
+	require.NoError(t, err)
+	require.Empty(t, expired)
+
+	expired, _, err = r.GetExpiredOperations(ctx, []string{"other"}, nil)
+	require.NoError(t, err)
+	require.Empty(t, expired)
+}
+
+func TestCheckpoints(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	// nothing recorded yet
+	last, now, err := r.LastCheck(ctx, "manager")
+	require.NoError(t, err)
+	require.True(t, last.IsZero())
+	require.False(t, now.IsZero())
+
+	require.NoError(t, r.RecordCheck(ctx, "manager"))
+
+	last, now, err = r.LastCheck(ctx, "manager")
+	require.NoError(t, err)
+	require.False(t, last.IsZero())
+	require.False(t, now.Before(last))
+	require.Less(t, now.Sub(last), 10*time.Second)
+
+	// checkpoints with other names are independent
+	last, _, err = r.LastCheck(ctx, "manager:ns")
+	require.NoError(t, err)
+	require.True(t, last.IsZero())
+
+	// recording again moves the checkpoint forward
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, r.RecordCheck(ctx, "manager"))
+
+	later, _, err := r.LastCheck(ctx, "manager")
+	require.NoError(t, err)
+	require.True(t, later.After(last))
 }
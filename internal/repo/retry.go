@@ -0,0 +1,320 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidRetryPolicy = errors.New("invalid retry policy")
+
+// maxRetryAttempts is the maximum number of attempts of a retry policy.
+const maxRetryAttempts = 100
+
+// RetryPolicy controls whether an operation is registered again once it has
+// been lost, see RetryOperation.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int `bson:"maxAttempts"`
+
+	// Backoff is the delay before the second attempt is started. It is
+	// doubled for each further attempt. Successors are started right away if
+	// zero.
+	Backoff time.Duration `bson:"backoff,omitempty"`
+}
+
+// CheckRetryPolicy returns an error wrapping ErrInvalidRetryPolicy if policy
+// is set but invalid.
+func CheckRetryPolicy(policy *RetryPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxAttempts < 1 || policy.MaxAttempts > maxRetryAttempts {
+		return fmt.Errorf("%w: max attempts must be between 1 and %d, got %d", ErrInvalidRetryPolicy, maxRetryAttempts, policy.MaxAttempts)
+	}
+
+	if policy.Backoff < 0 {
+		return fmt.Errorf("%w: backoff must not be negative", ErrInvalidRetryPolicy)
+	}
+
+	return nil
+}
+
+// delay returns the backoff before the successor of the given attempt is
+// started.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	return p.Backoff << min(attempt-1, 16)
+}
+
+func (r *Repo) setupRetries(ctx context.Context) error {
+	// each attempt must only be registered once, even if the lost operation
+	// is evaluated by multiple instances.
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "rootId", Value: 1},
+			{Key: "attempt", Value: 1},
+		},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"rootId": bson.M{
+				"$exists": true,
+			},
+		}),
+	}); err != nil {
+		return fmt.Errorf("failed to create retry index: %w", err)
+	}
+
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "retryPending", Value: 1},
+		},
+		Options: options.Index().SetPartialFilterExpression(bson.M{
+			"retryPending": true,
+		}),
+	}); err != nil {
+		return fmt.Errorf("failed to create pending retry index: %w", err)
+	}
+
+	return nil
+}
+
+// retryable reports whether a successor must be registered once op is lost.
+func (op *Operation) retryable() bool {
+	return op.Retry != nil && op.NextAttempt == nil && max(op.Attempt, 1) < op.Retry.MaxAttempts
+}
+
+// GetPendingRetries returns the LOST operations in the specified namespaces
+// that have been marked for a retry by MarkAsLost but whose successor has not
+// been registered yet, for example because the instance that marked them
+// stopped in between. If namespaces is empty, operations of all namespaces
+// are returned.
+func (r *Repo) GetPendingRetries(ctx context.Context, namespaces []string) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("GetPendingRetries", time.Now(), func() int { return len(ops) }, &err)
+
+	filter := bson.M{
+		"state":        longrunningv1.OperationState_OperationState_LOST,
+		"retryPending": true,
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	cursor, err := r.col.Find(ctx, filter, options.Find().SetProjection(bson.M{"authToken": 0}))
+	if err != nil {
+		return nil, err
+	}
+
+	var models []Operation
+	if err := cursor.All(ctx, &models); err != nil {
+		return nil, fmt.Errorf("failed to decode operations: %w", err)
+	}
+
+	ops = make([]*longrunningv1.Operation, 0, len(models))
+	for _, m := range models {
+		pb, err := m.toProto(nil, r.limits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert operation with id %q: %w", m.ID.Hex(), err)
+		}
+
+		ops = append(ops, pb)
+	}
+
+	return ops, nil
+}
+
+// RetryOperation evaluates the retry policy of the LOST operation with the
+// given id and registers its successor if attempts are left. The successor
+// is a copy of the registration of the lost operation that is PENDING, or
+// scheduled for the backoff of the policy, so a worker can acquire it, see
+// AcquireOperation. It is linked to the first attempt by its root id and
+// returned.
+//
+// Nil is returned without an error if the operation has no retry policy, has
+// no attempts left or has already been retried, so only one of concurrent
+// callers gets the successor. The retry marker set by MarkAsLost is cleared
+// in any of these cases.
+func (r *Repo) RetryOperation(ctx context.Context, id string, now time.Time) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("RetryOperation", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := r.findOperation(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	if model.State != longrunningv1.OperationState_OperationState_LOST {
+		return nil, nil
+	}
+
+	if !model.retryable() {
+		return nil, r.clearRetryPending(ctx, &model.Operation)
+	}
+
+	attempt := max(model.Attempt, 1)
+
+	authToken, err := newAuthToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// mongo only stores timestamps with millisecond precision
+	now = now.Truncate(time.Millisecond)
+
+	root := oid
+	if model.RootID != nil {
+		root = *model.RootID
+	}
+
+	next := Operation{
+		ID:               primitive.NewObjectID(),
+		CreateTime:       now,
+		LastUpdate:       now,
+		Namespace:        model.Namespace,
+		Owner:            model.Owner,
+		Creator:          model.Creator,
+		State:            longrunningv1.OperationState_OperationState_PENDING,
+		Ttl:              model.Ttl,
+		GracePeriod:      model.GracePeriod,
+		Description:      model.Description,
+		Parameters:       model.Parameters,
+		LegacyParameters: model.LegacyParameters,
+		Annotations:      model.Annotations,
+		Kind:             model.Kind,
+		PendingTimeout:   model.PendingTimeout,
+		Fingerprint:      model.Fingerprint,
+		ExternalRef:      model.ExternalRef,
+		Tags:             model.Tags,
+		Links:            model.Links,
+		VisibleTo:        model.VisibleTo,
+		Priority:         model.Priority,
+		MaxRuntime:       model.MaxRuntime,
+		Retry:            model.Retry,
+		Attempt:          attempt + 1,
+		RootID:           &root,
+	}
+
+	start := now
+	if delay := model.Retry.delay(attempt); delay > 0 {
+		start = now.Add(delay)
+		applySchedule(&next, &start, now)
+	} else if next.PendingTimeout > 0 {
+		deadline := now.Add(next.PendingTimeout)
+		next.PendingDeadline = &deadline
+	}
+
+	next.RuntimeDeadline = runtimeDeadline(start, next.MaxRuntime)
+
+	stored, err := r.insertOperations(ctx, []any{document{Operation: next, AuthToken: authToken}})
+	if err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("failed to register attempt %d: %w", next.Attempt, err)
+		}
+
+		// either the attempt has already been registered or another operation
+		// with the same external reference is active.
+		var existing Operation
+		ferr := r.col.FindOne(ctx, bson.M{"rootId": root, "attempt": next.Attempt}).Decode(&existing)
+		switch {
+		case ferr == nil:
+			// the successor may have been registered by a caller that failed
+			// to link it.
+			_, err := r.linkAttempt(ctx, oid, existing.ID)
+
+			return nil, err
+
+		case !errors.Is(ferr, mongo.ErrNoDocuments):
+			return nil, ferr
+		}
+
+		if cerr := r.clearRetryPending(ctx, &model.Operation); cerr != nil {
+			return nil, cerr
+		}
+
+		return nil, fmt.Errorf("%w: duplicate external reference %q", ErrAlreadyExists, model.ExternalRef)
+	}
+
+	linked, err := r.linkAttempt(ctx, oid, next.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link attempt %d: %w", next.Attempt, err)
+	}
+
+	if !linked {
+		return nil, nil
+	}
+
+	return stored[0].toProto(nil, r.limits)
+}
+
+// linkAttempt links the operation with the given id to its successor next and
+// clears its retry marker. It reports whether the operation has not been
+// linked before.
+func (r *Repo) linkAttempt(ctx context.Context, id, next primitive.ObjectID) (bool, error) {
+	res, err := r.col.UpdateOne(ctx, bson.M{
+		"_id":         id,
+		"nextAttempt": bson.M{"$exists": false},
+	}, bson.M{
+		"$set":   bson.M{"nextAttempt": next},
+		"$unset": bson.M{"retryPending": ""},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount > 0, nil
+}
+
+// clearRetryPending removes the retry marker of model, if any.
+func (r *Repo) clearRetryPending(ctx context.Context, model *Operation) error {
+	if !model.RetryPending {
+		return nil
+	}
+
+	if _, err := r.col.UpdateOne(ctx, bson.M{"_id": model.ID}, bson.M{"$unset": bson.M{"retryPending": ""}}); err != nil {
+		return fmt.Errorf("failed to clear retry marker: %w", err)
+	}
+
+	return nil
+}
+
+// unclaimed reports whether op is a PENDING operation that has been
+// registered by the service itself so nobody holds its auth token.
+func (op *Operation) unclaimed() bool {
+	if op.State != longrunningv1.OperationState_OperationState_PENDING || op.Scheduled {
+		return false
+	}
+
+	return op.Template != nil || op.Attempt > 1
+}
+
+func addRetryAnnotations(pbop *longrunningv1.Operation, policy *RetryPolicy, attempt int, root, next *primitive.ObjectID) {
+	if policy == nil {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.AttemptAnnotation] = strconv.Itoa(max(attempt, 1))
+	pbop.Annotations[op.MaxAttemptsAnnotation] = strconv.Itoa(policy.MaxAttempts)
+
+	if root != nil {
+		pbop.Annotations[op.RootOperationAnnotation] = root.Hex()
+	}
+
+	if next != nil {
+		pbop.Annotations[op.NextAttemptAnnotation] = next.Hex()
+	}
+}
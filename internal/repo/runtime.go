@@ -0,0 +1,117 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// runtimeDeadline returns the time at which an operation that is started at
+// start has exceeded maxRuntime, or nil if maxRuntime is zero.
+func runtimeDeadline(start time.Time, maxRuntime time.Duration) *time.Time {
+	if maxRuntime <= 0 {
+		return nil
+	}
+
+	deadline := start.Add(maxRuntime)
+
+	return &deadline
+}
+
+// GetExceededOperations returns all operations in the specified namespaces
+// that are neither COMPLETE nor LOST but whose maximum runtime has passed at
+// now, see RegisterOptions.MaxRuntime. Heartbeats do not extend the deadline.
+// If namespaces is empty, operations of all namespaces are returned.
+func (r *Repo) GetExceededOperations(ctx context.Context, namespaces []string, now time.Time) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("GetExceededOperations", time.Now(), func() int { return len(ops) }, &err)
+
+	filter := bson.M{
+		"state": bson.M{
+			"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+		},
+		"runtimeDeadline": bson.M{
+			"$lte": now,
+		},
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	return r.find(ctx, filter, nil)
+}
+
+// CompleteExceededOperation completes the operation with the given id with
+// reason as the error result because it exceeded its maximum runtime at now.
+// ErrNotFound is returned if the operation has been completed in the
+// meantime or has not exceeded its maximum runtime.
+func (r *Repo) CompleteExceededOperation(ctx context.Context, id string, reason *longrunningv1.OperationError, now time.Time) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("CompleteExceededOperation", time.Now(), nil, &err)
+
+	oid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// the filter makes sure concurrent managers and workers that complete
+	// the operation on their own do not overwrite each other.
+	res := r.col.FindOneAndUpdate(ctx, bson.M{
+		"_id": oid,
+		"state": bson.M{
+			"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+		},
+		"runtimeDeadline": bson.M{
+			"$lte": now,
+		},
+	}, stampLastUpdate(bson.M{
+		"$set": bson.M{
+			"state":      longrunningv1.OperationState_OperationState_COMPLETE,
+			"lastUpdate": now,
+			"error": Error{
+				Message: reason.Message,
+				Details: reason.ErrorDetails,
+			},
+		},
+		"$unset": bson.M{
+			"pausedAt":        "",
+			"scheduled":       "",
+			"autoStart":       "",
+			"pendingDeadline": "",
+		},
+	}), options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"authToken": 0}))
+
+	var model Operation
+	if err := res.Decode(&model); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("failed to complete operation: %w", err)
+	}
+
+	return model.toProto(nil, r.limits)
+}
+
+// addRuntimeAnnotations adds the computed op.RuntimeDeadlineAnnotation and,
+// for operations that are neither COMPLETE nor LOST,
+// op.RemainingRuntimeAnnotation.
+func addRuntimeAnnotations(pbop *longrunningv1.Operation, deadline *time.Time, now time.Time) {
+	if deadline == nil {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.RuntimeDeadlineAnnotation] = deadline.Format(time.RFC3339)
+
+	if pbop.State < longrunningv1.OperationState_OperationState_COMPLETE {
+		pbop.Annotations[op.RemainingRuntimeAnnotation] = deadline.Sub(now).Round(time.Second).String()
+	}
+}
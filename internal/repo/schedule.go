@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// applySchedule schedules o to be started at startTime, see
+// RegisterOptions.StartTime. Scheduled operations are PENDING until they are
+// due, their pending timeout only starts at the start time. Operations that
+// have been registered as RUNNING are started automatically once due.
+func applySchedule(o *Operation, startTime *time.Time, now time.Time) {
+	if startTime == nil {
+		return
+	}
+
+	start := startTime.Truncate(time.Millisecond)
+	o.StartTime = &start
+
+	if !start.After(now) {
+		return
+	}
+
+	o.Scheduled = true
+	o.AutoStart = o.State == longrunningv1.OperationState_OperationState_RUNNING
+	o.State = longrunningv1.OperationState_OperationState_PENDING
+
+	if o.PendingTimeout > 0 {
+		deadline := start.Add(o.PendingTimeout)
+		o.PendingDeadline = &deadline
+	}
+}
+
+// StartDueOperations starts all scheduled operations in the specified
+// namespaces whose start time has passed at now. Operations that have been
+// registered as RUNNING are switched to RUNNING, all others stay PENDING but
+// are no longer scheduled. The started operations are returned.
+// If namespaces is empty, operations of all namespaces are started.
+func (r *Repo) StartDueOperations(ctx context.Context, namespaces []string, now time.Time) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("StartDueOperations", time.Now(), func() int { return len(ops) }, &err)
+
+	filter := bson.M{
+		"scheduled": true,
+		"state":     longrunningv1.OperationState_OperationState_PENDING,
+		"startTime": bson.M{
+			"$lte": now,
+		},
+	}
+
+	r.addNamespaceFilter(filter, namespaces)
+
+	cursor, err := r.col.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "autoStart": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var due []Operation
+	if err := cursor.All(ctx, &due); err != nil {
+		return nil, fmt.Errorf("failed to decode operations: %w", err)
+	}
+
+	for _, model := range due {
+		state := longrunningv1.OperationState_OperationState_PENDING
+		if model.AutoStart {
+			state = longrunningv1.OperationState_OperationState_RUNNING
+		}
+
+		// the filter makes sure concurrent managers start the operation only
+		// once.
+		res := r.col.FindOneAndUpdate(ctx, bson.M{"_id": model.ID, "scheduled": true}, stampLastUpdate(bson.M{
+			"$set": bson.M{
+				"state":      state,
+				"lastUpdate": now,
+			},
+			"$unset": bson.M{
+				"scheduled": "",
+				"autoStart": "",
+			},
+		}), options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"authToken": 0}))
+
+		var started Operation
+		if err := res.Decode(&started); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				continue
+			}
+
+			return ops, fmt.Errorf("failed to start operation %q: %w", model.ID.Hex(), err)
+		}
+
+		pb, err := started.toProto(nil, r.limits)
+		if err != nil {
+			return ops, err
+		}
+
+		ops = append(ops, pb)
+	}
+
+	return ops, nil
+}
+
+func addScheduleAnnotations(pbop *longrunningv1.Operation, startTime *time.Time, scheduled bool) {
+	if startTime == nil {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.StartTimeAnnotation] = startTime.Format(time.RFC3339)
+
+	if scheduled && pbop.State == longrunningv1.OperationState_OperationState_PENDING {
+		pbop.Annotations[op.ScheduledAnnotation] = "true"
+	}
+}
@@ -0,0 +1,174 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidTag = errors.New("invalid tag")
+
+const (
+	// maxTags is the maximum number of tags per operation.
+	maxTags = 20
+
+	// maxTagLength is the maximum length of a tag in bytes.
+	maxTagLength = 64
+)
+
+// NormalizeTags trims and lowercases tags and removes empty values and
+// duplicates. An error wrapping ErrInvalidTag is returned if a tag is too
+// long or contains a comma.
+func NormalizeTags(tags []string) ([]string, error) {
+	var result []string
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+
+		switch {
+		case tag == "":
+			continue
+		case len(tag) > maxTagLength:
+			return nil, fmt.Errorf("%w: tag %q exceeds the maximum length of %d bytes", ErrInvalidTag, tag, maxTagLength)
+		case strings.Contains(tag, ","):
+			return nil, fmt.Errorf("%w: tag %q must not contain a comma", ErrInvalidTag, tag)
+		}
+
+		if !slices.Contains(result, tag) {
+			result = append(result, tag)
+		}
+	}
+
+	return result, nil
+}
+
+// AddTags adds tags to the operation, see NormalizeTags. Tags that are already
+// set are ignored. ErrSizeLimitExceeded is returned if the operation would end
+// up with more than maxTags tags and ErrNotFound if it is not visible to
+// viewer.
+func (r *Repo) AddTags(ctx context.Context, uniqueId string, tags []string, viewer *Viewer) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("AddTags", time.Now(), nil, &err)
+
+	id, tags, err := parseTagsRequest(uniqueId, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("%w: operations may have at most %d tags", ErrSizeLimitExceeded, maxTags)
+	}
+
+	// the limit is part of the filter so concurrent calls cannot exceed it.
+	filter := bson.M{
+		"_id": id,
+		"$expr": bson.M{
+			"$lte": bson.A{
+				bson.M{"$size": bson.M{"$setUnion": bson.A{bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}, tags}}},
+				maxTags,
+			},
+		},
+	}
+	addVisibilityFilter(filter, viewer)
+
+	res := r.col.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{
+			"$addToSet": bson.M{
+				"tags": bson.M{"$each": tags},
+			},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	)
+
+	if err := res.Err(); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+
+		if _, err := r.findVisibleOperation(ctx, id, viewer); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w: operations may have at most %d tags", ErrSizeLimitExceeded, maxTags)
+	}
+
+	var result Operation
+	if err := res.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return result.toProto(nil, r.limits)
+}
+
+// RemoveTags removes tags from the operation, see NormalizeTags. Tags that are
+// not set are ignored. ErrNotFound is returned if the operation is not visible
+// to viewer.
+func (r *Repo) RemoveTags(ctx context.Context, uniqueId string, tags []string, viewer *Viewer) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("RemoveTags", time.Now(), nil, &err)
+
+	id, tags, err := parseTagsRequest(uniqueId, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"_id": id}
+	addVisibilityFilter(filter, viewer)
+
+	result, err := r.findAndApplyFilteredUpdate(ctx, filter, bson.M{
+		"$pull": bson.M{
+			"tags": bson.M{"$in": tags},
+		},
+	})
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return result.toProto(nil, r.limits)
+}
+
+func parseTagsRequest(uniqueId string, tags []string) (id primitive.ObjectID, _ []string, err error) {
+	id, err = parseID(uniqueId)
+	if err != nil {
+		return id, nil, err
+	}
+
+	tags, err = NormalizeTags(tags)
+	if err != nil {
+		return id, nil, err
+	}
+
+	if len(tags) == 0 {
+		return id, nil, fmt.Errorf("%w: no tags specified", ErrInvalidTag)
+	}
+
+	return id, tags, nil
+}
+
+// addTagsAnnotation adds the computed op.TagsAnnotation to pbop if the
+// operation has tags.
+func addTagsAnnotation(pbop *longrunningv1.Operation, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.TagsAnnotation] = strings.Join(tags, ",")
+}
@@ -0,0 +1,395 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	ErrInvalidTemplate  = errors.New("invalid template")
+	ErrTemplateNotFound = errors.New("template not found")
+)
+
+// Template is a recurring operation that is registered at each occurrence of
+// a cron schedule, see MaterializeDueTemplates.
+type Template struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	CreateTime time.Time          `bson:"createTime"`
+
+	Kind        string `bson:"kind"`
+	Owner       string `bson:"owner"`
+	Description string `bson:"description,omitempty"`
+	Namespace   string `bson:"namespace,omitempty"`
+
+	// Parameters holds the protojson encoded parameters of the registered
+	// operations, see encodeParameters.
+	Parameters map[string]string `bson:"parameters,omitempty"`
+
+	// Ttl, GracePeriod and PendingTimeout fall back to the defaults of the
+	// kind if zero.
+	Ttl            time.Duration `bson:"ttl,omitempty"`
+	GracePeriod    time.Duration `bson:"gracePeriod,omitempty"`
+	PendingTimeout time.Duration `bson:"pendingTimeout,omitempty"`
+
+	// Schedule is the cron expression of the template which is evaluated in
+	// TimeZone.
+	Schedule string `bson:"schedule"`
+	TimeZone string `bson:"timeZone,omitempty"`
+
+	// Overlap is one of the op.OverlapPolicy values.
+	Overlap string `bson:"overlap"`
+
+	// NextRun is the next occurrence of the schedule. It is only advanced
+	// once the operation of the occurrence has been registered.
+	NextRun time.Time `bson:"nextRun"`
+
+	// LastOperation is the id of the operation that has been registered for
+	// the most recent occurrence.
+	LastOperation *primitive.ObjectID `bson:"lastOperation,omitempty"`
+}
+
+// ParameterValues returns the decoded parameters of t.
+func (t Template) ParameterValues() (map[string]*structpb.Value, error) {
+	if len(t.Parameters) == 0 {
+		return nil, nil
+	}
+
+	params := make(map[string]*structpb.Value, len(t.Parameters))
+	for key, blob := range t.Parameters {
+		value, err := decodeParameter(key, blob)
+		if err != nil {
+			return nil, err
+		}
+
+		params[key] = value
+	}
+
+	return params, nil
+}
+
+// templateOccurrence links an operation to the occurrence of a template it
+// has been registered for.
+type templateOccurrence struct {
+	template primitive.ObjectID
+	time     time.Time
+}
+
+// schedule parses the schedule and time zone of t.
+func (t Template) schedule() (*cronSchedule, *time.Location, error) {
+	schedule, err := parseCron(t.Schedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid schedule %q: %w", ErrInvalidTemplate, t.Schedule, err)
+	}
+
+	loc := time.UTC
+	if t.TimeZone != "" {
+		loc, err = time.LoadLocation(t.TimeZone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid time zone %q: %w", ErrInvalidTemplate, t.TimeZone, err)
+		}
+	}
+
+	return schedule, loc, nil
+}
+
+// nextRun returns the first occurrence of the schedule of t after now.
+func (t Template) nextRun(now time.Time) (time.Time, error) {
+	schedule, loc, err := t.schedule()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := schedule.next(now.In(loc))
+	if next.IsZero() {
+		return next, fmt.Errorf("%w: schedule %q never matches", ErrInvalidTemplate, t.Schedule)
+	}
+
+	return next.UTC(), nil
+}
+
+func (r *Repo) setupTemplates(ctx context.Context) error {
+	if _, err := r.templates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "nextRun", Value: 1}},
+	}); err != nil {
+		return fmt.Errorf("failed to create template index: %w", err)
+	}
+
+	// each occurrence of a template must only be registered once, even if
+	// multiple instances evaluate the template at the same time or the
+	// service is restarted before the next run has been stored.
+	if _, err := r.col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "template", Value: 1},
+			{Key: "occurrence", Value: 1},
+		},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"template": bson.M{
+				"$exists": true,
+			},
+		}),
+	}); err != nil {
+		return fmt.Errorf("failed to create template occurrence index: %w", err)
+	}
+
+	return nil
+}
+
+// CreateTemplate validates and stores tmpl. The parameters of tmpl are
+// replaced with params. The first run is the next occurrence of the schedule.
+func (r *Repo) CreateTemplate(ctx context.Context, tmpl Template, params map[string]*structpb.Value) (_ *Template, err error) {
+	defer r.observe("CreateTemplate", time.Now(), nil, &err)
+
+	if tmpl.Kind == "" || tmpl.Owner == "" {
+		return nil, fmt.Errorf("%w: kind and owner are required", ErrInvalidTemplate)
+	}
+
+	if tmpl.Ttl < 0 || tmpl.GracePeriod < 0 || tmpl.PendingTimeout < 0 {
+		return nil, fmt.Errorf("%w: durations must not be negative", ErrInvalidTemplate)
+	}
+
+	switch op.OverlapPolicy(tmpl.Overlap) {
+	case "":
+		tmpl.Overlap = string(op.OverlapSkip)
+	case op.OverlapSkip, op.OverlapAllow:
+	default:
+		return nil, fmt.Errorf("%w: unsupported overlap policy %q", ErrInvalidTemplate, tmpl.Overlap)
+	}
+
+	tmpl.Parameters, err = encodeParameters(params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+
+	tmpl.NextRun, err = tmpl.nextRun(now)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl.ID = primitive.NewObjectID()
+	tmpl.CreateTime = now
+	tmpl.LastOperation = nil
+
+	if _, err := r.templates.InsertOne(ctx, tmpl); err != nil {
+		return nil, fmt.Errorf("failed to store template: %w", err)
+	}
+
+	return &tmpl, nil
+}
+
+// ListTemplates returns all templates.
+func (r *Repo) ListTemplates(ctx context.Context) (templates []Template, err error) {
+	defer r.observe("ListTemplates", time.Now(), func() int { return len(templates) }, &err)
+
+	res, err := r.templates.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := res.All(ctx, &templates); err != nil {
+		return nil, fmt.Errorf("failed to decode templates: %w", err)
+	}
+
+	return templates, nil
+}
+
+// DeleteTemplate deletes the template with the given id. Operations that have
+// been registered for it are kept.
+func (r *Repo) DeleteTemplate(ctx context.Context, id string) (err error) {
+	defer r.observe("DeleteTemplate", time.Now(), nil, &err)
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%w: invalid id %q", ErrInvalidTemplate, id)
+	}
+
+	res, err := r.templates.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrTemplateNotFound
+	}
+
+	return nil
+}
+
+// MaterializeDueTemplates registers a PENDING operation for each template
+// whose next run has passed at now and advances the next run to the first
+// occurrence after now, so occurrences that have been missed are condensed
+// into a single one. With op.OverlapSkip, no operation is registered while
+// the operation of the previous occurrence is neither COMPLETE nor LOST.
+//
+// The registered operations are returned. Operations that have already been
+// registered for an occurrence, for example by another instance, are never
+// registered again.
+func (r *Repo) MaterializeDueTemplates(ctx context.Context, now time.Time) (ops []*longrunningv1.Operation, err error) {
+	defer r.observe("MaterializeDueTemplates", time.Now(), func() int { return len(ops) }, &err)
+
+	cursor, err := r.templates.Find(ctx, bson.M{
+		"nextRun": bson.M{
+			"$lte": now,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var due []Template
+	if err := cursor.All(ctx, &due); err != nil {
+		return nil, fmt.Errorf("failed to decode templates: %w", err)
+	}
+
+	for _, tmpl := range due {
+		pb, err := r.materialize(ctx, tmpl, now)
+		if err != nil {
+			return ops, fmt.Errorf("template %q: %w", tmpl.ID.Hex(), err)
+		}
+
+		if pb != nil {
+			ops = append(ops, pb)
+		}
+	}
+
+	return ops, nil
+}
+
+// materialize registers the operation for the due occurrence of tmpl, if
+// any, and advances the next run of tmpl.
+func (r *Repo) materialize(ctx context.Context, tmpl Template, now time.Time) (*longrunningv1.Operation, error) {
+	next, err := tmpl.nextRun(now)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := false
+	if tmpl.LastOperation != nil && tmpl.Overlap != string(op.OverlapAllow) {
+		active, err := r.col.CountDocuments(ctx, bson.M{
+			"_id": *tmpl.LastOperation,
+			"state": bson.M{
+				"$lt": longrunningv1.OperationState_OperationState_COMPLETE,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		skip = active > 0
+	}
+
+	var (
+		pb   *longrunningv1.Operation
+		last = tmpl.LastOperation
+	)
+
+	if !skip {
+		pb, last, err = r.registerOccurrence(ctx, tmpl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	set := bson.M{
+		"nextRun": next,
+	}
+
+	if last != nil {
+		set["lastOperation"] = *last
+	}
+
+	// the filter makes sure the next run is only advanced once if multiple
+	// instances materialize the template at the same time.
+	if _, err := r.templates.UpdateOne(ctx, bson.M{"_id": tmpl.ID, "nextRun": tmpl.NextRun}, bson.M{"$set": set}); err != nil {
+		return pb, fmt.Errorf("failed to advance next run: %w", err)
+	}
+
+	return pb, nil
+}
+
+// registerOccurrence registers the operation for the current next run of
+// tmpl. If it has been registered already, only the id of the existing
+// operation is returned.
+func (r *Repo) registerOccurrence(ctx context.Context, tmpl Template) (*longrunningv1.Operation, *primitive.ObjectID, error) {
+	params, err := tmpl.ParameterValues()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reg := &longrunningv1.RegisterOperationRequest{
+		Owner:        tmpl.Owner,
+		Kind:         tmpl.Kind,
+		Description:  tmpl.Description,
+		Parameters:   params,
+		InitialState: longrunningv1.OperationState_OperationState_PENDING,
+	}
+
+	if tmpl.Ttl > 0 {
+		reg.Ttl = durationpb.New(tmpl.Ttl)
+	}
+
+	if tmpl.GracePeriod > 0 {
+		reg.GracePeriod = durationpb.New(tmpl.GracePeriod)
+	}
+
+	defaults := r.durations.Defaults(tmpl.Kind)
+
+	pendingTimeout := tmpl.PendingTimeout
+	if pendingTimeout == 0 {
+		pendingTimeout = defaults.PendingTimeout
+	}
+
+	res, err := r.RegisterOperations(ctx, []*longrunningv1.RegisterOperationRequest{reg}, RegisterOptions{
+		Namespace:      tmpl.Namespace,
+		PendingTimeout: pendingTimeout,
+		MaxRuntime:     defaults.MaxRuntime,
+		occurrence: &templateOccurrence{
+			template: tmpl.ID,
+			time:     tmpl.NextRun,
+		},
+	})
+
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		var existing Operation
+		if err := r.col.FindOne(ctx, bson.M{"template": tmpl.ID, "occurrence": tmpl.NextRun}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&existing); err != nil {
+			return nil, nil, fmt.Errorf("failed to find existing occurrence: %w", err)
+		}
+
+		return nil, &existing.ID, nil
+
+	case err != nil:
+		return nil, nil, err
+	}
+
+	id, err := parseID(res[0].Operation.UniqueId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res[0].Operation, &id, nil
+}
+
+func addTemplateAnnotation(pbop *longrunningv1.Operation, template *primitive.ObjectID) {
+	if template == nil {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.TemplateAnnotation] = template.Hex()
+}
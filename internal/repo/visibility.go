@@ -0,0 +1,150 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInvalidViewers = errors.New("invalid viewers")
+
+// maxViewers is the maximum number of additional viewers per operation.
+const maxViewers = 50
+
+// Viewer identifies the caller operations are loaded for. Operations that
+// have been registered with a list of viewers, see RegisterOptions.VisibleTo,
+// are only visible to their owner, their creator, the listed viewers and
+// administrators. All other operations are visible to everyone.
+type Viewer struct {
+	// ID is the ID of the calling user. It is empty for unauthenticated
+	// callers.
+	ID string
+
+	// Admin permits access to all operations.
+	Admin bool
+}
+
+// CanView reports whether v may see an operation with the given owner,
+// creator and viewers.
+func (v Viewer) CanView(owner, creator string, visibleTo []string) bool {
+	if len(visibleTo) == 0 || v.Admin {
+		return true
+	}
+
+	if v.ID == "" {
+		return false
+	}
+
+	return v.ID == owner || v.ID == creator || slices.Contains(visibleTo, v.ID)
+}
+
+// filter returns the mongo filter that matches all operations v may see, or
+// nil if v may see all operations. A nil Viewer is not restricted.
+func (v *Viewer) filter() bson.M {
+	if v == nil || v.Admin {
+		return nil
+	}
+
+	clauses := bson.A{
+		bson.M{"visibleTo": bson.M{"$exists": false}},
+	}
+
+	if v.ID != "" {
+		clauses = append(clauses,
+			bson.M{"owner": v.ID},
+			bson.M{"creator": v.ID},
+			bson.M{"visibleTo": v.ID},
+		)
+	}
+
+	return bson.M{"$or": clauses}
+}
+
+// addVisibilityFilter restricts filter to the operations v may see. The
+// visibility is combined using $and since filter might use $or already.
+func addVisibilityFilter(filter bson.M, v *Viewer) {
+	f := v.filter()
+	if f == nil {
+		return
+	}
+
+	and, _ := filter["$and"].(bson.A)
+	filter["$and"] = append(and, f)
+}
+
+// NormalizeViewers trims the user ids and removes empty values and
+// duplicates. An error wrapping ErrInvalidViewers is returned if there are
+// more than maxViewers ids or an id contains a comma.
+func NormalizeViewers(ids []string) ([]string, error) {
+	var result []string
+
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+
+		switch {
+		case id == "":
+			continue
+		case strings.Contains(id, ","):
+			return nil, fmt.Errorf("%w: user id %q must not contain a comma", ErrInvalidViewers, id)
+		}
+
+		if !slices.Contains(result, id) {
+			result = append(result, id)
+		}
+	}
+
+	if len(result) > maxViewers {
+		return nil, fmt.Errorf("%w: at most %d viewers may be specified", ErrInvalidViewers, maxViewers)
+	}
+
+	return result, nil
+}
+
+// GetVisibleOperation is like GetOperation but returns ErrNotFound if the
+// operation is not visible to viewer.
+func (r *Repo) GetVisibleOperation(ctx context.Context, req *longrunningv1.GetOperationRequest, mask *ReadMask, viewer Viewer) (_ *longrunningv1.Operation, err error) {
+	defer r.observe("GetVisibleOperation", time.Now(), nil, &err)
+
+	return r.getOperation(ctx, req, mask, &viewer)
+}
+
+// findVisibleOperation is like findOperation but returns ErrNotFound if the
+// operation is not visible to viewer.
+func (r *Repo) findVisibleOperation(ctx context.Context, id primitive.ObjectID, viewer *Viewer) (*document, error) {
+	op, err := r.findOperation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !viewer.canView(op) {
+		return nil, ErrNotFound
+	}
+
+	return op, nil
+}
+
+// canView is like CanView but accepts a nil Viewer which may see all
+// operations.
+func (v *Viewer) canView(op *document) bool {
+	return v == nil || v.CanView(op.Owner, op.Creator, op.VisibleTo)
+}
+
+func addVisibleToAnnotation(pbop *longrunningv1.Operation, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.VisibleToAnnotation] = strings.Join(ids, ",")
+}
@@ -0,0 +1,361 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var (
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+	ErrWebhookNotFound = errors.New("webhook not found")
+)
+
+// deadLetterRetention is how long deliveries that finally failed are kept in
+// the dead-letter log.
+const deadLetterRetention = 7 * 24 * time.Hour
+
+// defaultWebhookEvents are the events a webhook receives if none have been
+// specified.
+var defaultWebhookEvents = []string{string(op.EventCompleted), string(op.EventLost)}
+
+// Webhook is a subscription that receives lifecycle events of operations as
+// HTTP POST requests.
+type Webhook struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	CreateTime time.Time          `bson:"createTime"`
+
+	// Kind is a path.Match pattern for the kinds of operations the webhook
+	// receives events for.
+	Kind string `bson:"kind"`
+
+	// URL is the http or https endpoint the events are posted to.
+	URL string `bson:"url"`
+
+	// Secret is used to sign the request body, see op.SignWebhook.
+	Secret string `bson:"secret"`
+
+	// Events holds the lifecycle event types the webhook receives.
+	Events []string `bson:"events"`
+
+	// Failures holds the number of consecutive failed delivery attempts. It is
+	// reset after a successful delivery. Once it reaches the configured limit,
+	// the webhook is disabled.
+	Failures  int    `bson:"failures"`
+	Disabled  bool   `bson:"disabled"`
+	LastError string `bson:"lastError,omitempty"`
+}
+
+// WebhookEvent is a lifecycle event that is delivered to all matching
+// webhooks, see EnqueueWebhookDeliveries.
+type WebhookEvent struct {
+	Type  op.EventType
+	Kind  string
+	Event *anypb.Any
+}
+
+// WebhookDelivery is a lifecycle event that is waiting to be delivered to a
+// webhook. Deliveries are claimed like OutboxEntry.
+type WebhookDelivery struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	CreateTime time.Time          `bson:"createTime"`
+	WebhookID  primitive.ObjectID `bson:"webhookId"`
+	Event      *anypb.Any         `bson:"event"`
+
+	Delivered   bool       `bson:"delivered"`
+	DeliveredAt *time.Time `bson:"deliveredAt,omitempty"`
+
+	Attempts  int    `bson:"attempts"`
+	LastError string `bson:"lastError,omitempty"`
+
+	LockedUntil time.Time `bson:"lockedUntil"`
+	ClaimToken  string    `bson:"claimToken,omitempty"`
+}
+
+// deadLetter is a delivery that has been given up on.
+type deadLetter struct {
+	WebhookDelivery `bson:",inline"`
+
+	FailedAt time.Time `bson:"failedAt"`
+}
+
+func (r *Repo) setupWebhooks(ctx context.Context) error {
+	if _, err := r.webhooks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "events", Value: 1},
+			{Key: "disabled", Value: 1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create webhook index: %w", err)
+	}
+
+	if _, err := r.deliveries.Indexes().CreateMany(ctx, outboxIndexes()); err != nil {
+		return fmt.Errorf("failed to create webhook delivery indexes: %w", err)
+	}
+
+	if _, err := r.deadLetters.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "failedAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(deadLetterRetention.Seconds())),
+	}); err != nil {
+		return fmt.Errorf("failed to create dead-letter index: %w", err)
+	}
+
+	return nil
+}
+
+// CreateWebhook validates and stores hook. An empty kind pattern matches all
+// operations and hooks without events receive op.EventCompleted and
+// op.EventLost.
+func (r *Repo) CreateWebhook(ctx context.Context, hook Webhook) (_ *Webhook, err error) {
+	defer r.observe("CreateWebhook", time.Now(), nil, &err)
+
+	if hook.Kind == "" {
+		hook.Kind = "*"
+	}
+
+	if _, err := path.Match(hook.Kind, ""); err != nil {
+		return nil, fmt.Errorf("%w: invalid kind pattern %q: %w", ErrInvalidWebhook, hook.Kind, err)
+	}
+
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q must be an absolute http or https URL", ErrInvalidWebhook, hook.URL)
+	}
+
+	if hook.Secret == "" {
+		return nil, fmt.Errorf("%w: missing secret", ErrInvalidWebhook)
+	}
+
+	if len(hook.Events) == 0 {
+		hook.Events = defaultWebhookEvents
+	}
+
+	for _, evt := range hook.Events {
+		if !slices.Contains(op.EventTypes, op.EventType(evt)) {
+			return nil, fmt.Errorf("%w: unsupported event type %q", ErrInvalidWebhook, evt)
+		}
+	}
+
+	hook.ID = primitive.NewObjectID()
+	hook.CreateTime = time.Now().Truncate(time.Millisecond)
+	hook.Failures = 0
+	hook.Disabled = false
+	hook.LastError = ""
+
+	if _, err := r.webhooks.InsertOne(ctx, hook); err != nil {
+		return nil, fmt.Errorf("failed to store webhook: %w", err)
+	}
+
+	return &hook, nil
+}
+
+// ListWebhooks returns all webhooks, including disabled ones.
+func (r *Repo) ListWebhooks(ctx context.Context) (hooks []Webhook, err error) {
+	defer r.observe("ListWebhooks", time.Now(), func() int { return len(hooks) }, &err)
+
+	res, err := r.webhooks.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := res.All(ctx, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to decode webhooks: %w", err)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook deletes the webhook with the given id together with all of
+// its pending deliveries.
+func (r *Repo) DeleteWebhook(ctx context.Context, id string) (err error) {
+	defer r.observe("DeleteWebhook", time.Now(), nil, &err)
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("%w: invalid id %q", ErrInvalidWebhook, id)
+	}
+
+	res, err := r.webhooks.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+
+	if _, err := r.deliveries.DeleteMany(ctx, bson.M{"webhookId": oid, "delivered": false}); err != nil {
+		return fmt.Errorf("failed to delete pending deliveries: %w", err)
+	}
+
+	return nil
+}
+
+// EnqueueWebhookDeliveries stores a delivery of each event for all enabled
+// webhooks that subscribed to the type and kind of the event. It reports
+// whether any delivery has been stored.
+func (r *Repo) EnqueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) (_ bool, err error) {
+	defer r.observe("EnqueueWebhookDeliveries", time.Now(), func() int { return len(events) }, &err)
+
+	if len(events) == 0 {
+		return false, nil
+	}
+
+	types := make([]string, 0, len(events))
+	for _, evt := range events {
+		if !slices.Contains(types, string(evt.Type)) {
+			types = append(types, string(evt.Type))
+		}
+	}
+
+	res, err := r.webhooks.Find(ctx, bson.M{
+		"events":   bson.M{"$in": types},
+		"disabled": false,
+	}, options.Find().SetProjection(bson.M{"_id": 1, "kind": 1, "events": 1}))
+	if err != nil {
+		return false, err
+	}
+
+	var hooks []Webhook
+	if err := res.All(ctx, &hooks); err != nil {
+		return false, fmt.Errorf("failed to decode webhooks: %w", err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+
+	var deliveries []any
+	for _, evt := range events {
+		for _, hook := range hooks {
+			// patterns are validated by CreateWebhook
+			if ok, _ := path.Match(hook.Kind, evt.Kind); !ok || !slices.Contains(hook.Events, string(evt.Type)) {
+				continue
+			}
+
+			deliveries = append(deliveries, WebhookDelivery{
+				ID:          primitive.NewObjectID(),
+				CreateTime:  now,
+				WebhookID:   hook.ID,
+				Event:       evt.Event,
+				LockedUntil: now,
+			})
+		}
+	}
+
+	if len(deliveries) == 0 {
+		return false, nil
+	}
+
+	if _, err := r.deliveries.InsertMany(ctx, deliveries); err != nil {
+		return false, fmt.Errorf("failed to store webhook deliveries: %w", err)
+	}
+
+	return true, nil
+}
+
+// ClaimWebhookDeliveries claims up to limit pending deliveries for lease, see
+// ClaimEvents.
+func (r *Repo) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (deliveries []WebhookDelivery, err error) {
+	defer r.observe("ClaimWebhookDeliveries", time.Now(), func() int { return len(deliveries) }, &err)
+
+	return claimEntries[WebhookDelivery](ctx, r.deliveries, limit, lease)
+}
+
+// MarkWebhookDelivered marks d as delivered and resets the failure counter of
+// its webhook.
+func (r *Repo) MarkWebhookDelivered(ctx context.Context, d WebhookDelivery) (err error) {
+	defer r.observe("MarkWebhookDelivered", time.Now(), nil, &err)
+
+	if err := markEntryDelivered(ctx, r.deliveries, d.ID); err != nil {
+		return err
+	}
+
+	_, err = r.webhooks.UpdateOne(ctx, bson.M{"_id": d.WebhookID, "failures": bson.M{"$gt": 0}}, bson.M{
+		"$set": bson.M{
+			"failures": 0,
+		},
+	})
+
+	return err
+}
+
+// MarkWebhookFailed records a failed delivery attempt of d. The delivery is
+// retried at retryAt unless it has been attempted maxAttempts times in which
+// case it is moved to the dead-letter log. The webhook is disabled once it
+// failed disableAfter times in a row, which is reported by the returned bool.
+// A value of zero disables the respective limit.
+func (r *Repo) MarkWebhookFailed(ctx context.Context, d WebhookDelivery, deliveryErr error, retryAt time.Time, maxAttempts int, disableAfter int) (_ bool, err error) {
+	defer r.observe("MarkWebhookFailed", time.Now(), nil, &err)
+
+	if maxAttempts > 0 && d.Attempts+1 >= maxAttempts {
+		d.Attempts++
+		err = r.deadLetter(ctx, d, deliveryErr)
+	} else {
+		err = markEntryFailed(ctx, r.deliveries, d.ID, deliveryErr, retryAt)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	res := r.webhooks.FindOneAndUpdate(ctx, bson.M{"_id": d.WebhookID}, bson.M{
+		"$inc": bson.M{
+			"failures": 1,
+		},
+		"$set": bson.M{
+			"lastError": deliveryErr.Error(),
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	var hook Webhook
+	if err := res.Decode(&hook); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to record webhook failure: %w", err)
+	}
+
+	if disableAfter <= 0 || hook.Disabled || hook.Failures < disableAfter {
+		return false, nil
+	}
+
+	if _, err := r.webhooks.UpdateByID(ctx, d.WebhookID, bson.M{"$set": bson.M{"disabled": true}}); err != nil {
+		return false, fmt.Errorf("failed to disable webhook: %w", err)
+	}
+
+	return true, nil
+}
+
+// DiscardWebhookDelivery moves d to the dead-letter log without attempting
+// it, for example because its webhook has been disabled.
+func (r *Repo) DiscardWebhookDelivery(ctx context.Context, d WebhookDelivery, reason error) (err error) {
+	defer r.observe("DiscardWebhookDelivery", time.Now(), nil, &err)
+
+	return r.deadLetter(ctx, d, reason)
+}
+
+func (r *Repo) deadLetter(ctx context.Context, d WebhookDelivery, reason error) error {
+	d.LastError = reason.Error()
+	d.ClaimToken = ""
+
+	if _, err := r.deadLetters.InsertOne(ctx, deadLetter{WebhookDelivery: d, FailedAt: time.Now()}); err != nil {
+		return fmt.Errorf("failed to store dead letter: %w", err)
+	}
+
+	if _, err := r.deliveries.DeleteOne(ctx, bson.M{"_id": d.ID}); err != nil {
+		return fmt.Errorf("failed to delete webhook delivery: %w", err)
+	}
+
+	return nil
+}
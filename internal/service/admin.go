@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// HandleAdminProcedures registers the handlers for all procedures that are
+// only served on the admin listener on mux. The auth interceptor does not run
+// for them so extractor is used to identify the calling administrator.
+func (s *Service) HandleAdminProcedures(mux *http.ServeMux, extractor auth.ExtractorFunc, opts ...connect.HandlerOption) {
+	forceMarkLost := func(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+		return s.ForceMarkLost(ctx, req, extractor)
+	}
+
+	purge := func(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest]) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
+		return s.PurgeOperations(ctx, req, extractor)
+	}
+
+	createWebhook := func(ctx context.Context, req *connect.Request[structpb.Struct]) (*connect.Response[structpb.Struct], error) {
+		return s.CreateWebhook(ctx, req, extractor)
+	}
+
+	listWebhooks := func(ctx context.Context, req *connect.Request[emptypb.Empty]) (*connect.Response[structpb.ListValue], error) {
+		return s.ListWebhooks(ctx, req, extractor)
+	}
+
+	deleteWebhook := func(ctx context.Context, req *connect.Request[wrapperspb.StringValue]) (*connect.Response[emptypb.Empty], error) {
+		return s.DeleteWebhook(ctx, req, extractor)
+	}
+
+	createTemplate := func(ctx context.Context, req *connect.Request[structpb.Struct]) (*connect.Response[structpb.Struct], error) {
+		return s.CreateTemplate(ctx, req, extractor)
+	}
+
+	listTemplates := func(ctx context.Context, req *connect.Request[emptypb.Empty]) (*connect.Response[structpb.ListValue], error) {
+		return s.ListTemplates(ctx, req, extractor)
+	}
+
+	deleteTemplate := func(ctx context.Context, req *connect.Request[wrapperspb.StringValue]) (*connect.Response[emptypb.Empty], error) {
+		return s.DeleteTemplate(ctx, req, extractor)
+	}
+
+	pendingLosses := func(ctx context.Context, req *connect.Request[emptypb.Empty]) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
+		return s.GetPendingLosses(ctx, req, extractor)
+	}
+
+	setDryRun := func(ctx context.Context, req *connect.Request[wrapperspb.BoolValue]) (*connect.Response[emptypb.Empty], error) {
+		return s.SetManagerDryRun(ctx, req, extractor)
+	}
+
+	mux.Handle(op.ForceMarkLostProcedure, connect.NewUnaryHandler(op.ForceMarkLostProcedure, forceMarkLost, opts...))
+	mux.Handle(op.PurgeOperationsProcedure, connect.NewUnaryHandler(op.PurgeOperationsProcedure, purge, opts...))
+	mux.Handle(op.CreateWebhookProcedure, connect.NewUnaryHandler(op.CreateWebhookProcedure, createWebhook, opts...))
+	mux.Handle(op.ListWebhooksProcedure, connect.NewUnaryHandler(op.ListWebhooksProcedure, listWebhooks, opts...))
+	mux.Handle(op.DeleteWebhookProcedure, connect.NewUnaryHandler(op.DeleteWebhookProcedure, deleteWebhook, opts...))
+	mux.Handle(op.CreateTemplateProcedure, connect.NewUnaryHandler(op.CreateTemplateProcedure, createTemplate, opts...))
+	mux.Handle(op.ListTemplatesProcedure, connect.NewUnaryHandler(op.ListTemplatesProcedure, listTemplates, opts...))
+	mux.Handle(op.DeleteTemplateProcedure, connect.NewUnaryHandler(op.DeleteTemplateProcedure, deleteTemplate, opts...))
+	mux.Handle(op.GetPendingLossesProcedure, connect.NewUnaryHandler(op.GetPendingLossesProcedure, pendingLosses, opts...))
+	mux.Handle(op.SetManagerDryRunProcedure, connect.NewUnaryHandler(op.SetManagerDryRunProcedure, setDryRun, opts...))
+}
+
+// purgeSampleSize is the number of operations returned for a dry run of
+// PurgeOperations.
+const purgeSampleSize = 10
+
+// requireAdmin returns the calling administrator or CodePermissionDenied.
+func requireAdmin(ctx context.Context, req connect.AnyRequest, extractor auth.ExtractorFunc, action string) (auth.RemoteUser, error) {
+	remoteUser, err := extractor(ctx, req)
+	if err != nil || !remoteUser.Admin {
+		return auth.RemoteUser{}, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("only administrators may %s", action))
+	}
+
+	return remoteUser, nil
+}
+
+// ForceMarkLost marks an operation as lost on behalf of an administrator, see
+// op.ForceMarkLostProcedure. The OnLost callbacks of the manager are invoked
+// and the retry policy is executed just like for operations whose TTL expired
+// so watchers are notified and dependents are evaluated.
+func (s *Service) ForceMarkLost(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest], extractor auth.ExtractorFunc) (*connect.Response[longrunningv1.Operation], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "mark operations as lost")
+	if err != nil {
+		return nil, err
+	}
+
+	reason := strings.TrimSpace(req.Header().Get(op.LostReasonHeader))
+	if reason == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("missing %s header", op.LostReasonHeader))
+	}
+
+	if err := s.resolveExternalRef(ctx, req); err != nil {
+		return nil, err
+	}
+
+	lostErr := manager.NewLostError(op.LostReasonAdmin, reason, map[string]any{
+		op.LostActorDetail: remoteUser.ID,
+	})
+
+	var lost *longrunningv1.Operation
+
+	err = s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		lost, err = s.repo.ForceMarkAsLost(ctx, req.Msg.UniqueId, lostErr, remoteUser.ID)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, lost)
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyStateChange(nil, lost)
+	s.retryLost(ctx, lost)
+
+	return connect.NewResponse(lost), nil
+}
+
+// PurgeOperations deletes terminal operations on behalf of an administrator,
+// see op.PurgeOperationsProcedure.
+func (s *Service) PurgeOperations(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest], extractor auth.ExtractorFunc) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "purge operations")
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := s.namespacesOf(req.Header(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	queryOpts, err := queryOptionsOf(req, namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	dryRun, err := boolFromHeader(req.Header(), op.DryRunHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.repo.PurgeOperations(ctx, req.Msg, repo.PurgeOptions{
+		QueryOptions: queryOpts,
+		DryRun:       dryRun,
+		SampleSize:   purgeSampleSize,
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	if !dryRun {
+		slog.Info("purged operations", "count", res.Count, "actor", remoteUser.ID, "kind", req.Msg.Kind, "state", req.Msg.State.String())
+	}
+
+	response := &longrunningv1.QueryOperationsResponse{
+		TotalCount: res.Count,
+	}
+
+	for _, id := range res.Sample {
+		response.Operation = append(response.Operation, &longrunningv1.Operation{
+			UniqueId: id,
+		})
+	}
+
+	return connect.NewResponse(response), nil
+}
+
+// GetPendingLosses returns the operations the manager would have marked as
+// lost in dry-run mode on behalf of an administrator, see
+// op.GetPendingLossesProcedure.
+func (s *Service) GetPendingLosses(ctx context.Context, req *connect.Request[emptypb.Empty], extractor auth.ExtractorFunc) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
+	if _, err := requireAdmin(ctx, req, extractor, "list pending losses"); err != nil {
+		return nil, err
+	}
+
+	if s.mng == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errNoManager)
+	}
+
+	losses := s.mng.PendingLosses()
+
+	response := &longrunningv1.QueryOperationsResponse{
+		TotalCount: int64(len(losses)),
+	}
+
+	for _, loss := range losses {
+		pbop := loss.Operation
+		pbop.Result = &longrunningv1.Operation_Error{Error: loss.Reason}
+
+		if pbop.Annotations == nil {
+			pbop.Annotations = make(map[string]string)
+		}
+
+		pbop.Annotations[op.PendingLossSinceAnnotation] = loss.Since.Format(time.RFC3339)
+
+		response.Operation = append(response.Operation, pbop)
+	}
+
+	res := connect.NewResponse(response)
+	res.Header().Set(op.DryRunHeader, strconv.FormatBool(s.mng.DryRun()))
+
+	return res, nil
+}
+
+// SetManagerDryRun switches the dry-run mode of the manager on behalf of an
+// administrator, see op.SetManagerDryRunProcedure.
+func (s *Service) SetManagerDryRun(ctx context.Context, req *connect.Request[wrapperspb.BoolValue], extractor auth.ExtractorFunc) (*connect.Response[emptypb.Empty], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "change the manager dry-run mode")
+	if err != nil {
+		return nil, err
+	}
+
+	if s.mng == nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errNoManager)
+	}
+
+	s.mng.SetDryRun(req.Msg.GetValue())
+
+	slog.Info("manager dry-run mode set", "enabled", req.Msg.GetValue(), "actor", remoteUser.ID)
+
+	return connect.NewResponse(&emptypb.Empty{}), nil
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// AttachmentsHandler returns an HTTP handler that serves op.AttachmentsPath.
+// Attachments cannot be transferred using the existing message types so they
+// are handled outside of connect.
+func (s *Service) AttachmentsHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("PUT "+op.AttachmentsPath+"{id}/{name}", s.addAttachment)
+	mux.HandleFunc("GET "+op.AttachmentsPath+"{id}/{name}", s.getAttachment)
+
+	return mux
+}
+
+func (s *Service) addAttachment(w http.ResponseWriter, r *http.Request) {
+	att := repo.Attachment{
+		Name:      r.PathValue("name"),
+		MediaType: r.Header.Get("Content-Type"),
+		URL:       r.Header.Get(op.AttachmentURLHeader),
+	}
+
+	if att.MediaType == "" {
+		att.MediaType = "application/octet-stream"
+	}
+
+	var content io.Reader = r.Body
+	if att.URL != "" {
+		content = nil
+
+		if v := r.Header.Get(op.AttachmentSizeHeader); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				http.Error(w, "invalid value for "+op.AttachmentSizeHeader, http.StatusBadRequest)
+				return
+			}
+
+			att.Size = size
+		}
+	}
+
+	pbop, err := s.repo.AddAttachment(r.Context(), r.PathValue("id"), r.Header.Get(op.AuthTokenHeader), att, content)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the content has been streamed before the operation is updated so the
+	// upload cannot be retried as part of a transaction.
+	s.publishEvents(r.Context(), op.EventTypeOf(pbop), []string{"annotations"}, pbop)
+	s.notifyWatchers(pbop)
+
+	blob, err := protojson.Marshal(pbop)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(blob)
+}
+
+func (s *Service) getAttachment(w http.ResponseWriter, r *http.Request) {
+	// the extractor requires a request so the headers are copied to an
+	// empty one.
+	req := connect.NewRequest(&emptypb.Empty{})
+	for key, values := range r.Header {
+		req.Header()[key] = values
+	}
+
+	viewer := s.viewerOf(r.Context(), req)
+	if viewer.ID == "" && !viewer.Admin {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	// attachments are only served to callers that may see the operation.
+	if _, err := s.repo.GetVisibleOperation(r.Context(), &longrunningv1.GetOperationRequest{UniqueId: r.PathValue("id")}, nil, viewer); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	att, content, err := s.repo.GetAttachment(r.Context(), r.PathValue("id"), r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if content == nil {
+		http.Redirect(w, r, att.URL, http.StatusTemporaryRedirect)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", att.MediaType)
+	w.Header().Set("Content-Length", strconv.FormatInt(att.Size, 10))
+
+	if _, err := io.Copy(w, content); err != nil {
+		slog.Error("failed to send attachment", "error", err, "uniqueId", r.PathValue("id"), "name", att.Name)
+	}
+}
+
+// writeError writes err as a plain HTTP error using the status code that
+// matches the connect code of toConnectError.
+func writeError(w http.ResponseWriter, err error) {
+	var connectErr *connect.Error
+	if !errors.As(toConnectError(err), &connectErr) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch connectErr.Code() {
+	case connect.CodeNotFound:
+		status = http.StatusNotFound
+	case connect.CodePermissionDenied:
+		status = http.StatusForbidden
+	case connect.CodeInvalidArgument:
+		status = http.StatusBadRequest
+	case connect.CodeAlreadyExists:
+		status = http.StatusConflict
+	case connect.CodeFailedPrecondition:
+		status = http.StatusPreconditionFailed
+	case connect.CodeResourceExhausted:
+		status = http.StatusTooManyRequests
+	case connect.CodeDeadlineExceeded:
+		status = http.StatusGatewayTimeout
+	}
+
+	http.Error(w, connectErr.Message(), status)
+}
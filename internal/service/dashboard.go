@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// defaultDashboardWindow is used if the request does not specify
+	// op.DashboardWindowHeader.
+	defaultDashboardWindow = 24 * time.Hour
+
+	// defaultDashboardLimit is used for sections that are not specified in
+	// op.DashboardLimitsHeader.
+	defaultDashboardLimit = 10
+)
+
+// GetDashboard returns an overview of the operations, see
+// op.GetDashboardProcedure.
+func (s *Service) GetDashboard(ctx context.Context, req *connect.Request[emptypb.Empty]) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
+	window, err := durationFromHeader(req.Header(), op.DashboardWindowHeader, defaultDashboardWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := s.namespacesFromHeader(ctx, req.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	viewer := s.viewerOf(ctx, req)
+
+	opts := repo.DashboardOptions{
+		Viewer:       &viewer,
+		Since:        time.Now().Add(-window),
+		Namespaces:   namespaces,
+		FailedLimit:  defaultDashboardLimit,
+		LostLimit:    defaultDashboardLimit,
+		RunningLimit: defaultDashboardLimit,
+	}
+
+	for _, v := range listFromHeader(req.Header(), op.DashboardLimitsHeader) {
+		section, value, _ := strings.Cut(v, "=")
+
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", op.DashboardLimitsHeader, v))
+		}
+
+		switch section {
+		case op.DashboardFailed:
+			opts.FailedLimit = limit
+		case op.DashboardLost:
+			opts.LostLimit = limit
+		case op.DashboardRunning:
+			opts.RunningLimit = limit
+		default:
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: unknown section %q", op.DashboardLimitsHeader, section))
+		}
+	}
+
+	dashboard, err := s.repo.Dashboard(ctx, opts)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	now := time.Now()
+
+	var ops []*longrunningv1.Operation
+	add := func(section string, list []*longrunningv1.Operation) {
+		for _, pbop := range list {
+			if pbop.Annotations == nil {
+				pbop.Annotations = make(map[string]string)
+			}
+
+			pbop.Annotations[op.DashboardSectionAnnotation] = section
+
+			if section == op.DashboardRunning {
+				pbop.Annotations[op.AgeAnnotation] = now.Sub(pbop.CreateTime.AsTime()).Round(time.Second).String()
+			}
+
+			ops = append(ops, pbop)
+		}
+	}
+
+	add(op.DashboardFailed, dashboard.Failed)
+	add(op.DashboardLost, dashboard.Lost)
+	add(op.DashboardRunning, dashboard.Running)
+
+	var (
+		counts []string
+		total  int64
+	)
+	for state, count := range dashboard.StateCounts {
+		counts = append(counts, fmt.Sprintf("%s=%d", state, count))
+		total += count
+	}
+
+	slices.Sort(counts)
+
+	res := connect.NewResponse(&longrunningv1.QueryOperationsResponse{
+		Operation:  ops,
+		TotalCount: total,
+	})
+
+	res.Header().Set(op.StateCountsHeader, strings.Join(counts, ","))
+
+	return res, nil
+}
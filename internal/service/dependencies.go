@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// evaluateDependents starts or fails all PENDING operations that depend on the
+// terminated operation op and notifies their watchers. Since failed dependents
+// terminate as well, their own dependents are evaluated in turn.
+func (s *Service) evaluateDependents(op *longrunningv1.Operation) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var ops []*longrunningv1.Operation
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		ops, err = s.repo.EvaluateDependents(ctx, op.UniqueId)
+		if err != nil {
+			return err
+		}
+
+		for _, dep := range ops {
+			if err := s.enqueueChange(ctx, dep, "state", "last_update"); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to evaluate dependent operations", "error", err, "uniqueId", op.UniqueId)
+		return
+	}
+
+	for _, dep := range ops {
+		slog.Info("dependencies of operation resolved", "uniqueId", dep.UniqueId, "dependency", op.UniqueId, "state", dep.State.String())
+
+		s.notifyWatchers(dep)
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxDiffSnapshots is the maximum number of operations a single watch stream
+// remembers the last sent state of. If exceeded, an arbitrary snapshot is
+// evicted and the next update of that operation is sent in full again.
+const maxDiffSnapshots = 1000
+
+// diffTracker computes the diff updates of a watch stream that has set
+// op.DiffUpdatesHeader. It is only accessed by the stream itself. A nil
+// diffTracker sends all updates in full.
+type diffTracker struct {
+	snapshots map[string]*longrunningv1.Operation
+}
+
+// newDiffTracker returns a diffTracker if diff updates have been requested
+// in h, or nil otherwise.
+func newDiffTracker(h http.Header) (*diffTracker, error) {
+	enabled, err := boolFromHeader(h, op.DiffUpdatesHeader)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	return &diffTracker{
+		snapshots: make(map[string]*longrunningv1.Operation),
+	}, nil
+}
+
+// next returns the message that should be sent for update. The first update
+// of an operation and terminal updates are returned in full, all others only
+// hold the unique_id, the state and the changed fields which are listed in
+// op.ChangedFieldsAnnotation. next returns nil if nothing changed since the
+// last sent update. update is never modified.
+func (d *diffTracker) next(update *longrunningv1.Operation) *longrunningv1.Operation {
+	if d == nil {
+		return update
+	}
+
+	prev, ok := d.snapshots[update.UniqueId]
+
+	if isTerminal(update.State) {
+		delete(d.snapshots, update.UniqueId)
+
+		return update
+	}
+
+	if !ok && len(d.snapshots) >= maxDiffSnapshots {
+		for id := range d.snapshots {
+			delete(d.snapshots, id)
+			break
+		}
+	}
+
+	d.snapshots[update.UniqueId] = update
+
+	if !ok {
+		return update
+	}
+
+	return diffOperation(prev, update)
+}
+
+// forget removes the snapshot of the operation with the given id.
+func (d *diffTracker) forget(id string) {
+	if d != nil {
+		delete(d.snapshots, id)
+	}
+}
+
+// diffOperation returns a copy of next that only holds the unique_id, the
+// state and all top-level fields that differ from prev. The annotations are
+// always included in full if any of them changed. It returns nil if prev and
+// next are equal.
+func diffOperation(prev, next *longrunningv1.Operation) *longrunningv1.Operation {
+	diff := proto.Clone(next).(*longrunningv1.Operation)
+
+	old := prev.ProtoReflect()
+	dst := diff.ProtoReflect()
+
+	var changed []string
+
+	fields := dst.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		if old.Has(fd) != dst.Has(fd) || !old.Get(fd).Equal(dst.Get(fd)) {
+			changed = append(changed, string(fd.Name()))
+
+			continue
+		}
+
+		switch fd.Name() {
+		case "unique_id", "state":
+		default:
+			dst.Clear(fd)
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if diff.Annotations == nil {
+		diff.Annotations = make(map[string]string, 1)
+	}
+	diff.Annotations[op.ChangedFieldsAnnotation] = strings.Join(changed, ",")
+
+	return diff
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+)
+
+// ExportHandler returns an HTTP handler that streams all operations matching
+// the owner, creator, kind, state and namespace query parameters as a
+// newline-delimited JSON dump. Auth tokens are only included if the
+// include_auth_tokens query parameter is set to true.
+//
+// The handler does not perform any authorization and must only be exposed on
+// the admin listener.
+func (s *Service) ExportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+
+		query := &longrunningv1.QueryOperationsRequest{
+			Owner:   params.Get("owner"),
+			Creator: params.Get("creator"),
+			Kind:    params.Get("kind"),
+		}
+
+		if v := params.Get("state"); v != "" {
+			state, ok := longrunningv1.OperationState_value[v]
+			if !ok {
+				http.Error(w, fmt.Sprintf("invalid state %q", v), http.StatusBadRequest)
+				return
+			}
+
+			query.State = longrunningv1.OperationState(state)
+		}
+
+		var opts repo.QueryOptions
+		if ns := params.Get("namespace"); ns != "" {
+			opts.Namespaces = []string{ns}
+		}
+
+		var includeAuthTokens bool
+		if v := params.Get("include_auth_tokens"); v != "" {
+			var err error
+			includeAuthTokens, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "invalid value for include_auth_tokens", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		count, err := s.repo.ExportOperations(r.Context(), w, query, opts, includeAuthTokens)
+		if err != nil {
+			// the response has likely been started already so we can only log the error.
+			slog.Error("failed to export operations", "error", err, "exported", count)
+			return
+		}
+
+		slog.Info("exported operations", "count", count, "includeAuthTokens", includeAuthTokens)
+	})
+}
+
+// ImportHandler returns an HTTP handler that imports a dump created by
+// ExportHandler from the request body. Operations are upserted by their ID.
+//
+// The handler does not perform any authorization and must only be exposed on
+// the admin listener.
+func (s *Service) ImportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		count, err := s.repo.ImportOperations(r.Context(), r.Body)
+		if err != nil {
+			slog.Error("failed to import operations", "error", err, "imported", count)
+			http.Error(w, fmt.Sprintf("imported %d operations: %s", count, err), http.StatusBadRequest)
+			return
+		}
+
+		slog.Info("imported operations", "count", count)
+
+		fmt.Fprintf(w, "imported %d operations\n", count)
+	})
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+)
+
+// toConnectError translates errors returned by the repository into connect
+// errors with a matching code. Unexpected errors are logged and reported as
+// CodeInternal without leaking any details to the caller.
+func toConnectError(err error) error {
+	var (
+		connectErr *connect.Error
+		existsErr  *repo.AlreadyExistsError
+	)
+
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.As(err, &connectErr):
+		return err
+
+	case errors.As(err, &existsErr):
+		cerr := connect.NewError(connect.CodeAlreadyExists, err)
+
+		// attach the existing operation so callers don't need another round-trip
+		if detail, derr := connect.NewErrorDetail(existsErr.Existing); derr == nil {
+			cerr.AddDetail(detail)
+		}
+
+		return cerr
+
+	case errors.Is(err, repo.ErrAlreadyExists):
+		return connect.NewError(connect.CodeAlreadyExists, err)
+
+	case errors.Is(err, repo.ErrAttachmentExists):
+		return connect.NewError(connect.CodeAlreadyExists, err)
+
+	case errors.Is(err, repo.ErrNotFound),
+		errors.Is(err, repo.ErrAttachmentNotFound),
+		errors.Is(err, repo.ErrWebhookNotFound),
+		errors.Is(err, repo.ErrTemplateNotFound):
+		return connect.NewError(connect.CodeNotFound, err)
+
+	case errors.Is(err, repo.ErrInvalidAuthToken):
+		return connect.NewError(connect.CodePermissionDenied, err)
+
+	case errors.Is(err, repo.ErrOperationCompleted),
+		errors.Is(err, repo.ErrOperationLost),
+		errors.Is(err, repo.ErrNotLost),
+		errors.Is(err, repo.ErrNotCompleted),
+		errors.Is(err, repo.ErrResultConflict):
+		return connect.NewError(connect.CodeFailedPrecondition, err)
+
+	case errors.Is(err, repo.ErrInvalidID),
+		errors.Is(err, repo.ErrInvalidUpdateMask),
+		errors.Is(err, repo.ErrInvalidReadMask),
+		errors.Is(err, repo.ErrMissingResult),
+		errors.Is(err, repo.ErrInvalidDependency),
+		errors.Is(err, repo.ErrInvalidDuration),
+		errors.Is(err, repo.ErrSizeLimitExceeded),
+		errors.Is(err, repo.ErrInvalidPurge),
+		errors.Is(err, repo.ErrInvalidNote),
+		errors.Is(err, repo.ErrInvalidTag),
+		errors.Is(err, repo.ErrInvalidLink),
+		errors.Is(err, repo.ErrInvalidViewers),
+		errors.Is(err, repo.ErrInvalidPause),
+		errors.Is(err, repo.ErrInvalidProgress),
+		errors.Is(err, repo.ErrInvalidPriority),
+		errors.Is(err, repo.ErrInvalidSchedule),
+		errors.Is(err, repo.ErrInvalidWebhook),
+		errors.Is(err, repo.ErrInvalidTemplate),
+		errors.Is(err, repo.ErrInvalidRetryPolicy):
+		return connect.NewError(connect.CodeInvalidArgument, err)
+
+	case errors.Is(err, repo.ErrQuotaExceeded):
+		return connect.NewError(connect.CodeResourceExhausted, err)
+
+	case errors.Is(err, context.Canceled):
+		return connect.NewError(connect.CodeCanceled, err)
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return connect.NewError(connect.CodeDeadlineExceeded, err)
+	}
+
+	slog.Error("unexpected error", "error", err)
+
+	return connect.NewError(connect.CodeInternal, fmt.Errorf("internal error"))
+}
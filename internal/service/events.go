@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/privacy"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// transact runs write in a transaction, see repo.Repo.Transaction. write
+// should store the lifecycle events of the operations it changes using
+// enqueueEvents so they are committed together with the change. The outbox
+// and webhook publishers are woken once the transaction has been committed.
+func (s *Service) transact(ctx context.Context, write func(ctx context.Context) error) error {
+	if err := s.repo.Transaction(ctx, write); err != nil {
+		return err
+	}
+
+	s.wakeWebhooks()
+
+	if s.providers.EventService != nil {
+		s.wakeOutbox()
+	}
+
+	return nil
+}
+
+// publishEvents is like enqueueEvents for events that cannot be stored
+// together with a change, like op.EventExpiring which is not caused by one.
+// The events are stored in their own transaction and errors are only logged.
+func (s *Service) publishEvents(ctx context.Context, typ op.EventType, changedFields []string, ops ...*longrunningv1.Operation) {
+	// the event must be stored even if the request is cancelled.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		return s.enqueueEvents(ctx, typ, changedFields, ops...)
+	})
+	if err != nil {
+		slog.Error("failed to store operation events", "error", err, "type", typ, "count", len(ops))
+	}
+}
+
+// enqueueChange stores the lifecycle event of the change of pbop, see
+// op.EventTypeOf and enqueueEvents.
+func (s *Service) enqueueChange(ctx context.Context, pbop *longrunningv1.Operation, changedFields ...string) error {
+	return s.enqueueEvents(ctx, op.EventTypeOf(pbop), changedFields, pbop)
+}
+
+// enqueueEvents stores a lifecycle event of type typ for each of ops in the
+// outbox from where they are published to the events-service by the outbox
+// publisher, see StartOutbox. changedFields is only used for op.EventUpdated.
+// If PublishLegacyEvents is enabled the bare operation is published as well.
+// Deliveries of the lifecycle events to matching webhooks are stored as well,
+// see StartWebhooks.
+//
+// ctx should belong to the transaction that changed ops, see transact, so the
+// events are stored if and only if the change is.
+func (s *Service) enqueueEvents(ctx context.Context, typ op.EventType, changedFields []string, ops ...*longrunningv1.Operation) error {
+	// subscribers of the events-service and webhooks are unknown so events are
+	// always redacted. Watchers on other instances receive the stored
+	// operation instead, see StartFanOut.
+	policy := s.providers.Config.PrivacyPolicy()
+
+	events := make([]*anypb.Any, 0, len(ops))
+	hooks := make([]repo.WebhookEvent, 0, len(ops))
+
+	for _, pbop := range ops {
+		pbop = privacy.Redact(policy, pbop)
+
+		evt, err := op.NewEvent(typ, pbop, changedFields)
+		if err != nil {
+			slog.Error("failed to create lifecycle event", "error", err, "type", typ)
+		} else {
+			events = append(events, evt)
+			hooks = append(hooks, repo.WebhookEvent{
+				Type:  typ,
+				Kind:  pbop.Kind,
+				Event: evt,
+			})
+		}
+
+		if !s.providers.Config.PublishLegacyEvents || s.providers.EventService == nil {
+			continue
+		}
+
+		legacy, err := anypb.New(pbop)
+		if err != nil {
+			slog.Error("failed to convert longrunningv1.Operation to anypb.Any", "error", err)
+			continue
+		}
+
+		events = append(events, legacy)
+	}
+
+	if _, err := s.repo.EnqueueWebhookDeliveries(ctx, hooks); err != nil {
+		return fmt.Errorf("failed to store webhook deliveries: %w", err)
+	}
+
+	if s.providers.EventService == nil {
+		slog.Info("not publishing events, event-service not available")
+		return nil
+	}
+
+	if err := s.repo.EnqueueEvents(ctx, events); err != nil {
+		return fmt.Errorf("failed to store operation events in the outbox: %w", err)
+	}
+
+	return nil
+}
+
+// changedFields returns the field paths of the operation that are changed by
+// upd, see repo.UpdateOperation.
+func changedFields(upd *longrunningv1.UpdateOperationRequest) []string {
+	paths := upd.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"running", "annotations", "status_message", "percent_done"}
+	}
+
+	fields := []string{"last_update"}
+	for _, p := range paths {
+		// running is not a field of the operation but updates it's state.
+		if p == "running" {
+			p = "state"
+		}
+
+		fields = append(fields, p)
+	}
+
+	return fields
+}
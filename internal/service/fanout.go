@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	eventsv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/privacy"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/proto"
+)
+
+// StartFanOut subscribes to the lifecycle events published by all service
+// instances and feeds them into the local watcher dispatch so watchers see
+// updates that have been handled by other instances. Events for updates that
+// have already been dispatched locally are dropped.
+//
+// StartFanOut returns immediately and keeps reconnecting to the events-service
+// until ctx is cancelled.
+func (s *Service) StartFanOut(ctx context.Context) {
+	if s.providers.EventService == nil {
+		slog.Info("not starting watcher fan-out, event-service not available")
+		return
+	}
+
+	go func() {
+		for {
+			if err := s.receiveEvents(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("failed to receive operation events", "error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+func (s *Service) receiveEvents(ctx context.Context) error {
+	stream := s.providers.EventService.Subscribe(ctx)
+	defer stream.CloseRequest()
+
+	for _, typ := range op.EventTypes {
+		if err := stream.Send(&eventsv1.SubscribeRequest{
+			Kind: &eventsv1.SubscribeRequest_Subscribe{
+				Subscribe: string(typ),
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		msg, err := stream.Receive()
+		if err != nil {
+			if errors.Is(err, io.EOF) || connect.CodeOf(err) == connect.CodeCanceled {
+				return nil
+			}
+
+			return err
+		}
+
+		evt, err := op.ParseEvent(msg.GetEvent())
+		if err != nil {
+			slog.Warn("failed to decode operation event", "error", err, "typeUrl", msg.GetEvent().GetTypeUrl())
+			continue
+		}
+
+		// updates that have been dispatched by this instance already are
+		// received through the fan-out as well.
+		if !s.dispatched.add(evt.Operation) {
+			continue
+		}
+
+		s.deliver(s.unredacted(ctx, evt.Operation), "")
+	}
+}
+
+// unredacted returns the stored version of pbop if the privacy policy is
+// enabled. Events are redacted before they are published so watchers would
+// never see the redacted values otherwise, even if the policy allows them to.
+// Watcher responses are redacted by the privacy interceptor.
+func (s *Service) unredacted(ctx context.Context, pbop *longrunningv1.Operation) *longrunningv1.Operation {
+	if !s.providers.Config.PrivacyPolicy().Enabled() {
+		return pbop
+	}
+
+	stored, err := s.repo.GetOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: pbop.UniqueId}, nil)
+	if err != nil {
+		// deleted operations are still delivered using the event.
+		if !errors.Is(err, repo.ErrNotFound) {
+			slog.Error("failed to load operation of event", "error", err, "uniqueId", pbop.UniqueId)
+		}
+
+		return pbop
+	}
+
+	return stored
+}
+
+// dispatchLog remembers recently dispatched operation updates so updates
+// received through the fan-out are not delivered twice. Updates are identified
+// by a hash of the redacted operation since events are redacted before they
+// are published, see publishEvents.
+type dispatchLog struct {
+	l      sync.Mutex
+	ttl    time.Duration
+	policy privacy.Policy
+	seen   map[string]time.Time
+
+	lastPrune time.Time
+}
+
+func newDispatchLog(ttl time.Duration, policy privacy.Policy) *dispatchLog {
+	return &dispatchLog{
+		ttl:    ttl,
+		policy: policy,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// add records op and reports whether it has not been seen before.
+func (d *dispatchLog) add(op *longrunningv1.Operation) bool {
+	blob, err := proto.MarshalOptions{Deterministic: true}.Marshal(privacy.Redact(d.policy, op))
+	if err != nil {
+		// better deliver twice than not at all.
+		return true
+	}
+
+	sum := sha256.Sum256(blob)
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	if now.Sub(d.lastPrune) > d.ttl {
+		for k, t := range d.seen {
+			if now.Sub(t) > d.ttl {
+				delete(d.seen, k)
+			}
+		}
+
+		d.lastPrune = now
+	}
+
+	if t, ok := d.seen[key]; ok && now.Sub(t) <= d.ttl {
+		return false
+	}
+
+	d.seen[key] = now
+
+	return true
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+func durationFromHeader(h http.Header, name string, def time.Duration) (time.Duration, error) {
+	v := h.Get(name)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", name, v))
+	}
+
+	return d, nil
+}
+
+func boolFromHeader(h http.Header, name string) (bool, error) {
+	v := h.Get(name)
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", name, v))
+	}
+
+	return b, nil
+}
+
+// optionalBoolFromHeader is like boolFromHeader but returns nil if the header
+// is not set.
+func optionalBoolFromHeader(h http.Header, name string) (*bool, error) {
+	if h.Get(name) == "" {
+		return nil, nil
+	}
+
+	b, err := boolFromHeader(h, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// optionalIntFromHeader returns the integer value of the header name or nil if
+// it is not set.
+func optionalIntFromHeader(h http.Header, name string) (*int, error) {
+	v := h.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", name, v))
+	}
+
+	return &i, nil
+}
+
+// percentFromHeader parses the op.PercentDoneHeader. The range is validated
+// by repo.Limits.CheckProgress.
+func percentFromHeader(h http.Header) (int32, error) {
+	v := h.Get(op.PercentDoneHeader)
+	if v == "" {
+		return 0, nil
+	}
+
+	percent, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", op.PercentDoneHeader, v))
+	}
+
+	return int32(percent), nil
+}
+
+// listFromHeader returns all non-empty values of the comma separated lists in
+// the header name.
+func listFromHeader(h http.Header, name string) []string {
+	var values []string
+
+	for _, v := range h.Values(name) {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				values = append(values, p)
+			}
+		}
+	}
+
+	return values
+}
+
+// linksFromHeader decodes all values of the op.LinkHeader.
+func linksFromHeader(h http.Header) ([]repo.Link, error) {
+	var links []repo.Link
+
+	for _, v := range h.Values(op.LinkHeader) {
+		var link op.Link
+		if err := json.Unmarshal([]byte(v), &link); err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %w", op.LinkHeader, err))
+		}
+
+		links = append(links, repo.Link{
+			Title: link.Title,
+			URL:   link.URL,
+			Icon:  link.Icon,
+		})
+	}
+
+	return links, nil
+}
+
+func readMaskFromHeader(h http.Header) (*repo.ReadMask, error) {
+	mask, err := repo.NewReadMask(listFromHeader(h, op.ReadMaskHeader))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	return mask, nil
+}
+
+func lastUpdateBeforeFromHeader(h http.Header) (time.Time, error) {
+	before := h.Get(op.LastUpdateBeforeHeader)
+	age := h.Get(op.LastUpdateAgeHeader)
+
+	switch {
+	case before != "" && age != "":
+		return time.Time{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%s and %s must not be specified together", op.LastUpdateBeforeHeader, op.LastUpdateAgeHeader))
+
+	case before != "":
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return time.Time{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", op.LastUpdateBeforeHeader, before))
+		}
+
+		return t, nil
+
+	case age != "":
+		d, err := durationFromHeader(h, op.LastUpdateAgeHeader, 0)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Time{}, nil
+}
+
+// timeFromHeader parses the RFC3339 time of the header name. The zero time is
+// returned if the header is not set.
+func timeFromHeader(h http.Header, name string) (time.Time, error) {
+	v := h.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", name, v))
+	}
+
+	return t, nil
+}
+
+// namespacesFromHeader returns the namespaces selected by the request headers.
+// The default namespace is used if no namespace is specified. A nil slice is
+// returned for op.AllNamespaces. Selecting a namespace other than the default
+// namespace requires administrative privileges.
+func (s *Service) namespacesFromHeader(ctx context.Context, h http.Header) ([]string, error) {
+	remoteUser := auth.From(ctx)
+
+	return s.namespacesOf(h, remoteUser != nil && remoteUser.Admin)
+}
+
+// namespacesOf is like namespacesFromHeader but for callers that have been
+// authorized already.
+func (s *Service) namespacesOf(h http.Header, admin bool) ([]string, error) {
+	ns := h.Get(op.NamespaceHeader)
+	if ns == "" || ns == s.providers.Config.DefaultNamespace {
+		return []string{s.providers.Config.DefaultNamespace}, nil
+	}
+
+	if !admin {
+		return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("reading operations of namespace %q is not permitted", ns))
+	}
+
+	if ns == op.AllNamespaces {
+		return nil, nil
+	}
+
+	return []string{ns}, nil
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"slices"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+func (s *Service) checkRegistrationLimits(req *longrunningv1.RegisterOperationRequest) error {
+	if err := s.providers.Config.DurationLimits().CheckRegistration(req); err != nil {
+		return err
+	}
+
+	limits := s.providers.Config.Limits()
+
+	if err := limits.CheckParameters(req.Parameters); err != nil {
+		return err
+	}
+
+	return limits.CheckAnnotations(req.Annotations)
+}
+
+func (s *Service) checkUpdateLimits(req *longrunningv1.UpdateOperationRequest) error {
+	limits := s.providers.Config.Limits()
+	paths := req.GetUpdateMask().GetPaths()
+
+	// fields that are not selected by the update mask are ignored.
+	selected := func(path string) bool {
+		return len(paths) == 0 || slices.Contains(paths, path)
+	}
+
+	if selected("percent_done") || selected("status_message") {
+		var (
+			percent int32
+			msg     string
+		)
+
+		if selected("percent_done") {
+			percent = req.PercentDone
+		}
+		if selected("status_message") {
+			msg = req.StatusMessage
+		}
+
+		if err := limits.CheckProgress(percent, msg); err != nil {
+			return err
+		}
+	}
+
+	if !selected("annotations") {
+		return nil
+	}
+
+	return limits.CheckAnnotations(req.Annotations)
+}
+
+// checkCompleteLimits enforces the result size limit on req and returns the
+// original size of the result if it has been truncated.
+func (s *Service) checkCompleteLimits(req *longrunningv1.CompleteOperationRequest) (int, error) {
+	return s.providers.Config.Limits().LimitResult(req)
+}
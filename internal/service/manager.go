@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/proto"
+)
+
+// errNoManager is returned for requests that require the manager on
+// instances without the manager role.
+var errNoManager = errors.New("manager role is not enabled on this instance")
+
+// StartManager starts the lost detection of the manager. ctx bounds the
+// lifetime of the manager and is used again when it is resumed, see
+// SetManagerRunning.
+func (s *Service) StartManager(ctx context.Context) error {
+	if s.mng == nil {
+		return errNoManager
+	}
+
+	s.mngL.Lock()
+	s.mngCtx = ctx
+	s.mngL.Unlock()
+
+	return s.mng.Start(ctx)
+}
+
+// SetManagerRunning stops (false) or resumes (true) the lost detection, for
+// example while operations are migrated. Operations are neither marked as
+// lost nor started or timed out while the manager is stopped, the first scan
+// after resuming catches up. Resuming a running manager is a no-op.
+func (s *Service) SetManagerRunning(running bool) error {
+	if s.mng == nil {
+		return errNoManager
+	}
+
+	if !running {
+		s.mng.Stop()
+		return nil
+	}
+
+	s.mngL.Lock()
+	ctx := s.mngCtx
+	s.mngL.Unlock()
+
+	if ctx == nil {
+		return errors.New("manager has not been started")
+	}
+
+	if err := s.mng.Start(ctx); err != nil && !errors.Is(err, manager.ErrRunning) {
+		return err
+	}
+
+	slog.Info("manager resumed")
+
+	return nil
+}
+
+// Close removes the callbacks the service registered with the manager so a
+// service with a shorter lifetime than its manager can be released. The
+// manager itself is not stopped.
+func (s *Service) Close() {
+	for _, unsubscribe := range s.mngCallbacks {
+		unsubscribe()
+	}
+}
+
+// notifyStateChange reports the state change of an operation handled by the
+// service to the manager. Without a manager, the change is passed to
+// stateChanged directly.
+func (s *Service) notifyStateChange(old, new *longrunningv1.Operation) {
+	if s.mng != nil {
+		s.mng.NotifyStateChange(old, new)
+		return
+	}
+
+	// like the manager callbacks, stateChanged must not share the operation
+	// with the response.
+	if old != nil {
+		old = proto.Clone(old).(*longrunningv1.Operation)
+	}
+
+	go s.stateChanged(old, proto.Clone(new).(*longrunningv1.Operation))
+}
+
+// observe passes op to the manager so it tracks its deadline, if any.
+func (s *Service) observe(op *longrunningv1.Operation) {
+	if s.mng != nil {
+		s.mng.Observe(op)
+	}
+}
+
+// retryLost executes the retry policy of the operation that has been lost
+// by the service. Without a manager, the successor is registered by the next
+// check of an instance that runs it, see manager.SetRetries.
+func (s *Service) retryLost(ctx context.Context, lost *longrunningv1.Operation) {
+	if s.mng != nil {
+		s.mng.RetryLost(ctx, lost)
+	}
+}
+
+// stateChanged is the OnStateChange callback of the service. Watchers of
+// operations that have been lost are notified and lost and failed operations
+// are reported to their owners. Updates of clients have already been
+// delivered to the watchers by the request itself.
+//
+// The lifecycle events of changes of the manager are stored by the manager
+// itself, see managerEvents.
+func (s *Service) stateChanged(_, pbop *longrunningv1.Operation) {
+	if pbop.State == longrunningv1.OperationState_OperationState_LOST {
+		s.notifyWatchers(pbop)
+	}
+
+	if isTerminal(pbop.State) && pbop.GetError() != nil {
+		s.notifyOwner(pbop)
+	}
+}
+
+// managerEvents stores the lifecycle events of the operations changed by the
+// manager in the same transaction as the change, see manager.SetEvents.
+type managerEvents struct {
+	s *Service
+}
+
+func (e managerEvents) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return e.s.transact(ctx, fn)
+}
+
+func (e managerEvents) StoreEvents(ctx context.Context, typ op.EventType, changedFields []string, ops ...*longrunningv1.Operation) error {
+	return e.s.enqueueEvents(ctx, typ, changedFields, ops...)
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	idmv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// notificationQueueSize is the number of owner notifications that may wait
+// for delivery. Further notifications are dropped so neither the manager nor
+// completions are ever blocked by the notification service.
+const notificationQueueSize = 256
+
+// errUnknownOwner is returned by resolveOwner if the owner of an operation
+// is not a user, like a service, and cannot be notified.
+var errUnknownOwner = errors.New("owner is not a known user")
+
+// ownerNotification is a pending notification about a lost or failed
+// operation.
+type ownerNotification struct {
+	pbop    *longrunningv1.Operation
+	attempt int
+}
+
+// StartNotifications starts delivering the notifications queued by
+// notifyOwner, see config.Config.NotifyOwners.
+//
+// StartNotifications returns immediately, the delivery stops once ctx is
+// cancelled.
+func (s *Service) StartNotifications(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-s.notifications:
+				s.sendNotification(ctx, n)
+			}
+		}
+	}()
+}
+
+// notifyOwner queues a notification for the owner of the lost or failed
+// operation pbop unless notifications are disabled for it. It never blocks.
+func (s *Service) notifyOwner(pbop *longrunningv1.Operation) {
+	if !s.wantsNotification(pbop) {
+		return
+	}
+
+	s.queueNotification(ownerNotification{pbop: pbop, attempt: 1})
+}
+
+// wantsNotification reports whether the owner of pbop is notified, see
+// config.Config.NotifyOwners.
+func (s *Service) wantsNotification(pbop *longrunningv1.Operation) bool {
+	cfg := s.providers.Config
+
+	if !cfg.NotifyOwners || s.providers.NotifyService == nil || s.providers.UserService == nil || pbop.Owner == "" {
+		return false
+	}
+
+	for _, owner := range cfg.NotifyExcludeOwners {
+		if owner == pbop.Owner {
+			return false
+		}
+	}
+
+	for _, pattern := range cfg.NotifyExcludeKinds {
+		// patterns are validated by config.LoadConfig
+		if ok, _ := path.Match(pattern, pbop.Kind); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queueNotification queues n for delivery or drops it if the queue is full.
+func (s *Service) queueNotification(n ownerNotification) {
+	select {
+	case s.notifications <- n:
+	default:
+		slog.Warn("notification queue full, dropping owner notification", "id", n.pbop.UniqueId, "owner", n.pbop.Owner)
+	}
+}
+
+// sendNotification delivers n and schedules a retry with an exponential
+// backoff if it failed and attempts are left.
+func (s *Service) sendNotification(ctx context.Context, n ownerNotification) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	err := s.deliverNotification(ctx, n.pbop)
+	switch {
+	case err == nil:
+		return
+
+	case errors.Is(err, errUnknownOwner):
+		slog.Debug("not notifying owner of operation", "id", n.pbop.UniqueId, "owner", n.pbop.Owner, "error", err)
+		return
+
+	case n.attempt >= s.providers.Config.NotifyMaxAttempts:
+		slog.Error("failed to notify owner of operation, giving up", "id", n.pbop.UniqueId, "owner", n.pbop.Owner, "attempts", n.attempt, "error", err)
+		return
+	}
+
+	delay := s.providers.Config.NotifyRetryBackoff << min(n.attempt-1, 16)
+
+	slog.Warn("failed to notify owner of operation, retrying", "id", n.pbop.UniqueId, "owner", n.pbop.Owner, "attempt", n.attempt, "retryIn", delay.String(), "error", err)
+
+	n.attempt++
+	time.AfterFunc(delay, func() {
+		s.queueNotification(n)
+	})
+}
+
+// deliverNotification sends the message about pbop to its owner.
+func (s *Service) deliverNotification(ctx context.Context, pbop *longrunningv1.Operation) error {
+	userID, err := s.resolveOwner(ctx, pbop.Owner)
+	if err != nil {
+		return err
+	}
+
+	subject, body := s.notificationMessage(pbop)
+
+	res, err := s.providers.NotifyService.SendNotification(ctx, connect.NewRequest(&idmv1.SendNotificationRequest{
+		TargetUsers: []string{userID},
+		Message: &idmv1.SendNotificationRequest_Email{
+			Email: &idmv1.EMailMessage{
+				Subject: subject,
+				Body:    body,
+			},
+		},
+	}))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range res.Msg.GetDeliveries() {
+		if d.Error != "" {
+			return fmt.Errorf("delivery to %s failed: %s", d.TargetUser, d.Error)
+		}
+	}
+
+	return nil
+}
+
+// resolveOwner returns the id of the user that owns an operation. Owners may
+// be set to either the id or the name of a user.
+func (s *Service) resolveOwner(ctx context.Context, owner string) (string, error) {
+	for _, search := range []*idmv1.GetUserRequest{
+		{Search: &idmv1.GetUserRequest_Id{Id: owner}},
+		{Search: &idmv1.GetUserRequest_Name{Name: owner}},
+	} {
+		res, err := s.providers.UserService.GetUser(ctx, connect.NewRequest(search))
+		if connect.CodeOf(err) == connect.CodeNotFound {
+			continue
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve owner: %w", err)
+		}
+
+		return res.Msg.GetProfile().GetUser().GetId(), nil
+	}
+
+	return "", errUnknownOwner
+}
+
+// notificationMessage returns the subject and body of the notification about
+// pbop.
+func (s *Service) notificationMessage(pbop *longrunningv1.Operation) (string, string) {
+	outcome := "failed"
+	if pbop.State == longrunningv1.OperationState_OperationState_LOST {
+		outcome = "has been lost"
+	}
+
+	subject := fmt.Sprintf("Operation %s %s", pbop.Kind, outcome)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "The operation %s %s.\n\n", pbop.UniqueId, outcome)
+	fmt.Fprintf(&body, "Kind: %s\n", pbop.Kind)
+
+	if pbop.Description != "" {
+		fmt.Fprintf(&body, "Description: %s\n", pbop.Description)
+	}
+
+	if msg := pbop.GetError().GetMessage(); msg != "" {
+		fmt.Fprintf(&body, "Error: %s\n", msg)
+	}
+
+	if link := s.providers.Config.NotifyLink; link != "" {
+		fmt.Fprintf(&body, "\n%s\n", strings.ReplaceAll(link, "{id}", pbop.UniqueId))
+	}
+
+	return subject, body.String()
+}
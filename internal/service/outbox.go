@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	eventsv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1"
+)
+
+const (
+	// outboxBatchSize is the maximum number of events claimed at once.
+	outboxBatchSize = 100
+
+	// outboxLease is how long claimed events are reserved for this instance.
+	// It must be long enough to publish a whole batch.
+	outboxLease = time.Minute
+
+	// outboxPollInterval is the interval at which the outbox is checked for
+	// events of other instances whose lease expired.
+	outboxPollInterval = 10 * time.Second
+)
+
+// StartOutbox starts publishing the events stored in the outbox to the
+// events-service. Events that are left over from a previous run are published
+// first. If publishing fails, the publisher backs off exponentially between
+// OutboxMinBackoff and OutboxMaxBackoff.
+//
+// StartOutbox returns immediately, the publisher stops once ctx is cancelled.
+func (s *Service) StartOutbox(ctx context.Context) {
+	if s.providers.EventService == nil {
+		slog.Info("not starting outbox publisher, event-service not available")
+		return
+	}
+
+	minBackoff := s.providers.Config.OutboxMinBackoff
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+
+	maxBackoff := max(s.providers.Config.OutboxMaxBackoff, minBackoff)
+
+	go func() {
+		backoff := minBackoff
+
+		for {
+			wait := outboxPollInterval
+
+			n, err := s.drainOutbox(ctx, backoff)
+			switch {
+			case ctx.Err() != nil:
+				return
+
+			case err != nil:
+				slog.Error("failed to publish events from the outbox", "error", err, "retryIn", backoff.String())
+
+				wait = backoff
+				backoff = min(2*backoff, maxBackoff)
+
+			default:
+				backoff = minBackoff
+
+				// there might be more events waiting.
+				if n == outboxBatchSize {
+					wait = 0
+				}
+			}
+
+			s.updateOutboxDepth(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.outboxWake:
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// drainOutbox claims a batch of events and publishes them in order. Publishing
+// stops at the first failure so events are not delivered out of order. The
+// failed event is not claimed again before retryIn elapsed.
+func (s *Service) drainOutbox(ctx context.Context, retryIn time.Duration) (int, error) {
+	entries, err := s.repo.ClaimEvents(ctx, outboxBatchSize, outboxLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, entry := range entries {
+		_, err := s.providers.EventService.Publish(ctx, connect.NewRequest(&eventsv1.Event{
+			Event: entry.Event,
+		}))
+
+		if err != nil {
+			if s.providers.Metrics != nil {
+				s.providers.Metrics.IncrOutboxFailures()
+			}
+
+			if markErr := s.repo.MarkEventFailed(ctx, entry.ID, err, time.Now().Add(retryIn)); markErr != nil {
+				slog.Error("failed to record failed event delivery", "error", markErr, "id", entry.ID.Hex())
+			}
+
+			return idx, err
+		}
+
+		// if this fails, the event will be published again once the lease
+		// expired.
+		if err := s.repo.MarkEventDelivered(ctx, entry.ID); err != nil {
+			slog.Error("failed to mark event as delivered", "error", err, "id", entry.ID.Hex())
+		}
+	}
+
+	return len(entries), nil
+}
+
+// wakeOutbox notifies the outbox publisher about new events.
+func (s *Service) wakeOutbox() {
+	select {
+	case s.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Service) updateOutboxDepth(ctx context.Context) {
+	if s.providers.Metrics == nil {
+		return
+	}
+
+	count, err := s.repo.CountPendingEvents(ctx)
+	if err != nil {
+		slog.Error("failed to count pending events", "error", err)
+		return
+	}
+
+	s.providers.Metrics.SetOutboxDepth(count)
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// HandleProcedures registers the handlers for all procedures that are served
+// in addition to the LongRunningService on mux. The auth interceptor does not
+// run for them so extractor is used to identify the calling user.
+func (s *Service) HandleProcedures(mux *http.ServeMux, extractor auth.ExtractorFunc, opts ...connect.HandlerOption) {
+	s.extractor = extractor
+
+	mux.Handle(op.WatchOperationsProcedure, connect.NewServerStreamHandler(op.WatchOperationsProcedure, s.WatchOperations, opts...))
+	mux.Handle(op.HeartbeatProcedure, connect.NewUnaryHandler(op.HeartbeatProcedure, s.Heartbeat, opts...))
+	mux.Handle(op.ListOperationsStreamProcedure, connect.NewServerStreamHandler(op.ListOperationsStreamProcedure, s.ListOperationsStream, opts...))
+	mux.Handle(op.WaitForCompletionProcedure, connect.NewUnaryHandler(op.WaitForCompletionProcedure, s.WaitForCompletion, opts...))
+	mux.Handle(op.CancelOperationProcedure, connect.NewUnaryHandler(op.CancelOperationProcedure, s.CancelOperation, opts...))
+	mux.Handle(op.GetKindDefaultsProcedure, connect.NewUnaryHandler(op.GetKindDefaultsProcedure, s.GetKindDefaults, opts...))
+	mux.Handle(op.AcquireOperationProcedure, connect.NewUnaryHandler(op.AcquireOperationProcedure, s.AcquireOperation, opts...))
+	mux.Handle(op.GetDashboardProcedure, connect.NewUnaryHandler(op.GetDashboardProcedure, s.GetDashboard, opts...))
+	mux.Handle(op.WatchProcedure, connect.NewBidiStreamHandler(op.WatchProcedure, s.Watch, opts...))
+	mux.Handle(op.AddNoteProcedure, connect.NewUnaryHandler(op.AddNoteProcedure, s.AddNote, opts...))
+	mux.Handle(op.AddTagsProcedure, connect.NewUnaryHandler(op.AddTagsProcedure, s.AddTags, opts...))
+	mux.Handle(op.RemoveTagsProcedure, connect.NewUnaryHandler(op.RemoveTagsProcedure, s.RemoveTags, opts...))
+	mux.Handle(op.AddLinkProcedure, connect.NewUnaryHandler(op.AddLinkProcedure, s.AddLink, opts...))
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"slices"
+	"sync"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/config"
+)
+
+// defaultWatchBufferSize is used if no buffer size is configured.
+const defaultWatchBufferSize = 100
+
+// watchQueue buffers the updates of a single watcher. Pushing never blocks so a
+// stalled watcher cannot delay the dispatch of updates to other watchers.
+// Once the buffer is full, the slow-consumer policy decides what happens with
+// new updates. Terminal updates are never dropped, if required the buffer grows
+// beyond its size to hold them. Watchers that are disconnected still receive
+// the buffered terminal updates before done is closed, see take.
+type watchQueue struct {
+	size   int
+	policy config.SlowConsumerPolicy
+
+	l            sync.Mutex
+	updates      []*longrunningv1.Operation
+	disconnected bool
+
+	// ready receives a value if updates are available.
+	ready chan struct{}
+
+	// done is closed once the watcher has been disconnected.
+	done chan struct{}
+}
+
+func newWatchQueue(size int, policy config.SlowConsumerPolicy) *watchQueue {
+	if size < 1 {
+		size = defaultWatchBufferSize
+	}
+
+	return &watchQueue{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// push adds update to the queue. It reports false if the buffer was full and
+// the slow-consumer policy has been applied.
+func (q *watchQueue) push(update *longrunningv1.Operation) bool {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	if q.disconnected {
+		return true
+	}
+
+	full := len(q.updates) >= q.size
+
+	if full {
+		switch {
+		case q.policy == config.Disconnect:
+			q.disconnected = true
+			q.updates = slices.DeleteFunc(q.updates, func(u *longrunningv1.Operation) bool {
+				return !isTerminal(u.State)
+			})
+
+			if isTerminal(update.State) {
+				q.updates = append(q.updates, update)
+			}
+
+			if len(q.updates) == 0 {
+				close(q.done)
+				return false
+			}
+
+			select {
+			case q.ready <- struct{}{}:
+			default:
+			}
+
+			return false
+
+		case q.policy == config.DropUpdate && !isTerminal(update.State):
+			return false
+
+		default:
+			// drop the oldest update that is not terminal. If all buffered
+			// updates are terminal, the buffer grows instead.
+			idx := slices.IndexFunc(q.updates, func(u *longrunningv1.Operation) bool {
+				return !isTerminal(u.State)
+			})
+
+			if idx >= 0 {
+				q.updates = slices.Delete(q.updates, idx, idx+1)
+			}
+		}
+	}
+
+	q.updates = append(q.updates, update)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return !full
+}
+
+// take removes and returns all buffered updates in the order they have been
+// pushed. If the watcher has been disconnected, done is closed once the
+// remaining updates have been taken.
+func (q *watchQueue) take() []*longrunningv1.Operation {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	updates := q.updates
+	q.updates = nil
+
+	if q.disconnected && len(updates) > 0 {
+		close(q.done)
+	}
+
+	return updates
+}
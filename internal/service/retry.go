@@ -0,0 +1,14 @@
+package service
+
+import (
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// retried is the OnRetried callback of the service. The successor next,
+// registered by the manager according to the retry policy of the lost
+// operation, is dispatched like operations registered by clients, see
+// op.RetryMaxAttemptsHeader. Its event has been stored by the manager, see
+// managerEvents.
+func (s *Service) retried(_, next *longrunningv1.Operation) {
+	s.dispatch(next, "")
+}
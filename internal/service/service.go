@@ -2,18 +2,25 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/bufbuild/connect-go"
-	eventsv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1"
 	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
 	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1/longrunningv1connect"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/config"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/privacy"
 	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
-	"google.golang.org/protobuf/types/known/anypb"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type Service struct {
@@ -23,192 +30,1163 @@ type Service struct {
 	providers *config.Providers
 	mng       *manager.Manager
 
-	l        sync.RWMutex
-	watchers map[string][]chan *longrunningv1.Operation
+	// mngL protects mngCtx which is used to resume the manager, see
+	// SetManagerRunning.
+	mngL   sync.Mutex
+	mngCtx context.Context
+
+	// mngCallbacks remove the manager callbacks of the service, see Close.
+	mngCallbacks []manager.Unsubscribe
+
+	l              sync.RWMutex
+	watchers       map[string][]*watchQueue
+	filterWatchers []*filterWatcher
+	peerWatchers   map[string]int
+	activeWatchers int
+
+	dispatched  *dispatchLog
+	outboxWake  chan struct{}
+	webhookWake chan struct{}
+	webhookCli  *http.Client
+
+	// notifications holds the pending owner notifications, see
+	// notifyOwner.
+	notifications chan ownerNotification
+
+	// extractor identifies the callers of procedures the auth interceptor
+	// does not run for, see HandleProcedures.
+	extractor auth.ExtractorFunc
 }
 
+// New returns a new service. mng may be nil on instances without the manager
+// role, see config.RoleManager. State changes of requests handled by the
+// service are then reported to its watchers and owners directly while lost
+// detection and retries are left to the instances that run the manager.
 func New(providers *config.Providers, mng *manager.Manager) *Service {
 	svc := &Service{
-		repo:      providers.Repo,
-		providers: providers,
-		mng:       mng,
-		watchers:  make(map[string][]chan *longrunningv1.Operation),
+		repo:         providers.Repo,
+		providers:    providers,
+		mng:          mng,
+		watchers:     make(map[string][]*watchQueue),
+		peerWatchers: make(map[string]int),
+		dispatched:   newDispatchLog(time.Minute, providers.Config.PrivacyPolicy()),
+		outboxWake:   make(chan struct{}, 1),
+		webhookWake:  make(chan struct{}, 1),
+		webhookCli: &http.Client{
+			Timeout: providers.Config.WebhookTimeout,
+		},
+		notifications: make(chan ownerNotification, notificationQueueSize),
+		extractor:     auth.RemoteHeaderExtractor,
+	}
+
+	if mng == nil {
+		return svc
 	}
 
-	mng.OnLost(svc.notifyWatchers)
+	mng.SetEvents(managerEvents{svc})
+
+	svc.mngCallbacks = []manager.Unsubscribe{
+		mng.OnStateChange(svc.stateChanged),
+
+		mng.OnTimeout(svc.notifyWatchers),
+
+		mng.OnStarted(svc.notifyWatchers),
+
+		mng.OnExpiring(svc.warnExpiring),
+
+		mng.OnRetried(svc.retried),
+	}
 
 	return svc
 }
 
 func (s *Service) RegisterOperation(ctx context.Context, req *connect.Request[longrunningv1.RegisterOperationRequest]) (*connect.Response[longrunningv1.RegisterOperationResponse], error) {
-	id, authCode, err := s.repo.RegisterOperation(ctx, req.Msg)
+	defaults := s.providers.Config.DurationLimits().Defaults(req.Msg.Kind)
+
+	pendingTimeout, err := durationFromHeader(req.Header(), op.PendingTimeoutHeader, defaults.PendingTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	op, err := s.repo.GetOperation(ctx, &longrunningv1.GetOperationRequest{
-		UniqueId: id,
-	})
+	maxRuntime, err := durationFromHeader(req.Header(), op.MaxRuntimeHeader, defaults.MaxRuntime)
 	if err != nil {
 		return nil, err
 	}
 
-	if s.providers.EventService != nil {
-		go func() {
-			anypb, err := anypb.New(op)
-			if err != nil {
-				slog.Error("failed to convert longrunningv1.Operation to anypb.Any", "error", err)
-			} else {
-				if _, err := s.providers.EventService.Publish(context.Background(), connect.NewRequest(&eventsv1.Event{
-					Event: anypb,
-				})); err != nil {
-					slog.Error("failed to publish operation to events-service", "error", err)
+	suppressWithin, err := durationFromHeader(req.Header(), op.SuppressDuplicatesHeader, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := linksFromHeader(req.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	visibleTo, err := repo.NormalizeViewers(listFromHeader(req.Header(), op.VisibleToHeader))
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	percentDone, err := percentFromHeader(req.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	priority, err := optionalIntFromHeader(req.Header(), op.PriorityHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime, err := timeFromHeader(req.Header(), op.StartTimeHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts, err := optionalIntFromHeader(req.Header(), op.RetryMaxAttemptsHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	retryBackoff, err := durationFromHeader(req.Header(), op.RetryBackoffHeader, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	validateOnly, err := boolFromHeader(req.Header(), op.ValidateOnlyHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	allowNoExpiry, err := boolFromHeader(req.Header(), op.AllowNoExpiryHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	statusMessage := req.Header().Get(op.StatusMessageHeader)
+	if err := s.providers.Config.Limits().CheckProgress(percentDone, statusMessage); err != nil {
+		return nil, toConnectError(err)
+	}
+
+	opts := repo.RegisterOptions{
+		PendingTimeout:           pendingTimeout,
+		MaxRuntime:               maxRuntime,
+		Namespace:                req.Header().Get(op.NamespaceHeader),
+		ExternalRef:              req.Header().Get(op.ExternalRefHeader),
+		DependsOn:                listFromHeader(req.Header(), op.DependsOnHeader),
+		SuppressDuplicatesWithin: suppressWithin,
+		Links:                    links,
+		VisibleTo:                visibleTo,
+		PercentDone:              int(percentDone),
+		StatusMessage:            statusMessage,
+		ValidateOnly:             validateOnly,
+		AllowNoExpiry:            allowNoExpiry || s.providers.Config.AllowNoExpiry,
+	}
+
+	if priority != nil {
+		opts.Priority = *priority
+	}
+
+	if !startTime.IsZero() {
+		opts.StartTime = &startTime
+	}
+
+	if maxAttempts != nil {
+		opts.Retry = &repo.RetryPolicy{
+			MaxAttempts: *maxAttempts,
+			Backoff:     retryBackoff,
+		}
+	} else if retryBackoff > 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%s requires %s", op.RetryBackoffHeader, op.RetryMaxAttemptsHeader))
+	}
+
+	if opts.Namespace == op.AllNamespaces {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid namespace %q", opts.Namespace))
+	}
+
+	res, err := s.registerOperations(ctx, []*longrunningv1.RegisterOperationRequest{req.Msg}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	response := connect.NewResponse(res[0])
+	switch {
+	case validateOnly && res[0].Operation.UniqueId == "":
+		response.Header().Set(op.ValidateOnlyHeader, "true")
+
+	case res[0].AuthToken == "":
+		response.Header().Set(op.DeduplicatedHeader, "true")
+	}
+
+	return response, nil
+}
+
+// registerOperations registers all operations in reqs at once and publishes them
+// to the events-service. Registration is all-or-nothing, see repo.RegisterOperations.
+func (s *Service) registerOperations(ctx context.Context, reqs []*longrunningv1.RegisterOperationRequest, opts repo.RegisterOptions) ([]*longrunningv1.RegisterOperationResponse, error) {
+	for idx, req := range reqs {
+		if err := s.checkRegistrationLimits(req); err != nil {
+			if len(reqs) > 1 {
+				err = fmt.Errorf("operation %d: %w", idx, err)
+			}
+
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+	}
+
+	// operations registered via the admin listener are not subject to quotas.
+	if remoteUser := auth.From(ctx); remoteUser == nil || !remoteUser.Admin {
+		opts.Quota = s.providers.Config.Quota()
+	}
+
+	var (
+		res []*longrunningv1.RegisterOperationResponse
+		ops []*longrunningv1.Operation
+	)
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		res, err = s.repo.RegisterOperations(ctx, reqs, opts)
+		if err != nil {
+			return err
+		}
+
+		// deduplicated registrations do not carry an auth token and have
+		// already been published when they were registered.
+		ops = make([]*longrunningv1.Operation, 0, len(res))
+		for _, r := range res {
+			if r.AuthToken != "" {
+				ops = append(ops, r.Operation)
+			}
+		}
+
+		return s.enqueueEvents(ctx, op.EventCreated, nil, ops...)
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = s.providers.Config.DefaultNamespace
+	}
+
+	for _, op := range ops {
+		s.dispatch(op, namespace)
+	}
+
+	// dependencies might have terminated before the operations were stored.
+	if len(opts.DependsOn) > 0 {
+		for _, r := range res {
+			if r.AuthToken == "" {
+				continue
+			}
+
+			var updated *longrunningv1.Operation
+
+			err := s.transact(ctx, func(ctx context.Context) error {
+				var err error
+
+				updated, err = s.repo.EvaluateDependencies(ctx, r.Operation.UniqueId)
+				if updated == nil || err != nil {
+					return err
 				}
+
+				return s.enqueueChange(ctx, updated, "state", "last_update")
+			})
+			if err != nil {
+				slog.Error("failed to evaluate operation dependencies", "error", err, "uniqueId", r.Operation.UniqueId)
+				continue
+			}
+
+			if updated != nil {
+				r.Operation = updated
+				s.notifyWatchers(updated)
 			}
-		}()
+		}
 	}
 
-	return connect.NewResponse(&longrunningv1.RegisterOperationResponse{
-		Operation: op,
-		AuthToken: authCode,
-	}), nil
+	return res, nil
 }
 
 func (s *Service) UpdateOperation(ctx context.Context, req *connect.Request[longrunningv1.UpdateOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
-	op, err := s.repo.UpdateOperation(ctx, req.Msg)
+	if err := s.checkUpdateLimits(req.Msg); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	pause, err := optionalBoolFromHeader(req.Header(), op.PauseHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	priority, err := optionalIntFromHeader(req.Header(), op.PriorityHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	merge, err := boolFromHeader(req.Header(), op.MergeAnnotationsHeader)
 	if err != nil {
 		return nil, err
 	}
 
+	opts := updateOptions(ctx)
+	opts.Pause = pause
+	opts.Priority = priority
+	opts.MergeAnnotations = merge
+
+	fields := changedFields(req.Msg)
+	if (pause != nil || priority != nil) && !slices.Contains(fields, "annotations") {
+		fields = append(fields, "annotations")
+	}
+
+	var op, previous, resumed *longrunningv1.Operation
+
+	err = s.transact(ctx, func(ctx context.Context) error {
+		var (
+			err   error
+			retry bool
+		)
+
+		op, previous, err = s.repo.UpdateOperation(ctx, req.Msg, opts)
+		if resumed, retry, err = s.resume(ctx, req.Header(), req.Msg.UniqueId, req.Msg.AuthToken, opts, err); retry {
+			op, previous, err = s.repo.UpdateOperation(ctx, req.Msg, opts)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op, fields...)
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyResumed(resumed)
 	s.notifyWatchers(op)
 
+	if previous.State != op.State {
+		s.notifyStateChange(previous, op)
+	}
+
 	return connect.NewResponse(op), nil
 }
 
-func (s *Service) CompleteOperation(ctx context.Context, req *connect.Request[longrunningv1.CompleteOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
-	op, err := s.repo.CompleteOperation(ctx, req.Msg)
+// Heartbeat keeps an operation alive without changing its state. The update
+// mask may select "percent_done" and "status_message" to report progress.
+// Watchers are only notified if the progress values actually changed.
+func (s *Service) Heartbeat(ctx context.Context, req *connect.Request[longrunningv1.UpdateOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	for _, p := range req.Msg.GetUpdateMask().GetPaths() {
+		if p != "percent_done" && p != "status_message" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid field in update mask: %q", p))
+		}
+	}
+
+	if len(req.Msg.GetUpdateMask().GetPaths()) > 0 {
+		if err := s.checkUpdateLimits(req.Msg); err != nil {
+			return nil, toConnectError(err)
+		}
+	}
+
+	var (
+		op, resumed *longrunningv1.Operation
+		changed     bool
+	)
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var (
+			err   error
+			retry bool
+		)
+
+		op, changed, err = s.repo.Heartbeat(ctx, req.Msg)
+		if resumed, retry, err = s.resume(ctx, req.Header(), req.Msg.UniqueId, req.Msg.AuthToken, repo.UpdateOptions{}, err); retry {
+			op, changed, err = s.repo.Heartbeat(ctx, req.Msg)
+		}
+
+		if !changed || err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op, append([]string{"last_update"}, req.Msg.GetUpdateMask().GetPaths()...)...)
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyResumed(resumed)
+
+	// heartbeats always move the deadline of the operation.
+	s.observe(op)
+
+	if changed {
+		s.notifyWatchers(op)
+	}
+
+	return connect.NewResponse(op), nil
+}
+
+// CancelOperation requests cancellation of an operation. The request is
+// delivered to the watchers of the operation so the worker can wind down
+// gracefully. It does not change the state of the operation.
+func (s *Service) CancelOperation(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	// CancelOperation is not part of the service definition so the auth
+	// interceptor does not run for it. Callers must either send the auth
+	// token of the operation or be the owner or an administrator.
+	viewer := s.viewerOf(ctx, req)
+	opts := repo.UpdateOptions{
+		Identity: viewer.ID,
+		Admin:    viewer.Admin,
+	}
+
+	authToken := req.Header().Get(op.AuthTokenHeader)
+
+	var op *longrunningv1.Operation
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		op, err = s.repo.RequestCancel(ctx, req.Msg.UniqueId, authToken, opts, &viewer)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op, "annotations")
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyWatchers(op)
+
+	return connect.NewResponse(op), nil
+}
+
+// AddNote adds a note to an operation on behalf of the calling user, see
+// op.AddNoteProcedure.
+func (s *Service) AddNote(ctx context.Context, req *connect.Request[longrunningv1.UpdateOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	// AddNote is not part of the service definition so the auth interceptor
+	// does not run for it.
+	viewer := s.viewerOf(ctx, req)
+	if viewer.ID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("notes may only be added by authenticated users"))
+	}
+
+	var op *longrunningv1.Operation
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		op, err = s.repo.AddNote(ctx, req.Msg.UniqueId, viewer.ID, req.Msg.StatusMessage, &viewer)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op, "annotations")
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyWatchers(op)
+
+	return connect.NewResponse(op), nil
+}
+
+// AddTags adds the tags of the op.TagsHeader to an operation, see
+// op.AddTagsProcedure.
+func (s *Service) AddTags(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	return s.updateTags(ctx, req, s.repo.AddTags)
+}
+
+// RemoveTags removes the tags of the op.TagsHeader from an operation, see
+// op.RemoveTagsProcedure.
+func (s *Service) RemoveTags(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	return s.updateTags(ctx, req, s.repo.RemoveTags)
+}
+
+func (s *Service) updateTags(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest], fn func(context.Context, string, []string, *repo.Viewer) (*longrunningv1.Operation, error)) (*connect.Response[longrunningv1.Operation], error) {
+	// tags are not part of the service definition so the auth interceptor
+	// does not run for them.
+	viewer := s.viewerOf(ctx, req)
+	if viewer.ID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("tags may only be changed by authenticated users"))
+	}
+
+	tags := listFromHeader(req.Header(), op.TagsHeader)
+
+	var op *longrunningv1.Operation
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		op, err = fn(ctx, req.Msg.UniqueId, tags, &viewer)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op, "annotations")
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyWatchers(op)
+
+	return connect.NewResponse(op), nil
+}
+
+// AddLink adds the link of the op.LinkHeader to an operation, see
+// op.AddLinkProcedure.
+func (s *Service) AddLink(ctx context.Context, req *connect.Request[longrunningv1.UpdateOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	links, err := linksFromHeader(req.Header())
 	if err != nil {
 		return nil, err
 	}
 
+	if len(links) != 1 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("exactly one %s header must be set", op.LinkHeader))
+	}
+
+	var op *longrunningv1.Operation
+
+	err = s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		op, err = s.repo.AddLink(ctx, req.Msg.UniqueId, req.Msg.AuthToken, links[0])
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op, "annotations")
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
 	s.notifyWatchers(op)
 
 	return connect.NewResponse(op), nil
 }
 
+// remoteUser returns the calling user of req or nil if the caller is not
+// authenticated. The auth interceptor only runs for the procedures of the
+// service definition so the extractor of the service is used for all others.
+func (s *Service) remoteUser(ctx context.Context, req connect.AnyRequest) *auth.RemoteUser {
+	if remoteUser := auth.From(ctx); remoteUser != nil {
+		return remoteUser
+	}
+
+	remoteUser, err := s.extractor(ctx, req)
+	if err != nil || remoteUser.ID == "" && !remoteUser.Admin {
+		return nil
+	}
+
+	return &remoteUser
+}
+
+// viewerOf returns the repo.Viewer for the caller of req. Unauthenticated
+// callers only see operations that are visible to everyone.
+func (s *Service) viewerOf(ctx context.Context, req connect.AnyRequest) repo.Viewer {
+	remoteUser := s.remoteUser(ctx, req)
+	if remoteUser == nil {
+		return repo.Viewer{}
+	}
+
+	return repo.Viewer{
+		ID:    remoteUser.ID,
+		Admin: remoteUser.Admin,
+	}
+}
+
+// remoteUserID returns the ID of the calling user for procedures that are not
+// part of the service definition, or an empty string if the caller is not
+// authenticated.
+func (s *Service) remoteUserID(ctx context.Context, req connect.AnyRequest) string {
+	if remoteUser := s.remoteUser(ctx, req); remoteUser != nil {
+		return remoteUser.ID
+	}
+
+	return ""
+}
+
+// GetKindDefaults returns the effective defaults for operations of the
+// requested kind, see op.GetKindDefaultsProcedure.
+func (s *Service) GetKindDefaults(ctx context.Context, req *connect.Request[longrunningv1.RegisterOperationRequest]) (*connect.Response[longrunningv1.RegisterOperationRequest], error) {
+	defaults := s.providers.Config.DurationLimits().Defaults(req.Msg.Kind)
+
+	res := connect.NewResponse(&longrunningv1.RegisterOperationRequest{
+		Kind:        req.Msg.Kind,
+		Ttl:         durationpb.New(defaults.TTL),
+		GracePeriod: durationpb.New(defaults.GracePeriod),
+	})
+
+	res.Header().Set(op.PendingTimeoutHeader, defaults.PendingTimeout.String())
+	res.Header().Set(op.MaxRuntimeHeader, defaults.MaxRuntime.String())
+
+	if defaults.Pattern != "" {
+		res.Header().Set(op.KindPatternHeader, defaults.Pattern)
+	}
+
+	return res, nil
+}
+
+// AcquireOperation takes over a LOST operation using a new auth token, see
+// op.AcquireOperationProcedure.
+func (s *Service) AcquireOperation(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.RegisterOperationResponse], error) {
+	// AcquireOperation is not part of the service definition so the auth
+	// interceptor does not run for it.
+	var opts repo.UpdateOptions
+	if remoteUser := s.remoteUser(ctx, req); remoteUser != nil {
+		opts.Identity = remoteUser.ID
+		opts.Admin = remoteUser.Admin
+	}
+
+	var res *longrunningv1.RegisterOperationResponse
+
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		res, err = s.repo.AcquireOperation(ctx, req.Msg.UniqueId, opts)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, res.Operation, "state", "last_update", "error")
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyWatchers(res.Operation)
+
+	return connect.NewResponse(res), nil
+}
+
+func (s *Service) CompleteOperation(ctx context.Context, req *connect.Request[longrunningv1.CompleteOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	opts := updateOptions(ctx)
+
+	size, err := s.checkCompleteLimits(req.Msg)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	opts.OriginalResultSize = size
+
+	var op, previous, resumed *longrunningv1.Operation
+
+	err = s.transact(ctx, func(ctx context.Context) error {
+		var (
+			err   error
+			retry bool
+		)
+
+		op, previous, err = s.repo.CompleteOperation(ctx, req.Msg, opts)
+		if resumed, retry, err = s.resume(ctx, req.Header(), req.Msg.UniqueId, req.Msg.AuthToken, opts, err); retry {
+			op, previous, err = s.repo.CompleteOperation(ctx, req.Msg, opts)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueChange(ctx, op)
+	})
+
+	// a retry of a completion that succeeded (for example after a
+	// client-side timeout) returns the operation without notifying watchers
+	// again.
+	if errors.Is(err, repo.ErrOperationCompleted) {
+		op, err = s.repo.ReplayCompletion(ctx, req.Msg, opts)
+		if err != nil {
+			return nil, toConnectError(err)
+		}
+
+		return connect.NewResponse(op), nil
+	}
+
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	s.notifyResumed(resumed)
+	s.notifyWatchers(op)
+	s.notifyStateChange(previous, op)
+
+	return connect.NewResponse(op), nil
+}
+
 func (s *Service) GetOperation(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
-	op, err := s.repo.GetOperation(ctx, req.Msg)
+	mask, err := readMaskFromHeader(req.Header())
 	if err != nil {
 		return nil, err
 	}
 
+	if err := s.resolveExternalRef(ctx, req); err != nil {
+		return nil, err
+	}
+
+	op, err := s.repo.GetVisibleOperation(ctx, req.Msg, mask, s.viewerOf(ctx, req))
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
 	return connect.NewResponse(op), nil
 }
 
 func (s *Service) QueryOperations(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest]) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
-	op, err := s.repo.QueryOperations(ctx, req.Msg)
+	opts, err := s.queryOptions(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	ops, err := s.repo.QueryOperations(ctx, req.Msg, opts)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
 	return connect.NewResponse(&longrunningv1.QueryOperationsResponse{
-		Operation:  op,
-		TotalCount: int64(len(op)),
+		Operation:  ops,
+		TotalCount: int64(len(ops)),
 	}), nil
 }
 
+// resolveExternalRef replaces the unique_id of req with the id of the most
+// recent operation that matches op.ExternalRefHeader. In that case unique_id
+// holds the kind of the operation. Requests without the header are not
+// modified.
+func (s *Service) resolveExternalRef(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) error {
+	ref := req.Header().Get(op.ExternalRefHeader)
+	if ref == "" {
+		return nil
+	}
+
+	id, err := s.repo.ResolveExternalRef(ctx, req.Msg.UniqueId, ref)
+	if err != nil {
+		return toConnectError(err)
+	}
+
+	req.Msg.UniqueId = id
+
+	return nil
+}
+
+// ListOperationsStream is the streaming variant of QueryOperations. Operations
+// are sent one at a time while they are read from the database so neither side
+// has to keep the whole result in memory.
+func (s *Service) ListOperationsStream(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest], stream *connect.ServerStream[longrunningv1.Operation]) error {
+	opts, err := s.queryOptions(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return toConnectError(s.repo.ListOperations(ctx, req.Msg, opts, stream.Send))
+}
+
+// queryOptions returns the repo.QueryOptions selected by the headers of a
+// QueryOperations request. Only operations that are visible to the caller are
+// selected.
+func (s *Service) queryOptions(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest]) (repo.QueryOptions, error) {
+	namespaces, err := s.namespacesFromHeader(ctx, req.Header())
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	opts, err := queryOptionsOf(req, namespaces)
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	viewer := s.viewerOf(ctx, req)
+	opts.Viewer = &viewer
+
+	return opts, nil
+}
+
+// queryOptionsOf is like queryOptions but uses the namespaces that have
+// already been selected by the caller.
+func queryOptionsOf(req *connect.Request[longrunningv1.QueryOperationsRequest], namespaces []string) (repo.QueryOptions, error) {
+	mask, err := readMaskFromHeader(req.Header())
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	lastUpdateBefore, err := lastUpdateBeforeFromHeader(req.Header())
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	kindPrefix, err := boolFromHeader(req.Header(), op.KindPrefixHeader)
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	tags, err := repo.NormalizeTags(listFromHeader(req.Header(), op.TagsHeader))
+	if err != nil {
+		return repo.QueryOptions{}, toConnectError(err)
+	}
+
+	paused, err := optionalBoolFromHeader(req.Header(), op.PausedHeader)
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	dueBefore, err := timeFromHeader(req.Header(), op.DueBeforeHeader)
+	if err != nil {
+		return repo.QueryOptions{}, err
+	}
+
+	var rootID primitive.ObjectID
+	if v := req.Header().Get(op.RootOperationHeader); v != "" {
+		rootID, err = primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return repo.QueryOptions{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", op.RootOperationHeader, v))
+		}
+	}
+
+	var sortByPriority bool
+	switch v := req.Header().Get(op.SortHeader); v {
+	case "", op.SortByCreateTime:
+	case op.SortByPriority:
+		sortByPriority = true
+	default:
+		return repo.QueryOptions{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", op.SortHeader, v))
+	}
+
+	opts := repo.QueryOptions{
+		ReadMask:         mask,
+		InvolvedUser:     req.Header().Get(op.InvolvedUserHeader),
+		LastUpdateBefore: lastUpdateBefore,
+		Namespaces:       namespaces,
+		KindPrefix:       kindPrefix,
+		ExternalRef:      req.Header().Get(op.ExternalRefHeader),
+		Tags:             tags,
+		Paused:           paused,
+		SortByPriority:   sortByPriority,
+		DueBefore:        dueBefore,
+		RootID:           rootID,
+	}
+
+	if opts.InvolvedUser != "" && req.Msg.Creator != "" {
+		return repo.QueryOptions{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%s and creator must not be specified together", op.InvolvedUserHeader))
+	}
+
+	return opts, nil
+}
+
+// WatchOperations streams all operations that match the request. It accepts
+// the same filters and headers as QueryOperations, except for the read-mask and
+// last-update filters. The stream starts with a snapshot of the currently
+// matching operations followed by every subsequent change, including newly
+// registered operations. Use op.KindPrefixHeader to watch all operations of a
+// kind prefix and op.DiffUpdatesHeader to receive diff updates. Since the
+// watcher is registered before the snapshot is loaded, an operation might be
+// sent twice.
+func (s *Service) WatchOperations(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest], stream *connect.ServerStream[longrunningv1.Operation]) error {
+	opts, err := s.queryOptions(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	// read-masks and last-update filters are not supported on watch streams.
+	opts.ReadMask = nil
+	opts.LastUpdateBefore = time.Time{}
+
+	diffs, err := newDiffTracker(req.Header())
+	if err != nil {
+		return err
+	}
+
+	w, err := s.addFilterWatcher(peerOf(req.Peer()), req.Msg, opts)
+	if err != nil {
+		return err
+	}
+	defer s.removeFilterWatcher(w)
+
+	snapshot, err := s.repo.QueryOperations(ctx, req.Msg, opts)
+	if err != nil {
+		return toConnectError(err)
+	}
+
+	for _, op := range snapshot {
+		if err := stream.Send(diffs.next(op)); err != nil {
+			slog.Error("failed to send operation snapshot", "error", err, "uniqueId", op.UniqueId)
+
+			return nil
+		}
+	}
+
+	for {
+		select {
+		case <-w.queue.ready:
+			for _, update := range w.queue.take() {
+				msg := diffs.next(update)
+				if msg == nil {
+					continue
+				}
+
+				if err := stream.Send(msg); err != nil {
+					slog.Error("failed to publish operation update", "error", err, "uniqueId", update.UniqueId)
+
+					// If sending fails there's no need to return an error to the caller
+					return nil
+				}
+			}
+
+		case <-w.queue.done:
+			return errSlowWatcher()
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// WatchOperation streams updates of a single operation. The current state of
+// the operation is always sent as the first message and the stream ends as soon
+// as the operation reaches a terminal state (COMPLETE or LOST).
+// If no update has been sent within the WatchKeepalive interval, the last sent
+// state is repeated as a keepalive. Keepalives can be recognized by an unchanged
+// last_update.
+//
+// Watchers that do not keep up with the updates may miss intermediate updates
+// or are disconnected with CodeResourceExhausted, depending on the configured
+// slow-consumer policy. The terminal update is never dropped.
+//
+// If op.DiffUpdatesHeader is set, updates only hold the changed fields and
+// updates without any change are skipped. Keepalives always hold the full
+// operation.
 func (s *Service) WatchOperation(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest], stream *connect.ServerStream[longrunningv1.Operation]) error {
-	ch := s.addWatcher(req.Msg.UniqueId)
-	defer s.removeWatcher(req.Msg.UniqueId, ch)
+	if err := s.resolveExternalRef(ctx, req); err != nil {
+		return err
+	}
+
+	// register the watcher before loading the operation so we don't miss any
+	// update in between.
+	peer := peerOf(req.Peer())
+
+	diffs, err := newDiffTracker(req.Header())
+	if err != nil {
+		return err
+	}
+
+	q, err := s.addWatcher(peer, req.Msg.UniqueId)
+	if err != nil {
+		return err
+	}
+	defer s.removeWatcher(peer, req.Msg.UniqueId, q)
+
+	current, err := s.repo.GetVisibleOperation(ctx, req.Msg, nil, s.viewerOf(ctx, req))
+	if err != nil {
+		return toConnectError(err)
+	}
+
+	if err := stream.Send(diffs.next(current)); err != nil {
+		slog.Error("failed to send current operation state", "error", err, "uniqueId", req.Msg.UniqueId)
+
+		return nil
+	}
+
+	if isTerminal(current.State) {
+		return nil
+	}
+
+	// keepalives repeat the most recently sent operation if no update has been
+	// sent within the keepalive interval so proxies don't drop idle streams.
+	var (
+		keepalive  <-chan time.Time
+		resetTimer = func() {}
+	)
+
+	if interval := s.providers.Config.WatchKeepalive; interval > 0 {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+
+		keepalive = timer.C
+		resetTimer = func() { timer.Reset(interval) }
+	}
 
 	for {
 		select {
-		case update, ok := <-ch:
-			// channel get's closed when it's state is set to complete or error.
-			if !ok {
-				return nil
+		case <-q.ready:
+			for _, update := range q.take() {
+				// skip updates that have been received before the current
+				// state was loaded.
+				if update.LastUpdate.AsTime().Before(current.LastUpdate.AsTime()) {
+					continue
+				}
+
+				if msg := diffs.next(update); msg != nil {
+					if err := stream.Send(msg); err != nil {
+						slog.Error("failed to publish operation update", "error", err, "uniqueId", req.Msg.UniqueId)
+
+						// If sending fails there's no need to return an error to the caller
+						return nil
+					}
+				}
+
+				// no updates are expected/allowed once the operation is either
+				// completed or lost.
+				if isTerminal(update.State) {
+					return nil
+				}
+
+				current = update
 			}
 
-			if err := stream.Send(update); err != nil {
-				slog.Error("failed to publish operation update", "error", err, "uniqueId", req.Msg.UniqueId)
+			resetTimer()
+
+		case <-q.done:
+			return errSlowWatcher()
+
+		case <-keepalive:
+			if err := stream.Send(current); err != nil {
+				slog.Error("failed to send keepalive", "error", err, "uniqueId", req.Msg.UniqueId)
 
-				// If sending fails there's no need to return an error to the caller
 				return nil
 			}
 
+			resetTimer()
+
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-func (s *Service) notifyWatchers(op *longrunningv1.Operation) {
-	// first, publish the operation to the events-service
-	if s.providers.EventService != nil {
-		anypb, err := anypb.New(op)
-		if err != nil {
-			slog.Error("failed to convert longrunningv1.Operation to anypb.Any", "error", err)
-		} else {
-			if _, err := s.providers.EventService.Publish(context.Background(), connect.NewRequest(&eventsv1.Event{
-				Event: anypb,
-			})); err != nil {
-				slog.Error("failed to publish operation to events-service", "error", err)
-			}
-		}
-	} else {
-		slog.Info("not publishing events, event-service not available")
+// resume switches a LOST operation back to RUNNING if a mutation failed with
+// repo.ErrOperationLost and the request has op.ResumeHeader set. The event of
+// the resumption is stored in the transaction of ctx and the resumed operation
+// is returned so watchers can be notified once it has been committed, see
+// notifyResumed. It reports whether the mutation should be retried, otherwise
+// the returned error should be reported to the caller.
+func (s *Service) resume(ctx context.Context, h http.Header, id, authToken string, opts repo.UpdateOptions, err error) (*longrunningv1.Operation, bool, error) {
+	if !errors.Is(err, repo.ErrOperationLost) {
+		return nil, false, err
 	}
 
-	s.l.RLock()
-	defer s.l.RUnlock()
+	resume, herr := boolFromHeader(h, op.ResumeHeader)
+	if herr != nil {
+		return nil, false, herr
+	}
 
-	for _, w := range s.watchers[op.UniqueId] {
-		select {
-		case w <- op:
-		case <-time.After(time.Second):
-			slog.Warn("failed to notify watcher")
-		}
+	if !resume {
+		return nil, false, err
 	}
 
-	// close all channels if the operation is either completed or lost since no updates are expected/allowed anymore.
-	if op.State == longrunningv1.OperationState_OperationState_COMPLETE || op.State == longrunningv1.OperationState_OperationState_LOST {
-		go func() {
-			s.l.Lock()
-			defer s.l.Unlock()
+	resumed, err := s.repo.ResumeOperation(ctx, id, authToken, opts)
+	switch {
+	case errors.Is(err, repo.ErrNotLost):
+		// resumed concurrently, the retry reports any other change.
+		return nil, true, nil
 
-			for _, w := range s.watchers[op.UniqueId] {
-				close(w)
-			}
+	case err != nil:
+		return nil, false, err
+	}
 
-			delete(s.watchers, op.UniqueId)
-		}()
+	if err := s.enqueueChange(ctx, resumed, "state", "last_update", "error"); err != nil {
+		return nil, false, err
 	}
-}
 
-func (s *Service) addWatcher(id string) chan *longrunningv1.Operation {
-	ch := make(chan *longrunningv1.Operation, 100)
+	return resumed, true, nil
+}
 
-	s.l.Lock()
-	defer s.l.Unlock()
+// notifyResumed notifies the watchers of the operation resumed by resume, if
+// any.
+func (s *Service) notifyResumed(resumed *longrunningv1.Operation) {
+	if resumed != nil {
+		s.notifyWatchers(resumed)
+	}
+}
 
-	s.watchers[id] = append(s.watchers[id], ch)
+// updateOptions returns the repo.UpdateOptions for a mutation. The identity of
+// the remote user is recorded as the actor of the mutation. If no auth token
+// is presented, the mutation is authorized using the identity which is either
+// the owner of the operation or an administrator (like the service-account of
+// the admin listener).
+func updateOptions(ctx context.Context) repo.UpdateOptions {
+	remoteUser := auth.From(ctx)
+	if remoteUser == nil {
+		return repo.UpdateOptions{}
+	}
 
-	return ch
+	return repo.UpdateOptions{
+		Identity: remoteUser.ID,
+		Admin:    remoteUser.Admin,
+	}
 }
 
-func (s *Service) removeWatcher(id string, ch chan *longrunningv1.Operation) {
-	s.l.Lock()
-	defer s.l.Unlock()
+// WaitForCompletion blocks until the operation reaches a terminal state and
+// returns the final operation. The wait may be bounded using
+// op.WaitTimeoutHeader in which case CodeDeadlineExceeded is returned with the
+// latest known state of the operation as an error detail.
+func (s *Service) WaitForCompletion(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	timeout, err := durationFromHeader(req.Header(), op.WaitTimeoutHeader, 0)
+	if err != nil {
+		return nil, err
+	}
 
-	m := make([]chan *longrunningv1.Operation, 0, len(s.watchers[id])-1)
+	if err := s.resolveExternalRef(ctx, req); err != nil {
+		return nil, err
+	}
 
-	for _, w := range s.watchers[id] {
-		if w == ch {
-			continue
-		}
+	// register the watcher before loading the operation so we don't miss any
+	// update in between.
+	peer := peerOf(req.Peer())
+
+	q, err := s.addWatcher(peer, req.Msg.UniqueId)
+	if err != nil {
+		return nil, err
+	}
+	defer s.removeWatcher(peer, req.Msg.UniqueId, q)
+
+	viewer := s.viewerOf(ctx, req)
+
+	latest, err := s.repo.GetVisibleOperation(ctx, req.Msg, nil, viewer)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		deadline = timer.C
+	}
+
+	for !isTerminal(latest.State) {
+		select {
+		case <-q.ready:
+			for _, update := range q.take() {
+				if !update.LastUpdate.AsTime().Before(latest.LastUpdate.AsTime()) {
+					latest = update
+				}
+			}
+
+		case <-q.done:
+			return nil, errSlowWatcher()
+
+		case <-deadline:
+			cerr := connect.NewError(connect.CodeDeadlineExceeded, fmt.Errorf("operation did not complete within %s", timeout))
 
-		m = append(m, w)
+			// error details are not redacted by the privacy interceptor.
+			pbop := latest
+			if !viewer.Admin {
+				pbop = privacy.Redact(s.providers.Config.PrivacyPolicy(), latest)
+			}
+
+			if detail, err := connect.NewErrorDetail(pbop); err == nil {
+				cerr.AddDetail(detail)
+			}
+
+			return nil, cerr
+
+		case <-ctx.Done():
+			return nil, toConnectError(ctx.Err())
+		}
 	}
 
-	s.watchers[id] = m
+	return connect.NewResponse(latest), nil
 }
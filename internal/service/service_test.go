@@ -0,0 +1,2916 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+	eventsv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1/eventsv1connect"
+	idmv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1/idmv1connect"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1/longrunningv1connect"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"github.com/tierklinik-dobersberg/apis/pkg/mongotest"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/config"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/manager"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/service"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// setupService starts a new service backed by a test database and returns a
+// client for it. events may be nil.
+func setupService(t *testing.T, events eventsv1connect.EventServiceClient) (context.Context, *op.Client) {
+	t.Helper()
+
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	_, client := startService(t, r, events)
+
+	return ctx, client
+}
+
+// startService starts a new service instance using r and returns it together
+// with a client for it. events may be nil.
+func startService(t *testing.T, r *repo.Repo, events eventsv1connect.EventServiceClient) (*service.Service, *op.Client) {
+	t.Helper()
+
+	svc, srv := startServer(t, r, events)
+
+	return svc, op.NewClient(srv.Client(), srv.URL)
+}
+
+// startServer is like startService but returns the test server instead of a
+// client.
+func startServer(t *testing.T, r *repo.Repo, events eventsv1connect.EventServiceClient) (*service.Service, *httptest.Server) {
+	t.Helper()
+
+	return startServerWithConfig(t, r, events, &config.Config{
+		DefaultNamespace: "default",
+	})
+}
+
+// startServerWithConfig is like startServer but uses cfg instead of the
+// default test configuration.
+func startServerWithConfig(t *testing.T, r *repo.Repo, events eventsv1connect.EventServiceClient, cfg *config.Config) (*service.Service, *httptest.Server) {
+	t.Helper()
+
+	svc, mux := newServiceMux(t, r, events, cfg)
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return svc, srv
+}
+
+// startHTTP2Server is like startServer but serves HTTP/2 using TLS which is
+// required for bidirectional streams.
+func startHTTP2Server(t *testing.T, r *repo.Repo) (*service.Service, *httptest.Server) {
+	t.Helper()
+
+	svc, mux := newServiceMux(t, r, nil, &config.Config{
+		DefaultNamespace: "default",
+	})
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return svc, srv
+}
+
+// newServiceMux returns a new service using cfg and a mux that serves it.
+func newServiceMux(t *testing.T, r *repo.Repo, events eventsv1connect.EventServiceClient, cfg *config.Config) (*service.Service, *http.ServeMux) {
+	t.Helper()
+
+	return newServiceMuxWithProviders(t, &config.Providers{
+		Config:       cfg,
+		Repo:         r,
+		EventService: events,
+	})
+}
+
+// newServiceMuxWithProviders is like newServiceMux but uses providers.
+func newServiceMuxWithProviders(t *testing.T, providers *config.Providers) (*service.Service, *http.ServeMux) {
+	t.Helper()
+
+	r, cfg := providers.Repo, providers.Config
+
+	r.SetDefaultNamespace(cfg.DefaultNamespace)
+	r.SetDurationLimits(cfg.DurationLimits())
+
+	// like main, instances without the manager role have none.
+	var mng *manager.Manager
+	if len(cfg.Roles) == 0 || cfg.HasRole(config.RoleManager) {
+		mng = manager.New(r, 0, nil, nil, nil)
+		mng.SetRetries(r)
+	}
+
+	svc := service.New(providers, mng)
+	t.Cleanup(svc.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	svc.StartOutbox(ctx)
+	svc.StartWebhooks(ctx)
+	svc.StartNotifications(ctx)
+
+	mux := http.NewServeMux()
+
+	path, handler := longrunningv1connect.NewLongRunningServiceHandler(svc)
+	mux.Handle(path, handler)
+	svc.HandleProcedures(mux, adminExtractor)
+	mux.Handle(op.AttachmentsPath, svc.AttachmentsHandler())
+	svc.HandleAdminProcedures(mux, adminExtractor)
+
+	return svc, mux
+}
+
+// adminExtractor treats the remote user "admin" as an administrator, like the
+// identity of the admin listener.
+func adminExtractor(ctx context.Context, req connect.AnyRequest) (auth.RemoteUser, error) {
+	remoteUser, err := auth.RemoteHeaderExtractor(ctx, req)
+	remoteUser.Admin = remoteUser.ID == "admin"
+
+	return remoteUser, err
+}
+
+func TestWatchOperation(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	t.Run("NotFound", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: "6560a4a0e4b0a1b2c3d4e5f6",
+		}))
+		require.NoError(t, err)
+		defer stream.Close()
+
+		require.False(t, stream.Receive())
+		require.Equal(t, connect.CodeNotFound, connect.CodeOf(stream.Err()))
+	})
+
+	t.Run("AlreadyComplete", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Creator:      "test-case",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         "test-op",
+		}))
+		require.NoError(t, err)
+
+		_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  reg.Msg.Operation.UniqueId,
+			AuthToken: reg.Msg.AuthToken,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{
+					Message: "done",
+				},
+			},
+		}))
+		require.NoError(t, err)
+
+		stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: reg.Msg.Operation.UniqueId,
+		}))
+		require.NoError(t, err)
+		defer stream.Close()
+
+		// the current state is sent first and the stream ends right away.
+		require.True(t, stream.Receive())
+		require.Equal(t, reg.Msg.Operation.UniqueId, stream.Msg().UniqueId)
+		require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, stream.Msg().State)
+
+		require.False(t, stream.Receive())
+		require.NoError(t, stream.Err())
+	})
+}
+
+func TestCancelOperation(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	// wait for the current state so the watcher is known to be registered.
+	require.True(t, stream.Receive())
+	require.Empty(t, stream.Msg().Annotations[op.CancelRequestedAnnotation])
+
+	errs := make(chan error, 1)
+	go func() {
+		req := connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: id,
+		})
+		req.Header().Set(op.AuthTokenHeader, reg.Msg.AuthToken)
+
+		_, err := cli.CancelOperation(ctx, req)
+		errs <- err
+	}()
+
+	require.True(t, stream.Receive())
+	require.Equal(t, "true", stream.Msg().Annotations[op.CancelRequestedAnnotation])
+	require.NoError(t, <-errs)
+
+	// the worker must still be able to update the operation while winding down.
+	_, err = cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     reg.Msg.AuthToken,
+		Running:       true,
+		StatusMessage: "cancelling",
+	}))
+	require.NoError(t, err)
+}
+
+func TestCancelOperationPermissions(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	userClient := func(id string) *op.Client {
+		return op.NewClient(&http.Client{
+			Transport: remoteUserTransport{userID: id, next: srv.Client().Transport},
+		}, srv.URL)
+	}
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	register := func(opts ...op.Option) string {
+		req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "alice",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Kind:         "test-op",
+		})
+		for _, opt := range opts {
+			opt(req)
+		}
+
+		reg, err := cli.RegisterOperation(ctx, req)
+		require.NoError(t, err)
+
+		return reg.Msg.Operation.UniqueId
+	}
+
+	cancelReq := func(id string, authToken string) *connect.Request[longrunningv1.GetOperationRequest] {
+		req := connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id})
+		if authToken != "" {
+			req.Header().Set(op.AuthTokenHeader, authToken)
+		}
+
+		return req
+	}
+
+	id := register()
+
+	_, err = cli.CancelOperation(ctx, cancelReq(id, ""))
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	_, err = cli.CancelOperation(ctx, cancelReq(id, "invalid"))
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	_, err = userClient("bob").CancelOperation(ctx, cancelReq(id, ""))
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	res, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+	require.NoError(t, err)
+	require.Empty(t, res.Msg.Annotations[op.CancelRequestedAnnotation])
+
+	cancelled, err := userClient("alice").CancelOperation(ctx, cancelReq(id, ""))
+	require.NoError(t, err)
+	require.Equal(t, "true", cancelled.Msg.Annotations[op.CancelRequestedAnnotation])
+	require.Equal(t, "alice", cancelled.Msg.Annotations[op.CancelRequestedByAnnotation])
+
+	// operations that are not visible to the caller are not found.
+	hidden := register(op.WithVisibleTo("carol"))
+
+	_, err = userClient("mallory").CancelOperation(ctx, cancelReq(hidden, ""))
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	_, err = userClient("carol").CancelOperation(ctx, cancelReq(hidden, ""))
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	// administrators may cancel all operations.
+	cancelled, err = userClient("admin").CancelOperation(ctx, cancelReq(hidden, ""))
+	require.NoError(t, err)
+	require.Equal(t, "admin", cancelled.Msg.Annotations[op.CancelRequestedByAnnotation])
+}
+
+func TestWatchAnnotationUpdates(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	cli := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "alice", next: srv.Client().Transport},
+	}, srv.URL)
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "alice",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.True(t, stream.Receive())
+
+	// none of these mutations changes the state of the operation, all of
+	// them must nevertheless be delivered.
+	_, err = cli.CancelOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Equal(t, "true", stream.Msg().Annotations[op.CancelRequestedAnnotation])
+
+	_, err = cli.AddTags(ctx, id, "nightly")
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Equal(t, "nightly", stream.Msg().Annotations[op.TagsAnnotation])
+
+	_, err = cli.AddNote(ctx, id, "looks good")
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Contains(t, stream.Msg().Annotations[op.NotesAnnotation], "looks good")
+}
+
+// recordingEvents is an events-service client that records all published events.
+type recordingEvents struct {
+	eventsv1connect.EventServiceClient
+
+	l      sync.Mutex
+	events []*eventsv1.Event
+}
+
+func (r *recordingEvents) Publish(_ context.Context, req *connect.Request[eventsv1.Event]) (*connect.Response[emptypb.Empty], error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.events = append(r.events, req.Msg)
+
+	return connect.NewResponse(new(emptypb.Empty)), nil
+}
+
+func (r *recordingEvents) count() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	return len(r.events)
+}
+
+func TestAuthTokenNeverReturned(t *testing.T) {
+	events := new(recordingEvents)
+
+	ctx, cli := setupService(t, events)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+	token := reg.Msg.AuthToken
+	require.NotEmpty(t, token)
+
+	var responses []proto.Message
+	responses = append(responses, reg.Msg.Operation)
+
+	watch, err := cli.WatchOperations(ctx, connect.NewRequest(&longrunningv1.QueryOperationsRequest{
+		Kind: "test-op",
+	}))
+	require.NoError(t, err)
+	defer watch.Close()
+
+	// wait for the snapshot so the watcher is known to be registered.
+	require.True(t, watch.Receive())
+	responses = append(responses, watch.Msg())
+
+	get, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	responses = append(responses, get.Msg)
+
+	query, err := cli.QueryOperations(ctx, connect.NewRequest(&longrunningv1.QueryOperationsRequest{}))
+	require.NoError(t, err)
+	responses = append(responses, query.Msg)
+
+	upd, err := cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:  id,
+		AuthToken: token,
+		Running:   true,
+	}))
+	require.NoError(t, err)
+	responses = append(responses, upd.Msg)
+
+	hb, err := cli.Heartbeat(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     token,
+		StatusMessage: "still running",
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"status_message"},
+		},
+	}))
+	require.NoError(t, err)
+	responses = append(responses, hb.Msg)
+
+	cancelReq := connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	})
+	cancelReq.Header().Set(op.AuthTokenHeader, token)
+
+	cancelled, err := cli.CancelOperation(ctx, cancelReq)
+	require.NoError(t, err)
+	responses = append(responses, cancelled.Msg)
+
+	completed, err := cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: token,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: "done",
+			},
+		},
+	}))
+	require.NoError(t, err)
+	responses = append(responses, completed.Msg)
+
+	// update, heartbeat, cancel and complete
+	for range 4 {
+		require.True(t, watch.Receive())
+		responses = append(responses, watch.Msg())
+	}
+
+	// register, update, heartbeat, cancel and complete
+	require.Eventually(t, func() bool { return events.count() >= 5 }, 5*time.Second, 10*time.Millisecond)
+
+	events.l.Lock()
+	for _, e := range events.events {
+		responses = append(responses, e)
+	}
+	events.l.Unlock()
+
+	for _, msg := range responses {
+		blob, err := protojson.Marshal(msg)
+		require.NoError(t, err)
+
+		if strings.Contains(string(blob), token) {
+			t.Errorf("auth token found in %T: %s", msg, blob)
+		}
+	}
+}
+
+// eventHub is a minimal in-memory events-service that delivers every published
+// event to all subscribers.
+type eventHub struct {
+	eventsv1connect.UnimplementedEventServiceHandler
+
+	l    sync.Mutex
+	subs []chan *eventsv1.Event
+}
+
+func (h *eventHub) Publish(_ context.Context, req *connect.Request[eventsv1.Event]) (*connect.Response[emptypb.Empty], error) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	for _, sub := range h.subs {
+		sub <- req.Msg
+	}
+
+	return connect.NewResponse(new(emptypb.Empty)), nil
+}
+
+func (h *eventHub) Subscribe(ctx context.Context, stream *connect.BidiStream[eventsv1.SubscribeRequest, eventsv1.Event]) error {
+	if _, err := stream.Receive(); err != nil {
+		return err
+	}
+
+	ch := make(chan *eventsv1.Event, 100)
+
+	h.l.Lock()
+	h.subs = append(h.subs, ch)
+	h.l.Unlock()
+
+	for {
+		select {
+		case evt := <-ch:
+			if err := stream.Send(evt); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (h *eventHub) subscribers() int {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	return len(h.subs)
+}
+
+func TestWatchFanOut(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	// bidirectional streams require HTTP/2
+	hub := new(eventHub)
+	_, handler := eventsv1connect.NewEventServiceHandler(hub)
+	hubSrv := httptest.NewUnstartedServer(handler)
+	hubSrv.EnableHTTP2 = true
+	hubSrv.StartTLS()
+	t.Cleanup(hubSrv.Close)
+
+	events := eventsv1connect.NewEventServiceClient(hubSrv.Client(), hubSrv.URL)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	// published events are redacted, watchers must nevertheless receive each
+	// update once and unredacted.
+	cfg := &config.Config{
+		DefaultNamespace:  "default",
+		RedactAnnotations: []string{"secret"},
+	}
+
+	svcA, srvA := startServerWithConfig(t, r, events, cfg)
+	svcB, srvB := startServerWithConfig(t, r, events, cfg)
+
+	cliA := op.NewClient(srvA.Client(), srvA.URL)
+	cliB := op.NewClient(srvB.Client(), srvB.URL)
+
+	svcA.StartFanOut(ctx)
+	svcB.StartFanOut(ctx)
+
+	require.Eventually(t, func() bool { return hub.subscribers() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	reg, err := cliA.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+		Annotations: map[string]string{
+			"secret": "s3cr3t",
+		},
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	// watch on instance B
+	stream, err := cliB.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.True(t, stream.Receive())
+
+	// and on instance A
+	local, err := cliA.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	defer local.Close()
+
+	require.True(t, local.Receive())
+
+	// update on instance A
+	_, err = cliA.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     reg.Msg.AuthToken,
+		Running:       true,
+		StatusMessage: "handled by A",
+	}))
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Equal(t, "handled by A", stream.Msg().StatusMessage)
+	require.Equal(t, "s3cr3t", stream.Msg().Annotations["secret"])
+
+	require.True(t, local.Receive())
+	require.Equal(t, "handled by A", local.Msg().StatusMessage)
+
+	// update on instance B must only be delivered once even though it's
+	// received through the fan-out as well.
+	_, err = cliB.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: "done",
+			},
+		},
+	}))
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, stream.Msg().State)
+
+	// the redacted copy of the update received through the fan-out must not
+	// be delivered to the watcher on A.
+	require.True(t, local.Receive())
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, local.Msg().State)
+
+	// the streams end after the terminal state
+	require.False(t, stream.Receive())
+	require.NoError(t, stream.Err())
+
+	require.False(t, local.Receive())
+	require.NoError(t, local.Err())
+}
+
+func TestErrorCodes(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+	token := reg.Msg.AuthToken
+
+	complete := func(id string, token string) error {
+		_, err := cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  id,
+			AuthToken: token,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}))
+
+		return err
+	}
+
+	t.Run("InvalidID", func(t *testing.T) {
+		_, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: "not-an-object-id",
+		}))
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: "6560a4a0e4b0a1b2c3d4e5f6",
+		}))
+		require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+		err = complete("6560a4a0e4b0a1b2c3d4e5f6", token)
+		require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+	})
+
+	t.Run("InvalidAuthToken", func(t *testing.T) {
+		err := complete(id, "wrong-token")
+		require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+	})
+
+	t.Run("InvalidUpdateMask", func(t *testing.T) {
+		_, err := cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+			UniqueId:  id,
+			AuthToken: token,
+			UpdateMask: &fieldmaskpb.FieldMask{
+				Paths: []string{"owner"},
+			},
+		}))
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+
+	t.Run("AlreadyCompleted", func(t *testing.T) {
+		require.NoError(t, complete(id, token))
+
+		// retrying with the same result succeeds
+		require.NoError(t, complete(id, token))
+
+		_, err := cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  id,
+			AuthToken: token,
+			Result: &longrunningv1.CompleteOperationRequest_Error{
+				Error: &longrunningv1.OperationError{Message: "failed"},
+			},
+		}))
+		require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+		err = complete(id, "wrong-token")
+		require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+	})
+}
+
+func TestWaitForCompletion(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	t.Run("Timeout", func(t *testing.T) {
+		_, err := cli.WaitForCompletion(ctx, id, 100*time.Millisecond)
+		require.Equal(t, connect.CodeDeadlineExceeded, connect.CodeOf(err))
+
+		var cerr *connect.Error
+		require.ErrorAs(t, err, &cerr)
+		require.Len(t, cerr.Details(), 1)
+
+		detail, err := cerr.Details()[0].Value()
+		require.NoError(t, err)
+		require.Equal(t, id, detail.(*longrunningv1.Operation).UniqueId)
+	})
+
+	t.Run("Complete", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+
+			_, err := cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+				UniqueId:  id,
+				AuthToken: reg.Msg.AuthToken,
+				Result: &longrunningv1.CompleteOperationRequest_Success{
+					Success: &longrunningv1.OperationSuccess{
+						Message: "done",
+					},
+				},
+			}))
+			require.NoError(t, err)
+		}()
+
+		result, err := cli.WaitForCompletion(ctx, id, 0)
+		require.NoError(t, err)
+		require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, result.State)
+		require.Equal(t, "done", result.GetSuccess().GetMessage())
+
+		// already complete operations return immediately
+		result, err = cli.WaitForCompletion(ctx, id, 0)
+		require.NoError(t, err)
+		require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, result.State)
+	})
+}
+
+func TestWaitForCompletionRedacted(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServerWithConfig(t, r, nil, &config.Config{
+		DefaultNamespace:  "default",
+		RedactAnnotations: []string{"secret"},
+	})
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+		Annotations: map[string]string{
+			"secret": "s3cr3t",
+		},
+	}))
+	require.NoError(t, err)
+
+	// the latest state attached to the error is redacted like responses.
+	_, err = cli.WaitForCompletion(ctx, reg.Msg.Operation.UniqueId, 100*time.Millisecond)
+	require.Equal(t, connect.CodeDeadlineExceeded, connect.CodeOf(err))
+
+	var cerr *connect.Error
+	require.ErrorAs(t, err, &cerr)
+	require.Len(t, cerr.Details(), 1)
+
+	detail, err := cerr.Details()[0].Value()
+	require.NoError(t, err)
+	require.Equal(t, op.RedactedValue, detail.(*longrunningv1.Operation).Annotations["secret"])
+}
+
+func TestWatchKindPrefix(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	register := func(kind string) string {
+		t.Helper()
+
+		reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Creator:      "test-case",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         kind,
+		}))
+		require.NoError(t, err)
+
+		return reg.Msg.Operation.UniqueId
+	}
+
+	full := register("tkd.backup.v1/full")
+
+	req := connect.NewRequest(&longrunningv1.QueryOperationsRequest{
+		Kind: "tkd.backup.v1/",
+	})
+	req.Header().Set(op.KindPrefixHeader, "true")
+
+	watch, err := cli.WatchOperations(ctx, req)
+	require.NoError(t, err)
+	defer watch.Close()
+
+	// snapshot
+	require.True(t, watch.Receive())
+	require.Equal(t, full, watch.Msg().UniqueId)
+
+	// operations of other kinds must not be delivered
+	register("tkd.other.v1/full")
+	incremental := register("tkd.backup.v1/incremental")
+
+	require.True(t, watch.Receive())
+	require.Equal(t, incremental, watch.Msg().UniqueId)
+	require.Equal(t, "tkd.backup.v1/incremental", watch.Msg().Kind)
+
+	// the kind is matched exactly if the header is not set
+	query, err := cli.QueryOperations(ctx, connect.NewRequest(&longrunningv1.QueryOperationsRequest{
+		Kind: "tkd.backup.v1/",
+	}))
+	require.NoError(t, err)
+	require.Empty(t, query.Msg.Operation)
+}
+
+func TestDependencies(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	register := func(opts ...op.Option) *longrunningv1.RegisterOperationResponse {
+		t.Helper()
+
+		req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Creator:      "test-case",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         "test-op",
+		})
+
+		for _, opt := range opts {
+			opt(req)
+		}
+
+		res, err := cli.RegisterOperation(ctx, req)
+		require.NoError(t, err)
+
+		return res.Msg
+	}
+
+	complete := func(reg *longrunningv1.RegisterOperationResponse, failed bool) {
+		t.Helper()
+
+		req := &longrunningv1.CompleteOperationRequest{
+			UniqueId:  reg.Operation.UniqueId,
+			AuthToken: reg.AuthToken,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}
+
+		if failed {
+			req.Result = &longrunningv1.CompleteOperationRequest_Error{
+				Error: &longrunningv1.OperationError{Message: "failed"},
+			}
+		}
+
+		_, err := cli.CompleteOperation(ctx, connect.NewRequest(req))
+		require.NoError(t, err)
+	}
+
+	t.Run("UnknownDependency", func(t *testing.T) {
+		req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner: "test",
+			Kind:  "test-op",
+		})
+		op.WithDependsOn("6564d8d4c4b7f1e2a3b4c5d6")(req)
+
+		_, err := cli.RegisterOperation(ctx, req)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+
+	t.Run("StartedOnSuccess", func(t *testing.T) {
+		importOp := register()
+		exportOp := register(op.WithDependsOn(importOp.Operation.UniqueId))
+
+		require.Equal(t, longrunningv1.OperationState_OperationState_PENDING, exportOp.Operation.State)
+		require.Equal(t, importOp.Operation.UniqueId, exportOp.Operation.Annotations[op.DependsOnAnnotation])
+
+		complete(importOp, false)
+
+		result, err := cli.WaitForCompletion(ctx, importOp.Operation.UniqueId, 0)
+		require.NoError(t, err)
+		require.Nil(t, result.GetError())
+
+		require.Eventually(t, func() bool {
+			res, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+				UniqueId: exportOp.Operation.UniqueId,
+			}))
+
+			return err == nil && res.Msg.State == longrunningv1.OperationState_OperationState_RUNNING
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("FailedDependency", func(t *testing.T) {
+		importOp := register()
+		exportOp := register(op.WithDependsOn(importOp.Operation.UniqueId))
+		notifyOp := register(op.WithDependsOn(exportOp.Operation.UniqueId))
+
+		complete(importOp, true)
+
+		// failures are propagated along the chain
+		for _, id := range []string{exportOp.Operation.UniqueId, notifyOp.Operation.UniqueId} {
+			res, err := cli.WaitForCompletion(ctx, id, 0)
+			require.NoError(t, err)
+			require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, res.State)
+			require.Contains(t, res.GetError().GetMessage(), "failed")
+		}
+	})
+
+	t.Run("AlreadyCompleted", func(t *testing.T) {
+		importOp := register()
+		complete(importOp, false)
+
+		exportOp := register(op.WithDependsOn(importOp.Operation.UniqueId))
+		require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, exportOp.Operation.State)
+	})
+}
+
+// remoteUserTransport adds the remote user headers of the forward-auth proxy
+// to all requests.
+type remoteUserTransport struct {
+	userID string
+	next   http.RoundTripper
+}
+
+func (rt remoteUserTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Remote-User-ID", rt.userID)
+
+	return rt.next.RoundTrip(req)
+}
+
+func TestAttachments(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	r.SetAttachmentWindow(time.Minute)
+	r.SetLimits(repo.Limits{
+		MaxAttachments:    2,
+		MaxAttachmentSize: 16,
+	})
+
+	_, srv := startServer(t, r, nil)
+
+	client := op.NewClient(srv.Client(), srv.URL)
+	userClient := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "alice", next: srv.Client().Transport},
+	}, srv.URL)
+
+	reg, err := client.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+	token := reg.Msg.AuthToken
+
+	_, err = client.AddAttachment(ctx, id, "invalid", "errors.csv", "text/csv", strings.NewReader("a,b"))
+	require.ErrorContains(t, err, "403")
+
+	result, err := client.AddAttachment(ctx, id, token, "errors.csv", "text/csv", strings.NewReader("a,b"))
+	require.NoError(t, err)
+
+	attachments, err := op.ParseAttachments(result)
+	require.NoError(t, err)
+	require.Len(t, attachments, 1)
+	require.Equal(t, "errors.csv", attachments[0].Name)
+	require.Equal(t, "text/csv", attachments[0].MediaType)
+	require.Equal(t, int64(3), attachments[0].Size)
+
+	// names must be unique
+	_, err = client.AddAttachment(ctx, id, token, "errors.csv", "text/csv", strings.NewReader("a,b"))
+	require.ErrorContains(t, err, "409")
+
+	// content must not exceed the size limit
+	_, err = client.AddAttachment(ctx, id, token, "big.bin", "application/octet-stream", strings.NewReader(strings.Repeat("x", 17)))
+	require.ErrorContains(t, err, "400")
+
+	// downloading requires an authenticated user
+	_, _, err = client.GetAttachment(ctx, id, "errors.csv")
+	require.ErrorContains(t, err, "401")
+
+	content, mediaType, err := userClient.GetAttachment(ctx, id, "errors.csv")
+	require.NoError(t, err)
+	defer content.Close()
+
+	blob, err := io.ReadAll(content)
+	require.NoError(t, err)
+	require.Equal(t, "a,b", string(blob))
+	require.Equal(t, "text/csv", mediaType)
+
+	_, err = client.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: token,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}))
+	require.NoError(t, err)
+
+	// reports may still be added right after completion
+	result, err = client.AddAttachmentURL(ctx, id, token, "report.pdf", "application/pdf", "https://example.com/report.pdf", 1024)
+	require.NoError(t, err)
+
+	attachments, err = op.ParseAttachments(result)
+	require.NoError(t, err)
+	require.Len(t, attachments, 2)
+	require.Equal(t, "https://example.com/report.pdf", attachments[1].URL)
+
+	// but not more than the configured maximum
+	_, err = client.AddAttachmentURL(ctx, id, token, "other.pdf", "application/pdf", "https://example.com/other.pdf", 0)
+	require.ErrorContains(t, err, "400")
+
+	// attachments of restricted operations are only served to their viewers
+	hiddenReq := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	})
+	op.WithVisibleTo("carol")(hiddenReq)
+
+	hidden, err := client.RegisterOperation(ctx, hiddenReq)
+	require.NoError(t, err)
+
+	_, err = client.AddAttachment(ctx, hidden.Msg.Operation.UniqueId, hidden.Msg.AuthToken, "secret.txt", "text/plain", strings.NewReader("secret"))
+	require.NoError(t, err)
+
+	_, _, err = userClient.GetAttachment(ctx, hidden.Msg.Operation.UniqueId, "secret.txt")
+	require.ErrorContains(t, err, "404")
+
+	carolClient := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "carol", next: srv.Client().Transport},
+	}, srv.URL)
+
+	content, _, err = carolClient.GetAttachment(ctx, hidden.Msg.Operation.UniqueId, "secret.txt")
+	require.NoError(t, err)
+	defer content.Close()
+
+	blob, err = io.ReadAll(content)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(blob))
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	events := new(recordingEvents)
+
+	ctx, cli := setupService(t, events)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	// registration events are published in the background
+	require.Eventually(t, func() bool { return events.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      reg.Msg.Operation.UniqueId,
+		AuthToken:     reg.Msg.AuthToken,
+		StatusMessage: "importing",
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"status_message"},
+		},
+	}))
+	require.NoError(t, err)
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  reg.Msg.Operation.UniqueId,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}))
+	require.NoError(t, err)
+
+	events.l.Lock()
+	defer events.l.Unlock()
+
+	require.Len(t, events.events, 3)
+
+	var parsed []*op.Event
+	for _, e := range events.events {
+		evt, err := op.ParseEvent(e.Event)
+		require.NoError(t, err)
+		require.Equal(t, reg.Msg.Operation.UniqueId, evt.Operation.UniqueId)
+
+		parsed = append(parsed, evt)
+	}
+
+	require.Equal(t, op.EventCreated, parsed[0].Type)
+	require.Equal(t, op.EventUpdated, parsed[1].Type)
+	require.Equal(t, []string{"last_update", "status_message"}, parsed[1].ChangedFields)
+	require.Equal(t, "importing", parsed[1].Operation.StatusMessage)
+	require.Equal(t, op.EventCompleted, parsed[2].Type)
+}
+
+// flakyEvents is a recordingEvents client that fails the first publish calls.
+type flakyEvents struct {
+	recordingEvents
+
+	failures int
+}
+
+func (f *flakyEvents) Publish(ctx context.Context, req *connect.Request[eventsv1.Event]) (*connect.Response[emptypb.Empty], error) {
+	f.l.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.l.Unlock()
+
+		return nil, connect.NewError(connect.CodeUnavailable, io.ErrUnexpectedEOF)
+	}
+	f.l.Unlock()
+
+	return f.recordingEvents.Publish(ctx, req)
+}
+
+func TestOutboxRetry(t *testing.T) {
+	events := &flakyEvents{failures: 2}
+
+	ctx, cli := setupService(t, events)
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  reg.Msg.Operation.UniqueId,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}))
+	require.NoError(t, err)
+
+	// both events are delivered in order once the events-service recovers.
+	require.Eventually(t, func() bool { return events.count() == 2 }, 15*time.Second, 50*time.Millisecond)
+
+	events.l.Lock()
+	defer events.l.Unlock()
+
+	var types []op.EventType
+	for _, e := range events.events {
+		evt, err := op.ParseEvent(e.Event)
+		require.NoError(t, err)
+
+		types = append(types, evt.Type)
+	}
+
+	require.Equal(t, []op.EventType{op.EventCreated, op.EventCompleted}, types)
+}
+
+func TestWatchKeepalive(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServerWithConfig(t, r, nil, &config.Config{
+		DefaultNamespace: "default",
+		WatchKeepalive:   50 * time.Millisecond,
+	})
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: reg.Msg.Operation.UniqueId,
+	}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.True(t, stream.Receive())
+	snapshot := stream.Msg()
+
+	// keepalives repeat the last state while the operation is idle
+	for range 2 {
+		require.True(t, stream.Receive())
+		require.True(t, proto.Equal(snapshot, stream.Msg()))
+	}
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  reg.Msg.Operation.UniqueId,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}))
+	require.NoError(t, err)
+
+	// skip keepalives that have been sent before the update
+	for stream.Receive() {
+		if stream.Msg().State == longrunningv1.OperationState_OperationState_COMPLETE {
+			break
+		}
+	}
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, stream.Msg().State)
+
+	// no keepalives are sent once the stream ended
+	require.False(t, stream.Receive())
+	require.NoError(t, stream.Err())
+}
+
+func TestDurationLimits(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		DefaultNamespace:   "default",
+		DefaultTTL:         time.Minute,
+		MinTTL:             10 * time.Second,
+		MaxTTL:             time.Hour,
+		DefaultGracePeriod: 30 * time.Second,
+		MaxGracePeriod:     time.Minute,
+	}
+
+	_, srv := startServerWithConfig(t, r, nil, cfg)
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	// the defaults are configured on the repository so the second instance
+	// needs it's own.
+	clampRepo, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, clampSrv := startServerWithConfig(t, clampRepo, nil, &config.Config{
+		DefaultNamespace: "default",
+		MinTTL:           cfg.MinTTL,
+		MaxTTL:           cfg.MaxTTL,
+		MaxGracePeriod:   cfg.MaxGracePeriod,
+		DefaultTTL:       cfg.DefaultTTL,
+		ClampDurations:   true,
+	})
+	clampCli := op.NewClient(clampSrv.Client(), clampSrv.URL)
+
+	register := func(cli *op.Client, ttl, grace *durationpb.Duration) (*longrunningv1.Operation, error) {
+		res, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Kind:         "test-op",
+			Ttl:          ttl,
+			GracePeriod:  grace,
+		}))
+		if err != nil {
+			return nil, err
+		}
+
+		return res.Msg.Operation, nil
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		res, err := register(cli, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, res.Ttl.AsDuration())
+		require.Equal(t, 30*time.Second, res.GracePeriod.AsDuration())
+	})
+
+	t.Run("OutOfRange", func(t *testing.T) {
+		for _, tc := range []struct {
+			ttl, grace time.Duration
+		}{
+			{ttl: time.Millisecond},
+			{ttl: 30 * 24 * time.Hour},
+			{ttl: -time.Minute},
+			{ttl: time.Minute, grace: time.Hour},
+			{ttl: time.Minute, grace: -time.Second},
+		} {
+			_, err := register(cli, durationpb.New(tc.ttl), durationpb.New(tc.grace))
+			require.Error(t, err)
+			require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err), "ttl=%s grace=%s", tc.ttl, tc.grace)
+		}
+
+		_, err := register(cli, durationpb.New(time.Millisecond), nil)
+		require.ErrorContains(t, err, "allowed range is [10s, 1h0m0s]")
+	})
+
+	t.Run("Clamp", func(t *testing.T) {
+		res, err := register(clampCli, durationpb.New(time.Millisecond), durationpb.New(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 10*time.Second, res.Ttl.AsDuration())
+		require.Equal(t, time.Minute, res.GracePeriod.AsDuration())
+
+		res, err = register(clampCli, durationpb.New(30*24*time.Hour), nil)
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, res.Ttl.AsDuration())
+
+		// negative durations are rejected even if clamping is enabled
+		_, err = register(clampCli, durationpb.New(-time.Minute), nil)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+}
+
+func TestAcquireOperation(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	userClient := func(id string) *op.Client {
+		return op.NewClient(&http.Client{
+			Transport: remoteUserTransport{userID: id, next: srv.Client().Transport},
+		}, srv.URL)
+	}
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+	owner := userClient("alice")
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "alice",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+	acquireReq := func() *connect.Request[longrunningv1.GetOperationRequest] {
+		return connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id})
+	}
+
+	// only lost operations can be acquired
+	_, err = owner.AcquireOperation(ctx, acquireReq())
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	_, err = r.ForceMarkAsLost(ctx, id, &longrunningv1.OperationError{Message: "worker crashed"}, "test")
+	require.NoError(t, err)
+
+	_, err = cli.AcquireOperation(ctx, acquireReq())
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	_, err = userClient("bob").AcquireOperation(ctx, acquireReq())
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	// concurrent attempts by the owner must only succeed once
+	var (
+		wg      sync.WaitGroup
+		l       sync.Mutex
+		results []*longrunningv1.RegisterOperationResponse
+		codes   []connect.Code
+	)
+
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := owner.AcquireOperation(ctx, acquireReq())
+
+			l.Lock()
+			defer l.Unlock()
+
+			if err != nil {
+				codes = append(codes, connect.CodeOf(err))
+			} else {
+				results = append(results, res.Msg)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, results, 1)
+	for _, code := range codes {
+		require.Equal(t, connect.CodeFailedPrecondition, code)
+	}
+
+	acquired := results[0]
+	require.NotEmpty(t, acquired.AuthToken)
+	require.NotEqual(t, reg.Msg.AuthToken, acquired.AuthToken)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, acquired.Operation.State)
+	require.Nil(t, acquired.Operation.GetError())
+
+	// only the new token may be used
+	_, err = cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     reg.Msg.AuthToken,
+		StatusMessage: "resumed",
+	}))
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: acquired.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}))
+	require.NoError(t, err)
+
+	// completed operations cannot be acquired
+	_, err = owner.AcquireOperation(ctx, acquireReq())
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// administrators may acquire operations of other users
+	other, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "bob",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	_, err = r.ForceMarkAsLost(ctx, other.Msg.Operation.UniqueId, &longrunningv1.OperationError{Message: "worker crashed"}, "test")
+	require.NoError(t, err)
+
+	res, err := userClient("admin").AcquireOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: other.Msg.Operation.UniqueId}))
+	require.NoError(t, err)
+	require.NotEmpty(t, res.Msg.AuthToken)
+}
+
+func TestResumeOperation(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	_, err = r.ForceMarkAsLost(ctx, id, &longrunningv1.OperationError{Message: "ttl expired"}, "test")
+	require.NoError(t, err)
+
+	updateReq := func(resume bool) *connect.Request[longrunningv1.UpdateOperationRequest] {
+		req := connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+			UniqueId:      id,
+			AuthToken:     reg.Msg.AuthToken,
+			StatusMessage: "still alive",
+			UpdateMask: &fieldmaskpb.FieldMask{
+				Paths: []string{"status_message"},
+			},
+		})
+
+		if resume {
+			req.Header().Set(op.ResumeHeader, "true")
+		}
+
+		return req
+	}
+
+	// mutations of lost operations are rejected
+	_, err = cli.UpdateOperation(ctx, updateReq(false))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	_, err = cli.Heartbeat(ctx, updateReq(false))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	current, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, current.Msg.State)
+	require.Empty(t, current.Msg.StatusMessage)
+
+	// the worker may resume the operation using it's auth token
+	res, err := cli.UpdateOperation(ctx, updateReq(true))
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, res.Msg.State)
+	require.Equal(t, "still alive", res.Msg.StatusMessage)
+	require.Nil(t, res.Msg.GetError())
+
+	// heartbeats recover as well
+	_, err = r.ForceMarkAsLost(ctx, id, &longrunningv1.OperationError{Message: "ttl expired"}, "test")
+	require.NoError(t, err)
+
+	res, err = cli.Heartbeat(ctx, updateReq(true))
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, res.Msg.State)
+
+	// an invalid auth token cannot be used to resume an operation
+	_, err = r.ForceMarkAsLost(ctx, id, &longrunningv1.OperationError{Message: "ttl expired"}, "test")
+	require.NoError(t, err)
+
+	req := updateReq(true)
+	req.Msg.AuthToken = "invalid"
+
+	_, err = cli.UpdateOperation(ctx, req)
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+}
+
+func TestKindDefaults(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		DefaultNamespace:   "default",
+		DefaultTTL:         5 * time.Minute,
+		DefaultGracePeriod: 5 * time.Minute,
+	}
+	require.NoError(t, cfg.KindDefaults.EnvDecode(`{"tkd.backup.v1/*": {"ttl": "1h", "pendingTimeout": "10m"}}`))
+
+	_, srv := startServerWithConfig(t, r, nil, cfg)
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	defaults, err := cli.GetKindDefaults(ctx, "tkd.backup.v1/create")
+	require.NoError(t, err)
+	require.Equal(t, &op.KindDefaults{
+		Pattern:        "tkd.backup.v1/*",
+		TTL:            time.Hour,
+		GracePeriod:    5 * time.Minute,
+		PendingTimeout: 10 * time.Minute,
+	}, defaults)
+
+	defaults, err = cli.GetKindDefaults(ctx, "tkd.notify.v1/send-mails")
+	require.NoError(t, err)
+	require.Equal(t, &op.KindDefaults{
+		TTL:         5 * time.Minute,
+		GracePeriod: 5 * time.Minute,
+	}, defaults)
+
+	// the defaults are applied during registration
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "tkd.backup.v1/create",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, reg.Msg.Operation.Ttl.AsDuration())
+	require.Equal(t, 5*time.Minute, reg.Msg.Operation.GracePeriod.AsDuration())
+}
+
+func TestQuota(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServerWithConfig(t, r, nil, &config.Config{
+		DefaultNamespace:  "default",
+		MaxActivePerOwner: 2,
+	})
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	register := func() (*connect.Response[longrunningv1.RegisterOperationResponse], error) {
+		return cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "alice",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Kind:         "test-op",
+		}))
+	}
+
+	first, err := register()
+	require.NoError(t, err)
+
+	_, err = register()
+	require.NoError(t, err)
+
+	_, err = register()
+	require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  first.Msg.Operation.UniqueId,
+		AuthToken: first.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{},
+		},
+	}))
+	require.NoError(t, err)
+
+	_, err = register()
+	require.NoError(t, err)
+}
+
+func TestDashboard(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	register := func() *longrunningv1.RegisterOperationResponse {
+		res, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "alice",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Kind:         "test-op",
+		}))
+		require.NoError(t, err)
+
+		return res.Msg
+	}
+
+	oldest := register()
+	register()
+
+	failed := register()
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  failed.Operation.UniqueId,
+		AuthToken: failed.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Error{
+			Error: &longrunningv1.OperationError{Message: "failed"},
+		},
+	}))
+	require.NoError(t, err)
+
+	lost := register()
+	_, err = r.ForceMarkAsLost(ctx, lost.Operation.UniqueId, &longrunningv1.OperationError{Message: "ttl expired"}, "test")
+	require.NoError(t, err)
+
+	dashboard, err := cli.GetDashboard(ctx, op.DashboardOptions{
+		FailedLimit:  10,
+		LostLimit:    10,
+		RunningLimit: 1,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, dashboard.Failed, 1)
+	require.Equal(t, failed.Operation.UniqueId, dashboard.Failed[0].UniqueId)
+
+	require.Len(t, dashboard.Lost, 1)
+	require.Equal(t, lost.Operation.UniqueId, dashboard.Lost[0].UniqueId)
+
+	require.Len(t, dashboard.Running, 1)
+	require.Equal(t, oldest.Operation.UniqueId, dashboard.Running[0].UniqueId)
+	require.NotEmpty(t, dashboard.Running[0].Annotations[op.AgeAnnotation])
+
+	require.Equal(t, map[longrunningv1.OperationState]int64{
+		longrunningv1.OperationState_OperationState_RUNNING:  2,
+		longrunningv1.OperationState_OperationState_COMPLETE: 1,
+		longrunningv1.OperationState_OperationState_LOST:     1,
+	}, dashboard.StateCounts)
+
+	// sections with a zero limit are omitted
+	dashboard, err = cli.GetDashboard(ctx, op.DashboardOptions{LostLimit: 10})
+	require.NoError(t, err)
+	require.Empty(t, dashboard.Failed)
+	require.Empty(t, dashboard.Running)
+	require.Len(t, dashboard.Lost, 1)
+}
+
+func TestSuppressDuplicates(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	calls := 0
+	fn := func(ctx context.Context) (string, error) {
+		calls++
+
+		return "done", nil
+	}
+
+	// a duplicate registered while the first operation is still running is
+	// suppressed and fn is not called.
+	_, err = op.Wrap(ctx, cli, func(ctx context.Context) (string, error) {
+		_, err := op.Wrap(ctx, cli, fn, op.WithSuppressDuplicates(time.Minute))
+		require.ErrorIs(t, err, op.ErrDeduplicated)
+
+		return fn(ctx)
+	}, op.WithSuppressDuplicates(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+
+	req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "cron",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	})
+	op.WithSuppressDuplicates(time.Minute)(req)
+
+	first, err := cli.RegisterOperation(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, first.Header().Get(op.DeduplicatedHeader))
+
+	second, err := cli.RegisterOperation(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "true", second.Header().Get(op.DeduplicatedHeader))
+	require.Equal(t, first.Msg.Operation.UniqueId, second.Msg.Operation.UniqueId)
+	require.Empty(t, second.Msg.AuthToken)
+}
+
+func TestSlowWatcher(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	// stall watches a new operation without receiving from the stream and
+	// sends large updates until the transport buffers are exhausted. It
+	// returns the stream and the maximum latency of UpdateOperation.
+	stall := func(t *testing.T, policy config.SlowConsumerPolicy) (*connect.ServerStreamForClient[longrunningv1.Operation], time.Duration) {
+		_, srv := startServerWithConfig(t, r, nil, &config.Config{
+			DefaultNamespace:        "default",
+			WatchBufferSize:         4,
+			WatchSlowConsumerPolicy: policy,
+		})
+		cli := op.NewClient(srv.Client(), srv.URL)
+
+		reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         "test-op",
+		}))
+		require.NoError(t, err)
+
+		stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: reg.Msg.Operation.UniqueId,
+		}))
+		require.NoError(t, err)
+		t.Cleanup(func() { stream.Close() })
+
+		var latency time.Duration
+
+		status := strings.Repeat("x", 128*1024)
+		for idx := range 200 {
+			start := time.Now()
+
+			_, err := cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+				UniqueId:      reg.Msg.Operation.UniqueId,
+				AuthToken:     reg.Msg.AuthToken,
+				Running:       true,
+				StatusMessage: status,
+				PercentDone:   int32(idx / 2),
+			}))
+			require.NoError(t, err)
+
+			latency = max(latency, time.Since(start))
+		}
+
+		_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  reg.Msg.Operation.UniqueId,
+			AuthToken: reg.Msg.AuthToken,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}))
+		require.NoError(t, err)
+
+		return stream, latency
+	}
+
+	for _, policy := range []config.SlowConsumerPolicy{config.DropOldest, config.DropUpdate} {
+		t.Run(string(policy), func(t *testing.T) {
+			stream, latency := stall(t, policy)
+
+			// a stalled watcher must not delay updates
+			require.Less(t, latency, 500*time.Millisecond)
+
+			// intermediate updates have been dropped but the terminal update
+			// is always delivered.
+			var received []*longrunningv1.Operation
+			for stream.Receive() {
+				received = append(received, stream.Msg())
+			}
+			require.NoError(t, stream.Err())
+
+			require.Less(t, len(received), 202)
+			require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, received[len(received)-1].State)
+		})
+	}
+
+	t.Run(string(config.Disconnect), func(t *testing.T) {
+		stream, latency := stall(t, config.Disconnect)
+
+		require.Less(t, latency, 500*time.Millisecond)
+
+		for stream.Receive() {
+			require.NotEqual(t, longrunningv1.OperationState_OperationState_COMPLETE, stream.Msg().State)
+		}
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(stream.Err()))
+	})
+
+	t.Run(string(config.Disconnect)+"/Terminal", func(t *testing.T) {
+		_, srv := startServerWithConfig(t, r, nil, &config.Config{
+			DefaultNamespace:        "default",
+			WatchBufferSize:         4,
+			WatchSlowConsumerPolicy: config.Disconnect,
+		})
+		cli := op.NewClient(srv.Client(), srv.URL)
+
+		reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         "test-op",
+		}))
+		require.NoError(t, err)
+
+		stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: reg.Msg.Operation.UniqueId,
+		}))
+		require.NoError(t, err)
+		defer stream.Close()
+
+		update := func(status string) {
+			_, err := cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+				UniqueId:      reg.Msg.Operation.UniqueId,
+				AuthToken:     reg.Msg.AuthToken,
+				Running:       true,
+				StatusMessage: status,
+			}))
+			require.NoError(t, err)
+		}
+
+		// stall the watcher with updates that exceed the transport buffers
+		// and give it time to block while sending them.
+		for range 2 {
+			update(strings.Repeat("x", 12<<20))
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		// fill the buffer so the terminal update finds it full.
+		for range 4 {
+			update("almost done")
+		}
+
+		_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  reg.Msg.Operation.UniqueId,
+			AuthToken: reg.Msg.AuthToken,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}))
+		require.NoError(t, err)
+
+		// the buffered updates are dropped but the terminal update is
+		// delivered before the watcher is disconnected.
+		var last *longrunningv1.Operation
+		for stream.Receive() {
+			last = stream.Msg()
+		}
+		require.NoError(t, stream.Err())
+
+		require.NotNil(t, last)
+		require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, last.State)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startHTTP2Server(t, r)
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	register := func() *longrunningv1.RegisterOperationResponse {
+		reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         "test-op",
+		}))
+		require.NoError(t, err)
+
+		return reg.Msg
+	}
+
+	complete := func(reg *longrunningv1.RegisterOperationResponse) {
+		_, err := cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  reg.Operation.UniqueId,
+			AuthToken: reg.AuthToken,
+			Result: &longrunningv1.CompleteOperationRequest_Success{
+				Success: &longrunningv1.OperationSuccess{},
+			},
+		}))
+		require.NoError(t, err)
+	}
+
+	update := func(reg *longrunningv1.RegisterOperationResponse, status string) {
+		_, err := cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+			UniqueId:      reg.Operation.UniqueId,
+			AuthToken:     reg.AuthToken,
+			Running:       true,
+			StatusMessage: status,
+		}))
+		require.NoError(t, err)
+	}
+
+	first, second, done := register(), register(), register()
+	complete(done)
+
+	stream := cli.Watch(ctx)
+	defer stream.CloseResponse()
+
+	receive := func() *longrunningv1.Operation {
+		msg, err := stream.Receive()
+		require.NoError(t, err)
+
+		return msg
+	}
+
+	for _, reg := range []*longrunningv1.RegisterOperationResponse{first, second} {
+		require.NoError(t, stream.Send(op.Subscribe(reg.Operation.UniqueId)))
+
+		// the current state is sent first
+		msg := receive()
+		require.Equal(t, reg.Operation.UniqueId, msg.UniqueId)
+		require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, msg.State)
+	}
+
+	// terminal operations emit their final snapshot right away
+	require.NoError(t, stream.Send(op.Subscribe(done.Operation.UniqueId)))
+
+	msg := receive()
+	require.Equal(t, done.Operation.UniqueId, msg.UniqueId)
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, msg.State)
+
+	// unknown operations are reported without a state
+	require.NoError(t, stream.Send(op.Subscribe("6560a4a0e4b0a1b2c3d4e5f6")))
+
+	msg = receive()
+	require.Equal(t, "6560a4a0e4b0a1b2c3d4e5f6", msg.UniqueId)
+	require.Equal(t, longrunningv1.OperationState_OperationState_UNSPECIFIED, msg.State)
+
+	// updates of all subscribed operations are received on the same stream
+	update(first, "first")
+	msg = receive()
+	require.Equal(t, first.Operation.UniqueId, msg.UniqueId)
+	require.Equal(t, "first", msg.StatusMessage)
+
+	update(second, "second")
+	msg = receive()
+	require.Equal(t, second.Operation.UniqueId, msg.UniqueId)
+	require.Equal(t, "second", msg.StatusMessage)
+
+	// unsubscribed operations are not delivered anymore
+	require.NoError(t, stream.Send(op.Unsubscribe(first.Operation.UniqueId)))
+
+	// the unsubscribe request is not acknowledged so wait until it has been
+	// handled by subscribing to another operation.
+	require.NoError(t, stream.Send(op.Subscribe(done.Operation.UniqueId)))
+	require.Equal(t, done.Operation.UniqueId, receive().UniqueId)
+
+	update(first, "ignored")
+	complete(second)
+
+	msg = receive()
+	require.Equal(t, second.Operation.UniqueId, msg.UniqueId)
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, msg.State)
+
+	require.NoError(t, stream.CloseRequest())
+
+	_, err = stream.Receive()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestForceMarkLost(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+	admin := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "admin", next: srv.Client().Transport},
+	}, srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Hour),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.True(t, stream.Receive())
+
+	// only administrators may mark operations as lost
+	_, err = cli.ForceMarkLost(ctx, id, "host is gone")
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	// a reason is required
+	_, err = admin.ForceMarkLost(ctx, id, "")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	lost, err := admin.ForceMarkLost(ctx, id, "host is gone")
+	require.NoError(t, err)
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, lost.State)
+	require.Equal(t, "host is gone", lost.GetError().Message)
+	require.Equal(t, "admin", lost.Annotations[op.LastUpdatedByAnnotation])
+
+	audit, err := op.ParseAudit(lost)
+	require.NoError(t, err)
+	require.Equal(t, "admin", audit[len(audit)-1].Actor)
+	require.Equal(t, "mark-lost", audit[len(audit)-1].Action)
+
+	details, err := lost.GetError().ErrorDetails.UnmarshalNew()
+	require.NoError(t, err)
+	require.Equal(t, op.LostReasonAdmin, details.(*structpb.Struct).Fields[op.LostReasonDetail].GetStringValue())
+	require.Equal(t, "admin", details.(*structpb.Struct).Fields[op.LostActorDetail].GetStringValue())
+
+	// watchers are notified and their stream ends
+	require.True(t, stream.Receive())
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, stream.Msg().State)
+	require.False(t, stream.Receive())
+	require.NoError(t, stream.Err())
+
+	// terminal operations are refused
+	_, err = admin.ForceMarkLost(ctx, id, "again")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
+
+func TestAPIOnly(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServerWithConfig(t, r, nil, &config.Config{
+		DefaultNamespace: "default",
+		Roles:            []string{config.RoleAPI},
+	})
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+	admin := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "admin", next: srv.Client().Transport},
+	}, srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	register := func() *longrunningv1.RegisterOperationResponse {
+		reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Hour),
+			Kind:         "test-op",
+		}))
+		require.NoError(t, err)
+
+		return reg.Msg
+	}
+
+	watch := func(id string) *connect.ServerStreamForClient[longrunningv1.Operation] {
+		stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+			UniqueId: id,
+		}))
+		require.NoError(t, err)
+		t.Cleanup(func() { stream.Close() })
+
+		require.True(t, stream.Receive())
+
+		return stream
+	}
+
+	// watchers are notified about completions handled by the instance
+	reg := register()
+	stream := watch(reg.Operation.UniqueId)
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  reg.Operation.UniqueId,
+		AuthToken: reg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Error{
+			Error: &longrunningv1.OperationError{Message: "failed"},
+		},
+	}))
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, stream.Msg().State)
+	require.False(t, stream.Receive())
+
+	// and about operations marked as lost by administrators
+	reg = register()
+	stream = watch(reg.Operation.UniqueId)
+
+	_, err = admin.ForceMarkLost(ctx, reg.Operation.UniqueId, "host is gone")
+	require.NoError(t, err)
+
+	require.True(t, stream.Receive())
+	require.Equal(t, longrunningv1.OperationState_OperationState_LOST, stream.Msg().State)
+	require.False(t, stream.Receive())
+
+	// the manager is not available
+	_, _, err = admin.GetPendingLosses(ctx)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
+
+func TestAddNote(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+	user := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "alice", next: srv.Client().Transport},
+	}, srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Hour),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	// notes require an authenticated caller
+	_, err = cli.AddNote(ctx, id, "customer called")
+	require.Equal(t, connect.CodeUnauthenticated, connect.CodeOf(err))
+
+	_, err = user.AddNote(ctx, id, "  ")
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	_, err = user.AddNote(ctx, id, "customer called, don't retry")
+	require.NoError(t, err)
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: "done",
+			},
+		},
+	}))
+	require.NoError(t, err)
+
+	// notes may be added to terminal operations as well
+	_, err = user.AddNote(ctx, id, "checked the result")
+	require.NoError(t, err)
+
+	res, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+
+	notes, err := op.ParseNotes(res.Msg)
+	require.NoError(t, err)
+	require.Len(t, notes, 2)
+	require.Equal(t, "alice", notes[0].Author)
+	require.Equal(t, "customer called, don't retry", notes[0].Text)
+	require.Equal(t, "checked the result", notes[1].Text)
+
+	_, err = user.AddNote(ctx, "0123456789abcdef01234567", "unknown")
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+}
+
+func TestTags(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+	user := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "alice", next: srv.Client().Transport},
+	}, srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Hour),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	req := connect.NewRequest(&longrunningv1.QueryOperationsRequest{})
+	req.Header().Set(op.TagsHeader, "Needs-Review")
+
+	stream, err := cli.WatchOperations(ctx, req)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	// tags require an authenticated caller
+	_, err = cli.AddTags(ctx, id, "needs-review")
+	require.Equal(t, connect.CodeUnauthenticated, connect.CodeOf(err))
+
+	_, err = user.AddTags(ctx, id, " Needs-Review ")
+	require.NoError(t, err)
+
+	// watchers see the tag change
+	require.True(t, stream.Receive())
+	require.Equal(t, id, stream.Msg().UniqueId)
+	require.Equal(t, "needs-review", stream.Msg().Annotations[op.TagsAnnotation])
+
+	res, err := cli.QueryOperations(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, res.Msg.Operation, 1)
+
+	_, err = user.RemoveTags(ctx, id, "needs-review")
+	require.NoError(t, err)
+
+	res, err = cli.QueryOperations(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, res.Msg.Operation)
+}
+
+func TestLinks(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	register := func(link op.Link) (*connect.Response[longrunningv1.RegisterOperationResponse], error) {
+		req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			Kind:         "test-op",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Hour),
+		})
+		op.WithLinks(link)(req)
+
+		return cli.RegisterOperation(ctx, req)
+	}
+
+	// only http and https URLs are accepted
+	_, err := register(op.Link{Title: "Script", URL: "javascript:alert(1)"})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	reg, err := register(op.Link{Title: "Dashboard", URL: "https://grafana.example.com/d/job", Icon: "grafana"})
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	stream, err := cli.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.True(t, stream.Receive())
+
+	_, err = cli.AddLink(ctx, id, "invalid", op.Link{Title: "Report", URL: "https://s3.example.com/report.pdf"})
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	_, err = cli.AddLink(ctx, id, reg.Msg.AuthToken, op.Link{Title: "Report", URL: "https://s3.example.com/report.pdf"})
+	require.NoError(t, err)
+
+	// watchers see the new link
+	require.True(t, stream.Receive())
+
+	links, err := op.ParseLinks(stream.Msg())
+	require.NoError(t, err)
+	require.Equal(t, []op.Link{
+		{Title: "Dashboard", URL: "https://grafana.example.com/d/job", Icon: "grafana"},
+		{Title: "Report", URL: "https://s3.example.com/report.pdf"},
+	}, links)
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServerWithConfig(t, r, nil, &config.Config{
+		DefaultNamespace:    "default",
+		WebhookMaxAttempts:  1,
+		WebhookDisableAfter: 1,
+	})
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+	admin := op.NewClient(&http.Client{
+		Transport: remoteUserTransport{userID: "admin", next: srv.Client().Transport},
+	}, srv.URL)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+
+	deliveries := make(chan delivery, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		deliveries <- delivery{header: req.Header, body: body}
+	}))
+	defer receiver.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	// only administrators may manage webhooks
+	_, err = cli.CreateWebhook(ctx, op.Webhook{URL: receiver.URL, Secret: "secret"})
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	_, err = admin.CreateWebhook(ctx, op.Webhook{URL: "ftp://example.com", Secret: "secret"})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	hook, err := admin.CreateWebhook(ctx, op.Webhook{Kind: "test-*", URL: receiver.URL, Secret: "secret"})
+	require.NoError(t, err)
+	require.Empty(t, hook.Secret)
+	require.Equal(t, []op.EventType{op.EventCompleted, op.EventLost}, hook.Events)
+
+	dead, err := admin.CreateWebhook(ctx, op.Webhook{URL: failing.URL, Secret: "secret"})
+	require.NoError(t, err)
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Hour),
+		Kind:         "test-op",
+	}))
+	require.NoError(t, err)
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  reg.Msg.Operation.UniqueId,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: "done",
+			},
+		},
+	}))
+	require.NoError(t, err)
+
+	select {
+	case d := <-deliveries:
+		require.Equal(t, string(op.EventCompleted), d.header.Get(op.WebhookEventHeader))
+		require.True(t, op.VerifyWebhook("secret", d.body, d.header.Get(op.WebhookSignatureHeader)))
+
+		var event anypb.Any
+		require.NoError(t, protojson.Unmarshal(d.body, &event))
+
+		parsed, err := op.ParseEvent(&event)
+		require.NoError(t, err)
+		require.Equal(t, reg.Msg.Operation.UniqueId, parsed.Operation.UniqueId)
+
+	case <-ctx.Done():
+		t.Fatal("webhook has not been delivered")
+	}
+
+	// the failing webhook is disabled after the first failure
+	require.Eventually(t, func() bool {
+		hooks, err := admin.ListWebhooks(ctx)
+		require.NoError(t, err)
+		require.Len(t, hooks, 2)
+
+		return hooks[1].ID == dead.ID && hooks[1].Disabled
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, admin.DeleteWebhook(ctx, dead.ID))
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(admin.DeleteWebhook(ctx, dead.ID)))
+}
+
+func TestWatchOperationDiffUpdates(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reg, err := cli.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		Creator:      "test-case",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Ttl:          durationpb.New(time.Minute),
+		Kind:         "test-op",
+		Description:  "diff updates",
+	}))
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	req := connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id})
+	req.Header().Set(op.DiffUpdatesHeader, "true")
+
+	stream, err := cli.WatchOperation(ctx, req)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	// the first message is a full snapshot.
+	require.True(t, stream.Receive())
+	current := stream.Msg()
+	require.False(t, op.IsDiff(current))
+	require.Equal(t, "diff updates", current.Description)
+
+	_, err = cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     reg.Msg.AuthToken,
+		Running:       true,
+		StatusMessage: "halfway",
+	}))
+	require.NoError(t, err)
+
+	// updates only hold the changed fields.
+	require.True(t, stream.Receive())
+	diff := stream.Msg()
+	require.True(t, op.IsDiff(diff))
+	require.Equal(t, id, diff.UniqueId)
+	require.Empty(t, diff.Description)
+	require.Equal(t, "halfway", diff.StatusMessage)
+	require.Contains(t, strings.Split(diff.Annotations[op.ChangedFieldsAnnotation], ","), "status_message")
+
+	current = op.ApplyDiff(current, diff)
+	require.Equal(t, "diff updates", current.Description)
+	require.Equal(t, "halfway", current.StatusMessage)
+	require.NotContains(t, current.Annotations, op.ChangedFieldsAnnotation)
+
+	_, err = cli.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+		UniqueId:  id,
+		AuthToken: reg.Msg.AuthToken,
+		Result: &longrunningv1.CompleteOperationRequest_Success{
+			Success: &longrunningv1.OperationSuccess{
+				Message: "done",
+			},
+		},
+	}))
+	require.NoError(t, err)
+
+	// the terminal update holds the full final state.
+	require.True(t, stream.Receive())
+	final := stream.Msg()
+	require.False(t, op.IsDiff(final))
+	require.Equal(t, longrunningv1.OperationState_OperationState_COMPLETE, final.State)
+	require.Equal(t, "diff updates", final.Description)
+
+	require.False(t, stream.Receive())
+	require.NoError(t, stream.Err())
+}
+
+func TestVisibleTo(t *testing.T) {
+	ctx, mongoCli := mongotest.Start(t)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := repo.NewRepoWithClient(ctx, mongoCli, "test-db")
+	require.NoError(t, err)
+
+	_, srv := startServer(t, r, nil)
+
+	userClient := func(id string) *op.Client {
+		return op.NewClient(&http.Client{
+			Transport: remoteUserTransport{userID: id, next: srv.Client().Transport},
+		}, srv.URL)
+	}
+
+	cli := op.NewClient(srv.Client(), srv.URL)
+
+	req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "alice",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	})
+	op.WithVisibleTo("carol")(req)
+
+	reg, err := cli.RegisterOperation(ctx, req)
+	require.NoError(t, err)
+
+	id := reg.Msg.Operation.UniqueId
+
+	for _, user := range []string{"alice", "carol"} {
+		_, err := userClient(user).GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+		require.NoError(t, err, user)
+
+		res, err := userClient(user).QueryOperations(ctx, connect.NewRequest(&longrunningv1.QueryOperationsRequest{}))
+		require.NoError(t, err, user)
+		require.Len(t, res.Msg.Operation, 1, user)
+	}
+
+	mallory := userClient("mallory")
+
+	_, err = mallory.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	res, err := mallory.QueryOperations(ctx, connect.NewRequest(&longrunningv1.QueryOperationsRequest{}))
+	require.NoError(t, err)
+	require.Empty(t, res.Msg.Operation)
+
+	// operations that are not visible cannot be changed either.
+	_, err = mallory.AddNote(ctx, id, "hidden")
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	_, err = mallory.AddTags(ctx, id, "hidden")
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	_, err = mallory.RemoveTags(ctx, id, "nightly")
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	tagged, err := userClient("carol").AddTags(ctx, id, "nightly")
+	require.NoError(t, err)
+	require.Equal(t, "nightly", tagged.Annotations[op.TagsAnnotation])
+
+	_, err = userClient("carol").AddNote(ctx, id, "checked")
+	require.NoError(t, err)
+
+	_, err = mallory.RemoveTags(ctx, id, "nightly")
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	current, err := userClient("alice").GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+	require.NoError(t, err)
+	require.Equal(t, "nightly", current.Msg.Annotations[op.TagsAnnotation])
+	require.NotContains(t, current.Msg.Annotations[op.NotesAnnotation], "hidden")
+
+	stream, err := mallory.WatchOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{UniqueId: id}))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	require.False(t, stream.Receive())
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(stream.Err()))
+}
+
+func TestInitialProgress(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner:        "test",
+		InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		Kind:         "test-op",
+	})
+	op.WithProgress(10, "validating input")(req)
+
+	reg, err := cli.RegisterOperation(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, int32(10), reg.Msg.Operation.PercentDone)
+	require.Equal(t, "validating input", reg.Msg.Operation.StatusMessage)
+
+	res, err := cli.GetOperation(ctx, connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: reg.Msg.Operation.UniqueId,
+	}))
+	require.NoError(t, err)
+	require.Equal(t, int32(10), res.Msg.PercentDone)
+	require.Equal(t, "validating input", res.Msg.StatusMessage)
+
+	// the initial progress is validated just like updates
+	req = connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Owner: "test",
+		Kind:  "test-op",
+	})
+	op.WithProgress(101, "")(req)
+
+	_, err = cli.RegisterOperation(ctx, req)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	_, err = cli.UpdateOperation(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:    reg.Msg.Operation.UniqueId,
+		AuthToken:   reg.Msg.AuthToken,
+		Running:     true,
+		PercentDone: -1,
+	}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func TestValidateOnly(t *testing.T) {
+	ctx, cli := setupService(t, nil)
+
+	req := func(ref string) *connect.Request[longrunningv1.RegisterOperationRequest] {
+		req := connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        "test",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+			Ttl:          durationpb.New(time.Minute),
+			Kind:         "test-op",
+		})
+		req.Header().Set(op.ExternalRefHeader, ref)
+		op.WithValidateOnly()(req)
+
+		return req
+	}
+
+	res, err := cli.RegisterOperation(ctx, req("ref-1"))
+	require.NoError(t, err)
+	require.Equal(t, "true", res.Header().Get(op.ValidateOnlyHeader))
+	require.Empty(t, res.Header().Get(op.DeduplicatedHeader))
+	require.Empty(t, res.Msg.AuthToken)
+	require.Empty(t, res.Msg.Operation.UniqueId)
+	require.Equal(t, "test-op", res.Msg.Operation.Kind)
+	require.Equal(t, longrunningv1.OperationState_OperationState_RUNNING, res.Msg.Operation.State)
+
+	// nothing has been registered
+	list, err := cli.QueryOperations(ctx, connect.NewRequest(&longrunningv1.QueryOperationsRequest{}))
+	require.NoError(t, err)
+	require.Empty(t, list.Msg.Operation)
+
+	_, err = op.Wrap(ctx, cli, func(ctx context.Context) (string, error) {
+		t.Fatal("fn must not be called")
+		return "", nil
+	}, op.WithValidateOnly())
+	require.ErrorIs(t, err, op.ErrValidateOnly)
+
+	// conflicts with active operations are reported
+	valid := req("ref-1")
+	valid.Header().Del(op.ValidateOnlyHeader)
+
+	_, err = cli.RegisterOperation(ctx, valid)
+	require.NoError(t, err)
+
+	_, err = cli.RegisterOperation(ctx, req("ref-1"))
+	require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+	// invalid registrations are rejected
+	invalid := req("ref-2")
+	invalid.Header().Set(op.PriorityHeader, "-1")
+
+	_, err = cli.RegisterOperation(ctx, invalid)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+// fakeUsers resolves the user names in ids to their user ids.
+type fakeUsers struct {
+	idmv1connect.UserServiceClient
+
+	ids map[string]string
+}
+
+func (f *fakeUsers) GetUser(_ context.Context, req *connect.Request[idmv1.GetUserRequest]) (*connect.Response[idmv1.GetUserResponse], error) {
+	id, ok := f.ids[req.Msg.GetName()]
+	if !ok {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+	}
+
+	return connect.NewResponse(&idmv1.GetUserResponse{
+		Profile: &idmv1.Profile{User: &idmv1.User{Id: id}},
+	}), nil
+}
+
+// fakeNotify records the notifications sent. The first fail calls return an
+// error.
+type fakeNotify struct {
+	idmv1connect.NotifyServiceClient
+
+	l     sync.Mutex
+	fail  int
+	calls int
+	sent  []*idmv1.SendNotificationRequest
+}
+
+func (f *fakeNotify) SendNotification(_ context.Context, req *connect.Request[idmv1.SendNotificationRequest]) (*connect.Response[idmv1.SendNotificationResponse], error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.calls++
+	if f.fail > 0 {
+		f.fail--
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("notification service unavailable"))
+	}
+
+	f.sent = append(f.sent, req.Msg)
+
+	return connect.NewResponse(&idmv1.SendNotificationResponse{}), nil
+}
+
+func (f *fakeNotify) notifications() []*idmv1.SendNotificationRequest {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	return slices.Clone(f.sent)
+}
+
+func TestOwnerNotifications(t *testing.T) {
+	ctx, cli := mongotest.Start(t)
+
+	r, err := repo.NewRepoWithClient(ctx, cli, "test-db")
+	require.NoError(t, err)
+
+	notify := &fakeNotify{fail: 1}
+
+	_, mux := newServiceMuxWithProviders(t, &config.Providers{
+		Config: &config.Config{
+			DefaultNamespace:    "default",
+			NotifyOwners:        true,
+			NotifyExcludeKinds:  []string{"tkd.heartbeat.v1/*"},
+			NotifyExcludeOwners: []string{"bob"},
+			NotifyLink:          "https://dashboard.example.com/operations/{id}",
+			NotifyMaxAttempts:   3,
+			NotifyRetryBackoff:  10 * time.Millisecond,
+		},
+		Repo:          r,
+		UserService:   &fakeUsers{ids: map[string]string{"alice": "user-alice", "bob": "user-bob"}},
+		NotifyService: notify,
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := op.NewClient(srv.Client(), srv.URL)
+
+	fail := func(owner, kind string) string {
+		t.Helper()
+
+		res, err := client.RegisterOperation(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+			Owner:        owner,
+			Kind:         kind,
+			Description:  "nightly backup",
+			InitialState: longrunningv1.OperationState_OperationState_RUNNING,
+		}))
+		require.NoError(t, err)
+
+		_, err = client.CompleteOperation(ctx, connect.NewRequest(&longrunningv1.CompleteOperationRequest{
+			UniqueId:  res.Msg.Operation.UniqueId,
+			AuthToken: res.Msg.AuthToken,
+			Result: &longrunningv1.CompleteOperationRequest_Error{
+				Error: &longrunningv1.OperationError{Message: "disk full"},
+			},
+		}))
+		require.NoError(t, err)
+
+		return res.Msg.Operation.UniqueId
+	}
+
+	// opted out by kind, by owner and owners that are not users.
+	fail("alice", "tkd.heartbeat.v1/ping")
+	fail("bob", "tkd.backup.v1/create")
+	fail("backup-service", "tkd.backup.v1/create")
+
+	id := fail("alice", "tkd.backup.v1/create")
+
+	// the first delivery fails and is retried.
+	require.Eventually(t, func() bool { return len(notify.notifications()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	sent := notify.notifications()[0]
+	require.Equal(t, []string{"user-alice"}, sent.TargetUsers)
+
+	body := sent.GetEmail().GetBody()
+	require.Contains(t, sent.GetEmail().GetSubject(), "tkd.backup.v1/create")
+	require.Contains(t, body, "nightly backup")
+	require.Contains(t, body, "disk full")
+	require.Contains(t, body, "https://dashboard.example.com/operations/"+id)
+
+	time.Sleep(100 * time.Millisecond)
+
+	notify.l.Lock()
+	defer notify.l.Unlock()
+
+	require.Equal(t, 2, notify.calls)
+	require.Len(t, notify.sent, 1)
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// templatePollInterval is the interval at which templates are checked for
+// due occurrences. Schedules have a resolution of one minute.
+const templatePollInterval = 15 * time.Second
+
+// StartTemplates starts registering the operations of recurring templates,
+// see op.CreateTemplateProcedure. The next run of each template is stored so
+// occurrences survive restarts and are registered only once, even if
+// multiple instances are running.
+//
+// StartTemplates returns immediately, the scheduler stops once ctx is
+// cancelled.
+func (s *Service) StartTemplates(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(templatePollInterval)
+		defer ticker.Stop()
+
+		for {
+			s.materializeTemplates(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// materializeTemplates registers the operations of all due templates and
+// publishes them like operations registered by clients.
+func (s *Service) materializeTemplates(ctx context.Context) {
+	var ops []*longrunningv1.Operation
+
+	// templates that failed are not advanced and materialized again by the
+	// next poll.
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+
+		ops, err = s.repo.MaterializeDueTemplates(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueEvents(ctx, op.EventCreated, nil, ops...)
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to materialize templates", "error", err)
+		}
+
+		return
+	}
+
+	for _, pbop := range ops {
+		slog.Info("registered operation from template", "id", pbop.UniqueId, "template", pbop.Annotations[op.TemplateAnnotation], "kind", pbop.Kind)
+
+		namespace, err := s.repo.GetNamespace(ctx, pbop.UniqueId)
+		if err != nil {
+			slog.Error("failed to get namespace of operation", "error", err, "id", pbop.UniqueId)
+			continue
+		}
+
+		s.dispatch(pbop, namespace)
+	}
+}
+
+// CreateTemplate creates a recurring template on behalf of an administrator,
+// see op.CreateTemplateProcedure.
+func (s *Service) CreateTemplate(ctx context.Context, req *connect.Request[structpb.Struct], extractor auth.ExtractorFunc) (*connect.Response[structpb.Struct], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "create templates")
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := op.ParseTemplate(req.Msg)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	if tmpl.Namespace == op.AllNamespaces {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid namespace %q", tmpl.Namespace))
+	}
+
+	model := repo.Template{
+		Kind:        tmpl.Kind,
+		Owner:       tmpl.Owner,
+		Description: tmpl.Description,
+		Namespace:   tmpl.Namespace,
+		Schedule:    tmpl.Schedule,
+		TimeZone:    tmpl.TimeZone,
+		Overlap:     string(tmpl.Overlap),
+	}
+
+	for _, d := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"ttl", tmpl.TTL, &model.Ttl},
+		{"gracePeriod", tmpl.GracePeriod, &model.GracePeriod},
+		{"pendingTimeout", tmpl.PendingTimeout, &model.PendingTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+
+		*d.target, err = time.ParseDuration(d.value)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", d.name, d.value))
+		}
+	}
+
+	params := make(map[string]*structpb.Value, len(tmpl.Parameters))
+	for key, value := range tmpl.Parameters {
+		params[key], err = structpb.NewValue(value)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid parameter %q: %w", key, err))
+		}
+	}
+
+	if err := s.checkRegistrationLimits(&longrunningv1.RegisterOperationRequest{
+		Owner:       model.Owner,
+		Kind:        model.Kind,
+		Description: model.Description,
+		Parameters:  params,
+	}); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	created, err := s.repo.CreateTemplate(ctx, model, params)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	slog.Info("created template", "id", created.ID.Hex(), "kind", created.Kind, "schedule", created.Schedule, "actor", remoteUser.ID)
+
+	res, err := templateToStruct(*created)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(res), nil
+}
+
+// ListTemplates returns all templates, see op.ListTemplatesProcedure.
+func (s *Service) ListTemplates(ctx context.Context, req *connect.Request[emptypb.Empty], extractor auth.ExtractorFunc) (*connect.Response[structpb.ListValue], error) {
+	if _, err := requireAdmin(ctx, req, extractor, "list templates"); err != nil {
+		return nil, err
+	}
+
+	templates, err := s.repo.ListTemplates(ctx)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	list := &structpb.ListValue{
+		Values: make([]*structpb.Value, len(templates)),
+	}
+
+	for idx, tmpl := range templates {
+		s, err := templateToStruct(tmpl)
+		if err != nil {
+			return nil, err
+		}
+
+		list.Values[idx] = structpb.NewStructValue(s)
+	}
+
+	return connect.NewResponse(list), nil
+}
+
+// DeleteTemplate deletes a template on behalf of an administrator, see
+// op.DeleteTemplateProcedure.
+func (s *Service) DeleteTemplate(ctx context.Context, req *connect.Request[wrapperspb.StringValue], extractor auth.ExtractorFunc) (*connect.Response[emptypb.Empty], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "delete templates")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.DeleteTemplate(ctx, req.Msg.GetValue()); err != nil {
+		return nil, toConnectError(err)
+	}
+
+	slog.Info("deleted template", "id", req.Msg.GetValue(), "actor", remoteUser.ID)
+
+	return connect.NewResponse(&emptypb.Empty{}), nil
+}
+
+// templateToStruct encodes tmpl as an op.Template.
+func templateToStruct(tmpl repo.Template) (*structpb.Struct, error) {
+	res := op.Template{
+		ID:          tmpl.ID.Hex(),
+		Kind:        tmpl.Kind,
+		Owner:       tmpl.Owner,
+		Description: tmpl.Description,
+		Namespace:   tmpl.Namespace,
+		Schedule:    tmpl.Schedule,
+		TimeZone:    tmpl.TimeZone,
+		Overlap:     op.OverlapPolicy(tmpl.Overlap),
+		CreateTime:  tmpl.CreateTime,
+		NextRun:     tmpl.NextRun,
+	}
+
+	for _, d := range []struct {
+		value  time.Duration
+		target *string
+	}{
+		{tmpl.Ttl, &res.TTL},
+		{tmpl.GracePeriod, &res.GracePeriod},
+		{tmpl.PendingTimeout, &res.PendingTimeout},
+	} {
+		if d.value > 0 {
+			*d.target = d.value.String()
+		}
+	}
+
+	if tmpl.LastOperation != nil {
+		res.LastOperation = tmpl.LastOperation.Hex()
+	}
+
+	params, err := tmpl.ParameterValues()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if len(params) > 0 {
+		res.Parameters = make(map[string]any, len(params))
+		for key, value := range params {
+			res.Parameters[key] = value.AsInterface()
+		}
+	}
+
+	s, err := res.Struct()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode template: %w", err))
+	}
+
+	return s, nil
+}
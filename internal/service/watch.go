@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	eventsv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// multiWatcher receives the updates of all operations a Watch stream is
+// subscribed to. All subscriptions share the same queue which is registered
+// as a watcher of each subscribed operation.
+type multiWatcher struct {
+	queue *watchQueue
+	peer  string
+
+	// viewer is the caller of the stream, only operations that are visible to
+	// it may be subscribed.
+	viewer repo.Viewer
+
+	// diffs is nil unless the stream requested diff updates.
+	diffs *diffTracker
+
+	// subscriptions maps the subscribed operation ids to the last_update of
+	// the most recent operation that has been sent. It is only accessed by
+	// the stream itself.
+	subscriptions map[string]time.Time
+}
+
+// Watch multiplexes the updates of many operations on a single stream, see
+// op.WatchProcedure. The stream counts as a single watcher for the per-peer
+// limit while each subscription counts towards the limit of the operation.
+// op.DiffUpdatesHeader may be set to receive diff updates.
+func (s *Service) Watch(ctx context.Context, stream *connect.BidiStream[eventsv1.SubscribeRequest, longrunningv1.Operation]) error {
+	diffs, err := newDiffTracker(stream.RequestHeader())
+	if err != nil {
+		return err
+	}
+
+	w, err := s.addMultiWatcher(peerOf(stream.Peer()))
+	if err != nil {
+		return err
+	}
+	defer s.removeMultiWatcher(w)
+
+	w.diffs = diffs
+	// the extractor requires a request so the headers of the stream are
+	// copied to an empty one.
+	headers := connect.NewRequest(&emptypb.Empty{})
+	for key, values := range stream.RequestHeader() {
+		headers.Header()[key] = values
+	}
+
+	w.viewer = s.viewerOf(ctx, headers)
+
+	// send the response headers right away, clients might wait for them
+	// before subscribing.
+	if err := stream.Send(nil); err != nil {
+		return nil
+	}
+
+	requests := make(chan *eventsv1.SubscribeRequest)
+	receiveErr := make(chan error, 1)
+
+	go func() {
+		for {
+			req, err := stream.Receive()
+			if err != nil {
+				receiveErr <- err
+				return
+			}
+
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case req := <-requests:
+			switch v := req.Kind.(type) {
+			case *eventsv1.SubscribeRequest_Subscribe:
+				if err := s.subscribe(ctx, w, v.Subscribe, stream); err != nil {
+					return err
+				}
+
+			case *eventsv1.SubscribeRequest_Unsubscribe:
+				s.unsubscribe(w, v.Unsubscribe)
+			}
+
+		case <-w.queue.ready:
+			for _, update := range w.queue.take() {
+				last, ok := w.subscriptions[update.UniqueId]
+
+				// skip updates of operations that have been unsubscribed in
+				// the meantime and updates that have been received before the
+				// current state was loaded.
+				if !ok || update.LastUpdate.AsTime().Before(last) {
+					continue
+				}
+
+				if msg := w.diffs.next(update); msg != nil {
+					if err := stream.Send(msg); err != nil {
+						slog.Error("failed to publish operation update", "error", err, "uniqueId", update.UniqueId)
+
+						// If sending fails there's no need to return an error to the caller
+						return nil
+					}
+				}
+
+				w.subscriptions[update.UniqueId] = update.LastUpdate.AsTime()
+
+				if isTerminal(update.State) {
+					s.unsubscribe(w, update.UniqueId)
+				}
+			}
+
+		case <-w.queue.done:
+			return errSlowWatcher()
+
+		case err := <-receiveErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// subscribe subscribes w to the operation with the given id and sends the
+// current state of it. Subscriptions to terminal or unknown operations end
+// right away. Only errors that should end the stream are returned.
+func (s *Service) subscribe(ctx context.Context, w *multiWatcher, id string, stream *connect.BidiStream[eventsv1.SubscribeRequest, longrunningv1.Operation]) error {
+	if _, ok := w.subscriptions[id]; ok {
+		return nil
+	}
+
+	// register the watcher before loading the operation so we don't miss any
+	// update in between.
+	if err := s.watch(w, id); err != nil {
+		return err
+	}
+
+	current, err := s.repo.GetVisibleOperation(ctx, &longrunningv1.GetOperationRequest{UniqueId: id}, nil, w.viewer)
+	switch {
+	case errors.Is(err, repo.ErrNotFound), errors.Is(err, repo.ErrInvalidID):
+		s.unsubscribe(w, id)
+
+		current = &longrunningv1.Operation{
+			UniqueId: id,
+		}
+
+	case err != nil:
+		return toConnectError(err)
+	}
+
+	// the current state is always sent in full and records the snapshot diff
+	// updates are based on.
+	if _, ok := w.subscriptions[id]; ok {
+		w.diffs.next(current)
+	}
+
+	if err := stream.Send(current); err != nil {
+		slog.Error("failed to send current operation state", "error", err, "uniqueId", id)
+
+		return nil
+	}
+
+	if _, ok := w.subscriptions[id]; !ok {
+		return nil
+	}
+
+	w.subscriptions[id] = current.LastUpdate.AsTime()
+
+	if isTerminal(current.State) {
+		s.unsubscribe(w, id)
+	}
+
+	return nil
+}
+
+func (s *Service) addMultiWatcher(peer string) (*multiWatcher, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if err := s.reserveWatcher(peer, ""); err != nil {
+		return nil, err
+	}
+
+	return &multiWatcher{
+		queue:         s.newWatchQueue(),
+		peer:          peer,
+		subscriptions: make(map[string]time.Time),
+	}, nil
+}
+
+// removeMultiWatcher releases w and removes all of its subscriptions.
+func (s *Service) removeMultiWatcher(w *multiWatcher) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.releaseWatcher(w.peer)
+
+	for id := range w.subscriptions {
+		s.unwatch(id, w.queue)
+	}
+}
+
+// watch registers the queue of w as a watcher of the operation with the given
+// id, respecting the per-operation watcher limit.
+func (s *Service) watch(w *multiWatcher, id string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if err := s.checkOperationWatchers(id); err != nil {
+		return err
+	}
+
+	s.watchers[id] = append(s.watchers[id], w.queue)
+	w.subscriptions[id] = time.Time{}
+
+	return nil
+}
+
+func (s *Service) unsubscribe(w *multiWatcher, id string) {
+	if _, ok := w.subscriptions[id]; !ok {
+		return
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.unwatch(id, w.queue)
+	delete(w.subscriptions, id)
+	w.diffs.forget(id)
+}
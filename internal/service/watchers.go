@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+)
+
+// filterWatcher receives updates for all operations that match a
+// QueryOperationsRequest.
+type filterWatcher struct {
+	queue *watchQueue
+	peer  string
+
+	query        *longrunningv1.QueryOperationsRequest
+	kindPrefix   bool
+	externalRef  string
+	involvedUser string
+	tags         []string
+	paused       *bool
+
+	// viewer restricts the watcher to the operations visible to the caller.
+	viewer *repo.Viewer
+
+	// namespaces holds the namespaces the watcher is restricted to. A nil
+	// slice matches operations of all namespaces.
+	namespaces []string
+}
+
+// matches reports whether op matches the filter of the watcher. namespace is
+// only called if the watcher is restricted to a set of namespaces.
+func (w *filterWatcher) matches(op *longrunningv1.Operation, namespace func() string) bool {
+	if u := w.involvedUser; u != "" && op.Creator != u && op.Owner != u {
+		return false
+	}
+
+	if c := w.query.Creator; c != "" && op.Creator != c {
+		return false
+	}
+
+	if o := w.query.Owner; o != "" && op.Owner != o {
+		return false
+	}
+
+	if st := w.query.State; st != longrunningv1.OperationState_OperationState_UNSPECIFIED && op.State != st {
+		return false
+	}
+
+	if k := w.query.Kind; k != "" {
+		if w.kindPrefix && !strings.HasPrefix(op.Kind, k) {
+			return false
+		}
+
+		if !w.kindPrefix && op.Kind != k {
+			return false
+		}
+	}
+
+	if w.externalRef != "" && externalRefOf(op) != w.externalRef {
+		return false
+	}
+
+	if len(w.tags) > 0 {
+		tags := tagsOf(op)
+		for _, tag := range w.tags {
+			if !slices.Contains(tags, tag) {
+				return false
+			}
+		}
+	}
+
+	if w.paused != nil && isPaused(op) != *w.paused {
+		return false
+	}
+
+	if w.viewer != nil && !w.viewer.CanView(op.Owner, op.Creator, visibleToOf(op)) {
+		return false
+	}
+
+	if w.namespaces != nil && !slices.Contains(w.namespaces, namespace()) {
+		return false
+	}
+
+	return true
+}
+
+// externalRefOf returns the external reference of o, if any.
+func externalRefOf(o *longrunningv1.Operation) string {
+	return o.Annotations[op.ExternalRefAnnotation]
+}
+
+// tagsOf returns the tags of o, if any.
+func tagsOf(o *longrunningv1.Operation) []string {
+	return strings.Split(o.Annotations[op.TagsAnnotation], ",")
+}
+
+// isPaused reports whether o is paused.
+func isPaused(o *longrunningv1.Operation) bool {
+	_, ok := o.Annotations[op.PausedAtAnnotation]
+
+	return ok
+}
+
+// visibleToOf returns the additional viewers of o, if any.
+func visibleToOf(o *longrunningv1.Operation) []string {
+	if v, ok := o.Annotations[op.VisibleToAnnotation]; ok {
+		return strings.Split(v, ",")
+	}
+
+	return nil
+}
+
+// notifyWatchers notifies all watchers about the change of pbop once it has
+// been committed together with its lifecycle event, see enqueueChange. If pbop
+// terminated, the operations that depend on it are evaluated as well.
+func (s *Service) notifyWatchers(pbop *longrunningv1.Operation) {
+	// operations that depend on pbop may be started now.
+	if isTerminal(pbop.State) {
+		go s.evaluateDependents(pbop)
+	}
+
+	s.dispatch(pbop, "")
+}
+
+// warnExpiring publishes op.EventExpiring for a RUNNING operation that is
+// about to be lost and pushes it to its watchers with the
+// op.ExpiringSoonAnnotation so the owner can be alerted in time.
+func (s *Service) warnExpiring(pbop *longrunningv1.Operation) {
+	if pbop.Annotations == nil {
+		pbop.Annotations = make(map[string]string)
+	}
+
+	pbop.Annotations[op.ExpiringSoonAnnotation] = "true"
+
+	s.publishEvents(context.Background(), op.EventExpiring, nil, pbop)
+	s.dispatch(pbop, "")
+}
+
+// dispatch sends an update of op that has been handled by this instance to
+// all watchers, see deliver. The update is recorded so it is not delivered
+// again once it is received through the fan-out.
+func (s *Service) dispatch(op *longrunningv1.Operation, namespace string) {
+	s.dispatched.add(op)
+	s.deliver(op, namespace)
+}
+
+// deliver sends op to all watchers of the operation and to all filter watchers
+// that match op. If namespace is empty it is loaded from the repository, but
+// only if there's a filter watcher that needs it.
+//
+// The registry lock is only held while collecting the watchers, never while
+// sending. Sending never blocks, slow watchers are handled according to the
+// configured slow-consumer policy, see watchQueue. Watchers end their stream on
+// their own once they receive a terminal update.
+func (s *Service) deliver(op *longrunningv1.Operation, namespace string) {
+	// the manager tracks the deadline of the operation, including updates
+	// received from other instances.
+	s.observe(op)
+
+	s.l.RLock()
+	targets := slices.Clone(s.watchers[op.UniqueId])
+	filters := slices.Clone(s.filterWatchers)
+	s.l.RUnlock()
+
+	getNamespace := func() string {
+		if namespace != "" {
+			return namespace
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ns, err := s.repo.GetNamespace(ctx, op.UniqueId)
+		if err != nil {
+			slog.Error("failed to load operation namespace", "error", err, "uniqueId", op.UniqueId)
+			return ""
+		}
+
+		namespace = ns
+
+		return namespace
+	}
+
+	for _, w := range filters {
+		if w.matches(op, getNamespace) {
+			targets = append(targets, w.queue)
+		}
+	}
+
+	for _, q := range targets {
+		if q.push(op) {
+			continue
+		}
+
+		slog.Warn("watcher is too slow to receive updates", "uniqueId", op.UniqueId, "policy", q.policy)
+
+		if s.providers.Metrics != nil {
+			s.providers.Metrics.IncrSlowWatchers(string(q.policy))
+		}
+	}
+}
+
+// errSlowWatcher returns the error for watch streams that have been
+// disconnected by the config.Disconnect slow-consumer policy.
+func errSlowWatcher() error {
+	return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("watcher is too slow to receive updates"))
+}
+
+// isTerminal reports whether no further updates are expected for an operation
+// in the given state.
+func isTerminal(state longrunningv1.OperationState) bool {
+	return state == longrunningv1.OperationState_OperationState_COMPLETE || state == longrunningv1.OperationState_OperationState_LOST
+}
+
+// peerOf returns the key used to limit the number of watch streams per remote
+// peer. The port is stripped so all connections of a host share the same limit.
+func peerOf(peer connect.Peer) string {
+	addr := peer.Addr
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// reserveWatcher checks the watcher limits for peer and, if permitted, counts
+// the new watcher. If id is empty, only the peer limit is checked.
+// The caller must hold s.l.
+func (s *Service) reserveWatcher(peer string, id string) error {
+	cfg := s.providers.Config
+
+	if limit := cfg.MaxWatchersPerPeer; limit > 0 && s.peerWatchers[peer] >= limit {
+		return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("too many concurrent watch streams"))
+	}
+
+	if id != "" {
+		if err := s.checkOperationWatchers(id); err != nil {
+			return err
+		}
+	}
+
+	s.peerWatchers[peer]++
+	s.recordWatchers(1)
+
+	return nil
+}
+
+// checkOperationWatchers checks the watcher limit of the operation with the
+// given id. The caller must hold s.l.
+func (s *Service) checkOperationWatchers(id string) error {
+	if limit := s.providers.Config.MaxWatchersPerOperation; limit > 0 && len(s.watchers[id]) >= limit {
+		return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("too many concurrent watch streams for operation %q", id))
+	}
+
+	return nil
+}
+
+// releaseWatcher releases a watcher reserved using reserveWatcher.
+// The caller must hold s.l.
+func (s *Service) releaseWatcher(peer string) {
+	if s.peerWatchers[peer]--; s.peerWatchers[peer] <= 0 {
+		delete(s.peerWatchers, peer)
+	}
+
+	s.recordWatchers(-1)
+}
+
+// recordWatchers updates the active-watchers gauge by delta.
+// The caller must hold s.l.
+func (s *Service) recordWatchers(delta int) {
+	s.activeWatchers += delta
+
+	if s.providers.Metrics != nil {
+		s.providers.Metrics.SetActiveWatchers(s.activeWatchers)
+	}
+}
+
+// newWatchQueue returns a new queue for a watcher using the configured buffer
+// size and slow-consumer policy.
+func (s *Service) newWatchQueue() *watchQueue {
+	cfg := s.providers.Config
+
+	return newWatchQueue(cfg.WatchBufferSize, cfg.WatchSlowConsumerPolicy)
+}
+
+func (s *Service) addWatcher(peer string, id string) (*watchQueue, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if err := s.reserveWatcher(peer, id); err != nil {
+		return nil, err
+	}
+
+	q := s.newWatchQueue()
+	s.watchers[id] = append(s.watchers[id], q)
+
+	return q, nil
+}
+
+func (s *Service) removeWatcher(peer string, id string, q *watchQueue) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.releaseWatcher(peer)
+	s.unwatch(id, q)
+}
+
+// unwatch removes q from the watchers of the operation with the given id.
+// The caller must hold s.l.
+func (s *Service) unwatch(id string, q *watchQueue) {
+	// the entry might already be gone if the operation reached a terminal state.
+	m := slices.DeleteFunc(s.watchers[id], func(w *watchQueue) bool {
+		return w == q
+	})
+
+	if len(m) == 0 {
+		delete(s.watchers, id)
+	} else {
+		s.watchers[id] = m
+	}
+}
+
+// addFilterWatcher registers a new filter watcher for query and the
+// InvolvedUser, Namespaces, KindPrefix and ExternalRef options of opts. Filter watchers must
+// be removed using removeFilterWatcher.
+func (s *Service) addFilterWatcher(peer string, query *longrunningv1.QueryOperationsRequest, opts repo.QueryOptions) (*filterWatcher, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if err := s.reserveWatcher(peer, ""); err != nil {
+		return nil, err
+	}
+
+	w := &filterWatcher{
+		queue:        s.newWatchQueue(),
+		peer:         peer,
+		query:        query,
+		kindPrefix:   opts.KindPrefix,
+		externalRef:  opts.ExternalRef,
+		involvedUser: opts.InvolvedUser,
+		tags:         opts.Tags,
+		paused:       opts.Paused,
+		viewer:       opts.Viewer,
+		namespaces:   opts.Namespaces,
+	}
+
+	s.filterWatchers = append(s.filterWatchers, w)
+
+	return w, nil
+}
+
+func (s *Service) removeFilterWatcher(w *filterWatcher) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.releaseWatcher(w.peer)
+
+	s.filterWatchers = slices.DeleteFunc(s.filterWatchers, func(other *filterWatcher) bool {
+		return other == w
+	})
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/tierklinik-dobersberg/apis/pkg/auth"
+	"github.com/tierklinik-dobersberg/longrunning-service/internal/repo"
+	"github.com/tierklinik-dobersberg/longrunning-service/pkg/op"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// webhookBatchSize is the maximum number of deliveries claimed at once.
+	webhookBatchSize = 50
+
+	// webhookLease is how long claimed deliveries are reserved for this
+	// instance. It must be long enough to attempt a whole batch.
+	webhookLease = 15 * time.Minute
+
+	// webhookPollInterval is the interval at which pending deliveries are
+	// checked for retries and deliveries of other instances.
+	webhookPollInterval = 10 * time.Second
+)
+
+var errWebhookDisabled = errors.New("webhook has been disabled")
+
+// StartWebhooks starts delivering the lifecycle events that have been stored
+// for webhooks, see publishEvents. Each delivery is retried independently
+// with an exponential backoff between WebhookMinBackoff and WebhookMaxBackoff
+// so a failing endpoint does not delay the deliveries of other webhooks.
+//
+// StartWebhooks returns immediately, the dispatcher stops once ctx is
+// cancelled.
+func (s *Service) StartWebhooks(ctx context.Context) {
+	go func() {
+		for {
+			n, err := s.drainWebhooks(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+
+			wait := webhookPollInterval
+			switch {
+			case err != nil:
+				slog.Error("failed to deliver webhooks", "error", err)
+
+			// there might be more deliveries waiting.
+			case n == webhookBatchSize:
+				wait = 0
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.webhookWake:
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// drainWebhooks claims a batch of deliveries and attempts each of them once.
+func (s *Service) drainWebhooks(ctx context.Context) (int, error) {
+	deliveries, err := s.repo.ClaimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+	if err != nil || len(deliveries) == 0 {
+		return 0, err
+	}
+
+	list, err := s.repo.ListWebhooks(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	hooks := make(map[primitive.ObjectID]repo.Webhook, len(list))
+	for _, hook := range list {
+		hooks[hook.ID] = hook
+	}
+
+	for _, d := range deliveries {
+		hook, ok := hooks[d.WebhookID]
+
+		switch {
+		// the webhook has been deleted after the delivery has been claimed.
+		case !ok:
+			err = s.repo.MarkWebhookDelivered(ctx, d)
+
+		case hook.Disabled:
+			err = s.repo.DiscardWebhookDelivery(ctx, d, errWebhookDisabled)
+
+		default:
+			err = s.attemptWebhook(ctx, hook, d)
+			if err == nil {
+				continue
+			}
+
+			if disabled := s.webhookFailed(ctx, hook, d, err); disabled {
+				hook.Disabled = true
+				hooks[hook.ID] = hook
+			}
+
+			err = nil
+		}
+
+		if err != nil {
+			slog.Error("failed to update webhook delivery", "error", err, "id", d.ID.Hex())
+		}
+	}
+
+	return len(deliveries), nil
+}
+
+// attemptWebhook posts the event of d to hook and marks d as delivered.
+func (s *Service) attemptWebhook(ctx context.Context, hook repo.Webhook, d repo.WebhookDelivery) error {
+	body, err := protojson.Marshal(d.Event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(op.WebhookSignatureHeader, op.SignWebhook(hook.Secret, body))
+	req.Header.Set(op.WebhookEventHeader, string(d.Event.MessageName()))
+	req.Header.Set(op.WebhookDeliveryHeader, d.ID.Hex())
+
+	res, err := s.webhookCli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// drain the body so the connection can be re-used.
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	// if this fails, the event will be delivered again once the lease
+	// expired.
+	if err := s.repo.MarkWebhookDelivered(ctx, d); err != nil {
+		slog.Error("failed to mark webhook delivery as delivered", "error", err, "id", d.ID.Hex())
+	}
+
+	return nil
+}
+
+// webhookFailed records the failed delivery attempt of d and reports whether
+// hook has been disabled because of it.
+func (s *Service) webhookFailed(ctx context.Context, hook repo.Webhook, d repo.WebhookDelivery, deliveryErr error) bool {
+	cfg := s.providers.Config
+
+	if s.providers.Metrics != nil {
+		s.providers.Metrics.IncrWebhookFailures()
+	}
+
+	minBackoff := cfg.WebhookMinBackoff
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+
+	backoff := minBackoff << min(d.Attempts, 16)
+	if cfg.WebhookMaxBackoff > 0 {
+		backoff = min(backoff, max(cfg.WebhookMaxBackoff, minBackoff))
+	}
+
+	slog.Warn("failed to deliver webhook", "error", deliveryErr, "webhook", hook.ID.Hex(), "url", hook.URL, "delivery", d.ID.Hex(), "attempt", d.Attempts+1)
+
+	if cfg.WebhookMaxAttempts > 0 && d.Attempts+1 >= cfg.WebhookMaxAttempts {
+		slog.Error("giving up on webhook delivery, moving it to the dead-letter log", "webhook", hook.ID.Hex(), "delivery", d.ID.Hex())
+	}
+
+	disabled, err := s.repo.MarkWebhookFailed(ctx, d, deliveryErr, time.Now().Add(backoff), cfg.WebhookMaxAttempts, cfg.WebhookDisableAfter)
+	if err != nil {
+		slog.Error("failed to record failed webhook delivery", "error", err, "id", d.ID.Hex())
+	}
+
+	if disabled {
+		slog.Error("disabled webhook after too many failed deliveries", "webhook", hook.ID.Hex(), "url", hook.URL)
+	}
+
+	return disabled
+}
+
+// wakeWebhooks notifies the webhook dispatcher about new deliveries.
+func (s *Service) wakeWebhooks() {
+	select {
+	case s.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// CreateWebhook creates a webhook on behalf of an administrator, see
+// op.CreateWebhookProcedure.
+func (s *Service) CreateWebhook(ctx context.Context, req *connect.Request[structpb.Struct], extractor auth.ExtractorFunc) (*connect.Response[structpb.Struct], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "create webhooks")
+	if err != nil {
+		return nil, err
+	}
+
+	hook, err := op.ParseWebhook(req.Msg)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	events := make([]string, len(hook.Events))
+	for idx, evt := range hook.Events {
+		events[idx] = string(evt)
+	}
+
+	created, err := s.repo.CreateWebhook(ctx, repo.Webhook{
+		Kind:   hook.Kind,
+		URL:    hook.URL,
+		Secret: hook.Secret,
+		Events: events,
+	})
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	slog.Info("created webhook", "id", created.ID.Hex(), "url", created.URL, "kind", created.Kind, "actor", remoteUser.ID)
+
+	res, err := webhookToStruct(*created)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(res), nil
+}
+
+// ListWebhooks returns all webhooks, see op.ListWebhooksProcedure.
+func (s *Service) ListWebhooks(ctx context.Context, req *connect.Request[emptypb.Empty], extractor auth.ExtractorFunc) (*connect.Response[structpb.ListValue], error) {
+	if _, err := requireAdmin(ctx, req, extractor, "list webhooks"); err != nil {
+		return nil, err
+	}
+
+	hooks, err := s.repo.ListWebhooks(ctx)
+	if err != nil {
+		return nil, toConnectError(err)
+	}
+
+	list := &structpb.ListValue{
+		Values: make([]*structpb.Value, len(hooks)),
+	}
+
+	for idx, hook := range hooks {
+		s, err := webhookToStruct(hook)
+		if err != nil {
+			return nil, err
+		}
+
+		list.Values[idx] = structpb.NewStructValue(s)
+	}
+
+	return connect.NewResponse(list), nil
+}
+
+// DeleteWebhook deletes a webhook on behalf of an administrator, see
+// op.DeleteWebhookProcedure.
+func (s *Service) DeleteWebhook(ctx context.Context, req *connect.Request[wrapperspb.StringValue], extractor auth.ExtractorFunc) (*connect.Response[emptypb.Empty], error) {
+	remoteUser, err := requireAdmin(ctx, req, extractor, "delete webhooks")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.DeleteWebhook(ctx, req.Msg.GetValue()); err != nil {
+		return nil, toConnectError(err)
+	}
+
+	slog.Info("deleted webhook", "id", req.Msg.GetValue(), "actor", remoteUser.ID)
+
+	return connect.NewResponse(&emptypb.Empty{}), nil
+}
+
+// webhookToStruct encodes hook as an op.Webhook without the secret.
+func webhookToStruct(hook repo.Webhook) (*structpb.Struct, error) {
+	events := make([]op.EventType, len(hook.Events))
+	for idx, evt := range hook.Events {
+		events[idx] = op.EventType(evt)
+	}
+
+	s, err := op.Webhook{
+		ID:         hook.ID.Hex(),
+		Kind:       hook.Kind,
+		URL:        hook.URL,
+		Events:     events,
+		CreateTime: hook.CreateTime,
+		Failures:   hook.Failures,
+		Disabled:   hook.Disabled,
+		LastError:  hook.LastError,
+	}.Struct()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to encode webhook: %w", err))
+	}
+
+	return s, nil
+}
@@ -0,0 +1,801 @@
+package op
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Request headers that are used to pass additional options to the
+// LongRunningService which are not (yet) part of the API definition.
+const (
+	// PendingTimeoutHeader may be set on a RegisterOperation request and
+	// specifies the duration (in time.ParseDuration format) after which an
+	// operation that is still in state PENDING will be marked as lost.
+	PendingTimeoutHeader = "X-Pending-Timeout"
+
+	// MaxRuntimeHeader may be set on a RegisterOperation request and
+	// specifies the duration (in time.ParseDuration format) after which the
+	// operation is completed with an error, even if it is still updated. The
+	// error details hold ReasonMaxRuntimeExceeded. The remaining runtime is
+	// reported in the RemainingRuntimeAnnotation so workers can wind down in
+	// time. If not set, the default of the kind is used.
+	MaxRuntimeHeader = "X-Max-Runtime"
+
+	// RetryMaxAttemptsHeader may be set on a RegisterOperation request and
+	// holds the total number of attempts (including the first one) of the
+	// operation, see WithRetryPolicy. Once an attempt is LOST, the service
+	// registers a PENDING successor with the same registration that workers
+	// take over using AcquireOperationProcedure. RetryBackoffHeader holds the
+	// delay (in time.ParseDuration format) before the second attempt is
+	// started, it is doubled for each further attempt. Attempts are linked by
+	// the RootOperationAnnotation and NextAttemptAnnotation.
+	RetryMaxAttemptsHeader = "X-Retry-Max-Attempts"
+	RetryBackoffHeader     = "X-Retry-Backoff"
+
+	// ReadMaskHeader may be set on GetOperation and QueryOperations requests
+	// and holds a comma separated list of longrunningv1.Operation field paths
+	// that should be returned.
+	ReadMaskHeader = "X-Read-Mask"
+
+	// InvolvedUserHeader may be set on QueryOperations requests to only return
+	// operations where the specified user is either the creator or the owner.
+	// It must not be combined with the creator filter of the request.
+	InvolvedUserHeader = "X-Involved-User"
+
+	// LastUpdateBeforeHeader may be set on QueryOperations requests to only
+	// return operations that have not been updated since the specified time
+	// (in RFC3339 format).
+	LastUpdateBeforeHeader = "X-Last-Update-Before"
+
+	// LastUpdateAgeHeader may be set on QueryOperations requests to only return
+	// operations that have not been updated for at least the specified duration.
+	// It must not be combined with LastUpdateBeforeHeader.
+	LastUpdateAgeHeader = "X-Last-Update-Age"
+
+	// NamespaceHeader may be set on RegisterOperation requests to specify the
+	// namespace of the operation and on QueryOperations requests to select the
+	// namespace that should be queried. Use AllNamespaces to query all
+	// namespaces. Querying a namespace other than the default namespace
+	// requires administrative privileges.
+	NamespaceHeader = "X-Namespace"
+
+	// KindPrefixHeader may be set to "true" on QueryOperations, WatchOperations
+	// and ListOperationsStream requests to match the kind of the request as a
+	// prefix instead of an exact value, e.g. "tkd.backup.v1/" matches all
+	// operations of the backup service.
+	KindPrefixHeader = "X-Kind-Prefix"
+
+	// ExternalRefHeader may be set on RegisterOperation requests to assign a
+	// client supplied reference (like an import batch id) to the operation.
+	// Only one operation per kind may be registered with the same reference
+	// until it completes or is lost. On QueryOperations and ListOperationsStream
+	// requests it restricts the result to operations with that reference.
+	// On GetOperation, WatchOperation and WaitForCompletion requests the
+	// unique_id of the request is interpreted as the kind and the most
+	// recent operation with that kind and reference is returned.
+	ExternalRefHeader = "X-External-Ref"
+
+	// DependsOnHeader may be set on RegisterOperation requests and holds a comma
+	// separated list of operation ids that must complete successfully before
+	// the operation is started. Such operations are registered as PENDING and
+	// switched to RUNNING by the service. If a dependency fails or is lost,
+	// the operation is completed with an error that references the dependency.
+	DependsOnHeader = "X-Depends-On"
+
+	// AuthTokenHeader holds the auth token of the operation when adding
+	// attachments, see AttachmentsPath, or requesting cancellation, see
+	// CancelOperationProcedure.
+	AuthTokenHeader = "X-Auth-Token"
+
+	// AttachmentURLHeader may be set when adding an attachment to record an
+	// attachment that is stored at an external URL instead of uploading it's
+	// content. AttachmentSizeHeader may be used to specify it's size in bytes.
+	AttachmentURLHeader  = "X-Attachment-URL"
+	AttachmentSizeHeader = "X-Attachment-Size"
+
+	// ResumeHeader may be set to "true" on UpdateOperation, Heartbeat and
+	// CompleteOperation requests. Mutations of LOST operations are rejected with
+	// CodeFailedPrecondition unless this header is set in which case the
+	// operation is switched back to RUNNING before the mutation is applied.
+	ResumeHeader = "X-Resume"
+
+	// SuppressDuplicatesHeader may be set on RegisterOperation requests and
+	// specifies a duration (in time.ParseDuration format). If an active
+	// operation of the same namespace, kind, owner and parameters has been
+	// registered within that duration, it is returned instead of registering a
+	// new one. See DeduplicatedHeader.
+	SuppressDuplicatesHeader = "X-Suppress-Duplicates-Within"
+
+	// DeduplicatedHeader is set to "true" on RegisterOperation responses if an
+	// existing operation has been returned because of the
+	// SuppressDuplicatesHeader. The response does not hold an auth token in
+	// that case so the caller must neither update nor complete the operation.
+	DeduplicatedHeader = "X-Deduplicated"
+
+	// AllowNoExpiryHeader may be set to "true" on RegisterOperation requests
+	// to permit an explicit TTL of zero, see WithNoExpiry. Such operations are
+	// never marked as lost because of missing updates and carry the
+	// NoExpiryAnnotation. Without the header, an explicit zero TTL is rejected
+	// with CodeInvalidArgument unless the service allows it for all
+	// registrations. An absent TTL always falls back to the default.
+	AllowNoExpiryHeader = "X-Allow-No-Expiry"
+
+	// ValidateOnlyHeader may be set to "true" on RegisterOperation requests to
+	// run all checks of the registration, including quotas and the uniqueness
+	// of the external reference, without registering the operation, see
+	// WithValidateOnly. The response holds the operation with all defaults
+	// applied but neither a unique_id nor an auth token and has the header
+	// set to "true" as well.
+	ValidateOnlyHeader = "X-Validate-Only"
+
+	// KindPatternHeader is set on GetKindDefaults responses and holds the kind
+	// pattern of the per-kind defaults that apply, if any.
+	KindPatternHeader = "X-Kind-Pattern"
+
+	// DashboardWindowHeader may be set on GetDashboard requests and specifies
+	// the time window (in time.ParseDuration format) of the dashboard. It
+	// defaults to 24 hours.
+	DashboardWindowHeader = "X-Dashboard-Window"
+
+	// DashboardLimitsHeader may be set on GetDashboard requests and holds a
+	// comma separated list of section limits like "failed=10,lost=0,running=5"
+	// where the sections are the values of DashboardSectionAnnotation.
+	// Sections with a limit of zero are omitted, sections that are not
+	// specified default to 10 operations.
+	DashboardLimitsHeader = "X-Dashboard-Limits"
+
+	// StateCountsHeader is set on GetDashboard responses and holds a comma
+	// separated list of the operation counts per state like
+	// "OperationState_RUNNING=3,OperationState_LOST=1".
+	StateCountsHeader = "X-State-Counts"
+
+	// WaitTimeoutHeader may be set on WaitForCompletion requests and specifies
+	// the maximum duration (in time.ParseDuration format) to wait for the
+	// operation to complete.
+	WaitTimeoutHeader = "X-Wait-Timeout"
+
+	// LinkHeader holds a JSON encoded Link. It may be set multiple times on
+	// RegisterOperation requests to add links to the new operation, see
+	// WithLinks, and must be set on AddLinkProcedure requests.
+	LinkHeader = "X-Link"
+
+	// TagsHeader holds a comma separated list of tags. It must be set on
+	// AddTagsProcedure and RemoveTagsProcedure requests and may be set on
+	// QueryOperations and WatchOperations requests to only return operations
+	// that have all of the tags. Tags are trimmed and lowercased.
+	TagsHeader = "X-Tags"
+
+	// DiffUpdatesHeader may be set to "true" on WatchOperation,
+	// WatchOperations and Watch requests to receive diff updates. The first
+	// message of each operation and terminal updates hold the full operation,
+	// all other updates only hold the unique_id, the state and the fields that
+	// changed since the previous message, see ChangedFieldsAnnotation and
+	// ApplyDiff.
+	DiffUpdatesHeader = "X-Diff-Updates"
+
+	// VisibleToHeader may be set on RegisterOperation requests and holds a
+	// comma separated list of user IDs. The operation is then only visible to
+	// its owner, its creator, the listed users and administrators. Operations
+	// registered without it are visible to everyone. See WithVisibleTo.
+	VisibleToHeader = "X-Visible-To"
+
+	// PauseHeader may be set on UpdateOperation requests to pause ("true") or
+	// un-pause ("false") the operation. Paused operations stay RUNNING, since
+	// there is no dedicated state, but are marked with the
+	// PausedAtAnnotation and are never considered lost. Un-pausing resets
+	// the last_update so the TTL starts fresh. Only operations that are
+	// RUNNING after the update may be paused, paused operations can still be
+	// completed or cancelled.
+	PauseHeader = "X-Pause"
+
+	// MergeAnnotationsHeader may be set to "true" on UpdateOperation requests
+	// that select the "annotations" path. The annotations of the request are
+	// then combined with the stored ones instead of replacing all of them,
+	// keys with an empty value are removed. This lets multiple components
+	// maintain their own annotations of the same operation.
+	MergeAnnotationsHeader = "X-Merge-Annotations"
+
+	// PercentDoneHeader and StatusMessageHeader may be set on
+	// RegisterOperation requests to specify the initial percent_done and
+	// status_message of the operation, see WithProgress. They are validated
+	// just like updates.
+	PercentDoneHeader   = "X-Percent-Done"
+	StatusMessageHeader = "X-Status-Message"
+
+	// PriorityHeader may be set on RegisterOperation requests and on
+	// UpdateOperation requests (with the auth token) and holds the
+	// non-negative priority of the operation, see WithPriority. Higher values
+	// are more important, the default priority is zero.
+	PriorityHeader = "X-Priority"
+
+	// StartTimeHeader may be set on RegisterOperation requests and holds the
+	// time (in RFC3339 format) the operation is scheduled for, see
+	// WithStartTime. Until then, the operation is PENDING, marked with the
+	// ScheduledAnnotation and never considered lost. Once due, the operation
+	// stays PENDING, or is switched to RUNNING if it has been registered with
+	// that initial state, and watchers are notified. Scheduled operations
+	// cannot depend on other operations.
+	StartTimeHeader = "X-Start-Time"
+
+	// DueBeforeHeader may be set on QueryOperations requests to only return
+	// scheduled operations with a start time before or at the specified time
+	// (in RFC3339 format).
+	DueBeforeHeader = "X-Due-Before"
+
+	// RootOperationHeader may be set on QueryOperations requests and holds the
+	// id of the first attempt of an operation with a retry policy. Only the
+	// attempts of that operation are returned, ordered by attempt.
+	RootOperationHeader = "X-Root-Operation"
+
+	// SortHeader may be set on QueryOperations requests to select the sort
+	// order of the result. Supported values are SortByCreateTime (the
+	// default) and SortByPriority.
+	SortHeader = "X-Sort"
+
+	// PausedHeader may be set on QueryOperations and WatchOperations requests
+	// to only return operations that are ("true") or are not ("false")
+	// paused.
+	PausedHeader = "X-Paused"
+
+	// AllNamespaces may be used as the value of NamespaceHeader to query
+	// operations of all namespaces.
+	AllNamespaces = "*"
+)
+
+// Annotations that are computed by the LongRunningService when returning
+// operations. They are never stored.
+const (
+	// LostInAnnotation holds the remaining time (in time.Duration format) until
+	// a RUNNING operation is marked as lost if it is not updated. The value is
+	// negative if the deadline has already passed.
+	LostInAnnotation = "tkd.longrunning.v1/lost-in"
+
+	// NoExpiryAnnotation is set to "true" on operations that have been
+	// registered with a TTL of zero and thus never expire, see
+	// AllowNoExpiryHeader.
+	NoExpiryAnnotation = "tkd.longrunning.v1/no-expiry"
+
+	// RuntimeDeadlineAnnotation holds the time (in RFC3339 format) at which
+	// the operation exceeds its maximum runtime, see MaxRuntimeHeader.
+	// RemainingRuntimeAnnotation holds the remaining time until then (in
+	// time.Duration format) as long as the operation is neither COMPLETE nor
+	// LOST.
+	RuntimeDeadlineAnnotation  = "tkd.longrunning.v1/runtime-deadline"
+	RemainingRuntimeAnnotation = "tkd.longrunning.v1/remaining-runtime"
+
+	// CancelRequestedAnnotation is set to "true" once cancellation of the
+	// operation has been requested using CancelOperationProcedure. Workers
+	// should wind down and complete the operation as soon as possible.
+	CancelRequestedAnnotation = "tkd.longrunning.v1/cancel-requested"
+
+	// CancelRequestedByAnnotation holds the ID of the user that requested
+	// cancellation, if known.
+	CancelRequestedByAnnotation = "tkd.longrunning.v1/cancel-requested-by"
+
+	// CancelRequestedAtAnnotation holds the time (in RFC3339 format) at which
+	// cancellation has been requested.
+	CancelRequestedAtAnnotation = "tkd.longrunning.v1/cancel-requested-at"
+
+	// ExternalRefAnnotation holds the external reference the operation has
+	// been registered with, see ExternalRefHeader.
+	ExternalRefAnnotation = "tkd.longrunning.v1/external-ref"
+
+	// DependsOnAnnotation holds a comma separated list of the operation ids
+	// the operation depends on, see DependsOnHeader.
+	DependsOnAnnotation = "tkd.longrunning.v1/depends-on"
+
+	// AttachmentsAnnotation holds the JSON encoded list of attachments of the
+	// operation, see ParseAttachments.
+	AttachmentsAnnotation = "tkd.longrunning.v1/attachments"
+
+	// EstimatedCompletionAnnotation holds the estimated time (in RFC3339
+	// format) at which the operation reaches 100 percent, based on the rate of
+	// its recent percent_done updates. It is not set for terminal operations
+	// or if the progress did not increase recently.
+	EstimatedCompletionAnnotation = "tkd.longrunning.v1/estimated-completion"
+
+	// DashboardSectionAnnotation is set on the operations returned by
+	// GetDashboardProcedure and holds the section the operation belongs to,
+	// either DashboardFailed, DashboardLost or DashboardRunning.
+	DashboardSectionAnnotation = "tkd.longrunning.v1/dashboard-section"
+
+	// AgeAnnotation is set on the running operations returned by
+	// GetDashboardProcedure and holds the time (in time.Duration format) since
+	// the operation has been created.
+	AgeAnnotation = "tkd.longrunning.v1/age"
+
+	// LastUpdatedByAnnotation holds the ID of the user that performed the last
+	// update, completion or resumption of the operation, if known.
+	LastUpdatedByAnnotation = "tkd.longrunning.v1/last-updated-by"
+
+	// AuditAnnotation holds the JSON encoded audit log of the operation, see
+	// ParseAudit.
+	AuditAnnotation = "tkd.longrunning.v1/audit"
+
+	// ResultOriginalSizeAnnotation holds the serialized size in bytes of the
+	// result the operation has been completed with if the result message has
+	// been truncated by the service.
+	ResultOriginalSizeAnnotation = "tkd.longrunning.v1/result-original-size"
+
+	// NotesAnnotation holds the JSON encoded list of notes that users added
+	// to the operation, see AddNoteProcedure and ParseNotes.
+	NotesAnnotation = "tkd.longrunning.v1/notes"
+
+	// TagsAnnotation holds a comma separated list of the tags of the
+	// operation, see TagsHeader.
+	TagsAnnotation = "tkd.longrunning.v1/tags"
+
+	// LinksAnnotation holds the JSON encoded list of links of the operation,
+	// see ParseLinks.
+	LinksAnnotation = "tkd.longrunning.v1/links"
+
+	// ChangedFieldsAnnotation is set on the diff updates of watch streams and
+	// holds a comma separated list of the (proto) names of the top-level
+	// fields that changed, see DiffUpdatesHeader. If the annotations changed,
+	// the update holds all of them.
+	ChangedFieldsAnnotation = "tkd.longrunning.v1/changed-fields"
+
+	// VisibleToAnnotation holds a comma separated list of the IDs of the
+	// users that may see the operation in addition to its owner and creator,
+	// see VisibleToHeader.
+	VisibleToAnnotation = "tkd.longrunning.v1/visible-to"
+
+	// PausedAtAnnotation holds the time (in RFC3339 format) at which the
+	// operation has been paused, see PauseHeader. It is only set on RUNNING
+	// operations.
+	PausedAtAnnotation = "tkd.longrunning.v1/paused-at"
+
+	// PriorityAnnotation holds the priority of the operation if it is not the
+	// default one, see PriorityHeader.
+	PriorityAnnotation = "tkd.longrunning.v1/priority"
+
+	// StartTimeAnnotation holds the time (in RFC3339 format) the operation
+	// has been scheduled for, see StartTimeHeader. ScheduledAnnotation is set
+	// to "true" while the operation waits for its start time.
+	StartTimeAnnotation = "tkd.longrunning.v1/start-time"
+	ScheduledAnnotation = "tkd.longrunning.v1/scheduled"
+
+	// TemplateAnnotation holds the id of the Template the operation has been
+	// created from.
+	TemplateAnnotation = "tkd.longrunning.v1/template"
+
+	// AttemptAnnotation and MaxAttemptsAnnotation hold the attempt number of
+	// an operation with a retry policy and the total number of attempts, see
+	// RetryMaxAttemptsHeader. RootOperationAnnotation holds the id of the
+	// first attempt and NextAttemptAnnotation the id of the successor once
+	// the operation has been retried.
+	AttemptAnnotation       = "tkd.longrunning.v1/attempt"
+	MaxAttemptsAnnotation   = "tkd.longrunning.v1/max-attempts"
+	RootOperationAnnotation = "tkd.longrunning.v1/root-operation"
+	NextAttemptAnnotation   = "tkd.longrunning.v1/next-attempt"
+
+	// ExpiringSoonAnnotation is set to "true" on the update that is pushed to
+	// watchers when a RUNNING operation has not been updated for most of its
+	// TTL and grace period, see EventExpiring. It is gone with the next
+	// update of the operation.
+	ExpiringSoonAnnotation = "tkd.longrunning.v1/expiring-soon"
+
+	// PendingLossSinceAnnotation holds the time (in RFC3339 format) at which
+	// the manager detected that the operation would be lost, see
+	// GetPendingLossesProcedure.
+	PendingLossSinceAnnotation = "tkd.longrunning.v1/pending-loss-since"
+
+	// ExitCodeAnnotation is set by lrun to the exit code of the wrapped
+	// command, 128 plus the signal number if it has been killed by a signal.
+	// ExitSignalAnnotation holds the name of that signal.
+	ExitCodeAnnotation   = "tkd.longrunning.v1/exit-code"
+	ExitSignalAnnotation = "tkd.longrunning.v1/exit-signal"
+
+	// ExitCodesAnnotation is set by lrun --retries to the comma separated
+	// exit codes of all attempts of the command, the last one is the
+	// ExitCodeAnnotation.
+	ExitCodesAnnotation = "tkd.longrunning.v1/exit-codes"
+
+	// ResultWarningAnnotation is set by lrun --result-from if the result of
+	// the command could not be read, like when it is not valid JSON. It
+	// holds the reason, the operation is completed without a result then.
+	ResultWarningAnnotation = "tkd.longrunning.v1/result-warning"
+)
+
+// Annotations that lrun sets on its operations to identify where the command
+// runs, unless disabled using --no-auto-annotations. Annotations with the
+// LrunAnnotationPrefix cannot be passed to lrun using --annotation.
+const (
+	LrunAnnotationPrefix = "lrun.tkd.longrunning.v1/"
+
+	// LrunHostAnnotation holds the hostname of the machine and
+	// LrunUserAnnotation the name of the OS user that runs lrun.
+	LrunHostAnnotation = LrunAnnotationPrefix + "host"
+	LrunUserAnnotation = LrunAnnotationPrefix + "user"
+
+	// LrunPIDAnnotation holds the process id of the command once it has been
+	// started.
+	LrunPIDAnnotation = LrunAnnotationPrefix + "pid"
+
+	// LrunVersionAnnotation holds the version of lrun.
+	LrunVersionAnnotation = LrunAnnotationPrefix + "version"
+
+	// StdoutBytesAnnotation and StderrBytesAnnotation are set by lrun to the
+	// total number of bytes the command wrote to stdout and stderr. Only the
+	// beginning and the end of larger outputs are part of the completion.
+	StdoutBytesAnnotation = "tkd.longrunning.v1/stdout-bytes"
+	StderrBytesAnnotation = "tkd.longrunning.v1/stderr-bytes"
+)
+
+// Sort orders of QueryOperations, see SortHeader.
+const (
+	// SortByCreateTime returns the most recently created operations first.
+	SortByCreateTime = "create_time"
+
+	// SortByPriority returns the operations with the highest priority first
+	// and operations of the same priority by SortByCreateTime.
+	SortByPriority = "priority"
+)
+
+// Sections of the dashboard, see DashboardSectionAnnotation.
+const (
+	DashboardFailed  = "failed"
+	DashboardLost    = "lost"
+	DashboardRunning = "running"
+)
+
+// RedactedValue replaces the values of parameters and annotations that the
+// caller is not permitted to see.
+const RedactedValue = "[redacted]"
+
+// WithNamespace sets the namespace of the operation.
+func WithNamespace(ns string) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(NamespaceHeader, ns)
+	}
+}
+
+// WithSuppressDuplicates returns an existing operation of the same kind, owner
+// and parameters that has been registered within d instead of registering a
+// new one, see SuppressDuplicatesHeader.
+func WithSuppressDuplicates(d time.Duration) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(SuppressDuplicatesHeader, d.String())
+	}
+}
+
+// WithExternalRef sets the external reference of the operation.
+func WithExternalRef(ref string) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(ExternalRefHeader, ref)
+	}
+}
+
+// WithDependsOn sets the operations that must complete successfully before the
+// operation is started.
+func WithDependsOn(ids ...string) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(DependsOnHeader, strings.Join(ids, ","))
+	}
+}
+
+// WithPendingTimeout sets the timeout after which the operation is marked as
+// lost if it has not been switched to RUNNING.
+func WithPendingTimeout(d time.Duration) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(PendingTimeoutHeader, d.String())
+	}
+}
+
+// WithMaxRuntime sets the maximum runtime after which the operation is
+// completed with an error, see MaxRuntimeHeader.
+func WithMaxRuntime(d time.Duration) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(MaxRuntimeHeader, d.String())
+	}
+}
+
+// WithValidateOnly validates the registration without registering the
+// operation, see ValidateOnlyHeader.
+func WithValidateOnly() Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(ValidateOnlyHeader, "true")
+	}
+}
+
+// WithNoExpiry registers the operation with a TTL of zero so it is never
+// marked as lost, see AllowNoExpiryHeader.
+func WithNoExpiry() Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Msg.Ttl = durationpb.New(0)
+		req.Header().Set(AllowNoExpiryHeader, "true")
+	}
+}
+
+// WithRetryPolicy registers a successor of the operation once it is lost
+// until maxAttempts attempts have been made, see RetryMaxAttemptsHeader.
+func WithRetryPolicy(maxAttempts int, backoff time.Duration) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(RetryMaxAttemptsHeader, strconv.Itoa(maxAttempts))
+
+		if backoff > 0 {
+			req.Header().Set(RetryBackoffHeader, backoff.String())
+		}
+	}
+}
+
+// WithProgress sets the initial percent_done and status_message of the
+// operation, see PercentDoneHeader and StatusMessageHeader.
+func WithProgress(percentDone int, statusMessage string) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(PercentDoneHeader, strconv.Itoa(percentDone))
+		req.Header().Set(StatusMessageHeader, statusMessage)
+	}
+}
+
+// WithStartTime schedules the operation for t, see StartTimeHeader.
+func WithStartTime(t time.Time) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(StartTimeHeader, t.Format(time.RFC3339))
+	}
+}
+
+// WithPriority sets the priority of the operation, see PriorityHeader.
+func WithPriority(priority int) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(PriorityHeader, strconv.Itoa(priority))
+	}
+}
+
+// WithVisibleTo restricts the visibility of the operation to its owner, its
+// creator and the given users, see VisibleToHeader.
+func WithVisibleTo(userIDs ...string) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		req.Header().Set(VisibleToHeader, strings.Join(userIDs, ","))
+	}
+}
+
+// DryRunHeader may be set to "true" to only report what PurgeOperationsProcedure
+// would delete.
+const DryRunHeader = "X-Dry-Run"
+
+// LostReasonHeader holds the reason why an administrator marks an operation as
+// lost, see ForceMarkLostProcedure. It is recorded as the error message of the
+// operation.
+const LostReasonHeader = "X-Lost-Reason"
+
+// Keys and reasons used in the error_details of operations that have been
+// marked as lost. The details are encoded as a google.protobuf.Struct.
+const (
+	// LostReasonDetail is the key of the error detail that holds the reason.
+	LostReasonDetail = "reason"
+
+	// LostActorDetail is the key of the error detail that holds the identity
+	// of the user that marked the operation as lost.
+	LostActorDetail = "actor"
+
+	// LostReasonTTLExpired is used when the operation has not been updated
+	// within the TTL and grace period.
+	LostReasonTTLExpired = "ttl-expired"
+
+	// LostReasonPendingTimeout is used when the operation has not been started
+	// within it's pending timeout.
+	LostReasonPendingTimeout = "pending-timeout"
+
+	// LostReasonAdmin is used when an administrator marked the operation as lost.
+	LostReasonAdmin = "admin"
+
+	// ReasonMaxRuntimeExceeded is used when the operation exceeded its
+	// maximum runtime, see MaxRuntimeHeader. In contrast to the other reasons,
+	// the operation is COMPLETE instead of LOST.
+	ReasonMaxRuntimeExceeded = "max-runtime-exceeded"
+)
+
+// Keys used in the error_details of operations whose command failed when run
+// by lrun, see ExitCodeAnnotation. The details are encoded as a
+// google.protobuf.Struct.
+const (
+	// ExitCodeDetail is the key of the error detail that holds the exit code.
+	ExitCodeDetail = "exitCode"
+
+	// ExitSignalDetail is the key of the error detail that holds the name of
+	// the signal that killed the command, if any.
+	ExitSignalDetail = "signal"
+
+	// ExitInterruptedDetail is the key of the error detail that holds the
+	// name of the signal lrun received and forwarded to the command, like
+	// when it has been stopped using Ctrl-C.
+	ExitInterruptedDetail = "interrupted"
+
+	// ExitTimeoutDetail and ExitElapsedDetail are the keys of the error
+	// details that hold the limit of lrun --timeout and the time the command
+	// ran once it exceeded the limit, both in time.Duration format.
+	ExitTimeoutDetail = "timeout"
+	ExitElapsedDetail = "elapsed"
+
+	// ExitCancelledDetail is the key of the error detail that is true if the
+	// command has been stopped since cancellation of the operation has been
+	// requested, see CancelOperationProcedure.
+	ExitCancelledDetail = "cancelled"
+)
+
+// Procedures that are served in addition to the procedures of the
+// LongRunningService. They re-use the existing message types and are available
+// through Client.
+const (
+	// WatchOperationsProcedure accepts a longrunningv1.QueryOperationsRequest
+	// (and the same request headers as QueryOperations) and streams all
+	// matching operations, starting with a snapshot of the current matching
+	// set followed by every subsequent change.
+	WatchOperationsProcedure = "/tkd.longrunning.v1.LongRunningService/WatchOperations"
+
+	// HeartbeatProcedure accepts a longrunningv1.UpdateOperationRequest and
+	// only bumps the last-update time of the operation. The update mask may
+	// select "percent_done" and "status_message" to report progress as well.
+	HeartbeatProcedure = "/tkd.longrunning.v1.LongRunningService/Heartbeat"
+
+	// CancelOperationProcedure accepts a longrunningv1.GetOperationRequest and
+	// requests cancellation of the operation. The request is recorded using
+	// the CancelRequestedAnnotation and delivered to all watchers of the
+	// operation. It's up to the worker to actually stop the operation.
+	// Cancellation may be requested by the owner of the operation, by
+	// administrators or using the AuthTokenHeader.
+	CancelOperationProcedure = "/tkd.longrunning.v1.LongRunningService/CancelOperation"
+
+	// ListOperationsStreamProcedure is the streaming variant of QueryOperations.
+	// It accepts the same request and headers but sends the matching operations
+	// one at a time.
+	ListOperationsStreamProcedure = "/tkd.longrunning.v1.LongRunningService/ListOperationsStream"
+
+	// WaitForCompletionProcedure accepts a longrunningv1.GetOperationRequest and
+	// blocks until the operation reaches a terminal state. The final operation
+	// is returned. Use WaitTimeoutHeader to bound the wait in which case
+	// CodeDeadlineExceeded is returned with the latest known state of the
+	// operation as an error detail.
+	WaitForCompletionProcedure = "/tkd.longrunning.v1.LongRunningService/WaitForCompletion"
+
+	// GetKindDefaultsProcedure accepts a longrunningv1.RegisterOperationRequest
+	// and returns the defaults that are applied when registering an operation
+	// of the requested kind without a TTL, grace period, pending timeout or
+	// maximum runtime. The TTL and grace period are returned in a
+	// RegisterOperationRequest while the pending timeout and maximum runtime
+	// are returned in the PendingTimeoutHeader and MaxRuntimeHeader of the
+	// response. If per-kind defaults matched, the KindPatternHeader of the
+	// response holds their pattern.
+	GetKindDefaultsProcedure = "/tkd.longrunning.v1.LongRunningService/GetKindDefaults"
+
+	// AcquireOperationProcedure accepts a longrunningv1.GetOperationRequest and
+	// takes over a LOST operation, for example when a replacement worker
+	// resumes the job of a crashed one. PENDING operations that have been
+	// created from a Template are acquired the same way. The operation is
+	// switched to RUNNING and a longrunningv1.RegisterOperationResponse with a
+	// new auth token is returned. Only the owner of the operation or an administrator
+	// may acquire it. COMPLETE operations cannot be acquired.
+	AcquireOperationProcedure = "/tkd.longrunning.v1.LongRunningService/AcquireOperation"
+
+	// GetDashboardProcedure accepts a google.protobuf.Empty and returns an
+	// overview of the operations for monitoring as a
+	// longrunningv1.QueryOperationsResponse: the most recent operations that
+	// failed within the time window, the currently LOST operations and the
+	// longest running operations. The section of each operation is recorded in
+	// the DashboardSectionAnnotation. The operation counts per state are
+	// returned in the StateCountsHeader and their sum as the total_count. See DashboardWindowHeader and
+	// DashboardLimitsHeader for the supported request options.
+	GetDashboardProcedure = "/tkd.longrunning.v1.LongRunningService/GetDashboard"
+
+	// WatchProcedure is a bidirectional stream that multiplexes the updates of
+	// many operations. Clients send a tkd.events.v1.SubscribeRequest with the
+	// unique id of an operation to subscribe to it or to unsubscribe from it,
+	// see Subscribe and Unsubscribe. The server streams the operations of all
+	// subscribed ids: the current state first, followed by every subsequent
+	// change. Subscriptions end on their own once the operation reached a
+	// terminal state. Unknown operations are reported using an operation with
+	// just the unique_id and an unspecified state.
+	WatchProcedure = "/tkd.longrunning.v1.LongRunningService/Watch"
+
+	// ForceMarkLostProcedure accepts a longrunningv1.GetOperationRequest and
+	// marks the operation as lost right away, without waiting for its TTL to
+	// expire. The reason must be passed in the LostReasonHeader. The lost
+	// operation is returned. The procedure is only served on the admin
+	// listener and refuses to act on operations that are COMPLETE or LOST
+	// already.
+	ForceMarkLostProcedure = "/tkd.longrunning.v1.LongRunningService/ForceMarkLost"
+
+	// PurgeOperationsProcedure accepts a longrunningv1.QueryOperationsRequest
+	// (and the same request headers as QueryOperations) and deletes all
+	// matching operations including the content of their attachments. The
+	// state of the request must be either COMPLETE or LOST. The number of
+	// deleted operations is returned as the total_count of a
+	// longrunningv1.QueryOperationsResponse. If the DryRunHeader is set,
+	// nothing is deleted and the response holds the number of matching
+	// operations together with a sample of them, with only the unique_id
+	// populated. The procedure is only served on the admin listener.
+	PurgeOperationsProcedure = "/tkd.longrunning.v1.LongRunningService/PurgeOperations"
+
+	// AddNoteProcedure accepts a longrunningv1.UpdateOperationRequest and
+	// appends its status_message as a note to the operation, see
+	// NotesAnnotation. All other fields except the unique_id are ignored and
+	// no auth token is required, but the caller must be authenticated. Notes
+	// may be added to terminal operations as well. The updated operation is
+	// returned.
+	AddNoteProcedure = "/tkd.longrunning.v1.LongRunningService/AddNote"
+
+	// AddTagsProcedure accepts a longrunningv1.GetOperationRequest and adds
+	// the tags in the TagsHeader to the operation. RemoveTagsProcedure removes
+	// them instead. No auth token is required, but the caller must be
+	// authenticated. Tags may be changed on terminal operations as well and
+	// the updated operation is returned.
+	AddTagsProcedure    = "/tkd.longrunning.v1.LongRunningService/AddTags"
+	RemoveTagsProcedure = "/tkd.longrunning.v1.LongRunningService/RemoveTags"
+
+	// AddLinkProcedure accepts a longrunningv1.UpdateOperationRequest and
+	// appends the link in the LinkHeader to the operation. Only the unique_id
+	// and auth_token of the request are used. Links may only be added to
+	// operations that are neither COMPLETE nor LOST. The updated operation is
+	// returned.
+	AddLinkProcedure = "/tkd.longrunning.v1.LongRunningService/AddLink"
+
+	// CreateWebhookProcedure accepts a Webhook encoded as a
+	// google.protobuf.Struct, see Webhook.Struct. The created webhook is
+	// returned the same way, without the secret. Matching lifecycle events are
+	// posted to the URL of the webhook in the background and retried on
+	// failure. Deliveries are not ordered. The procedure is only served on the
+	// admin listener.
+	CreateWebhookProcedure = "/tkd.longrunning.v1.LongRunningService/CreateWebhook"
+
+	// ListWebhooksProcedure accepts a google.protobuf.Empty and returns all
+	// webhooks as a google.protobuf.ListValue of Webhook structs, see
+	// ParseWebhook. The procedure is only served on the admin listener.
+	ListWebhooksProcedure = "/tkd.longrunning.v1.LongRunningService/ListWebhooks"
+
+	// DeleteWebhookProcedure accepts the id of a webhook as a
+	// google.protobuf.StringValue and deletes the webhook together with its
+	// pending deliveries. The procedure is only served on the admin listener.
+	DeleteWebhookProcedure = "/tkd.longrunning.v1.LongRunningService/DeleteWebhook"
+
+	// CreateTemplateProcedure accepts a Template encoded as a
+	// google.protobuf.Struct, see Template.Struct, and returns the created
+	// template the same way. From then on, an operation is registered at each
+	// occurrence of the schedule of the template. Occurrences that have been
+	// missed while the service was down are condensed into a single one. The
+	// procedure is only served on the admin listener.
+	CreateTemplateProcedure = "/tkd.longrunning.v1.LongRunningService/CreateTemplate"
+
+	// ListTemplatesProcedure accepts a google.protobuf.Empty and returns all
+	// templates as a google.protobuf.ListValue of Template structs, see
+	// ParseTemplate. The procedure is only served on the admin listener.
+	ListTemplatesProcedure = "/tkd.longrunning.v1.LongRunningService/ListTemplates"
+
+	// DeleteTemplateProcedure accepts the id of a template as a
+	// google.protobuf.StringValue and deletes it. Operations that have already
+	// been created from the template are kept. The procedure is only served
+	// on the admin listener.
+	DeleteTemplateProcedure = "/tkd.longrunning.v1.LongRunningService/DeleteTemplate"
+
+	// GetPendingLossesProcedure accepts a google.protobuf.Empty and returns
+	// the operations that the manager would have marked as lost while it is
+	// in dry-run mode as a longrunningv1.QueryOperationsResponse. The
+	// operations are returned as they were when the loss has been detected,
+	// with the error they would have been lost with and the time of the
+	// detection in the PendingLossSinceAnnotation. The DryRunHeader of the response
+	// reports whether the dry-run mode is enabled. The procedure is only
+	// served on the admin listener.
+	GetPendingLossesProcedure = "/tkd.longrunning.v1.LongRunningService/GetPendingLosses"
+
+	// SetManagerDryRunProcedure accepts a google.protobuf.BoolValue and
+	// enables or disables the dry-run mode of the manager of the instance
+	// that serves the request, see GetPendingLossesProcedure. Disabling it
+	// marks the pending losses as lost by the next check. The procedure is
+	// only served on the admin listener.
+	SetManagerDryRunProcedure = "/tkd.longrunning.v1.LongRunningService/SetManagerDryRun"
+
+	// AttachmentsPath is the path prefix of the plain HTTP endpoint for
+	// attachments. Attachments are added by sending a PUT request with the
+	// content of the attachment and the AuthTokenHeader to
+	// AttachmentsPath + "<unique-id>/<name>". The Content-Type of the request is
+	// recorded as the media type. A GET request to the same path returns the
+	// content or redirects to the external URL of the attachment. Attachments
+	// are only served to authenticated users that may see the operation, see
+	// VisibleToHeader.
+	AttachmentsPath = "/tkd.longrunning.v1.LongRunningService/attachments/"
+)
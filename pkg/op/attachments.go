@@ -0,0 +1,137 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// AttachmentInfo describes an attachment of an operation as encoded in the
+// AttachmentsAnnotation.
+type AttachmentInfo struct {
+	Name       string    `json:"name"`
+	MediaType  string    `json:"mediaType"`
+	Size       int64     `json:"size"`
+	URL        string    `json:"url,omitempty"`
+	CreateTime time.Time `json:"createTime"`
+}
+
+// ParseAttachments returns the attachments of pbop. Attachments without an URL
+// are stored inside the service and can be downloaded using
+// Client.GetAttachment.
+func ParseAttachments(pbop *longrunningv1.Operation) ([]AttachmentInfo, error) {
+	value, ok := pbop.GetAnnotations()[AttachmentsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var list []AttachmentInfo
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", AttachmentsAnnotation, err)
+	}
+
+	return list, nil
+}
+
+// AddAttachment uploads content as the attachment name of the operation.
+func (c *Client) AddAttachment(ctx context.Context, uniqueId, authToken, name, mediaType string, content io.Reader) (*longrunningv1.Operation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.attachmentURL(uniqueId, name), content)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+
+	return c.addAttachment(req, authToken)
+}
+
+// AddAttachmentURL records an attachment that is stored at an external URL.
+// size may be zero if unknown.
+func (c *Client) AddAttachmentURL(ctx context.Context, uniqueId, authToken, name, mediaType, externalURL string, size int64) (*longrunningv1.Operation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.attachmentURL(uniqueId, name), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set(AttachmentURLHeader, externalURL)
+
+	if size > 0 {
+		req.Header.Set(AttachmentSizeHeader, strconv.FormatInt(size, 10))
+	}
+
+	return c.addAttachment(req, authToken)
+}
+
+// GetAttachment returns the content and the media type of the attachment name.
+// Redirects to the external URL of an attachment are followed by the HTTP
+// client. The returned reader must be closed by the caller.
+func (c *Client) GetAttachment(ctx context.Context, uniqueId, name string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.attachmentURL(uniqueId, name), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := checkResponse(res); err != nil {
+		return nil, "", err
+	}
+
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
+
+func (c *Client) addAttachment(req *http.Request, authToken string) (*longrunningv1.Operation, error) {
+	req.Header.Set(AuthTokenHeader, authToken)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var pbop longrunningv1.Operation
+	if err := protojson.Unmarshal(body, &pbop); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+
+	return &pbop, nil
+}
+
+func (c *Client) attachmentURL(uniqueId, name string) string {
+	return c.baseURL + AttachmentsPath + url.PathEscape(uniqueId) + "/" + url.PathEscape(name)
+}
+
+// checkResponse returns an error for non-2xx responses and closes the body in
+// that case.
+func checkResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	defer res.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	return fmt.Errorf("unexpected response %s: %s", res.Status, msg)
+}
@@ -0,0 +1,46 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// AuditEntry describes a mutation of an operation as encoded in the
+// AuditAnnotation.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+
+	// Actor holds the ID of the user that performed the mutation. It is empty
+	// if the mutation has been authorized using the auth token by an unknown
+	// caller.
+	Actor string `json:"actor,omitempty"`
+
+	// Action describes the mutation, like "update", "complete" or "resume".
+	Action string `json:"action"`
+
+	// Reason describes why the mutation has been authorized, either
+	// "auth-token", "owner" or "admin".
+	Reason string `json:"reason"`
+
+	// State holds the name of the state the operation transitioned to, if the
+	// mutation changed the state.
+	State string `json:"state,omitempty"`
+}
+
+// ParseAudit returns the audit log of pbop, oldest entry first.
+func ParseAudit(pbop *longrunningv1.Operation) ([]AuditEntry, error) {
+	value, ok := pbop.GetAnnotations()[AuditAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var list []AuditEntry
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", AuditAnnotation, err)
+	}
+
+	return list, nil
+}
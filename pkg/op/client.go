@@ -0,0 +1,541 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	eventsv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/events/v1"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1/longrunningv1connect"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// HeartbeatClient is implemented by clients that support the Heartbeat RPC.
+type HeartbeatClient interface {
+	Heartbeat(context.Context, *connect.Request[longrunningv1.UpdateOperationRequest]) (*connect.Response[longrunningv1.Operation], error)
+}
+
+// Client is a LongRunningServiceClient that also supports the procedures which
+// are not (yet) part of the API definition.
+type Client struct {
+	longrunningv1connect.LongRunningServiceClient
+
+	httpClient connect.HTTPClient
+	baseURL    string
+
+	heartbeat       *connect.Client[longrunningv1.UpdateOperationRequest, longrunningv1.Operation]
+	watchOperations *connect.Client[longrunningv1.QueryOperationsRequest, longrunningv1.Operation]
+	cancelOperation *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.Operation]
+	listOperations  *connect.Client[longrunningv1.QueryOperationsRequest, longrunningv1.Operation]
+	waitCompletion  *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.Operation]
+	acquire         *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.RegisterOperationResponse]
+	kindDefaults    *connect.Client[longrunningv1.RegisterOperationRequest, longrunningv1.RegisterOperationRequest]
+	dashboard       *connect.Client[emptypb.Empty, longrunningv1.QueryOperationsResponse]
+	watch           *connect.Client[eventsv1.SubscribeRequest, longrunningv1.Operation]
+	forceMarkLost   *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.Operation]
+	purge           *connect.Client[longrunningv1.QueryOperationsRequest, longrunningv1.QueryOperationsResponse]
+	addNote         *connect.Client[longrunningv1.UpdateOperationRequest, longrunningv1.Operation]
+	addTags         *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.Operation]
+	removeTags      *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.Operation]
+	addLink         *connect.Client[longrunningv1.UpdateOperationRequest, longrunningv1.Operation]
+	createWebhook   *connect.Client[structpb.Struct, structpb.Struct]
+	listWebhooks    *connect.Client[emptypb.Empty, structpb.ListValue]
+	deleteWebhook   *connect.Client[wrapperspb.StringValue, emptypb.Empty]
+	createTemplate  *connect.Client[structpb.Struct, structpb.Struct]
+	listTemplates   *connect.Client[emptypb.Empty, structpb.ListValue]
+	deleteTemplate  *connect.Client[wrapperspb.StringValue, emptypb.Empty]
+	pendingLosses   *connect.Client[emptypb.Empty, longrunningv1.QueryOperationsResponse]
+	setDryRun       *connect.Client[wrapperspb.BoolValue, emptypb.Empty]
+}
+
+// NewClient returns a new client for the LongRunningService at baseURL.
+func NewClient(httpClient connect.HTTPClient, baseURL string, opts ...connect.ClientOption) *Client {
+	baseURL = strings.TrimRight(baseURL, "/")
+
+	return &Client{
+		LongRunningServiceClient: longrunningv1connect.NewLongRunningServiceClient(httpClient, baseURL, opts...),
+		httpClient:               httpClient,
+		baseURL:                  baseURL,
+		heartbeat:                connect.NewClient[longrunningv1.UpdateOperationRequest, longrunningv1.Operation](httpClient, baseURL+HeartbeatProcedure, opts...),
+		watchOperations:          connect.NewClient[longrunningv1.QueryOperationsRequest, longrunningv1.Operation](httpClient, baseURL+WatchOperationsProcedure, opts...),
+		cancelOperation:          connect.NewClient[longrunningv1.GetOperationRequest, longrunningv1.Operation](httpClient, baseURL+CancelOperationProcedure, opts...),
+		listOperations:           connect.NewClient[longrunningv1.QueryOperationsRequest, longrunningv1.Operation](httpClient, baseURL+ListOperationsStreamProcedure, opts...),
+		waitCompletion:           connect.NewClient[longrunningv1.GetOperationRequest, longrunningv1.Operation](httpClient, baseURL+WaitForCompletionProcedure, opts...),
+		acquire:                  connect.NewClient[longrunningv1.GetOperationRequest, longrunningv1.RegisterOperationResponse](httpClient, baseURL+AcquireOperationProcedure, opts...),
+		kindDefaults:             connect.NewClient[longrunningv1.RegisterOperationRequest, longrunningv1.RegisterOperationRequest](httpClient, baseURL+GetKindDefaultsProcedure, opts...),
+		dashboard:                connect.NewClient[emptypb.Empty, longrunningv1.QueryOperationsResponse](httpClient, baseURL+GetDashboardProcedure, opts...),
+		watch:                    connect.NewClient[eventsv1.SubscribeRequest, longrunningv1.Operation](httpClient, baseURL+WatchProcedure, opts...),
+		forceMarkLost:            connect.NewClient[longrunningv1.GetOperationRequest, longrunningv1.Operation](httpClient, baseURL+ForceMarkLostProcedure, opts...),
+		purge:                    connect.NewClient[longrunningv1.QueryOperationsRequest, longrunningv1.QueryOperationsResponse](httpClient, baseURL+PurgeOperationsProcedure, opts...),
+		addNote:                  connect.NewClient[longrunningv1.UpdateOperationRequest, longrunningv1.Operation](httpClient, baseURL+AddNoteProcedure, opts...),
+		addTags:                  connect.NewClient[longrunningv1.GetOperationRequest, longrunningv1.Operation](httpClient, baseURL+AddTagsProcedure, opts...),
+		removeTags:               connect.NewClient[longrunningv1.GetOperationRequest, longrunningv1.Operation](httpClient, baseURL+RemoveTagsProcedure, opts...),
+		addLink:                  connect.NewClient[longrunningv1.UpdateOperationRequest, longrunningv1.Operation](httpClient, baseURL+AddLinkProcedure, opts...),
+		createWebhook:            connect.NewClient[structpb.Struct, structpb.Struct](httpClient, baseURL+CreateWebhookProcedure, opts...),
+		listWebhooks:             connect.NewClient[emptypb.Empty, structpb.ListValue](httpClient, baseURL+ListWebhooksProcedure, opts...),
+		deleteWebhook:            connect.NewClient[wrapperspb.StringValue, emptypb.Empty](httpClient, baseURL+DeleteWebhookProcedure, opts...),
+		createTemplate:           connect.NewClient[structpb.Struct, structpb.Struct](httpClient, baseURL+CreateTemplateProcedure, opts...),
+		listTemplates:            connect.NewClient[emptypb.Empty, structpb.ListValue](httpClient, baseURL+ListTemplatesProcedure, opts...),
+		deleteTemplate:           connect.NewClient[wrapperspb.StringValue, emptypb.Empty](httpClient, baseURL+DeleteTemplateProcedure, opts...),
+		pendingLosses:            connect.NewClient[emptypb.Empty, longrunningv1.QueryOperationsResponse](httpClient, baseURL+GetPendingLossesProcedure, opts...),
+		setDryRun:                connect.NewClient[wrapperspb.BoolValue, emptypb.Empty](httpClient, baseURL+SetManagerDryRunProcedure, opts...),
+	}
+}
+
+// Heartbeat calls the Heartbeat RPC, see HeartbeatProcedure.
+func (c *Client) Heartbeat(ctx context.Context, req *connect.Request[longrunningv1.UpdateOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	return c.heartbeat.CallUnary(ctx, req)
+}
+
+// WatchOperations calls the WatchOperations RPC, see WatchOperationsProcedure.
+func (c *Client) WatchOperations(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest]) (*connect.ServerStreamForClient[longrunningv1.Operation], error) {
+	return c.watchOperations.CallServerStream(ctx, req)
+}
+
+// Watch opens a multiplexed watch stream, see WatchProcedure. The stream
+// requires HTTP/2.
+func (c *Client) Watch(ctx context.Context) *connect.BidiStreamForClient[eventsv1.SubscribeRequest, longrunningv1.Operation] {
+	return c.watch.CallBidiStream(ctx)
+}
+
+// Subscribe returns the request to subscribe to the operation with the given
+// id on a Watch stream.
+func Subscribe(id string) *eventsv1.SubscribeRequest {
+	return &eventsv1.SubscribeRequest{
+		Kind: &eventsv1.SubscribeRequest_Subscribe{
+			Subscribe: id,
+		},
+	}
+}
+
+// Unsubscribe returns the request to unsubscribe from the operation with the
+// given id on a Watch stream.
+func Unsubscribe(id string) *eventsv1.SubscribeRequest {
+	return &eventsv1.SubscribeRequest{
+		Kind: &eventsv1.SubscribeRequest_Unsubscribe{
+			Unsubscribe: id,
+		},
+	}
+}
+
+// ForceMarkLost marks the operation with the given id as lost for reason, see
+// ForceMarkLostProcedure. The client must be connected to the admin listener.
+func (c *Client) ForceMarkLost(ctx context.Context, id string, reason string) (*longrunningv1.Operation, error) {
+	req := connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	})
+	req.Header().Set(LostReasonHeader, reason)
+
+	res, err := c.forceMarkLost.CallUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// PurgeOperations calls the PurgeOperations RPC, see
+// PurgeOperationsProcedure. The client must be connected to the admin listener.
+func (c *Client) PurgeOperations(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest]) (*connect.Response[longrunningv1.QueryOperationsResponse], error) {
+	return c.purge.CallUnary(ctx, req)
+}
+
+// AddNote adds a note with the given text to the operation with the given id,
+// see AddNoteProcedure.
+func (c *Client) AddNote(ctx context.Context, id string, text string) (*longrunningv1.Operation, error) {
+	res, err := c.addNote.CallUnary(ctx, connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		StatusMessage: text,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// AddTags adds tags to the operation with the given id, see AddTagsProcedure.
+func (c *Client) AddTags(ctx context.Context, id string, tags ...string) (*longrunningv1.Operation, error) {
+	return c.callTags(ctx, c.addTags, id, tags)
+}
+
+// RemoveTags removes tags from the operation with the given id, see
+// RemoveTagsProcedure.
+func (c *Client) RemoveTags(ctx context.Context, id string, tags ...string) (*longrunningv1.Operation, error) {
+	return c.callTags(ctx, c.removeTags, id, tags)
+}
+
+func (c *Client) callTags(ctx context.Context, cli *connect.Client[longrunningv1.GetOperationRequest, longrunningv1.Operation], id string, tags []string) (*longrunningv1.Operation, error) {
+	req := connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: id,
+	})
+	req.Header().Set(TagsHeader, strings.Join(tags, ","))
+
+	res, err := cli.CallUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// AddLink adds link to the operation with the given id, see AddLinkProcedure.
+func (c *Client) AddLink(ctx context.Context, id string, authToken string, link Link) (*longrunningv1.Operation, error) {
+	blob, err := json.Marshal(link)
+	if err != nil {
+		return nil, err
+	}
+
+	req := connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:  id,
+		AuthToken: authToken,
+	})
+	req.Header().Set(LinkHeader, string(blob))
+
+	res, err := c.addLink.CallUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// CreateWebhook creates a new webhook, see CreateWebhookProcedure. The client
+// must be connected to the admin listener.
+func (c *Client) CreateWebhook(ctx context.Context, hook Webhook) (Webhook, error) {
+	s, err := hook.Struct()
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	res, err := c.createWebhook.CallUnary(ctx, connect.NewRequest(s))
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return ParseWebhook(res.Msg)
+}
+
+// ListWebhooks returns all webhooks, see ListWebhooksProcedure. The client
+// must be connected to the admin listener.
+func (c *Client) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	res, err := c.listWebhooks.CallUnary(ctx, connect.NewRequest(&emptypb.Empty{}))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]Webhook, 0, len(res.Msg.Values))
+	for _, v := range res.Msg.Values {
+		hook, err := ParseWebhook(v.GetStructValue())
+		if err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook deletes the webhook with the given id, see
+// DeleteWebhookProcedure. The client must be connected to the admin listener.
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	_, err := c.deleteWebhook.CallUnary(ctx, connect.NewRequest(wrapperspb.String(id)))
+
+	return err
+}
+
+// GetPendingLosses returns the operations that the manager would have marked
+// as lost and whether its dry-run mode is enabled, see
+// GetPendingLossesProcedure. The client must be connected to the admin
+// listener.
+func (c *Client) GetPendingLosses(ctx context.Context) ([]*longrunningv1.Operation, bool, error) {
+	res, err := c.pendingLosses.CallUnary(ctx, connect.NewRequest(&emptypb.Empty{}))
+	if err != nil {
+		return nil, false, err
+	}
+
+	return res.Msg.Operation, res.Header().Get(DryRunHeader) == "true", nil
+}
+
+// SetManagerDryRun enables or disables the dry-run mode of the manager, see
+// SetManagerDryRunProcedure. The client must be connected to the admin
+// listener.
+func (c *Client) SetManagerDryRun(ctx context.Context, enabled bool) error {
+	_, err := c.setDryRun.CallUnary(ctx, connect.NewRequest(wrapperspb.Bool(enabled)))
+
+	return err
+}
+
+// CreateTemplate creates a new recurring template, see
+// CreateTemplateProcedure. The client must be connected to the admin listener.
+func (c *Client) CreateTemplate(ctx context.Context, tmpl Template) (Template, error) {
+	s, err := tmpl.Struct()
+	if err != nil {
+		return Template{}, err
+	}
+
+	res, err := c.createTemplate.CallUnary(ctx, connect.NewRequest(s))
+	if err != nil {
+		return Template{}, err
+	}
+
+	return ParseTemplate(res.Msg)
+}
+
+// ListTemplates returns all templates, see ListTemplatesProcedure. The client
+// must be connected to the admin listener.
+func (c *Client) ListTemplates(ctx context.Context) ([]Template, error) {
+	res, err := c.listTemplates.CallUnary(ctx, connect.NewRequest(&emptypb.Empty{}))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]Template, 0, len(res.Msg.Values))
+	for _, v := range res.Msg.Values {
+		tmpl, err := ParseTemplate(v.GetStructValue())
+		if err != nil {
+			return nil, err
+		}
+
+		templates = append(templates, tmpl)
+	}
+
+	return templates, nil
+}
+
+// DeleteTemplate deletes the template with the given id, see
+// DeleteTemplateProcedure. The client must be connected to the admin listener.
+func (c *Client) DeleteTemplate(ctx context.Context, id string) error {
+	_, err := c.deleteTemplate.CallUnary(ctx, connect.NewRequest(wrapperspb.String(id)))
+
+	return err
+}
+
+// CancelOperation calls the CancelOperation RPC, see CancelOperationProcedure.
+func (c *Client) CancelOperation(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.Operation], error) {
+	return c.cancelOperation.CallUnary(ctx, req)
+}
+
+// ListOperationsStream calls the ListOperationsStream RPC, see
+// ListOperationsStreamProcedure.
+func (c *Client) ListOperationsStream(ctx context.Context, req *connect.Request[longrunningv1.QueryOperationsRequest]) (*connect.ServerStreamForClient[longrunningv1.Operation], error) {
+	return c.listOperations.CallServerStream(ctx, req)
+}
+
+// WaitForCompletion calls the WaitForCompletion RPC, see
+// WaitForCompletionProcedure. A timeout of zero waits until ctx is cancelled.
+func (c *Client) WaitForCompletion(ctx context.Context, uniqueId string, timeout time.Duration) (*longrunningv1.Operation, error) {
+	req := connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: uniqueId,
+	})
+
+	if timeout > 0 {
+		req.Header().Set(WaitTimeoutHeader, timeout.String())
+	}
+
+	res, err := c.waitCompletion.CallUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// AcquireOperation calls the AcquireOperation RPC, see
+// AcquireOperationProcedure.
+func (c *Client) AcquireOperation(ctx context.Context, req *connect.Request[longrunningv1.GetOperationRequest]) (*connect.Response[longrunningv1.RegisterOperationResponse], error) {
+	return c.acquire.CallUnary(ctx, req)
+}
+
+// KindDefaults holds the defaults for operations of a kind, see
+// GetKindDefaultsProcedure.
+type KindDefaults struct {
+	// Pattern is the kind pattern of the matching per-kind defaults or empty
+	// if the global defaults apply.
+	Pattern string
+
+	TTL            time.Duration
+	GracePeriod    time.Duration
+	PendingTimeout time.Duration
+	MaxRuntime     time.Duration
+}
+
+// GetKindDefaults returns the defaults for operations of kind, see
+// GetKindDefaultsProcedure.
+func (c *Client) GetKindDefaults(ctx context.Context, kind string) (*KindDefaults, error) {
+	res, err := c.kindDefaults.CallUnary(ctx, connect.NewRequest(&longrunningv1.RegisterOperationRequest{
+		Kind: kind,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := &KindDefaults{
+		Pattern:     res.Header().Get(KindPatternHeader),
+		TTL:         res.Msg.Ttl.AsDuration(),
+		GracePeriod: res.Msg.GracePeriod.AsDuration(),
+	}
+
+	if v := res.Header().Get(PendingTimeoutHeader); v != "" {
+		defaults.PendingTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pending timeout %q: %w", v, err)
+		}
+	}
+
+	if v := res.Header().Get(MaxRuntimeHeader); v != "" {
+		defaults.MaxRuntime, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max runtime %q: %w", v, err)
+		}
+	}
+
+	return defaults, nil
+}
+
+// DashboardOptions configures GetDashboard. A zero limit omits the respective
+// section. If Window is zero, the default window of the service is used.
+type DashboardOptions struct {
+	Window       time.Duration
+	FailedLimit  int
+	LostLimit    int
+	RunningLimit int
+}
+
+// Dashboard is an overview of the operations, see GetDashboardProcedure.
+type Dashboard struct {
+	Failed  []*longrunningv1.Operation
+	Lost    []*longrunningv1.Operation
+	Running []*longrunningv1.Operation
+
+	StateCounts map[longrunningv1.OperationState]int64
+}
+
+// GetDashboard returns an overview of the operations, see
+// GetDashboardProcedure.
+func (c *Client) GetDashboard(ctx context.Context, opts DashboardOptions) (*Dashboard, error) {
+	req := connect.NewRequest(&emptypb.Empty{})
+
+	if opts.Window > 0 {
+		req.Header().Set(DashboardWindowHeader, opts.Window.String())
+	}
+
+	req.Header().Set(DashboardLimitsHeader, fmt.Sprintf("%s=%d,%s=%d,%s=%d",
+		DashboardFailed, opts.FailedLimit,
+		DashboardLost, opts.LostLimit,
+		DashboardRunning, opts.RunningLimit,
+	))
+
+	res, err := c.dashboard.CallUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboard := &Dashboard{
+		StateCounts: make(map[longrunningv1.OperationState]int64),
+	}
+
+	for _, pbop := range res.Msg.Operation {
+		switch pbop.GetAnnotations()[DashboardSectionAnnotation] {
+		case DashboardFailed:
+			dashboard.Failed = append(dashboard.Failed, pbop)
+		case DashboardLost:
+			dashboard.Lost = append(dashboard.Lost, pbop)
+		case DashboardRunning:
+			dashboard.Running = append(dashboard.Running, pbop)
+		}
+	}
+
+	for _, v := range strings.Split(res.Header().Get(StateCountsHeader), ",") {
+		name, count, ok := strings.Cut(v, "=")
+		if !ok {
+			continue
+		}
+
+		state, ok := longrunningv1.OperationState_value[name]
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state count %q: %w", v, err)
+		}
+
+		dashboard.StateCounts[longrunningv1.OperationState(state)] = n
+	}
+
+	return dashboard, nil
+}
+
+// GetOperationByExternalRef returns the most recent operation of kind that has
+// been registered with the external reference ref, see ExternalRefHeader.
+func (c *Client) GetOperationByExternalRef(ctx context.Context, kind, ref string) (*longrunningv1.Operation, error) {
+	req := connect.NewRequest(&longrunningv1.GetOperationRequest{
+		UniqueId: kind,
+	})
+
+	req.Header().Set(ExternalRefHeader, ref)
+
+	res, err := c.GetOperation(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// SetPaused pauses or un-pauses the operation with the given id, see
+// PauseHeader. The status message of the operation is replaced with msg.
+func (c *Client) SetPaused(ctx context.Context, id, authToken string, paused bool, msg string) (*longrunningv1.Operation, error) {
+	req := connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:      id,
+		AuthToken:     authToken,
+		Running:       true,
+		StatusMessage: msg,
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"running", "status_message"},
+		},
+	})
+
+	req.Header().Set(PauseHeader, strconv.FormatBool(paused))
+
+	res, err := c.UpdateOperation(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
+
+// MergeAnnotations sets the given annotations of the operation with the
+// given id without touching any other annotations, see
+// MergeAnnotationsHeader. Keys with an empty value are removed.
+func (c *Client) MergeAnnotations(ctx context.Context, id, authToken string, annotations map[string]string) (*longrunningv1.Operation, error) {
+	req := connect.NewRequest(&longrunningv1.UpdateOperationRequest{
+		UniqueId:    id,
+		AuthToken:   authToken,
+		Annotations: annotations,
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"annotations"},
+		},
+	})
+
+	req.Header().Set(MergeAnnotationsHeader, "true")
+
+	res, err := c.UpdateOperation(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Msg, nil
+}
@@ -0,0 +1,61 @@
+package op
+
+import (
+	"strings"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// IsDiff reports whether update is a diff update, see DiffUpdatesHeader.
+func IsDiff(update *longrunningv1.Operation) bool {
+	_, ok := update.GetAnnotations()[ChangedFieldsAnnotation]
+
+	return ok
+}
+
+// ApplyDiff returns the operation that results from applying update to prev.
+// If update is not a diff update, or prev is nil or of a different
+// operation, update is returned as is. Neither prev nor update is modified.
+func ApplyDiff(prev, update *longrunningv1.Operation) *longrunningv1.Operation {
+	value, ok := update.GetAnnotations()[ChangedFieldsAnnotation]
+	if !ok || prev == nil || prev.UniqueId != update.UniqueId {
+		return update
+	}
+
+	res := proto.Clone(prev).(*longrunningv1.Operation)
+	res.State = update.State
+
+	src := update.ProtoReflect()
+	dst := res.ProtoReflect()
+	fields := src.Descriptor().Fields()
+
+	for _, name := range strings.Split(value, ",") {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			continue
+		}
+
+		if !src.Has(fd) {
+			dst.Clear(fd)
+			continue
+		}
+
+		dst.Set(fd, src.Get(fd))
+	}
+
+	// the map of update is shared, copy it before stripping the list of
+	// changed fields.
+	if strings.Contains(","+value+",", ",annotations,") {
+		res.Annotations = make(map[string]string, len(update.Annotations))
+		for key, value := range update.Annotations {
+			if key != ChangedFieldsAnnotation {
+				res.Annotations[key] = value
+			}
+		}
+	}
+
+	// the messages that have been set on res are still shared with update.
+	return proto.Clone(res).(*longrunningv1.Operation)
+}
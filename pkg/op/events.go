@@ -0,0 +1,214 @@
+package op
+
+import (
+	"fmt"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// EventType is the fully qualified message name of a lifecycle event that is
+// published to the events-service whenever an operation changes.
+//
+// The API definition does not (yet) contain event messages so they are
+// defined at runtime in the tkd.longrunning.events.v1 package. Each event has
+// an "operation" field holding the operation. OperationUpdated events also have
+// a "changed_fields" field mask with the changed field paths of the operation.
+type EventType string
+
+const (
+	EventCreated   EventType = "tkd.longrunning.events.v1.OperationCreated"
+	EventUpdated   EventType = "tkd.longrunning.events.v1.OperationUpdated"
+	EventCompleted EventType = "tkd.longrunning.events.v1.OperationCompleted"
+	EventLost      EventType = "tkd.longrunning.events.v1.OperationLost"
+
+	// EventExpiring is published once when a RUNNING operation has not been
+	// updated for most of its TTL and grace period, or once it missed its TTL
+	// if the service is configured to warn at the start of the grace period.
+	// The operation carries the ExpiringSoonAnnotation and the remaining time
+	// until it is lost in the LostInAnnotation. It is published again if the
+	// operation stalls again after an update.
+	EventExpiring EventType = "tkd.longrunning.events.v1.OperationExpiring"
+)
+
+// EventTypes holds all lifecycle event types.
+var EventTypes = []EventType{EventCreated, EventUpdated, EventCompleted, EventLost, EventExpiring}
+
+// Event is a decoded lifecycle event.
+type Event struct {
+	Type      EventType
+	Operation *longrunningv1.Operation
+
+	// ChangedFields holds the changed field paths of OperationUpdated events.
+	ChangedFields []string
+}
+
+// EventTypeOf returns the type of the event that is published when pbop has
+// been changed.
+func EventTypeOf(pbop *longrunningv1.Operation) EventType {
+	switch pbop.State {
+	case longrunningv1.OperationState_OperationState_COMPLETE:
+		return EventCompleted
+	case longrunningv1.OperationState_OperationState_LOST:
+		return EventLost
+	default:
+		return EventUpdated
+	}
+}
+
+// NewEvent returns the lifecycle event typ for pbop wrapped in an anypb.Any.
+// changedFields is only recorded for EventUpdated.
+func NewEvent(typ EventType, pbop *longrunningv1.Operation, changedFields []string) (*anypb.Any, error) {
+	desc, err := eventDescriptor(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(desc.Fields().ByName("operation"), protoreflect.ValueOfMessage(pbop.ProtoReflect()))
+
+	if fd := desc.Fields().ByName("changed_fields"); fd != nil && len(changedFields) > 0 {
+		mask := &fieldmaskpb.FieldMask{Paths: changedFields}
+		msg.Set(fd, protoreflect.ValueOfMessage(mask.ProtoReflect()))
+	}
+
+	return anypb.New(msg)
+}
+
+// ParseEvent decodes a lifecycle event created by NewEvent.
+func ParseEvent(event *anypb.Any) (*Event, error) {
+	typ := EventType(event.MessageName())
+
+	desc, err := eventDescriptor(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(event.GetValue(), msg); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", typ, err)
+	}
+
+	res := &Event{
+		Type:      typ,
+		Operation: new(longrunningv1.Operation),
+	}
+
+	// embedded messages are decoded as dynamic messages so they need to be
+	// converted to their concrete types.
+	if err := convertField(msg, desc.Fields().ByName("operation"), res.Operation); err != nil {
+		return nil, err
+	}
+
+	if fd := desc.Fields().ByName("changed_fields"); fd != nil {
+		mask := new(fieldmaskpb.FieldMask)
+		if err := convertField(msg, fd, mask); err != nil {
+			return nil, err
+		}
+
+		res.ChangedFields = mask.Paths
+	}
+
+	return res, nil
+}
+
+func convertField(msg *dynamicpb.Message, fd protoreflect.FieldDescriptor, target proto.Message) error {
+	if !msg.Has(fd) {
+		return nil
+	}
+
+	blob, err := proto.Marshal(msg.Get(fd).Message().Interface())
+	if err != nil {
+		return fmt.Errorf("failed to convert %s: %w", fd.FullName(), err)
+	}
+
+	return proto.Unmarshal(blob, target)
+}
+
+var eventsFile protoreflect.FileDescriptor
+
+func eventDescriptor(typ EventType) (protoreflect.MessageDescriptor, error) {
+	name := protoreflect.FullName(typ)
+
+	if name.Parent() == eventsFile.Package() {
+		if desc := eventsFile.Messages().ByName(name.Name()); desc != nil {
+			return desc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported event type %q", typ)
+}
+
+// init builds and registers the descriptors of the lifecycle events so they
+// can be resolved when encoding and decoding anypb.Any messages.
+func init() {
+	eventMessage := func(name string, withChangedFields bool) *descriptorpb.DescriptorProto {
+		msg := &descriptorpb.DescriptorProto{
+			Name: proto.String(name),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{
+					Name:     proto.String("operation"),
+					JsonName: proto.String("operation"),
+					Number:   proto.Int32(1),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+					TypeName: proto.String(".tkd.longrunning.v1.Operation"),
+				},
+			},
+		}
+
+		if withChangedFields {
+			msg.Field = append(msg.Field, &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String("changed_fields"),
+				JsonName: proto.String("changedFields"),
+				Number:   proto.Int32(2),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".google.protobuf.FieldMask"),
+			})
+		}
+
+		return msg
+	}
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("tkd/longrunning/events/v1/events.proto"),
+		Package: proto.String("tkd.longrunning.events.v1"),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			longrunningv1.File_tkd_longrunning_v1_operation_proto.Path(),
+			fieldmaskpb.File_google_protobuf_field_mask_proto.Path(),
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			eventMessage("OperationCreated", false),
+			eventMessage("OperationUpdated", true),
+			eventMessage("OperationCompleted", false),
+			eventMessage("OperationLost", false),
+			eventMessage("OperationExpiring", false),
+		},
+	}
+
+	file, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(fmt.Sprintf("failed to build lifecycle event descriptors: %s", err))
+	}
+
+	if err := protoregistry.GlobalFiles.RegisterFile(file); err != nil {
+		panic(fmt.Sprintf("failed to register lifecycle event descriptors: %s", err))
+	}
+
+	for i := 0; i < file.Messages().Len(); i++ {
+		if err := protoregistry.GlobalTypes.RegisterMessage(dynamicpb.NewMessageType(file.Messages().Get(i))); err != nil {
+			panic(fmt.Sprintf("failed to register lifecycle event type: %s", err))
+		}
+	}
+
+	eventsFile = file
+}
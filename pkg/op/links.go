@@ -0,0 +1,49 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bufbuild/connect-go"
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// Link references an external resource of an operation, like the dashboard
+// of the job, the location of a produced report or a related ticket. Links
+// are encoded in the LinksAnnotation and the LinkHeader.
+type Link struct {
+	Title string `json:"title"`
+
+	// URL must be an absolute http or https URL.
+	URL string `json:"url"`
+
+	// Icon is an optional hint for user interfaces, like "grafana" or
+	// "ticket".
+	Icon string `json:"icon,omitempty"`
+}
+
+// ParseLinks returns the links of pbop in the order they have been added.
+func ParseLinks(pbop *longrunningv1.Operation) ([]Link, error) {
+	value, ok := pbop.GetAnnotations()[LinksAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var list []Link
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", LinksAnnotation, err)
+	}
+
+	return list, nil
+}
+
+// WithLinks adds links to the operation when it is registered.
+func WithLinks(links ...Link) Option {
+	return func(req *connect.Request[longrunningv1.RegisterOperationRequest]) {
+		for _, link := range links {
+			// encoding a struct of strings does not fail.
+			blob, _ := json.Marshal(link)
+			req.Header().Add(LinkHeader, string(blob))
+		}
+	}
+}
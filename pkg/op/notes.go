@@ -0,0 +1,35 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	longrunningv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/longrunning/v1"
+)
+
+// Note is a free text comment on an operation as encoded in the
+// NotesAnnotation, see AddNoteProcedure.
+type Note struct {
+	Time time.Time `json:"time"`
+
+	// Author holds the ID of the user that added the note.
+	Author string `json:"author"`
+
+	Text string `json:"text"`
+}
+
+// ParseNotes returns the notes of pbop, oldest note first.
+func ParseNotes(pbop *longrunningv1.Operation) ([]Note, error) {
+	value, ok := pbop.GetAnnotations()[NotesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var list []Note
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", NotesAnnotation, err)
+	}
+
+	return list, nil
+}
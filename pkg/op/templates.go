@@ -0,0 +1,104 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// OverlapPolicy controls whether a Template creates a new occurrence while
+// the operation of the previous one is neither COMPLETE nor LOST.
+type OverlapPolicy string
+
+const (
+	// OverlapSkip skips the occurrence if the previous one is still active.
+	// This is the default.
+	OverlapSkip OverlapPolicy = "skip"
+
+	// OverlapAllow always creates a new operation.
+	OverlapAllow OverlapPolicy = "allow"
+)
+
+// Template is a recurring operation, see CreateTemplateProcedure. At each
+// occurrence of the schedule, a PENDING operation is registered using the
+// fields of the template. It is encoded as a google.protobuf.Struct using the
+// JSON field names.
+//
+// Operations created from a template are linked to it by the
+// TemplateAnnotation. Nobody holds their auth token so workers must take them
+// over using AcquireOperationProcedure.
+type Template struct {
+	// ID is assigned by the service.
+	ID string `json:"id,omitempty"`
+
+	// Kind, Owner, Description and Parameters are used for the registered
+	// operations.
+	Kind        string         `json:"kind"`
+	Owner       string         `json:"owner"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+
+	// Namespace is the namespace of the registered operations. The default
+	// namespace is used if empty.
+	Namespace string `json:"namespace,omitempty"`
+
+	// TTL, GracePeriod and PendingTimeout hold durations in the format of
+	// time.ParseDuration, like "10m". The defaults of the kind are used if
+	// empty.
+	TTL            string `json:"ttl,omitempty"`
+	GracePeriod    string `json:"gracePeriod,omitempty"`
+	PendingTimeout string `json:"pendingTimeout,omitempty"`
+
+	// Schedule is a cron expression with the five fields minute, hour, day of
+	// month, month and day of week, like "30 2 * * *". The shortcuts @hourly,
+	// @daily, @weekly, @monthly and @yearly are supported as well.
+	Schedule string `json:"schedule"`
+
+	// TimeZone is the IANA time zone the schedule is evaluated in. UTC is
+	// used if empty.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Overlap defaults to OverlapSkip.
+	Overlap OverlapPolicy `json:"overlap,omitempty"`
+
+	// The following fields are set by the service and ignored when creating
+	// a template. LastOperation holds the id of the operation that has been
+	// created for the most recent occurrence.
+	CreateTime    time.Time `json:"createTime"`
+	NextRun       time.Time `json:"nextRun"`
+	LastOperation string    `json:"lastOperation,omitempty"`
+}
+
+// Struct returns t encoded as a google.protobuf.Struct.
+func (t Template) Struct() (*structpb.Struct, error) {
+	blob, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(structpb.Struct)
+	if err := protojson.Unmarshal(blob, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ParseTemplate decodes a template encoded by Template.Struct.
+func ParseTemplate(s *structpb.Struct) (Template, error) {
+	var t Template
+
+	blob, err := protojson.Marshal(s)
+	if err != nil {
+		return t, err
+	}
+
+	if err := json.Unmarshal(blob, &t); err != nil {
+		return t, fmt.Errorf("invalid template: %w", err)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,112 @@
+package op
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Headers that are set on the requests sent to webhooks. The body of the
+// request holds the protojson encoded lifecycle event wrapped in a
+// google.protobuf.Any.
+const (
+	// WebhookSignatureHeader holds the HMAC-SHA256 of the request body using
+	// the secret of the webhook, see SignWebhook and VerifyWebhook.
+	WebhookSignatureHeader = "X-Longrunning-Signature"
+
+	// WebhookEventHeader holds the EventType of the delivered event.
+	WebhookEventHeader = "X-Longrunning-Event"
+
+	// WebhookDeliveryHeader holds the unique id of the delivery. Deliveries
+	// might be retried so receivers should use it to detect duplicates.
+	WebhookDeliveryHeader = "X-Longrunning-Delivery"
+)
+
+// Webhook is a subscription for lifecycle events, see CreateWebhookProcedure.
+// It is encoded as a google.protobuf.Struct using the JSON field names.
+type Webhook struct {
+	// ID is assigned by the service.
+	ID string `json:"id,omitempty"`
+
+	// Kind is a path.Match pattern for the kinds of operations to receive
+	// events for, like "tkd.backup.v1/*". An empty pattern matches all
+	// operations.
+	Kind string `json:"kind,omitempty"`
+
+	// URL is the http or https endpoint the events are posted to.
+	URL string `json:"url"`
+
+	// Secret is used to sign the request body. It is only set when creating
+	// a webhook and never returned by the service.
+	Secret string `json:"secret,omitempty"`
+
+	// Events holds the event types to deliver. EventCompleted and EventLost
+	// are delivered if empty.
+	Events []EventType `json:"events,omitempty"`
+
+	// CreateTime is set by the service and ignored when creating a webhook.
+	CreateTime time.Time `json:"createTime"`
+
+	// Failures holds the number of consecutive failed delivery attempts and
+	// LastError the error of the last one. The webhook is disabled once too
+	// many deliveries failed in a row.
+	Failures  int    `json:"failures,omitempty"`
+	Disabled  bool   `json:"disabled,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Struct returns w encoded as a google.protobuf.Struct.
+func (w Webhook) Struct() (*structpb.Struct, error) {
+	blob, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(structpb.Struct)
+	if err := protojson.Unmarshal(blob, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ParseWebhook decodes a webhook encoded by Webhook.Struct.
+func ParseWebhook(s *structpb.Struct) (Webhook, error) {
+	var w Webhook
+
+	blob, err := protojson.Marshal(s)
+	if err != nil {
+		return w, err
+	}
+
+	if err := json.Unmarshal(blob, &w); err != nil {
+		return w, fmt.Errorf("invalid webhook: %w", err)
+	}
+
+	return w, nil
+}
+
+// SignWebhook returns the value of the WebhookSignatureHeader for body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature is a valid WebhookSignatureHeader
+// for body.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
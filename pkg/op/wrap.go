@@ -2,6 +2,7 @@ package op
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -17,6 +18,15 @@ import (
 
 type Option func(req *connect.Request[longrunningv1.RegisterOperationRequest])
 
+// ErrDeduplicated is returned by Wrap if the registration has been suppressed
+// as a duplicate of an existing operation, see WithSuppressDuplicates. fn is
+// not called in that case.
+var ErrDeduplicated = errors.New("operation has been deduplicated")
+
+// ErrValidateOnly is returned by Wrap if the registration has only been
+// validated, see WithValidateOnly. fn is not called in that case.
+var ErrValidateOnly = errors.New("operation has only been validated")
+
 func Wrap[T any](ctx context.Context, cli longrunningv1connect.LongRunningServiceClient, fn func(ctx context.Context) (T, error), ops ...Option) (T, error) {
 	var empty T
 
@@ -36,6 +46,14 @@ func Wrap[T any](ctx context.Context, cli longrunningv1connect.LongRunningServic
 		return empty, err
 	}
 
+	if res.Header().Get(DeduplicatedHeader) == "true" {
+		return empty, fmt.Errorf("%w: %s", ErrDeduplicated, res.Msg.GetOperation().GetUniqueId())
+	}
+
+	if res.Header().Get(ValidateOnlyHeader) == "true" {
+		return empty, ErrValidateOnly
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -56,10 +74,6 @@ func Wrap[T any](ctx context.Context, cli longrunningv1connect.LongRunningServic
 			updReq := connect.NewRequest(&longrunningv1.UpdateOperationRequest{
 				UniqueId:  res.Msg.Operation.UniqueId,
 				AuthToken: res.Msg.GetAuthToken(),
-				Running:   true,
-				UpdateMask: &fieldmaskpb.FieldMask{
-					Paths: []string{"running"},
-				},
 			})
 
 			for key, values := range headers {
@@ -68,7 +82,22 @@ func Wrap[T any](ctx context.Context, cli longrunningv1connect.LongRunningServic
 				}
 			}
 
-			_, err := cli.UpdateOperation(ctx, updReq)
+			// recover if the operation has been marked as lost while we
+			// could not reach the service.
+			updReq.Header().Set(ResumeHeader, "true")
+
+			var err error
+			if hb, ok := cli.(HeartbeatClient); ok {
+				_, err = hb.Heartbeat(ctx, updReq)
+			} else {
+				updReq.Msg.Running = true
+				updReq.Msg.UpdateMask = &fieldmaskpb.FieldMask{
+					Paths: []string{"running"},
+				}
+
+				_, err = cli.UpdateOperation(ctx, updReq)
+			}
+
 			if err != nil {
 				slog.Error("failed to update operation", "error", err)
 			}
@@ -116,6 +145,7 @@ func Wrap[T any](ctx context.Context, cli longrunningv1connect.LongRunningServic
 			completeRequest.Header().Add(key, v)
 		}
 	}
+	completeRequest.Header().Set(ResumeHeader, "true")
 
 	if _, err := cli.CompleteOperation(context.Background(), completeRequest); err != nil {
 		slog.Error("failed to mark operation as complete", "error", err.Error())